@@ -2,94 +2,139 @@ package client
 
 import (
 	"bytes"
+	"crypto/ecdsa"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math/big"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/ukibbb/crypto-exchange/config"
+	"github.com/ukibbb/crypto-exchange/orderbook"
 	"github.com/ukibbb/crypto-exchange/server"
 )
 
-const Endpoint = "http://localhost:3000"
-
 type Client struct {
 	*http.Client
+
+	// base url of the exchange api.
+	Endpoint string
+	// every request is signed with the key when it's set.
+	APIKey    string
+	APISecret string
 }
 
-func NewClient() *Client {
+// NewClient talks to the endpoint of the config,
+// signing the requests with its api key if it has one.
+func NewClient(cfg config.ClientConfig) *Client {
 	return &Client{
-		Client: http.DefaultClient,
+		Client:    &http.Client{Timeout: cfg.Timeout},
+		Endpoint:  strings.TrimSuffix(cfg.Endpoint, "/"),
+		APIKey:    cfg.APIKey,
+		APISecret: cfg.APISecret,
 	}
 }
 
-type PlaceOrderParams struct {
-	UserID int64
-	Bid    bool
-	// price only needed for placing LIMIT orders.
-	Price float64
-	Size  float64
+func NewClientWithKey(cfg config.ClientConfig, apiKey, apiSecret string) *Client {
+	c := NewClient(cfg)
+	c.APIKey = apiKey
+	c.APISecret = apiSecret
+	return c
 }
 
-func (c *Client) GetOrders(userID int64) (*server.GetOrdersResponse, error) {
-	e := fmt.Sprintf("%s/order/%d", Endpoint, userID)
-	req, err := http.NewRequest(http.MethodGet, e, nil)
-	if err != nil {
-		return nil, err
+// newRequest builds the request for the path and signs it
+// with the api key the same way the server checks it.
+func (c *Client) newRequest(method, path string, body []byte) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
 	}
-
-	resp, err := c.Do(req)
+	req, err := http.NewRequest(method, c.Endpoint+path, r)
 	if err != nil {
 		return nil, err
 	}
 
-	orders := server.GetOrdersResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
-		return nil, err
+	if c.APIKey != "" {
+		timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+		req.Header.Set(server.HeaderAPIKey, c.APIKey)
+		req.Header.Set(server.HeaderTimestamp, timestamp)
+		req.Header.Set(server.HeaderSignature, server.Sign(c.APISecret, timestamp, method, req.URL.RequestURI(), body))
 	}
 
-	return &orders, nil
-
+	return req, nil
 }
 
-func (c *Client) GetBestAsk() (float64, error) {
-	e := fmt.Sprintf("%s/book/ETH/ask", Endpoint)
-	req, err := http.NewRequest(http.MethodGet, e, nil)
-	if err != nil {
-		return 0, err
-
+// doJSON sends the params as the body and decodes the response into out.
+// Error responses are returned as one of the error types of the package.
+func (c *Client) doJSON(method, path string, params, out any) error {
+	var body []byte
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		body = b
 	}
 
-	resp, err := c.Do(req)
+	req, err := c.newRequest(method, path, body)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	priceResp := &server.PriceResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(priceResp); err != nil {
-		return 0, err
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	return priceResp.Price, nil
-
+	if resp.StatusCode >= http.StatusBadRequest {
+		return decodeError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
 }
 
-func (c *Client) GetBestBid() (float64, error) {
-	e := fmt.Sprintf("%s/book/ETH/bid", Endpoint)
-	req, err := http.NewRequest(http.MethodGet, e, nil)
-	if err != nil {
-		return 0, err
+type PlaceOrderParams struct {
+	UserID int64
+	Bid    bool
+	// price only needed for placing LIMIT orders.
+	Price float64
+	Size  float64
+	// of limit orders, GTC when empty.
+	TimeInForce server.TimeInForce
+	// when a GTD order expires.
+	ExpiresAt time.Time
+	// pegs a limit order to the book, Price is ignored then.
+	Peg *orderbook.Peg
+}
 
+func (c *Client) GetOrders(userID int64) (*server.GetOrdersResponse, error) {
+	orders := &server.GetOrdersResponse{}
+	if err := c.doJSON(http.MethodGet, fmt.Sprintf("/order/%d", userID), nil, orders); err != nil {
+		return nil, err
 	}
+	return orders, nil
+}
 
-	resp, err := c.Do(req)
-	if err != nil {
+func (c *Client) GetBestAsk() (float64, error) {
+	priceResp := &server.PriceResponse{}
+	if err := c.doJSON(http.MethodGet, "/book/ETH/ask", nil, priceResp); err != nil {
 		return 0, err
 	}
+	return priceResp.Price, nil
+}
+
+func (c *Client) GetBestBid() (float64, error) {
 	priceResp := &server.PriceResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(priceResp); err != nil {
+	if err := c.doJSON(http.MethodGet, "/book/ETH/bid", nil, priceResp); err != nil {
 		return 0, err
 	}
-
 	return priceResp.Price, nil
-
 }
 
 func (c *Client) PlaceMarketOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
@@ -101,43 +146,144 @@ func (c *Client) PlaceMarketOrder(p *PlaceOrderParams) (*server.PlaceOrderRespon
 		Price:  p.Price,
 		Market: server.MarketETH,
 	}
-	body, err := json.Marshal(params)
-	if err != nil {
+	resp := &server.PlaceOrderResponse{}
+	if err := c.doJSON(http.MethodPost, "/order", params, resp); err != nil {
 		return nil, err
 	}
+	return resp, nil
+}
 
-	e := Endpoint + "/order"
-	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
-	if err != nil {
+// CancelOrder returns the order as it was cancelled, with what got filled of it.
+func (c *Client) CancelOrder(orderID int64) (*server.OrderState, error) {
+	resp := &server.CancelOrderResponse{}
+	if err := c.doJSON(http.MethodDelete, fmt.Sprintf("/order/%d", orderID), nil, resp); err != nil {
 		return nil, err
 	}
-	resp, err := c.Do(req)
-	if err != nil {
+	return &resp.Order, nil
+}
+
+// CancelAll cancels every resting order of the key's user. An empty
+// market is all markets, side is "BID", "ASK" or empty for both.
+func (c *Client) CancelAll(market server.Market, side string) ([]server.OrderState, error) {
+	query := url.Values{}
+	if market != "" {
+		query.Set("market", string(market))
+	}
+	if side != "" {
+		query.Set("side", side)
+	}
+	path := "/orders"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	resp := &server.CancelAllResponse{}
+	if err := c.doJSON(http.MethodDelete, path, nil, resp); err != nil {
 		return nil, err
 	}
-	fmt.Printf("%+v", resp)
-	placeOrderResponse := &server.PlaceOrderResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(placeOrderResponse); err != nil {
+	return resp.Orders, nil
+}
+
+// ClearMarket cancels the orders of every user on the market, it needs an admin key.
+func (c *Client) ClearMarket(market server.Market) ([]server.OrderState, error) {
+	resp := &server.CancelAllResponse{}
+	if err := c.doJSON(http.MethodDelete, fmt.Sprintf("/book/%s/orders", market), nil, resp); err != nil {
 		return nil, err
 	}
+	return resp.Orders, nil
+}
 
-	return placeOrderResponse, nil
+// GetAuction returns the phase of the market, with the indicative
+// price, volume and imbalance during the call phase of an auction.
+func (c *Client) GetAuction(market server.Market) (*server.AuctionResponse, error) {
+	resp := &server.AuctionResponse{}
+	if err := c.doJSON(http.MethodGet, fmt.Sprintf("/book/%s/auction", market), nil, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
 
+// StartAuction puts the market in the call phase, it uncrosses by itself after
+// the duration or on Uncross when it's 0. It needs an admin key.
+func (c *Client) StartAuction(market server.Market, d time.Duration) (*server.AuctionResponse, error) {
+	resp := &server.AuctionResponse{}
+	params := &server.AuctionRequest{DurationMs: d.Milliseconds()}
+	if err := c.doJSON(http.MethodPost, fmt.Sprintf("/book/%s/auction", market), params, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
 }
 
-func (c *Client) CancelOrder(orderID int64) error {
-	e := fmt.Sprintf("%s/order/%d", Endpoint, orderID)
+// Uncross ends the auction of the market, it needs an admin key.
+func (c *Client) Uncross(market server.Market) (*server.UncrossResponse, error) {
+	resp := &server.UncrossResponse{}
+	if err := c.doJSON(http.MethodPost, fmt.Sprintf("/book/%s/uncross", market), nil, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
 
-	req, err := http.NewRequest(http.MethodDelete, e, nil)
-	if err != nil {
-		return err
+// HaltMarket stops the trading of the market until an auction opens it, it needs an admin key.
+func (c *Client) HaltMarket(market server.Market) error {
+	return c.doJSON(http.MethodPost, fmt.Sprintf("/book/%s/halt", market), nil, nil)
+}
+
+// BatchResult is what happened to one item of a batch,
+// Err is one of the error types of the package.
+type BatchResult struct {
+	OrderID int64
+	Err     error
+}
+
+type BatchResponse struct {
+	Cancels []BatchResult
+	Orders  []BatchResult
+}
+
+// PlaceBatch cancels and places orders in one request. The items of an all or
+// nothing batch fail together, the error returned is the first that failed.
+func (c *Client) PlaceBatch(batch *server.BatchRequest) (*BatchResponse, error) {
+	resp := &server.BatchResponse{}
+	if err := c.doJSON(http.MethodPost, "/orders/batch", batch, resp); err != nil {
+		return nil, err
 	}
-	_, err = c.Do(req)
-	if err != nil {
-		return err
+
+	results := func(items []server.BatchResult) []BatchResult {
+		out := make([]BatchResult, len(items))
+		for i, item := range items {
+			out[i].OrderID = item.OrderID
+			if item.Error != nil {
+				out[i].Err = typedError(&APIError{Code: item.Error.Code, Message: item.Error.Message, Details: item.Error.Details})
+			}
+		}
+		return out
+	}
+	return &BatchResponse{Cancels: results(resp.Cancels), Orders: results(resp.Orders)}, nil
+}
+
+// CancelAfter arms the dead man's switch of the key's user, all their orders get
+// cancelled unless it's armed again within the timeout. 0 turns it off.
+// It returns when the orders get cancelled.
+func (c *Client) CancelAfter(timeout time.Duration) (time.Time, error) {
+	resp := &server.CancelAfterResponse{}
+	params := &server.CancelAfterRequest{TimeoutMs: timeout.Milliseconds()}
+	if err := c.doJSON(http.MethodPost, "/cancel-after", params, resp); err != nil {
+		return time.Time{}, err
 	}
+	if resp.Deadline == 0 {
+		return time.Time{}, nil
+	}
+	return time.UnixMilli(resp.Deadline), nil
+}
 
-	return nil
+// AmendOrder changes the price and size of a resting limit order.
+func (c *Client) AmendOrder(orderID int64, price, size float64) (*server.PlaceOrderResponse, error) {
+	resp := &server.PlaceOrderResponse{}
+	params := &server.AmendOrderRequest{Market: server.MarketETH, Price: price, Size: size}
+	if err := c.doJSON(http.MethodPatch, fmt.Sprintf("/order/%d", orderID), params, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
 }
 
 func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
@@ -148,26 +294,69 @@ func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderRespons
 		Size:   p.Size,
 		Price:  p.Price,
 		Market: server.MarketETH,
+
+		TimeInForce: p.TimeInForce,
+		Peg:         p.Peg,
 	}
-	body, err := json.Marshal(params)
-	if err != nil {
+	if !p.ExpiresAt.IsZero() {
+		params.ExpiresAt = p.ExpiresAt.UnixMilli()
+	}
+	resp := &server.PlaceOrderResponse{}
+	if err := c.doJSON(http.MethodPost, "/order", params, resp); err != nil {
 		return nil, err
 	}
+	return resp, nil
+}
 
-	e := Endpoint + "/order"
-	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
-	if err != nil {
+// PlaceStopOrder places a plain or trailing stop, the id it returns
+// is the one of the stop, not of the order it places when it fires.
+func (c *Client) PlaceStopOrder(bid bool, size float64, stop *server.StopParams) (*server.PlaceOrderResponse, error) {
+	params := &server.PlaceOrderRequest{
+		Type:   server.StopOrder,
+		Bid:    bid,
+		Size:   size,
+		Market: server.MarketETH,
+		Stop:   stop,
+	}
+	resp := &server.PlaceOrderResponse{}
+	if err := c.doJSON(http.MethodPost, "/order", params, resp); err != nil {
 		return nil, err
 	}
-	resp, err := c.Do(req)
-	if err != nil {
+	return resp, nil
+}
+
+// PlaceLink places an OCO pair, or a bracket when the request has an entry.
+func (c *Client) PlaceLink(link *server.LinkRequest) (*server.OrderLink, error) {
+	resp := &server.LinkResponse{}
+	if err := c.doJSON(http.MethodPost, "/links", link, resp); err != nil {
 		return nil, err
 	}
-	fmt.Printf("%+v", resp)
-	placeOrderResponse := &server.PlaceOrderResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(placeOrderResponse); err != nil {
+	return &resp.Link, nil
+}
+
+// GetLinks lists the OCO pairs and brackets of the key's user, done ones too.
+func (c *Client) GetLinks() ([]server.OrderLink, error) {
+	resp := &server.GetLinksResponse{}
+	if err := c.doJSON(http.MethodGet, "/links", nil, resp); err != nil {
 		return nil, err
 	}
+	return resp.Links, nil
+}
 
-	return placeOrderResponse, nil
+// PlaceSignedOrder signs the order with the wallet key (EIP-712),
+// no api key is needed for it.
+func (c *Client) PlaceSignedOrder(key *ecdsa.PrivateKey, chainID *big.Int, order *server.SignedOrder) (*server.PlaceOrderResponse, error) {
+	sig, err := server.SignOrder(key, chainID, order)
+	if err != nil {
+		return nil, err
+	}
+	params := &server.SignedOrderRequest{
+		Order:     *order,
+		Signature: sig,
+	}
+	resp := &server.PlaceOrderResponse{}
+	if err := c.doJSON(http.MethodPost, "/order/signed", params, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
 }
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ukibbb/crypto-exchange/server"
+)
+
+// APIError is an error response of the exchange. The errors with their
+// own type below wrap it, errors.As(err, &apiErr) works for all of them.
+type APIError struct {
+	StatusCode int              `json:"-"`
+	Code       server.ErrorCode `json:"code"`
+	Message    string           `json:"message"`
+	Details    map[string]any   `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("exchange: %s (%s)", e.Message, e.Code)
+}
+
+// Is matches the errors of the server package by code,
+// errors.Is(err, server.ErrOrderNotFound) works on the client too.
+func (e *APIError) Is(target error) bool {
+	switch t := target.(type) {
+	case *server.APIError:
+		return t.Code == e.Code
+	case *APIError:
+		return t.Code == e.Code
+	}
+	return false
+}
+
+type OrderNotFoundError struct {
+	*APIError
+	// 0 when the server didn't say.
+	OrderID int64
+}
+
+func (e *OrderNotFoundError) Unwrap() error { return e.APIError }
+
+// OrderNotOpenError is an order that was filled or cancelled already.
+type OrderNotOpenError struct {
+	*APIError
+	OrderID int64
+	Status  server.OrderStatus
+}
+
+func (e *OrderNotOpenError) Unwrap() error { return e.APIError }
+
+type MarketNotFoundError struct {
+	*APIError
+	Market server.Market
+}
+
+func (e *MarketNotFoundError) Unwrap() error { return e.APIError }
+
+type InsufficientBalanceError struct {
+	*APIError
+	Asset     server.Asset
+	Available float64
+	Requested float64
+}
+
+func (e *InsufficientBalanceError) Unwrap() error { return e.APIError }
+
+// InvalidOrderError is an order with a bad price or size.
+type InvalidOrderError struct {
+	*APIError
+}
+
+func (e *InvalidOrderError) Unwrap() error { return e.APIError }
+
+type RateLimitedError struct {
+	*APIError
+}
+
+func (e *RateLimitedError) Unwrap() error { return e.APIError }
+
+// decodeError reads the error response, a body that isn't an APIError
+// (a proxy in front of the exchange) still gives an APIError.
+func decodeError(resp *http.Response) error {
+	apiErr := &APIError{StatusCode: resp.StatusCode}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err := json.Unmarshal(body, apiErr); err != nil || apiErr.Code == "" {
+		apiErr.Code = server.CodeInternal
+		if resp.StatusCode < http.StatusInternalServerError {
+			apiErr.Code = server.CodeBadRequest
+		}
+		apiErr.Message = strings.TrimSpace(string(body))
+		if apiErr.Message == "" {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+	}
+	return typedError(apiErr)
+}
+
+// typedError picks the error type of the code.
+func typedError(apiErr *APIError) error {
+	switch apiErr.Code {
+	case server.CodeOrderNotFound:
+		id, _ := apiErr.Details["orderID"].(float64)
+		return &OrderNotFoundError{APIError: apiErr, OrderID: int64(id)}
+	case server.CodeOrderNotOpen:
+		id, _ := apiErr.Details["orderID"].(float64)
+		status, _ := apiErr.Details["status"].(string)
+		return &OrderNotOpenError{APIError: apiErr, OrderID: int64(id), Status: server.OrderStatus(status)}
+	case server.CodeMarketNotFound:
+		market, _ := apiErr.Details["market"].(string)
+		return &MarketNotFoundError{APIError: apiErr, Market: server.Market(market)}
+	case server.CodeInsufficientBalance:
+		asset, _ := apiErr.Details["asset"].(string)
+		available, _ := apiErr.Details["available"].(float64)
+		requested, _ := apiErr.Details["requested"].(float64)
+		return &InsufficientBalanceError{APIError: apiErr, Asset: server.Asset(asset), Available: available, Requested: requested}
+	case server.CodeInvalidPrice, server.CodeInvalidSize:
+		return &InvalidOrderError{APIError: apiErr}
+	case server.CodeRateLimited:
+		return &RateLimitedError{APIError: apiErr}
+	}
+	return apiErr
+}
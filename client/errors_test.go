@@ -0,0 +1,43 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ukibbb/crypto-exchange/config"
+	"github.com/ukibbb/crypto-exchange/server"
+)
+
+func TestDecodeError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/order/42":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":"ORDER_NOT_FOUND","message":"order not found [42]","details":{"orderID":42}}`))
+		default:
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+		}
+	}))
+	defer ts.Close()
+	c := NewClient(config.ClientConfig{Endpoint: ts.URL})
+
+	_, err := c.CancelOrder(42)
+	var notFound *OrderNotFoundError
+	if !errors.As(err, &notFound) {
+		t.Fatalf("%v is not an OrderNotFoundError", err)
+	}
+	if notFound.OrderID != 42 || notFound.StatusCode != http.StatusNotFound {
+		t.Errorf("%+v", notFound)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !errors.Is(err, server.ErrOrderNotFound) {
+		t.Errorf("%v is not an order not found APIError", err)
+	}
+
+	_, err = c.GetBestBid()
+	if !errors.As(err, &apiErr) || apiErr.Code != server.CodeInternal || apiErr.Message != "bad gateway" {
+		t.Errorf("%+v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ukibbb/crypto-exchange/server"
+)
+
+// CreateUser needs an admin key, wallet is optional.
+func (c *Client) CreateUser(wallet string) (*server.CreateUserResponse, error) {
+	resp := &server.CreateUserResponse{}
+	if err := c.doJSON(http.MethodPost, "/users", &server.CreateUserRequest{WalletAddress: wallet}, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) GetUser(userID int64) (*server.User, error) {
+	user := &server.User{}
+	if err := c.doJSON(http.MethodGet, fmt.Sprintf("/users/%d", userID), nil, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (c *Client) SetUserStatus(userID int64, status server.UserStatus) (*server.User, error) {
+	user := &server.User{}
+	if err := c.doJSON(http.MethodPut, fmt.Sprintf("/users/%d/status", userID), &server.UserStatusRequest{Status: status}, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (c *Client) GetAPIKeys(userID int64) ([]*server.APIKey, error) {
+	keys := []*server.APIKey{}
+	if err := c.doJSON(http.MethodGet, fmt.Sprintf("/users/%d/keys", userID), nil, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// CreateAPIKey returns the key with its secret.
+func (c *Client) CreateAPIKey(userID int64, perms ...server.Permission) (*server.APIKey, error) {
+	key := &server.APIKey{}
+	if err := c.doJSON(http.MethodPost, fmt.Sprintf("/users/%d/keys", userID), &server.CreateAPIKeyRequest{Permissions: perms}, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (c *Client) RevokeAPIKey(userID int64, key string) error {
+	return c.doJSON(http.MethodDelete, fmt.Sprintf("/users/%d/keys/%s", userID, key), nil, nil)
+}
+
+// CreditBalance funds an asset that isn't on chain, like USD, it needs an admin key.
+func (c *Client) CreditBalance(userID int64, asset server.Asset, amount float64) (map[server.Asset]server.Balance, error) {
+	resp := &server.BalancesResponse{}
+	if err := c.doJSON(http.MethodPost, fmt.Sprintf("/balance/%d/credit", userID), &server.CreditRequest{Asset: asset, Amount: amount}, resp); err != nil {
+		return nil, err
+	}
+	return resp.Balances, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/ukibbb/crypto-exchange/replay"
+)
+
+func (c *cli) replay(args []string) error {
+	fs := c.flags("replay")
+	step := fs.Duration("step", 0, "time between events without a time of their own (default 1ms)")
+	start := fs.Int64("start", 0, "simulated time the run starts at, in nanoseconds")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return usageError("replay takes at most one file")
+	}
+
+	// without a file, or with "-", the events come from stdin.
+	var in io.Reader = c.stdin
+	if path := fs.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	result, err := replay.Run(in, replay.Config{Start: *start, Step: *step})
+	if err != nil {
+		return err
+	}
+	_, err = result.WriteTo(c.stdout)
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ukibbb/crypto-exchange/config"
+	"github.com/ukibbb/crypto-exchange/server"
+)
+
+// pairFlag collects repeated NAME=VALUE flags.
+type pairFlag map[string]string
+
+func (p pairFlag) String() string {
+	pairs := make([]string, 0, len(p))
+	for k, v := range p {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (p pairFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" || v == "" {
+		return fmt.Errorf("%q is not NAME=VALUE", s)
+	}
+	p[k] = v
+	return nil
+}
+
+// serve reads the config file and the environment,
+// flags given on the command line win over both.
+func (c *cli) serve(args []string) error {
+	fs := c.flags("serve")
+	configPath := fs.String("config", "", "YAML config file")
+	addr := fs.String("addr", "", "address to listen on")
+	rpcURL := fs.String("rpc", "", "RPC URL of the chain node")
+	chainID := fs.Int64("chain-id", 0, "chain id, asked from the node when 0")
+	hotWallet := fs.String("keystore", "", "keystore file of the hot wallet")
+	deposits := fs.String("deposit-keystore", "", "keystore directory of the deposit addresses")
+	users := fs.String("users", "", "user registry file")
+	journal := fs.String("journal", "", "journal directory")
+	snapshots := fs.String("snapshots", "", "snapshot directory")
+	interval := fs.Duration("snapshot-interval", 0, "time between snapshots")
+	tokens := pairFlag{}
+	fs.Var(tokens, "token", "list a token as ASSET=ADDRESS, repeatable")
+	markets := pairFlag{}
+	fs.Var(markets, "market", "open a market as NAME=BASE/QUOTE, repeatable")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError("serve takes no arguments")
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+
+	set := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	set(&cfg.Server.Listen, *addr)
+	set(&cfg.Chain.RPC, *rpcURL)
+	set(&cfg.Keys.HotWallet, *hotWallet)
+	set(&cfg.Keys.Deposits, *deposits)
+	set(&cfg.Storage.Users, *users)
+	set(&cfg.Storage.Journal, *journal)
+	set(&cfg.Storage.Snapshots, *snapshots)
+	if *chainID != 0 {
+		cfg.Chain.ChainID = *chainID
+	}
+	if *interval != 0 {
+		cfg.Storage.SnapshotInterval = *interval
+	}
+	for asset, address := range tokens {
+		cfg.Tokens[asset] = address
+	}
+	for market, pair := range markets {
+		base, quote, ok := strings.Cut(pair, "/")
+		if !ok || base == "" || quote == "" {
+			return usageError("market %s: %q is not BASE/QUOTE", market, pair)
+		}
+		cfg.Markets[market] = config.MarketConfig{Base: base, Quote: quote}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid config:\n%w", err)
+	}
+	return server.StartServer(server.NewOptions(cfg))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/ukibbb/crypto-exchange/orderbook"
+	"github.com/ukibbb/crypto-exchange/server"
+)
+
+func (c *cli) snapshot(args []string) error {
+	if len(args) == 0 {
+		return usageError("snapshot needs a subcommand")
+	}
+	switch args[0] {
+	case "inspect":
+		return c.snapshotInspect(args[1:])
+	default:
+		return usageError("unknown snapshot command %q", args[0])
+	}
+}
+
+func (c *cli) snapshotInspect(args []string) error {
+	fs := c.flags("snapshot inspect")
+	orders := fs.Bool("orders", false, "print the orders of every limit")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError("snapshot inspect takes one file")
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	books, seq, err := server.DecodeSnapshot(data)
+	if err != nil {
+		return err
+	}
+
+	markets := make([]server.Market, 0, len(books))
+	for market := range books {
+		markets = append(markets, market)
+	}
+	sort.Slice(markets, func(i, j int) bool { return markets[i] < markets[j] })
+
+	fmt.Fprintf(c.stdout, "journal seq %d markets %d\n", seq, len(markets))
+	for _, market := range markets {
+		ob := books[market]
+		fmt.Fprintf(c.stdout, "market %s seq %d orders %d trades %d asks %.8f bids %.8f\n",
+			market, ob.Seq, len(ob.Orders), len(ob.Trades), ob.AskTotalVolume(), ob.BidTotalVolume())
+		c.printLimits("ask", ob.Asks(), *orders)
+		c.printLimits("bid", ob.Bids(), *orders)
+	}
+	return nil
+}
+
+func (c *cli) printLimits(kind string, limits []*orderbook.Limit, orders bool) {
+	for _, limit := range limits {
+		fmt.Fprintf(c.stdout, "  %s %.8f volume %.8f orders %d\n", kind, limit.Price, limit.TotalVolume, len(limit.Orders))
+		if !orders {
+			continue
+		}
+		for _, o := range limit.Orders {
+			fmt.Fprintf(c.stdout, "    order %d user %d size %.8f t=%d\n", o.ID, o.UserID, o.Size, o.Timestamp)
+		}
+	}
+}
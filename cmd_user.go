@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ukibbb/crypto-exchange/config"
+	"github.com/ukibbb/crypto-exchange/server"
+)
+
+func (c *cli) user(args []string) error {
+	if len(args) == 0 {
+		return usageError("user needs a subcommand")
+	}
+	switch args[0] {
+	case "create":
+		return c.userCreate(args[1:])
+	default:
+		return usageError("unknown user command %q", args[0])
+	}
+}
+
+// userCreate writes to the registry and the keys file directly, the server
+// must not be running at the same time. It prints the first api key of the
+// user, the secret is never shown again. The operator of the exchange is
+// created with -admin.
+func (c *cli) userCreate(args []string) error {
+	fs := c.flags("user create")
+	configPath := fs.String("config", "", "YAML config file")
+	users := fs.String("users", "", "user registry file")
+	keys := fs.String("keys", "", "api keys file")
+	admin := fs.Bool("admin", false, "the first api key is an admin key")
+	deposits := fs.String("deposit-keystore", "", "keystore directory of the deposit addresses")
+	wallet := fs.String("wallet", "", "wallet address of the user for signed orders, optional")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError("user create takes no arguments")
+	}
+
+	var walletAddress common.Address
+	if *wallet != "" {
+		if !common.IsHexAddress(*wallet) {
+			return usageError("%q is not an address", *wallet)
+		}
+		walletAddress = common.HexToAddress(*wallet)
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+	if *users != "" {
+		cfg.Storage.Users = *users
+	}
+	if *keys != "" {
+		cfg.Storage.APIKeys = *keys
+	}
+	if *deposits != "" {
+		cfg.Keys.Deposits = *deposits
+	}
+	if cfg.Keys.Passphrase == "" {
+		return errors.New("EXCHANGE_KEYSTORE_PASSPHRASE is not set")
+	}
+
+	registry, err := server.NewUserRegistry(cfg.Storage.Users)
+	if err != nil {
+		return err
+	}
+	apiKeys, err := server.NewAPIKeyStore(cfg.Storage.APIKeys, cfg.Keys.Passphrase)
+	if err != nil {
+		return err
+	}
+	ks := keystore.NewKeyStore(cfg.Keys.Deposits, keystore.StandardScryptN, keystore.StandardScryptP)
+	ex := server.NewExchange(nil, server.NewKeystoreWallet(ks, cfg.Keys.Passphrase), registry, nil, server.DefaultExchangeConfig)
+
+	ex.APIKeys = apiKeys
+
+	user, err := ex.NewUser(walletAddress)
+	if err != nil {
+		return err
+	}
+
+	// the same first key POST /users hands out.
+	perms := []server.Permission{server.PermRead, server.PermTrade, server.PermWithdraw}
+	if *admin {
+		perms = append(perms, server.PermAdmin)
+	}
+	key, err := apiKeys.Create(user.ID, perms...)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&server.CreateUserResponse{User: user, APIKey: key})
+}
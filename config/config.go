@@ -0,0 +1,349 @@
+// Package config loads the settings of the exchange and its client from a
+// YAML file. Every setting has a default and most can be overridden from the
+// environment, the variable is in the env tag of the field:
+//
+//	server:
+//	  listen: ":3000"
+//	  rateLimit: {rate: 20, burst: 40}
+//	chain:
+//	  rpc: http://localhost:7545
+//	  confirmations: 12
+//	tokens:
+//	  USDC: "0x..."
+//	markets:
+//	  ETH-USDC: {base: ETH, quote: USDC}
+//
+// The keystore passphrase is only ever read from the environment.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Server  ServerConfig  `yaml:"server"`
+	Chain   ChainConfig   `yaml:"chain"`
+	Keys    KeysConfig    `yaml:"keys"`
+	Storage StorageConfig `yaml:"storage"`
+	// asset => address of the ERC-20 contract.
+	Tokens map[string]string `yaml:"tokens"`
+	// markets opened next to the ETH market.
+	Markets     map[string]MarketConfig `yaml:"markets"`
+	Withdrawals WithdrawalConfig        `yaml:"withdrawals"`
+	Trading     TradingConfig           `yaml:"trading"`
+	Client      ClientConfig            `yaml:"client"`
+}
+
+type ServerConfig struct {
+	Listen    string          `yaml:"listen" env:"EXCHANGE_LISTEN"`
+	TLS       TLSConfig       `yaml:"tls"`
+	RateLimit RateLimitConfig `yaml:"rateLimit"`
+}
+
+type TLSConfig struct {
+	Cert string `yaml:"cert" env:"EXCHANGE_TLS_CERT"`
+	Key  string `yaml:"key" env:"EXCHANGE_TLS_KEY"`
+}
+
+type RateLimitConfig struct {
+	// requests per second of an api key, or of an ip without one. 0 turns it off.
+	Rate  float64 `yaml:"rate" env:"EXCHANGE_RATE_LIMIT"`
+	Burst int     `yaml:"burst" env:"EXCHANGE_RATE_BURST"`
+}
+
+type ChainConfig struct {
+	RPC string `yaml:"rpc" env:"EXCHANGE_RPC_URL"`
+	// asked from the node when 0.
+	ChainID       int64  `yaml:"chainID" env:"EXCHANGE_CHAIN_ID"`
+	Confirmations uint64 `yaml:"confirmations" env:"EXCHANGE_CONFIRMATIONS"`
+	// deposits are looked for from this block on, the one the exchange went live in.
+	DepositStartBlock uint64    `yaml:"depositStartBlock" env:"EXCHANGE_DEPOSIT_START_BLOCK"`
+	Fees              FeeConfig `yaml:"fees"`
+}
+
+// FeeConfig is the fee schedule of the transactions the exchange sends.
+type FeeConfig struct {
+	MaxTipGwei     uint64 `yaml:"maxTipGwei"`
+	MaxFeeGwei     uint64 `yaml:"maxFeeGwei"`
+	GasLimitMargin uint64 `yaml:"gasLimitMargin"`
+}
+
+type KeysConfig struct {
+	// encrypted keystore file of the hot wallet, withdrawals are paid from it.
+	HotWallet string `yaml:"hotWallet" env:"EXCHANGE_KEYSTORE"`
+	// directory of the keystore holding the deposit address keys.
+	Deposits string `yaml:"deposits" env:"EXCHANGE_DEPOSIT_KEYSTORE"`
+	// passphrase of both keystores.
+	Passphrase string `yaml:"-" env:"EXCHANGE_KEYSTORE_PASSPHRASE"`
+}
+
+type StorageConfig struct {
+	Users            string        `yaml:"users" env:"EXCHANGE_USERS"`
+	APIKeys          string        `yaml:"apiKeys" env:"EXCHANGE_API_KEYS"`
+	Journal          string        `yaml:"journal" env:"EXCHANGE_JOURNAL"`
+	Snapshots        string        `yaml:"snapshots" env:"EXCHANGE_SNAPSHOTS"`
+	SnapshotInterval time.Duration `yaml:"snapshotInterval" env:"EXCHANGE_SNAPSHOT_INTERVAL"`
+}
+
+type MarketConfig struct {
+	Base  string `yaml:"base"`
+	Quote string `yaml:"quote"`
+}
+
+type WithdrawalConfig struct {
+	MaxAmount         float64 `yaml:"maxAmount"`
+	DailyLimit        float64 `yaml:"dailyLimit"`
+	ApprovalThreshold float64 `yaml:"approvalThreshold"`
+}
+
+type TradingConfig struct {
+	// HH:MM in UTC the trading day ends at, day orders expire then.
+	DayEnd string `yaml:"dayEnd" env:"EXCHANGE_DAY_END"`
+	// rates of what a side gets out of a trade, 0.001 is 0.1%. The taker is
+	// the market order, the maker the order that rested in the book.
+	MakerFee float64 `yaml:"makerFee" env:"EXCHANGE_MAKER_FEE"`
+	TakerFee float64 `yaml:"takerFee" env:"EXCHANGE_TAKER_FEE"`
+}
+
+// DayEndLayout is the layout of TradingConfig.DayEnd.
+const DayEndLayout = "15:04"
+
+// the asset of the chain itself, every other asset is a listed token.
+const nativeAsset = "ETH"
+
+type ClientConfig struct {
+	Endpoint string        `yaml:"endpoint" env:"EXCHANGE_ENDPOINT"`
+	Timeout  time.Duration `yaml:"timeout" env:"EXCHANGE_CLIENT_TIMEOUT"`
+	// requests are signed with the key when it's set.
+	APIKey    string `yaml:"apiKey" env:"EXCHANGE_API_KEY"`
+	APISecret string `yaml:"-" env:"EXCHANGE_API_SECRET"`
+}
+
+// Default is the config of a local dev setup, the server
+// starts with the same settings without a config.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{Listen: ":3000"},
+		Chain: ChainConfig{
+			RPC:           "http://localhost:7545",
+			Confirmations: 12,
+			Fees:          FeeConfig{MaxTipGwei: 5, MaxFeeGwei: 500, GasLimitMargin: 20},
+		},
+		Keys: KeysConfig{Deposits: "keystore/deposits"},
+		Storage: StorageConfig{
+			Users:            "data/users.json",
+			APIKeys:          "data/keys.json",
+			Journal:          "data/journal",
+			Snapshots:        "data/snapshots",
+			SnapshotInterval: 10 * time.Minute,
+		},
+		Tokens:  make(map[string]string),
+		Markets: make(map[string]MarketConfig),
+		Withdrawals: WithdrawalConfig{
+			MaxAmount:         100,
+			DailyLimit:        250,
+			ApprovalThreshold: 10,
+		},
+		Trading: TradingConfig{DayEnd: "00:00"},
+		Client: ClientConfig{
+			Endpoint: "http://localhost:3000",
+			Timeout:  10 * time.Second,
+		},
+	}
+}
+
+// Load reads the file over the defaults and then the environment over both.
+// Without a path only the environment is read. The result isn't validated,
+// callers can still change it before they call Validate.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		// a typo should not silently fall back to the default.
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("config %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv sets every field with an env tag whose variable is set.
+func applyEnv(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, sf := v.Field(i), v.Type().Field(i)
+		if sf.Type.Kind() == reflect.Struct && sf.Type != reflect.TypeOf(time.Duration(0)) {
+			if err := applyEnv(field); err != nil {
+				return err
+			}
+			continue
+		}
+		name := sf.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("can't set a %s from the environment", field.Type())
+	}
+	return nil
+}
+
+// Validate reports everything wrong with the config at once,
+// every problem is named by its key in the file.
+func (cfg *Config) Validate() error {
+	var errs []error
+	fail := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	if cfg.Server.Listen == "" {
+		fail("server.listen", "must be set")
+	}
+	if (cfg.Server.TLS.Cert == "") != (cfg.Server.TLS.Key == "") {
+		fail("server.tls", "cert and key must be set together")
+	}
+	if cfg.Server.RateLimit.Rate < 0 {
+		fail("server.rateLimit.rate", "can't be negative")
+	}
+	if cfg.Server.RateLimit.Rate > 0 && cfg.Server.RateLimit.Burst < 1 {
+		fail("server.rateLimit.burst", "must be at least 1 with a rate limit")
+	}
+
+	if cfg.Chain.RPC == "" {
+		fail("chain.rpc", "must be set")
+	}
+	if cfg.Chain.ChainID < 0 {
+		fail("chain.chainID", "can't be negative")
+	}
+	if cfg.Chain.Confirmations == 0 {
+		fail("chain.confirmations", "must be at least 1")
+	}
+	if cfg.Chain.Fees.MaxTipGwei > cfg.Chain.Fees.MaxFeeGwei {
+		fail("chain.fees.maxTipGwei", "is above maxFeeGwei")
+	}
+
+	if cfg.Keys.HotWallet == "" {
+		fail("keys.hotWallet", "must be set")
+	}
+	if cfg.Keys.Deposits == "" {
+		fail("keys.deposits", "must be set")
+	}
+	if cfg.Keys.Passphrase == "" {
+		fail("keys", "EXCHANGE_KEYSTORE_PASSPHRASE is not set")
+	}
+
+	if cfg.Storage.Users == "" {
+		fail("storage.users", "must be set")
+	}
+	if cfg.Storage.APIKeys == "" {
+		fail("storage.apiKeys", "must be set")
+	}
+	if cfg.Storage.Journal == "" {
+		fail("storage.journal", "must be set")
+	}
+	if cfg.Storage.Snapshots != "" && cfg.Storage.SnapshotInterval <= 0 {
+		fail("storage.snapshotInterval", "must be positive")
+	}
+
+	for asset, address := range cfg.Tokens {
+		if !common.IsHexAddress(address) {
+			fail("tokens."+asset, "%q is not an address", address)
+		}
+	}
+	for name, market := range cfg.Markets {
+		for _, asset := range []string{market.Base, market.Quote} {
+			if _, ok := cfg.Tokens[asset]; !ok && asset != nativeAsset {
+				fail("markets."+name, "asset %q is not ETH or a listed token", asset)
+			}
+		}
+		if market.Base == market.Quote {
+			fail("markets."+name, "base and quote are the same asset")
+		}
+	}
+
+	w := cfg.Withdrawals
+	if w.MaxAmount <= 0 || w.DailyLimit <= 0 || w.ApprovalThreshold < 0 {
+		fail("withdrawals", "limits must be positive")
+	}
+	if w.MaxAmount > w.DailyLimit {
+		fail("withdrawals.maxAmount", "is above the daily limit")
+	}
+
+	if _, err := time.Parse(DayEndLayout, cfg.Trading.DayEnd); err != nil {
+		fail("trading.dayEnd", "%q is not a time like 22:00", cfg.Trading.DayEnd)
+	}
+
+	if fee := cfg.Trading.MakerFee; fee < 0 || fee >= 1 {
+		fail("trading.makerFee", "%g is not a rate from 0 to 1", fee)
+	}
+	if fee := cfg.Trading.TakerFee; fee < 0 || fee >= 1 {
+		fail("trading.takerFee", "%g is not a rate from 0 to 1", fee)
+	}
+
+	if cfg.Client.Endpoint == "" {
+		fail("client.endpoint", "must be set")
+	}
+
+	return errors.Join(errs...)
+}
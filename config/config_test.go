@@ -0,0 +1,131 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "exchange.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testConfig = `
+server:
+  listen: ":8443"
+  tls: {cert: cert.pem, key: key.pem}
+  rateLimit: {rate: 20, burst: 40}
+chain:
+  rpc: http://node:8545
+  confirmations: 6
+  fees: {maxTipGwei: 2, maxFeeGwei: 100, gasLimitMargin: 10}
+keys:
+  hotWallet: keystore/hot.json
+storage:
+  snapshotInterval: 1m
+tokens:
+  USDC: "0x0000000000000000000000000000000000000abc"
+markets:
+  ETH-USDC: {base: ETH, quote: USDC}
+trading:
+  dayEnd: "21:30"
+  makerFee: 0.001
+  takerFee: 0.002
+`
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	t.Setenv("EXCHANGE_RPC_URL", "http://other:8545")
+	t.Setenv("EXCHANGE_CHAIN_ID", "1337")
+	t.Setenv("EXCHANGE_KEYSTORE_PASSPHRASE", "secret")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, cfg.Server.Listen, ":8443")
+	assert(t, cfg.Server.TLS.Cert, "cert.pem")
+	assert(t, cfg.Server.RateLimit, RateLimitConfig{Rate: 20, Burst: 40})
+	// the environment wins over the file.
+	assert(t, cfg.Chain.RPC, "http://other:8545")
+	assert(t, cfg.Chain.ChainID, int64(1337))
+	assert(t, cfg.Keys.Passphrase, "secret")
+	assert(t, cfg.Chain.Fees, FeeConfig{MaxTipGwei: 2, MaxFeeGwei: 100, GasLimitMargin: 10})
+	assert(t, cfg.Chain.Confirmations, uint64(6))
+	assert(t, cfg.Storage.SnapshotInterval, time.Minute)
+	assert(t, cfg.Trading.DayEnd, "21:30")
+	assert(t, [2]float64{cfg.Trading.MakerFee, cfg.Trading.TakerFee}, [2]float64{0.001, 0.002})
+	// not in the file, so the defaults.
+	assert(t, cfg.Storage.Users, "data/users.json")
+	assert(t, cfg.Withdrawals, Default().Withdrawals)
+	assert(t, cfg.Tokens["USDC"], "0x0000000000000000000000000000000000000abc")
+	assert(t, cfg.Markets["ETH-USDC"], MarketConfig{Base: "ETH", Quote: "USDC"})
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	_, err := Load(writeConfig(t, "chain:\n  rcp: http://node:8545\n"))
+	assert(t, err != nil && strings.Contains(err.Error(), "rcp"), true)
+}
+
+func TestLoadBadEnv(t *testing.T) {
+	t.Setenv("EXCHANGE_CONFIRMATIONS", "many")
+	_, err := Load("")
+	assert(t, err != nil && strings.HasPrefix(err.Error(), "EXCHANGE_CONFIRMATIONS"), true)
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.Server.TLS.Cert = "cert.pem"
+	cfg.Chain.Fees.MaxTipGwei = 1000
+	cfg.Markets["ETH-DAI"] = MarketConfig{Base: "ETH", Quote: "DAI"}
+	cfg.Trading.DayEnd = "25:00"
+	cfg.Trading.TakerFee = -0.1
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected the config to be invalid")
+	}
+	for _, want := range []string{
+		"server.tls: cert and key must be set together",
+		"chain.fees.maxTipGwei: is above maxFeeGwei",
+		"keys.hotWallet: must be set",
+		"keys: EXCHANGE_KEYSTORE_PASSPHRASE is not set",
+		`markets.ETH-DAI: asset "DAI" is not ETH or a listed token`,
+		`trading.dayEnd: "25:00" is not a time like 22:00`,
+		"trading.takerFee: -0.1 is not a rate from 0 to 1",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q is missing from:\n%s", want, err)
+		}
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	t.Setenv("EXCHANGE_KEYSTORE_PASSPHRASE", "secret")
+	cfg, err := Load("../config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
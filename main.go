@@ -1,4 +1,104 @@
+// Command exchange runs the exchange and the tools around it.
+//
+//	exchange serve [flags]               run the exchange server
+//	exchange replay [flags] [file]       replay recorded order commands
+//	exchange snapshot inspect <file>     print what is in a book snapshot
+//	exchange user create [flags]         add a user and print their first api key
 package main
 
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// exit codes, usage errors are told apart from failures.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// errUsage wraps mistakes in the command line.
+var errUsage = errors.New("usage")
+
+func usageError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", errUsage, fmt.Sprintf(format, args...))
+}
+
+const usage = `usage: exchange <command> [flags]
+
+commands:
+  serve              run the exchange server
+  replay             replay recorded order commands
+  snapshot inspect   print what is in a book snapshot
+  user create        add a user and print their first api key
+
+run "exchange <command> -h" for the flags of a command.
+`
+
+type cli struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
 func main() {
+	c := &cli{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}
+	os.Exit(c.run(os.Args[1:]))
+}
+
+func (c *cli) run(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(c.stderr, usage)
+		return exitUsage
+	}
+
+	var err error
+	switch args[0] {
+	case "serve":
+		err = c.serve(args[1:])
+	case "replay":
+		err = c.replay(args[1:])
+	case "snapshot":
+		err = c.snapshot(args[1:])
+	case "user":
+		err = c.user(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(c.stdout, usage)
+		return exitOK
+	default:
+		err = usageError("unknown command %q", args[0])
+	}
+
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.Is(err, errUsage):
+		fmt.Fprintf(c.stderr, "exchange: %s\n\n%s", err, usage)
+		return exitUsage
+	default:
+		fmt.Fprintf(c.stderr, "exchange: %s\n", err)
+		return exitError
+	}
+}
+
+// flags makes a flag set that reports to the cli instead of exiting.
+func (c *cli) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	return fs
+}
+
+// parse turns bad flags into usage errors, the flag set printed them already.
+func parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return fmt.Errorf("%w: %s", errUsage, err)
+	}
+	return nil
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ukibbb/crypto-exchange/server"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func runCLI(args ...string) (int, string, string) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	c := &cli{stdin: strings.NewReader(""), stdout: stdout, stderr: stderr}
+	code := c.run(args)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestExitCodes(t *testing.T) {
+	code, _, _ := runCLI()
+	assert(t, code, exitUsage)
+	code, _, _ = runCLI("nope")
+	assert(t, code, exitUsage)
+	code, _, _ = runCLI("replay", "-bogus")
+	assert(t, code, exitUsage)
+	code, _, _ = runCLI("snapshot", "inspect")
+	assert(t, code, exitUsage)
+	code, _, _ = runCLI("replay", "-h")
+	assert(t, code, exitOK)
+
+	code, _, stderr := runCLI("replay", filepath.Join(t.TempDir(), "missing.jsonl"))
+	assert(t, code, exitError)
+	assert(t, strings.Contains(stderr, "no such file"), true)
+
+	t.Setenv("EXCHANGE_KEYSTORE_PASSPHRASE", "")
+	code, _, _ = runCLI("user", "create", "-users", filepath.Join(t.TempDir(), "users.json"))
+	assert(t, code, exitError)
+}
+
+func TestReplay(t *testing.T) {
+	golden, err := os.ReadFile("replay/testdata/matching.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, stdout, stderr := runCLI("replay", "replay/testdata/matching.jsonl")
+	assert(t, code, exitOK)
+	assert(t, stderr, "")
+	assert(t, stdout, string(golden))
+}
+
+func TestSnapshotInspect(t *testing.T) {
+	users, err := server.NewUserRegistry("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := server.NewExchange(nil, nil, users, nil, server.DefaultExchangeConfig)
+	ex.SnapshotDir = t.TempDir()
+	path, err := ex.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, stdout, _ := runCLI("snapshot", "inspect", path)
+	assert(t, code, exitOK)
+	assert(t, strings.HasPrefix(stdout, "journal seq 0 markets 1\nmarket ETH seq 0 orders 0"), true)
+
+	if err := os.WriteFile(path, []byte("not a snapshot"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	code, _, _ = runCLI("snapshot", "inspect", path)
+	assert(t, code, exitError)
+}
+
+func TestUserCreate(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("EXCHANGE_KEYSTORE_PASSPHRASE", "test")
+	code, stdout, stderr := runCLI("user", "create", "-admin",
+		"-users", filepath.Join(dir, "users.json"),
+		"-keys", filepath.Join(dir, "keys.json"),
+		"-deposit-keystore", filepath.Join(dir, "deposits"))
+	assert(t, code, exitOK)
+	assert(t, stderr, "")
+
+	created := &server.CreateUserResponse{}
+	if err := json.Unmarshal([]byte(stdout), created); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, created.User.ID, int64(1))
+	assert(t, created.APIKey.Secret != "", true)
+	assert(t, created.APIKey.Can(server.PermAdmin), true)
+
+	// the server finds the key, without its secret.
+	keys, err := server.NewAPIKeyStore(filepath.Join(dir, "keys.json"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, ok := keys.Get(created.APIKey.Key)
+	assert(t, ok, true)
+	assert(t, key.UserID, created.User.ID)
+	assert(t, key.Secret, "")
+}
@@ -0,0 +1,128 @@
+package orderbook
+
+import (
+	"math"
+	"sort"
+)
+
+// Auction is where a call auction would uncross the book now.
+type Auction struct {
+	Price  float64
+	Volume float64
+	// bid volume at the price minus ask volume at it, what's left over
+	// on the side with more. Positive when the buyers are left over.
+	Imbalance float64
+}
+
+// Auction finds the single price that executes the most volume between the
+// bids at or above it and the asks at or below it. Prices with the same
+// volume go to the smallest imbalance, then the side left over pushes it:
+// up for buyers and down for sellers. What's still tied goes to the price
+// closest to the last trade, or the lowest one without trades.
+// It's false when nothing crosses.
+func (ob *OrderBook) Auction() (Auction, bool) {
+	prices := make([]float64, 0, len(ob.bids)+len(ob.asks))
+	for _, limit := range ob.bids {
+		prices = append(prices, limit.Price)
+	}
+	for _, limit := range ob.asks {
+		prices = append(prices, limit.Price)
+	}
+	sort.Float64s(prices)
+
+	var (
+		best  Auction
+		found bool
+	)
+	for _, price := range prices {
+		bidVolume, askVolume := 0.0, 0.0
+		for _, limit := range ob.bids {
+			if limit.Price >= price {
+				bidVolume += limit.TotalVolume
+			}
+		}
+		for _, limit := range ob.asks {
+			if limit.Price <= price {
+				askVolume += limit.TotalVolume
+			}
+		}
+		a := Auction{Price: price, Volume: min(bidVolume, askVolume), Imbalance: bidVolume - askVolume}
+		if a.Volume <= 0 {
+			continue
+		}
+		if !found || ob.betterAuction(a, best) {
+			best, found = a, true
+		}
+	}
+	return best, found
+}
+
+// betterAuction reports whether a uncrosses better than b, a has the higher price.
+func (ob *OrderBook) betterAuction(a, b Auction) bool {
+	if a.Volume != b.Volume {
+		return a.Volume > b.Volume
+	}
+	if math.Abs(a.Imbalance) != math.Abs(b.Imbalance) {
+		return math.Abs(a.Imbalance) < math.Abs(b.Imbalance)
+	}
+	if a.Imbalance > 0 {
+		return true
+	}
+	if a.Imbalance < 0 {
+		return false
+	}
+	if len(ob.Trades) == 0 {
+		return false
+	}
+	last := ob.Trades[len(ob.Trades)-1].Price
+	return math.Abs(a.Price-last) < math.Abs(b.Price-last)
+}
+
+// uncross executes the crossing bids and asks at the price of the auction,
+// best price first and in queue order on a price. Both sides rested in
+// the book, the trades are marked with the side that was left over.
+func (ob *OrderBook) uncross(timestamp int64) []Match {
+	auction, ok := ob.Auction()
+	if !ok {
+		return nil
+	}
+
+	var bids, asks []*Order
+	for _, limit := range ob.Bids() {
+		if limit.Price >= auction.Price {
+			bids = append(bids, limit.Orders...)
+		}
+	}
+	for _, limit := range ob.Asks() {
+		if limit.Price <= auction.Price {
+			asks = append(asks, limit.Orders...)
+		}
+	}
+
+	matches := []Match{}
+	var filled []*Order
+	for len(bids) > 0 && len(asks) > 0 {
+		bid, ask := bids[0], asks[0]
+		size := min(bid.Size, ask.Size)
+		for _, o := range []*Order{bid, ask} {
+			o.Size -= size
+			o.Limit.TotalVolume -= size
+		}
+		matches = append(matches, Match{Bid: bid, Ask: ask, SizeFilled: size, Price: auction.Price})
+		ob.Trades = append(ob.Trades, &Trade{Price: auction.Price, Size: size, Bid: auction.Imbalance > 0, Timestamp: timestamp})
+
+		if bid.IsFilled() {
+			filled = append(filled, bid)
+			bids = bids[1:]
+		}
+		if ask.IsFilled() {
+			filled = append(filled, ask)
+			asks = asks[1:]
+		}
+	}
+
+	for _, o := range filled {
+		ob.CancelOrder(o)
+	}
+	return matches
+}
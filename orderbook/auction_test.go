@@ -0,0 +1,81 @@
+package orderbook
+
+import "testing"
+
+func TestAuctionPrice(t *testing.T) {
+	ob := NewOrderBook()
+	_, ok := ob.Auction()
+	assert(t, ok, false)
+
+	// a crossed book, the most volume trades at 101.
+	for _, cmd := range []Command{
+		{Type: CmdPlaceLimit, OrderID: 1, Bid: true, Price: 102, Size: 2, Timestamp: 1},
+		{Type: CmdPlaceLimit, OrderID: 2, Bid: true, Price: 101, Size: 3, Timestamp: 2},
+		{Type: CmdPlaceLimit, OrderID: 3, Bid: true, Price: 99, Size: 5, Timestamp: 3},
+		{Type: CmdPlaceLimit, OrderID: 4, Price: 100, Size: 2, Timestamp: 4},
+		{Type: CmdPlaceLimit, OrderID: 5, Price: 101, Size: 2, Timestamp: 5},
+		{Type: CmdPlaceLimit, OrderID: 6, Price: 103, Size: 4, Timestamp: 6},
+	} {
+		if _, _, err := ob.Apply(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	auction, ok := ob.Auction()
+	assert(t, ok, true)
+	assert(t, auction, Auction{Price: 101, Volume: 4, Imbalance: 1})
+
+	_, matches, err := ob.Apply(Command{Type: CmdUncross, Timestamp: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(matches), 2)
+	for _, match := range matches {
+		assert(t, match.Price, 101.0)
+	}
+	// 102 fills first, the rest of the volume comes out of 101.
+	assert(t, matches[0].Bid.ID, int64(1))
+	assert(t, matches[0].Ask.ID, int64(4))
+	assert(t, ob.Orders[2].Size, 1.0)
+	assert(t, ob.BidTotalVolume(), 6.0)
+	assert(t, ob.AskTotalVolume(), 4.0)
+	assert(t, len(ob.Trades), 2)
+	assert(t, ob.Trades[0].Bid, true)
+
+	// nothing crosses anymore.
+	_, ok = ob.Auction()
+	assert(t, ok, false)
+	_, matches, _ = ob.Apply(Command{Type: CmdUncross, Timestamp: 8})
+	assert(t, len(matches), 0)
+}
+
+func TestAuctionTieBreak(t *testing.T) {
+	book := func(cmds ...Command) *OrderBook {
+		ob := NewOrderBook()
+		for _, cmd := range cmds {
+			if _, _, err := ob.Apply(cmd); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return ob
+	}
+
+	// the same volume and no imbalance from 100 to 104, closest to the last trade of 103.
+	ob := book(
+		Command{Type: CmdPlaceLimit, OrderID: 1, Bid: true, Price: 110, Size: 1},
+		Command{Type: CmdPlaceMarket, OrderID: 2, Size: 1},
+		Command{Type: CmdPlaceLimit, OrderID: 3, Bid: true, Price: 104, Size: 1},
+		Command{Type: CmdPlaceLimit, OrderID: 4, Price: 100, Size: 1},
+	)
+	ob.Trades[0].Price = 103
+	auction, _ := ob.Auction()
+	assert(t, auction.Price, 104.0)
+
+	// sellers left over push it down.
+	ob = book(
+		Command{Type: CmdPlaceLimit, OrderID: 1, Bid: true, Price: 104, Size: 1},
+		Command{Type: CmdPlaceLimit, OrderID: 2, Price: 100, Size: 2},
+		Command{Type: CmdPlaceLimit, OrderID: 3, Price: 102, Size: 1},
+	)
+	auction, _ = ob.Auction()
+	assert(t, auction, Auction{Price: 100, Volume: 1, Imbalance: -1})
+}
@@ -0,0 +1,212 @@
+package orderbook
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	CmdPlaceLimit  CommandType = "PLACE_LIMIT"
+	CmdPlaceMarket CommandType = "PLACE_MARKET"
+	CmdCancel      CommandType = "CANCEL"
+	CmdAmend       CommandType = "AMEND"
+	// cancels every resting order of the filter in the command.
+	CmdCancelAll CommandType = "CANCEL_ALL"
+	// takes out an order whose expiry has passed at the timestamp of the command.
+	CmdExpire CommandType = "EXPIRE"
+	// ends a call auction, the crossing orders trade at the auction price.
+	CmdUncross CommandType = "UNCROSS"
+)
+
+type CommandType string
+
+// Errors of the commands the book rejects, the returned
+// errors wrap them with the values that were wrong.
+var (
+	ErrInvalidSize     = errors.New("invalid order size")
+	ErrInvalidPrice    = errors.New("invalid order price")
+	ErrOrderExists     = errors.New("order already exists")
+	ErrOrderNotFound   = errors.New("order not found")
+	ErrNotEnoughVolume = errors.New("not enough volume")
+	ErrInvalidExpiry   = errors.New("invalid order expiry")
+	ErrNotExpired      = errors.New("order not expired")
+)
+
+// Command is a single change to the book. It carries everything that
+// would otherwise be random or read from the clock, applying the same
+// commands to an empty book always ends in the same book.
+type Command struct {
+	Type    CommandType
+	OrderID int64
+	UserID  int64
+	Bid     bool
+	// limit price, the new price for an amend.
+	Price float64
+	// the new size for an amend.
+	Size      float64
+	Timestamp int64
+	// expiry of a limit order, unix nanoseconds.
+	ExpiresAt int64 `json:",omitempty"`
+	// of a pegged limit order, the book prices it and Price is ignored.
+	Peg *Peg `json:",omitempty"`
+	// filter of a cancel all, UserID is the user of the orders.
+	Side     string `json:",omitempty"`
+	AllUsers bool   `json:",omitempty"`
+	// set from the journal record, it's not part of the record itself.
+	Seq uint64 `json:"-"`
+}
+
+// PlaceCommand is the command placing the order, price is ignored for market orders.
+func PlaceCommand(limit bool, price float64, o *Order) Command {
+	cmd := Command{
+		Type:      CmdPlaceMarket,
+		OrderID:   o.ID,
+		UserID:    o.UserID,
+		Bid:       o.Bid,
+		Size:      o.Size,
+		Timestamp: o.Timestamp,
+	}
+	if limit {
+		cmd.Type = CmdPlaceLimit
+		cmd.Price = price
+		cmd.ExpiresAt = o.ExpiresAt
+		cmd.Peg = o.Peg
+	}
+	return cmd
+}
+
+// CancelAllCommand is the command cancelling the orders of the filter.
+func CancelAllCommand(filter CancelFilter) Command {
+	return Command{Type: CmdCancelAll, UserID: filter.UserID, Side: filter.Side, AllUsers: filter.AllUsers}
+}
+
+// Expiring returns the resting orders with an expiry, the ones
+// that expire first first and by id when they expire together.
+func (ob *OrderBook) Expiring() []*Order {
+	orders := []*Order{}
+	for _, o := range ob.Orders {
+		if o.Limit != nil && o.ExpiresAt != 0 {
+			orders = append(orders, o)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		if orders[i].ExpiresAt != orders[j].ExpiresAt {
+			return orders[i].ExpiresAt < orders[j].ExpiresAt
+		}
+		return orders[i].ID < orders[j].ID
+	})
+	return orders
+}
+
+// Filter is the filter of a cancel all.
+func (cmd Command) Filter() CancelFilter {
+	return CancelFilter{UserID: cmd.UserID, AllUsers: cmd.AllUsers, Side: cmd.Side}
+}
+
+// Check reports whether the command can be applied, without changing the book.
+func (ob *OrderBook) Check(cmd Command) error {
+	switch cmd.Type {
+	case CmdPlaceLimit, CmdPlaceMarket:
+		if cmd.Size <= 0 {
+			return fmt.Errorf("%w [%.8f]", ErrInvalidSize, cmd.Size)
+		}
+		if _, ok := ob.Orders[cmd.OrderID]; ok {
+			return fmt.Errorf("%w [%d]", ErrOrderExists, cmd.OrderID)
+		}
+		if cmd.Type == CmdPlaceMarket && cmd.ExpiresAt != 0 {
+			return fmt.Errorf("%w: market orders don't rest on the book", ErrInvalidExpiry)
+		}
+		if cmd.Type == CmdPlaceMarket && cmd.Peg != nil {
+			return fmt.Errorf("%w: market orders can't be pegged", ErrInvalidPrice)
+		}
+		if cmd.Type == CmdPlaceMarket {
+			return ob.checkMarketVolume(&Order{Bid: cmd.Bid, Size: cmd.Size})
+		}
+		if cmd.Peg != nil {
+			if err := cmd.Peg.Check(); err != nil {
+				return err
+			}
+			if _, ok := ob.PegPrice(cmd.Bid, cmd.Peg); !ok {
+				return fmt.Errorf("%w: no %s price to peg to", ErrInvalidPrice, cmd.Peg.Ref)
+			}
+		} else if cmd.Price <= 0 {
+			return fmt.Errorf("%w [%.8f]", ErrInvalidPrice, cmd.Price)
+		}
+		if cmd.ExpiresAt != 0 && cmd.ExpiresAt <= cmd.Timestamp {
+			return fmt.Errorf("%w [%d]: already passed at [%d]", ErrInvalidExpiry, cmd.ExpiresAt, cmd.Timestamp)
+		}
+	case CmdCancel, CmdAmend, CmdExpire:
+		o, ok := ob.Orders[cmd.OrderID]
+		if !ok || o.Limit == nil {
+			return fmt.Errorf("%w [%d]", ErrOrderNotFound, cmd.OrderID)
+		}
+		if cmd.Type == CmdExpire && (o.ExpiresAt == 0 || o.ExpiresAt > cmd.Timestamp) {
+			return fmt.Errorf("%w [%d]", ErrNotExpired, cmd.OrderID)
+		}
+		if cmd.Type == CmdAmend && cmd.Size <= 0 {
+			return fmt.Errorf("%w [%.8f]", ErrInvalidSize, cmd.Size)
+		}
+		if cmd.Type == CmdAmend && cmd.Price <= 0 {
+			return fmt.Errorf("%w [%.8f]", ErrInvalidPrice, cmd.Price)
+		}
+		if cmd.Type == CmdAmend && o.Peg != nil && cmd.Price != o.Limit.Price {
+			return fmt.Errorf("%w: order [%d] is pegged, only its size can change", ErrInvalidPrice, cmd.OrderID)
+		}
+	case CmdCancelAll:
+		if cmd.Side != "" && cmd.Side != SideBid && cmd.Side != SideAsk {
+			return fmt.Errorf("unknown side [%s]", cmd.Side)
+		}
+	case CmdUncross:
+		// a book that doesn't cross uncrosses to nothing.
+	default:
+		return fmt.Errorf("unknown command type [%s]", cmd.Type)
+	}
+	return nil
+}
+
+// Apply runs the command against the book. It returns the order
+// the command is about and the matches of a market order, a cancel
+// all returns neither and an uncross only its matches. The pegged
+// orders follow the book after it.
+func (ob *OrderBook) Apply(cmd Command) (*Order, []Match, error) {
+	if err := ob.Check(cmd); err != nil {
+		return nil, nil, err
+	}
+	if cmd.Seq > 0 {
+		ob.Seq = cmd.Seq
+	}
+
+	o, matches := ob.apply(cmd)
+	ob.reprice(cmd.Timestamp)
+	return o, matches, nil
+}
+
+func (ob *OrderBook) apply(cmd Command) (*Order, []Match) {
+	switch cmd.Type {
+	case CmdPlaceLimit:
+		o := &Order{ID: cmd.OrderID, UserID: cmd.UserID, Size: cmd.Size, Bid: cmd.Bid, Timestamp: cmd.Timestamp, ExpiresAt: cmd.ExpiresAt, Peg: cmd.Peg}
+		price := cmd.Price
+		if cmd.Peg != nil {
+			price, _ = ob.PegPrice(cmd.Bid, cmd.Peg)
+		}
+		ob.PlaceLimitOrder(price, o)
+		return o, nil
+	case CmdPlaceMarket:
+		o := &Order{ID: cmd.OrderID, UserID: cmd.UserID, Size: cmd.Size, Bid: cmd.Bid, Timestamp: cmd.Timestamp}
+		return o, ob.placeMarketOrder(o, cmd.Timestamp)
+	case CmdCancel, CmdExpire:
+		o := ob.Orders[cmd.OrderID]
+		ob.CancelOrder(o)
+		return o, nil
+	case CmdCancelAll:
+		ob.CancelAll(cmd.Filter())
+		return nil, nil
+	case CmdUncross:
+		return nil, ob.uncross(cmd.Timestamp)
+	default:
+		o := ob.Orders[cmd.OrderID]
+		ob.AmendOrder(o, cmd.Price, cmd.Size, cmd.Timestamp)
+		return o, nil
+	}
+}
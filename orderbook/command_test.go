@@ -0,0 +1,109 @@
+package orderbook
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAmendOrder(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Apply(Command{Type: CmdPlaceLimit, OrderID: 1, Price: 100, Size: 5, Timestamp: 1})
+	ob.Apply(Command{Type: CmdPlaceLimit, OrderID: 2, Price: 100, Size: 5, Timestamp: 2})
+
+	// a smaller size keeps the place in the queue.
+	ob.Apply(Command{Type: CmdAmend, OrderID: 1, Price: 100, Size: 2, Timestamp: 3})
+	limit := ob.AsksLimits[100]
+	assert(t, limit.Orders[0].ID, int64(1))
+	assert(t, limit.TotalVolume, 7.0)
+
+	// a bigger one goes to the back.
+	ob.Apply(Command{Type: CmdAmend, OrderID: 1, Price: 100, Size: 6, Timestamp: 4})
+	assert(t, limit.Orders[0].ID, int64(2))
+	assert(t, limit.Orders[1].ID, int64(1))
+	assert(t, limit.TotalVolume, 11.0)
+
+	// so does a new price.
+	ob.Apply(Command{Type: CmdAmend, OrderID: 2, Price: 101, Size: 5, Timestamp: 5})
+	assert(t, ob.AsksLimits[101].Orders[0].ID, int64(2))
+	assert(t, ob.AskTotalVolume(), 11.0)
+}
+
+func TestApplyChecksCommand(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Apply(Command{Type: CmdPlaceLimit, OrderID: 1, Price: 100, Size: 5})
+
+	_, _, err := ob.Apply(Command{Type: CmdPlaceMarket, OrderID: 2, Bid: true, Size: 6})
+	assert(t, err != nil, true)
+	_, _, err = ob.Apply(Command{Type: CmdCancel, OrderID: 3})
+	assert(t, err != nil, true)
+	_, _, err = ob.Apply(Command{Type: CmdPlaceLimit, OrderID: 1, Price: 100, Size: 1})
+	assert(t, err != nil, true)
+	assert(t, ob.AskTotalVolume(), 5.0)
+
+	taker, matches, err := ob.Apply(Command{Type: CmdPlaceMarket, OrderID: 2, Bid: true, Size: 5, Timestamp: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(matches), 1)
+	assert(t, matches[0].Bid, taker)
+	assert(t, ob.Trades[0].Timestamp, int64(42))
+
+	// the filled maker is gone from the book.
+	_, ok := ob.Orders[1]
+	assert(t, ok, false)
+}
+
+func TestCancelAll(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Apply(Command{Type: CmdPlaceLimit, OrderID: 1, UserID: 1, Price: 100, Size: 5})
+	ob.Apply(Command{Type: CmdPlaceLimit, OrderID: 2, UserID: 1, Bid: true, Price: 90, Size: 5})
+	ob.Apply(Command{Type: CmdPlaceLimit, OrderID: 3, UserID: 2, Price: 100, Size: 3})
+	ob.Apply(Command{Type: CmdPlaceLimit, OrderID: 4, UserID: 1, Price: 101, Size: 1})
+
+	_, _, err := ob.Apply(Command{Type: CmdCancelAll, UserID: 1, Side: "SIDEWAYS"})
+	assert(t, err != nil, true)
+
+	cancelled := ob.CancelAll(CancelFilter{UserID: 1, Side: SideAsk})
+	assert(t, len(cancelled), 2)
+	assert(t, cancelled[0].ID, int64(1))
+	assert(t, cancelled[1].ID, int64(4))
+	assert(t, ob.AskTotalVolume(), 3.0)
+	assert(t, ob.BidTotalVolume(), 5.0)
+	_, ok := ob.AsksLimits[101]
+	assert(t, ok, false)
+
+	// the command clears the whole book.
+	_, _, err = ob.Apply(CancelAllCommand(CancelFilter{AllUsers: true}))
+	assert(t, err, nil)
+	assert(t, len(ob.Orders), 0)
+	assert(t, len(ob.Asks())+len(ob.Bids()), 0)
+}
+
+func TestExpire(t *testing.T) {
+	ob := NewOrderBook()
+	_, _, err := ob.Apply(Command{Type: CmdPlaceLimit, OrderID: 1, Price: 100, Size: 5, Timestamp: 10, ExpiresAt: 10})
+	assert(t, errors.Is(err, ErrInvalidExpiry), true)
+	_, _, err = ob.Apply(Command{Type: CmdPlaceMarket, OrderID: 1, Bid: true, Size: 1, Timestamp: 10, ExpiresAt: 20})
+	assert(t, errors.Is(err, ErrInvalidExpiry), true)
+
+	ob.Apply(Command{Type: CmdPlaceLimit, OrderID: 1, Price: 100, Size: 5, Timestamp: 10, ExpiresAt: 30})
+	ob.Apply(Command{Type: CmdPlaceLimit, OrderID: 2, Price: 100, Size: 5, Timestamp: 11, ExpiresAt: 20})
+	ob.Apply(Command{Type: CmdPlaceLimit, OrderID: 3, Price: 100, Size: 5, Timestamp: 12})
+	expiring := ob.Expiring()
+	assert(t, len(expiring), 2)
+	assert(t, expiring[0].ID, int64(2))
+
+	_, _, err = ob.Apply(Command{Type: CmdExpire, OrderID: 2, Timestamp: 19})
+	assert(t, errors.Is(err, ErrNotExpired), true)
+	_, _, err = ob.Apply(Command{Type: CmdExpire, OrderID: 3, Timestamp: 100})
+	assert(t, errors.Is(err, ErrNotExpired), true)
+
+	o, _, err := ob.Apply(Command{Type: CmdExpire, OrderID: 2, Timestamp: 20})
+	assert(t, err, nil)
+	assert(t, o.Limit == nil, true)
+	assert(t, ob.AskTotalVolume(), 10.0)
+
+	// an amend keeps the expiry.
+	ob.Apply(Command{Type: CmdAmend, OrderID: 1, Price: 101, Size: 5, Timestamp: 21})
+	assert(t, ob.Orders[1].ExpiresAt, int64(30))
+}
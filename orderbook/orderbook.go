@@ -25,6 +25,10 @@ type Order struct {
 	// limit is a bucket containing orders for the same price of different size.
 	Limit     *Limit
 	Timestamp int64
+	// unix nanoseconds the order expires at, 0 when it never does.
+	ExpiresAt int64
+	// set for limit orders that follow the top of the book.
+	Peg *Peg
 }
 
 type Orders []*Order
@@ -49,9 +53,9 @@ func (o *Order) String() string {
 
 func (o *Order) Type() string {
 	if o.Bid {
-		return "BID"
+		return SideBid
 	}
-	return "ASK"
+	return SideAsk
 }
 
 func (o *Order) IsFilled() bool {
@@ -187,6 +191,9 @@ type OrderBook struct {
 	BidsLimits map[float64]*Limit
 
 	Orders map[int64]*Order
+
+	// sequence number of the last journaled command applied to the book.
+	Seq uint64
 }
 
 func NewOrderBook() *OrderBook {
@@ -201,13 +208,28 @@ func NewOrderBook() *OrderBook {
 }
 
 func (ob *OrderBook) PlaceMarketOrder(o *Order) []Match {
+	if err := ob.checkMarketVolume(o); err != nil {
+		panic(err)
+	}
+	return ob.placeMarketOrder(o, time.Now().UnixNano())
+}
+
+func (ob *OrderBook) checkMarketVolume(o *Order) error {
+	if o.Bid && o.Size > ob.AskTotalVolume() {
+		return fmt.Errorf("%w [%.2f] for market order [%.2f]", ErrNotEnoughVolume, ob.AskTotalVolume(), o.Size)
+	}
+	if !o.Bid && o.Size > ob.BidTotalVolume() {
+		return fmt.Errorf("%w [%.2f] for market order [%.2f]", ErrNotEnoughVolume, ob.BidTotalVolume(), o.Size)
+	}
+	return nil
+}
+
+// placeMarketOrder stamps the trades with the timestamp,
+// replaying the order gives the exact same trades.
+func (ob *OrderBook) placeMarketOrder(o *Order, timestamp int64) []Match {
 	matches := []Match{}
 
 	if o.Bid {
-		if o.Size > ob.AskTotalVolume() {
-			panic(fmt.Errorf("not enough volume [%.2f] for market order [%.2f]", ob.AskTotalVolume(), o.Size))
-		}
-
 		for _, limit := range ob.Asks() {
 			limitMatches := limit.Fill(o)
 			matches = append(matches, limitMatches...)
@@ -217,10 +239,6 @@ func (ob *OrderBook) PlaceMarketOrder(o *Order) []Match {
 			}
 		}
 	} else {
-		if o.Size > ob.BidTotalVolume() {
-			panic(fmt.Errorf("not enough volume [%.2f] for market order [%.2f]", ob.BidTotalVolume(), o.Size))
-		}
-
 		for _, limit := range ob.Bids() {
 			limitMatches := limit.Fill(o)
 			matches = append(matches, limitMatches...)
@@ -235,12 +253,20 @@ func (ob *OrderBook) PlaceMarketOrder(o *Order) []Match {
 		trade := &Trade{
 			Price:     match.Price,
 			Size:      match.SizeFilled,
-			Timestamp: time.Now().UnixNano(),
+			Timestamp: timestamp,
 			Bid:       o.Bid,
 		}
 
 		ob.Trades = append(ob.Trades, trade)
 
+		// filled makers are not in the book anymore.
+		maker := match.Bid
+		if o.Bid {
+			maker = match.Ask
+		}
+		if maker.IsFilled() {
+			delete(ob.Orders, maker.ID)
+		}
 	}
 
 	return matches
@@ -315,6 +341,64 @@ func (ob *OrderBook) CancelOrder(o *Order) {
 
 }
 
+const (
+	SideBid = "BID"
+	SideAsk = "ASK"
+)
+
+// CancelFilter picks the resting orders CancelAll takes out of the book.
+type CancelFilter struct {
+	UserID int64
+	// orders of every user, UserID is ignored.
+	AllUsers bool
+	// SideBid or SideAsk, both sides when empty.
+	Side string
+}
+
+func (f CancelFilter) Match(o *Order) bool {
+	if !f.AllUsers && o.UserID != f.UserID {
+		return false
+	}
+	return f.Side == "" || f.Side == o.Type()
+}
+
+// Select returns the resting orders of the filter, ordered by id.
+func (ob *OrderBook) Select(filter CancelFilter) []*Order {
+	orders := []*Order{}
+	for _, o := range ob.Orders {
+		if o.Limit != nil && filter.Match(o) {
+			orders = append(orders, o)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+	return orders
+}
+
+// CancelAll cancels every resting order of the filter and returns them.
+func (ob *OrderBook) CancelAll(filter CancelFilter) []*Order {
+	orders := ob.Select(filter)
+	for _, o := range orders {
+		ob.CancelOrder(o)
+	}
+	return orders
+}
+
+// AmendOrder changes the price and size of a resting order. Only a smaller
+// size at the same price keeps its place in the queue, anything else
+// puts it at the back with the new timestamp.
+func (ob *OrderBook) AmendOrder(o *Order, price, size float64, timestamp int64) {
+	if price == o.Limit.Price && size <= o.Size {
+		o.Limit.TotalVolume -= o.Size - size
+		o.Size = size
+		return
+	}
+
+	ob.CancelOrder(o)
+	o.Size = size
+	o.Timestamp = timestamp
+	ob.PlaceLimitOrder(price, o)
+}
+
 func (ob *OrderBook) BidTotalVolume() float64 {
 	totalVolume := 0.0
 
@@ -332,14 +416,17 @@ func (ob *OrderBook) AskTotalVolume() float64 {
 	return totalVolume
 }
 
+// Asks are the ask limits, the best first. It sorts a copy, the book
+// itself doesn't change and readers can share it.
 func (ob *OrderBook) Asks() []*Limit {
-	// it's swapping thing in memory
-	sort.Sort(ByBestAsk{ob.asks})
-	return ob.asks
+	asks := append([]*Limit(nil), ob.asks...)
+	sort.Sort(ByBestAsk{asks})
+	return asks
 }
 
+// Bids are the bid limits, the best first, in a copy like Asks.
 func (ob *OrderBook) Bids() []*Limit {
-	// it's swapping thing in memory
-	sort.Sort(ByBestBid{ob.bids})
-	return ob.bids
+	bids := append([]*Limit(nil), ob.bids...)
+	sort.Sort(ByBestBid{bids})
+	return bids
 }
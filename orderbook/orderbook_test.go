@@ -158,3 +158,18 @@ func TestCancelOrderBid(t *testing.T) {
 	assert(t, ok, false)
 
 }
+
+func TestSidesSortACopy(t *testing.T) {
+	ob := NewOrderBook()
+	for _, price := range []float64{100, 300, 200} {
+		ob.PlaceLimitOrder(price, NewOrder(false, 1, 0))
+		ob.PlaceLimitOrder(price-50, NewOrder(true, 1, 0))
+	}
+
+	asks, bids := ob.Asks(), ob.Bids()
+	assert(t, []float64{asks[0].Price, asks[1].Price, asks[2].Price}, []float64{100, 200, 300})
+	assert(t, []float64{bids[0].Price, bids[1].Price, bids[2].Price}, []float64{250, 150, 50})
+	// readers holding the read lock only don't move the limits of the book.
+	assert(t, []float64{ob.asks[0].Price, ob.asks[1].Price, ob.asks[2].Price}, []float64{100, 300, 200})
+	assert(t, []float64{ob.bids[0].Price, ob.bids[1].Price, ob.bids[2].Price}, []float64{50, 250, 150})
+}
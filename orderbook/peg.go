@@ -0,0 +1,127 @@
+package orderbook
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	// the best price on the side of the order, the best bid for a bid.
+	PegPrimary = "PRIMARY"
+	// the best price on the other side, the best ask for a bid.
+	PegOpposite = "OPPOSITE"
+	// halfway between the best bid and the best ask.
+	PegMid = "MID"
+)
+
+// Peg makes a limit order follow the top of the book. Only orders that
+// are not pegged themselves make the top, pegged orders can't chase each other.
+type Peg struct {
+	Ref string
+	// added to the reference price, negative to sit behind it.
+	Offset float64 `json:",omitempty"`
+	// the highest price of a bid and the lowest of an ask, 0 for none.
+	Cap float64 `json:",omitempty"`
+}
+
+// Check reports whether the peg can be followed at all.
+func (p *Peg) Check() error {
+	if p.Ref != PegPrimary && p.Ref != PegOpposite && p.Ref != PegMid {
+		return fmt.Errorf("%w: unknown peg [%s]", ErrInvalidPrice, p.Ref)
+	}
+	if p.Cap < 0 {
+		return fmt.Errorf("%w: peg cap [%.8f]", ErrInvalidPrice, p.Cap)
+	}
+	return nil
+}
+
+// topPrice is the best price of the side that isn't pegged.
+func (ob *OrderBook) topPrice(bid bool) (float64, bool) {
+	limits := ob.Asks()
+	if bid {
+		limits = ob.Bids()
+	}
+	for _, limit := range limits {
+		for _, o := range limit.Orders {
+			if o.Peg == nil {
+				return limit.Price, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// PegPrice is where an order on the side with the peg goes now,
+// false while the book has no price for it to follow.
+func (ob *OrderBook) PegPrice(bid bool, peg *Peg) (float64, bool) {
+	var (
+		ref float64
+		ok  bool
+	)
+	switch peg.Ref {
+	case PegPrimary:
+		ref, ok = ob.topPrice(bid)
+	case PegOpposite:
+		ref, ok = ob.topPrice(!bid)
+	case PegMid:
+		bestBid, okBid := ob.topPrice(true)
+		bestAsk, okAsk := ob.topPrice(false)
+		ref, ok = (bestBid+bestAsk)/2, okBid && okAsk
+	}
+	if !ok {
+		return 0, false
+	}
+
+	price := ref + peg.Offset
+	if peg.Cap > 0 && bid && price > peg.Cap {
+		price = peg.Cap
+	}
+	if peg.Cap > 0 && !bid && price < peg.Cap {
+		price = peg.Cap
+	}
+	return price, price > 0
+}
+
+// Pegged returns the resting pegged orders, ordered by id.
+func (ob *OrderBook) Pegged() []*Order {
+	orders := []*Order{}
+	for _, o := range ob.Orders {
+		if o.Limit != nil && o.Peg != nil {
+			orders = append(orders, o)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+	return orders
+}
+
+// reprice moves the pegged orders to where their pegs are now. Orders
+// whose price stays keep their place, moved ones go to the back of
+// the queue of their new limit. A peg that lost its price stays put.
+func (ob *OrderBook) reprice(timestamp int64) {
+	for _, o := range ob.Pegged() {
+		price, ok := ob.PegPrice(o.Bid, o.Peg)
+		if !ok || price == o.Limit.Price {
+			continue
+		}
+		ob.moveOrder(o, price, max(timestamp, o.Timestamp))
+	}
+}
+
+// moveOrder puts a resting order at the back of the queue on the price. Queues
+// are kept in timestamp order, so it gets a timestamp after the ones there.
+func (ob *OrderBook) moveOrder(o *Order, price float64, timestamp int64) {
+	ob.CancelOrder(o)
+	limits := ob.AsksLimits
+	if o.Bid {
+		limits = ob.BidsLimits
+	}
+	if limit, ok := limits[price]; ok {
+		for _, other := range limit.Orders {
+			if other.Timestamp >= timestamp {
+				timestamp = other.Timestamp + 1
+			}
+		}
+	}
+	o.Timestamp = timestamp
+	ob.PlaceLimitOrder(price, o)
+}
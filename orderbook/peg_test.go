@@ -0,0 +1,58 @@
+package orderbook
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPeggedOrders(t *testing.T) {
+	ob := NewOrderBook()
+	apply := func(cmd Command) {
+		t.Helper()
+		if _, _, err := ob.Apply(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// nothing to follow yet.
+	_, _, err := ob.Apply(Command{Type: CmdPlaceLimit, OrderID: 10, Bid: true, Size: 1, Timestamp: 1, Peg: &Peg{Ref: PegPrimary}})
+	assert(t, errors.Is(err, ErrInvalidPrice), true)
+
+	apply(Command{Type: CmdPlaceLimit, OrderID: 1, Bid: true, Price: 99, Size: 1, Timestamp: 1})
+	apply(Command{Type: CmdPlaceLimit, OrderID: 2, Price: 103, Size: 1, Timestamp: 2})
+	apply(Command{Type: CmdPlaceLimit, OrderID: 10, Bid: true, Size: 1, Timestamp: 3, Peg: &Peg{Ref: PegPrimary, Offset: 0.5}})
+	apply(Command{Type: CmdPlaceLimit, OrderID: 11, Size: 1, Timestamp: 4, Peg: &Peg{Ref: PegOpposite, Offset: 1}})
+	apply(Command{Type: CmdPlaceLimit, OrderID: 12, Bid: true, Size: 1, Timestamp: 5, Peg: &Peg{Ref: PegMid, Cap: 101.5}})
+	assert(t, ob.Orders[10].Limit.Price, 99.5)
+	assert(t, ob.Orders[11].Limit.Price, 100.0)
+	assert(t, ob.Orders[12].Limit.Price, 101.0)
+	// the mid peg is the best bid, the pegs still follow the 99 under it.
+	assert(t, ob.Bids()[0].Price, 101.0)
+
+	// a better bid moves the pegs, the cap holds the mid one.
+	apply(Command{Type: CmdPlaceLimit, OrderID: 3, Bid: true, Price: 101, Size: 1, Timestamp: 6})
+	assert(t, ob.Orders[10].Limit.Price, 101.5)
+	assert(t, ob.Orders[11].Limit.Price, 102.0)
+	assert(t, ob.Orders[12].Limit.Price, 101.5)
+	// moved to the back of the queue of 101.5, the mid peg got there later.
+	assert(t, ob.BidsLimits[101.5].Orders[0].ID, int64(10))
+	assert(t, ob.BidsLimits[101.5].Orders[1].ID, int64(12))
+	assert(t, ob.Orders[10].Timestamp, int64(6))
+	assert(t, ob.Orders[12].Timestamp, int64(7))
+
+	// only the size of a pegged order changes.
+	_, _, err = ob.Apply(Command{Type: CmdAmend, OrderID: 10, Price: 100, Size: 1, Timestamp: 8})
+	assert(t, errors.Is(err, ErrInvalidPrice), true)
+
+	// the cancel doesn't carry a time, the pegs keep theirs.
+	apply(Command{Type: CmdCancel, OrderID: 3})
+	assert(t, ob.Orders[10].Limit.Price, 99.5)
+	assert(t, ob.Orders[10].Timestamp, int64(6))
+	assert(t, ob.Orders[12].Limit.Price, 101.0)
+
+	// a peg that loses its price stays where it is.
+	apply(Command{Type: CmdCancel, OrderID: 2})
+	assert(t, ob.Orders[11].Limit.Price, 100.0)
+	assert(t, ob.Orders[12].Limit.Price, 101.0)
+	assert(t, len(ob.Pegged()), 3)
+}
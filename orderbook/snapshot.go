@@ -0,0 +1,222 @@
+package orderbook
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Snapshot layout, little endian:
+//
+//	magic "OBSN" | version uint16 | seq uint64
+//	asks, then bids: count uint32, per limit
+//		price float64 | total volume float64 | count uint32
+//		per order in queue order: id int64 | user id int64 | size float64 | timestamp int64 | expires at int64
+//			| peg uint8 | peg offset float64 | peg cap float64
+//	trades: count uint32, per trade
+//		price float64 | size float64 | bid uint8 | timestamp int64
+//	crc32 (IEEE) of everything before it | uint32
+//
+// Orders of version 1 have no expiry and the ones of version 2 no peg,
+// they are still read. The peg is 0 for orders that aren't pegged and
+// the index in pegRefs plus one for the others.
+const snapshotVersion uint16 = 3
+
+var pegRefs = []string{PegPrimary, PegOpposite, PegMid}
+
+var (
+	snapshotMagic = [4]byte{'O', 'B', 'S', 'N'}
+
+	ErrBadSnapshot = errors.New("orderbook: bad snapshot")
+)
+
+// Snapshot serialises the whole book, restoring it gives back
+// the same limits with the orders in the same queue order.
+func (ob *OrderBook) Snapshot() ([]byte, error) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	buf := &bytes.Buffer{}
+	w := func(v any) {
+		// writes to a bytes.Buffer don't fail.
+		binary.Write(buf, binary.LittleEndian, v)
+	}
+
+	w(snapshotMagic)
+	w(snapshotVersion)
+	w(ob.Seq)
+
+	for _, limits := range [][]*Limit{ob.Asks(), ob.Bids()} {
+		w(uint32(len(limits)))
+		for _, limit := range limits {
+			w(limit.Price)
+			w(limit.TotalVolume)
+			w(uint32(len(limit.Orders)))
+			for _, o := range limit.Orders {
+				w(o.ID)
+				w(o.UserID)
+				w(o.Size)
+				w(o.Timestamp)
+				w(o.ExpiresAt)
+				var (
+					peg            uint8
+					offset, pegCap float64
+				)
+				if o.Peg != nil {
+					for i, ref := range pegRefs {
+						if o.Peg.Ref == ref {
+							peg = uint8(i + 1)
+						}
+					}
+					offset, pegCap = o.Peg.Offset, o.Peg.Cap
+				}
+				w(peg)
+				w(offset)
+				w(pegCap)
+			}
+		}
+	}
+
+	w(uint32(len(ob.Trades)))
+	for _, trade := range ob.Trades {
+		w(trade.Price)
+		w(trade.Size)
+		bid := uint8(0)
+		if trade.Bid {
+			bid = 1
+		}
+		w(bid)
+		w(trade.Timestamp)
+	}
+
+	w(crc32.ChecksumIEEE(buf.Bytes()))
+
+	return buf.Bytes(), nil
+}
+
+// snapshotReader keeps the first error, the caller checks it once at the end.
+type snapshotReader struct {
+	r   io.Reader
+	err error
+}
+
+func (sr *snapshotReader) read(v any) {
+	if sr.err == nil {
+		sr.err = binary.Read(sr.r, binary.LittleEndian, v)
+	}
+}
+
+// count reads a length and rejects one that can't fit in the rest of the data.
+func (sr *snapshotReader) count(minSize int) int {
+	var n uint32
+	sr.read(&n)
+	if r, ok := sr.r.(*bytes.Reader); ok && sr.err == nil && int64(n)*int64(minSize) > int64(r.Len()) {
+		sr.err = ErrBadSnapshot
+	}
+	return int(n)
+}
+
+// Restore replaces the whole state of the book with the snapshot.
+func (ob *OrderBook) Restore(data []byte) error {
+	if len(data) < 4 {
+		return ErrBadSnapshot
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return fmt.Errorf("%w: checksum mismatch", ErrBadSnapshot)
+	}
+
+	sr := &snapshotReader{r: bytes.NewReader(body)}
+	var (
+		magic   [4]byte
+		version uint16
+		seq     uint64
+	)
+	sr.read(&magic)
+	sr.read(&version)
+	if sr.err != nil || magic != snapshotMagic {
+		return ErrBadSnapshot
+	}
+	if version < 1 || version > snapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrBadSnapshot, version)
+	}
+	orderSize := []int{32, 40, 57}[version-1]
+	sr.read(&seq)
+
+	restored := NewOrderBook()
+	restored.Seq = seq
+	for _, bid := range []bool{false, true} {
+		limits := sr.count(20)
+		for i := 0; i < limits && sr.err == nil; i++ {
+			limit := NewLimit(0)
+			sr.read(&limit.Price)
+			var totalVolume float64
+			sr.read(&totalVolume)
+
+			orders := sr.count(orderSize)
+			for j := 0; j < orders && sr.err == nil; j++ {
+				o := &Order{Bid: bid}
+				sr.read(&o.ID)
+				sr.read(&o.UserID)
+				sr.read(&o.Size)
+				sr.read(&o.Timestamp)
+				if version > 1 {
+					sr.read(&o.ExpiresAt)
+				}
+				if version > 2 {
+					var peg uint8
+					p := &Peg{}
+					sr.read(&peg)
+					sr.read(&p.Offset)
+					sr.read(&p.Cap)
+					if int(peg) > len(pegRefs) {
+						sr.err = ErrBadSnapshot
+					} else if peg > 0 {
+						p.Ref = pegRefs[peg-1]
+						o.Peg = p
+					}
+				}
+				limit.AddOrder(o)
+				restored.Orders[o.ID] = o
+			}
+			// summing up again could be off in the last digits.
+			limit.TotalVolume = totalVolume
+
+			if bid {
+				restored.bids = append(restored.bids, limit)
+				restored.BidsLimits[limit.Price] = limit
+			} else {
+				restored.asks = append(restored.asks, limit)
+				restored.AsksLimits[limit.Price] = limit
+			}
+		}
+	}
+
+	trades := sr.count(25)
+	for i := 0; i < trades && sr.err == nil; i++ {
+		trade := &Trade{}
+		var bid uint8
+		sr.read(&trade.Price)
+		sr.read(&trade.Size)
+		sr.read(&bid)
+		sr.read(&trade.Timestamp)
+		trade.Bid = bid == 1
+		restored.Trades = append(restored.Trades, trade)
+	}
+	if sr.err != nil {
+		return fmt.Errorf("%w: %s", ErrBadSnapshot, sr.err)
+	}
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	ob.asks, ob.bids = restored.asks, restored.bids
+	ob.AsksLimits, ob.BidsLimits = restored.AsksLimits, restored.BidsLimits
+	ob.Orders = restored.Orders
+	ob.Trades = restored.Trades
+	ob.Seq = restored.Seq
+
+	return nil
+}
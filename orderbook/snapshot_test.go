@@ -0,0 +1,69 @@
+package orderbook
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	ob := NewOrderBook()
+	cmds := []Command{
+		{Type: CmdPlaceLimit, OrderID: 1, UserID: 1, Price: 100, Size: 5, Timestamp: 1},
+		{Type: CmdPlaceLimit, OrderID: 2, UserID: 2, Price: 100, Size: 3, Timestamp: 2},
+		{Type: CmdPlaceLimit, OrderID: 3, UserID: 1, Price: 101, Size: 1, Timestamp: 3, ExpiresAt: 100},
+		{Type: CmdPlaceLimit, OrderID: 4, UserID: 3, Bid: true, Price: 99, Size: 2, Timestamp: 4},
+		{Type: CmdPlaceLimit, OrderID: 8, UserID: 4, Bid: true, Size: 1, Timestamp: 4, Peg: &Peg{Ref: PegPrimary, Offset: -1, Cap: 120}},
+		{Type: CmdPlaceMarket, OrderID: 5, UserID: 3, Bid: true, Size: 5.5, Timestamp: 5},
+		{Type: CmdAmend, OrderID: 2, Price: 100, Size: 2, Timestamp: 6, Seq: 6},
+	}
+	for _, cmd := range cmds {
+		if _, _, err := ob.Apply(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ob.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewOrderBook()
+	if err := restored.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, restored.Seq, uint64(6))
+	assert(t, restored.AskTotalVolume(), ob.AskTotalVolume())
+	assert(t, restored.BidTotalVolume(), ob.BidTotalVolume())
+	assert(t, len(restored.Trades), 2)
+	assert(t, restored.Orders[2].Limit.Price, 100.0)
+	assert(t, restored.Orders[3].ExpiresAt, int64(100))
+	assert(t, *restored.Orders[8].Peg, Peg{Ref: PegPrimary, Offset: -1, Cap: 120})
+	assert(t, restored.Orders[8].Limit.Price, 98.0)
+
+	// both books keep going the same way.
+	next := Command{Type: CmdPlaceMarket, OrderID: 7, Bid: true, Size: 2.5, Timestamp: 7}
+	_, matches, _ := ob.Apply(next)
+	_, restoredMatches, _ := restored.Apply(next)
+	assert(t, len(restoredMatches), len(matches))
+	for i := range matches {
+		assert(t, restoredMatches[i].Ask.ID, matches[i].Ask.ID)
+		assert(t, restoredMatches[i].SizeFilled, matches[i].SizeFilled)
+	}
+
+	again, _ := restored.Snapshot()
+	data, _ = ob.Snapshot()
+	assert(t, again, data)
+}
+
+func TestRestoreRejectsBadSnapshot(t *testing.T) {
+	ob := NewOrderBook()
+	ob.Apply(Command{Type: CmdPlaceLimit, OrderID: 1, Price: 100, Size: 5})
+	data, _ := ob.Snapshot()
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[10] ^= 0xff
+	err := NewOrderBook().Restore(corrupt)
+	assert(t, errors.Is(err, ErrBadSnapshot), true)
+
+	err = NewOrderBook().Restore(data[:len(data)-1])
+	assert(t, errors.Is(err, ErrBadSnapshot), true)
+}
@@ -0,0 +1,319 @@
+// Package replay feeds a recorded stream of order commands through the
+// order books on a simulated clock. The same input always gives the same
+// output, which makes it good for backtesting strategies and for checking
+// changes to the matching against golden outputs.
+//
+// The input is JSONL, one event per line:
+//
+//	{"At":1000,"Market":"ETH","Type":"PLACE_LIMIT","UserID":1,"Price":100,"Size":2}
+//
+// At is the simulated time in nanoseconds, events without it happen one step
+// after the previous one. Orders without an OrderID get the next free one.
+// Limit orders with an ExpiresAt are expired as soon as the clock reaches it.
+// An UNCROSS event ends a call auction, the crossing orders trade at one price.
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ukibbb/crypto-exchange/orderbook"
+)
+
+const DefaultMarket = "ETH"
+
+type Event struct {
+	At     int64  `json:",omitempty"`
+	Market string `json:",omitempty"`
+	orderbook.Command
+}
+
+// Clock is the simulated clock, it only moves when an event moves it.
+type Clock struct {
+	now  int64
+	step int64
+}
+
+func (c *Clock) Now() int64 {
+	return c.now
+}
+
+// advance moves to the time of the event, or one step ahead if it has none.
+// Time never goes back.
+func (c *Clock) advance(at int64) int64 {
+	if at > c.now {
+		c.now = at
+	} else {
+		c.now += c.step
+	}
+	return c.now
+}
+
+// Strategy is shown the book after every event and can answer with
+// commands of its own. They run right away at the same simulated time.
+type Strategy interface {
+	OnEvent(now int64, market string, ob *orderbook.OrderBook, trades []Trade) []orderbook.Command
+}
+
+type Config struct {
+	// simulated time the run starts at.
+	Start int64
+	// time between events without a time of their own, 1ms when zero.
+	Step     time.Duration
+	Strategy Strategy
+}
+
+type Trade struct {
+	Market    string
+	Timestamp int64
+	Price     float64
+	Size      float64
+	// side of the taker.
+	Bid     bool
+	TakerID int64
+	MakerID int64
+}
+
+// Fill is what a single order got out of a trade.
+type Fill struct {
+	Market  string
+	OrderID int64
+	UserID  int64
+	Bid     bool
+	Maker   bool
+	Price   float64
+	Size    float64
+	// size of the order still open after the fill.
+	Left float64
+}
+
+type Reject struct {
+	// line of the input, 0 for the commands of the strategy.
+	Line    int
+	Command orderbook.Command
+	Reason  string
+}
+
+// Expiry is a limit order that expired on the book.
+type Expiry struct {
+	Market    string
+	Timestamp int64
+	OrderID   int64
+	UserID    int64
+}
+
+type Result struct {
+	Events   int
+	Trades   []Trade
+	Fills    []Fill
+	Rejects  []Reject
+	Expiries []Expiry
+	Books    map[string]*orderbook.OrderBook
+}
+
+type runner struct {
+	config Config
+	clock  Clock
+	nextID int64
+	result *Result
+}
+
+// Run replays the events of r until EOF. Commands the book rejects
+// are recorded and skipped, a line that isn't an event stops the run.
+func Run(r io.Reader, config Config) (*Result, error) {
+	if config.Step <= 0 {
+		config.Step = time.Millisecond
+	}
+	rn := &runner{
+		config: config,
+		clock:  Clock{now: config.Start, step: int64(config.Step)},
+		nextID: 1,
+		result: &Result{Books: make(map[string]*orderbook.OrderBook)},
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var event Event
+		if err := json.Unmarshal([]byte(text), &event); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if event.Market == "" {
+			event.Market = DefaultMarket
+		}
+		rn.result.Events++
+		now := rn.clock.advance(event.At)
+		rn.expire(now)
+
+		trades := rn.apply(line, event.Market, event.Command, now)
+		if rn.config.Strategy == nil {
+			continue
+		}
+		for _, cmd := range rn.config.Strategy.OnEvent(now, event.Market, rn.book(event.Market), trades) {
+			rn.apply(0, event.Market, cmd, now)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rn.result, nil
+}
+
+func (rn *runner) book(market string) *orderbook.OrderBook {
+	ob, ok := rn.result.Books[market]
+	if !ok {
+		ob = orderbook.NewOrderBook()
+		rn.result.Books[market] = ob
+	}
+	return ob
+}
+
+// expire takes the orders whose expiry passed out of all books, market by market.
+func (rn *runner) expire(now int64) {
+	markets := make([]string, 0, len(rn.result.Books))
+	for market := range rn.result.Books {
+		markets = append(markets, market)
+	}
+	sort.Strings(markets)
+
+	for _, market := range markets {
+		ob := rn.result.Books[market]
+		for _, o := range ob.Expiring() {
+			if o.ExpiresAt > now {
+				break
+			}
+			if _, _, err := ob.Apply(orderbook.Command{Type: orderbook.CmdExpire, OrderID: o.ID, Timestamp: now}); err != nil {
+				continue
+			}
+			rn.result.Expiries = append(rn.result.Expiries, Expiry{Market: market, Timestamp: now, OrderID: o.ID, UserID: o.UserID})
+		}
+	}
+}
+
+func (rn *runner) apply(line int, market string, cmd orderbook.Command, now int64) []Trade {
+	isPlace := cmd.Type == orderbook.CmdPlaceLimit || cmd.Type == orderbook.CmdPlaceMarket
+	if isPlace && cmd.OrderID == 0 {
+		cmd.OrderID = rn.nextID
+	}
+	if isPlace && cmd.OrderID >= rn.nextID {
+		rn.nextID = cmd.OrderID + 1
+	}
+	if cmd.Timestamp == 0 {
+		cmd.Timestamp = now
+	}
+
+	ob := rn.book(market)
+	taker, matches, err := ob.Apply(cmd)
+	if err != nil {
+		rn.result.Rejects = append(rn.result.Rejects, Reject{Line: line, Command: cmd, Reason: err.Error()})
+		return nil
+	}
+
+	trades := make([]Trade, len(matches))
+	first := len(ob.Trades) - len(matches)
+	filled := 0.0
+	for i, match := range matches {
+		t, maker := taker, match.Bid
+		if taker == nil {
+			// an uncross, both orders rested. The side that
+			// was left over at the auction counts as the taker.
+			t, maker = match.Ask, match.Bid
+			if ob.Trades[first+i].Bid {
+				t, maker = match.Bid, match.Ask
+			}
+		} else if taker.Bid {
+			maker = match.Ask
+		}
+		filled += match.SizeFilled
+		left := cmd.Size - filled
+		if taker == nil {
+			left = t.Size
+		}
+
+		trades[i] = Trade{
+			Market:    market,
+			Timestamp: cmd.Timestamp,
+			Price:     match.Price,
+			Size:      match.SizeFilled,
+			Bid:       t.Bid,
+			TakerID:   t.ID,
+			MakerID:   maker.ID,
+		}
+		rn.result.Fills = append(rn.result.Fills,
+			Fill{Market: market, OrderID: t.ID, UserID: t.UserID, Bid: t.Bid, Price: match.Price, Size: match.SizeFilled, Left: left},
+			Fill{Market: market, OrderID: maker.ID, UserID: maker.UserID, Bid: maker.Bid, Maker: true, Price: match.Price, Size: match.SizeFilled, Left: maker.Size},
+		)
+	}
+	rn.result.Trades = append(rn.result.Trades, trades...)
+
+	return trades
+}
+
+func side(bid bool) string {
+	if bid {
+		return "BID"
+	}
+	return "ASK"
+}
+
+// WriteTo writes the result as plain text, one thing per line,
+// so two runs can be compared with diff.
+func (res *Result) WriteTo(w io.Writer) (int64, error) {
+	b := &strings.Builder{}
+
+	fmt.Fprintf(b, "events %d trades %d fills %d rejects %d\n", res.Events, len(res.Trades), len(res.Fills), len(res.Rejects))
+	for _, r := range res.Rejects {
+		fmt.Fprintf(b, "reject line %d %s order %d: %s\n", r.Line, r.Command.Type, r.Command.OrderID, r.Reason)
+	}
+	for _, e := range res.Expiries {
+		fmt.Fprintf(b, "expire %s t=%d order %d user %d\n", e.Market, e.Timestamp, e.OrderID, e.UserID)
+	}
+	for _, t := range res.Trades {
+		fmt.Fprintf(b, "trade %s t=%d %s price %.8f size %.8f taker %d maker %d\n", t.Market, t.Timestamp, side(t.Bid), t.Price, t.Size, t.TakerID, t.MakerID)
+	}
+	for _, f := range res.Fills {
+		role := "taker"
+		if f.Maker {
+			role = "maker"
+		}
+		fmt.Fprintf(b, "fill %s order %d user %d %s %s price %.8f size %.8f left %.8f\n", f.Market, f.OrderID, f.UserID, side(f.Bid), role, f.Price, f.Size, f.Left)
+	}
+
+	markets := make([]string, 0, len(res.Books))
+	for market := range res.Books {
+		markets = append(markets, market)
+	}
+	sort.Strings(markets)
+	for _, market := range markets {
+		ob := res.Books[market]
+		fmt.Fprintf(b, "book %s asks %.8f bids %.8f\n", market, ob.AskTotalVolume(), ob.BidTotalVolume())
+		writeLimits(b, "ask", ob.Asks())
+		writeLimits(b, "bid", ob.Bids())
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func writeLimits(b *strings.Builder, kind string, limits []*orderbook.Limit) {
+	for _, limit := range limits {
+		fmt.Fprintf(b, "%s %.8f volume %.8f orders", kind, limit.Price, limit.TotalVolume)
+		for _, o := range limit.Orders {
+			fmt.Fprintf(b, " %d:%.8f", o.ID, o.Size)
+		}
+		b.WriteString("\n")
+	}
+}
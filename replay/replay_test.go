@@ -0,0 +1,101 @@
+package replay
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ukibbb/crypto-exchange/orderbook"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func runGolden(t *testing.T, name string, config Config) {
+	t.Helper()
+	in, err := os.Open(filepath.Join("testdata", name+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	res, err := Run(in, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	res.WriteTo(out)
+
+	golden := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(golden, out.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != string(expected) {
+		t.Errorf("output differs from %s, rerun with -update if the change is intended\n%s", golden, out)
+	}
+}
+
+func TestReplayMatchesGolden(t *testing.T) {
+	runGolden(t, "matching", Config{})
+}
+
+// quoter keeps a bid one tick under the best ask.
+type quoter struct {
+	orderID int64
+}
+
+func (q *quoter) OnEvent(now int64, market string, ob *orderbook.OrderBook, trades []Trade) []orderbook.Command {
+	asks := ob.Asks()
+	if len(asks) == 0 {
+		return nil
+	}
+	price := asks[0].Price - 1
+
+	if o, ok := ob.Orders[q.orderID]; ok && o.Limit != nil {
+		if o.Limit.Price == price {
+			return nil
+		}
+		return []orderbook.Command{{Type: orderbook.CmdAmend, OrderID: q.orderID, Price: price, Size: 1}}
+	}
+	q.orderID = 1000 + now
+	return []orderbook.Command{{Type: orderbook.CmdPlaceLimit, OrderID: q.orderID, UserID: 99, Bid: true, Price: price, Size: 1}}
+}
+
+func TestReplayStrategy(t *testing.T) {
+	runGolden(t, "strategy", Config{Strategy: &quoter{}, Step: 10})
+}
+
+func TestReplayIsDeterministic(t *testing.T) {
+	data, _ := os.ReadFile(filepath.Join("testdata", "matching.jsonl"))
+	a, _ := Run(bytes.NewReader(data), Config{})
+	b, _ := Run(bytes.NewReader(data), Config{})
+	assert(t, a.Trades, b.Trades)
+	assert(t, a.Fills, b.Fills)
+
+	_, err := Run(strings.NewReader("{not json"), Config{})
+	assert(t, err != nil, true)
+}
+
+func TestReplayExpiresOrders(t *testing.T) {
+	runGolden(t, "expiry", Config{})
+}
+
+func TestReplayUncrossesAuction(t *testing.T) {
+	runGolden(t, "uncross", Config{})
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ukibbb/crypto-exchange/orderbook"
+)
+
+const (
+	// the default, market orders trade against the book as they come in.
+	PhaseContinuous MarketPhase = "CONTINUOUS"
+	// orders collect without trading until the book is uncrossed.
+	PhaseCall MarketPhase = "CALL"
+	// trading stopped, orders can only be cancelled.
+	PhaseHalted MarketPhase = "HALTED"
+)
+
+type MarketPhase string
+
+type AuctionRequest struct {
+	// the call phase uncrosses by itself after it, 0 waits for POST /book/:market/uncross.
+	DurationMs int64
+}
+
+// AuctionResponse is the phase of a market. In the call phase it has
+// where the book would uncross now, when anything crosses.
+type AuctionResponse struct {
+	Market Market
+	Phase  MarketPhase
+	// unix milliseconds the call phase uncrosses at, 0 when it waits for an admin.
+	EndsAt     int64              `json:",omitempty"`
+	Indicative *orderbook.Auction `json:",omitempty"`
+}
+
+type UncrossResponse struct {
+	Market  Market
+	Price   float64
+	Volume  float64
+	Matches int
+}
+
+// marketAuction is a market out of continuous trading. Phases live in
+// memory, a market comes back from a restart trading continuously.
+type marketAuction struct {
+	phase  MarketPhase
+	endsAt time.Time
+	timer  *time.Timer
+}
+
+// phase has to be called with bookMu held.
+func (ex *Exchange) phase(market Market) MarketPhase {
+	if a, ok := ex.auctions[market]; ok {
+		return a.phase
+	}
+	return PhaseContinuous
+}
+
+// checkPhase turns away what the market doesn't take in its phase, nothing
+// while it's halted and market orders during the call phase.
+// It has to be called with bookMu held.
+func (ex *Exchange) checkPhase(market Market, typ OrderType) error {
+	switch ex.phase(market) {
+	case PhaseHalted:
+		return ErrMarketClosed.WithMessage("market %s is halted", market).WithDetail("market", market)
+	case PhaseCall:
+		if typ == MarketOrder {
+			return ErrMarketClosed.WithMessage("market %s is in an auction, it takes no market orders", market).WithDetail("market", market)
+		}
+	}
+	return nil
+}
+
+// setPhase stops the timer of the call phase the market was in, if any.
+// It has to be called with bookMu held.
+func (ex *Exchange) setPhase(market Market, a *marketAuction) {
+	if old, ok := ex.auctions[market]; ok && old.timer != nil {
+		old.timer.Stop()
+	}
+	if a == nil {
+		delete(ex.auctions, market)
+		return
+	}
+	ex.auctions[market] = a
+}
+
+// startAuction puts the market in the call phase, a duration other than 0
+// uncrosses it after that long. It has to be called with bookMu held.
+func (ex *Exchange) startAuction(market Market, d time.Duration) error {
+	if phase := ex.phase(market); phase == PhaseCall {
+		return ErrBadRequest.WithMessage("market %s is in an auction already", market).WithDetail("market", market)
+	}
+	a := &marketAuction{phase: PhaseCall}
+	if d > 0 {
+		a.endsAt = time.Now().Add(d)
+		a.timer = time.AfterFunc(d, func() {
+			ex.bookMu.Lock()
+			defer ex.unlockBooks()
+			// uncrossed or halted by an admin before the time was up.
+			if ex.auctions[market] != a || ex.draining.Load() {
+				return
+			}
+			if _, err := ex.uncross(market); err != nil {
+				log.Printf("uncrossing %s: %s", market, err)
+			}
+		})
+	}
+	ex.setPhase(market, a)
+	return nil
+}
+
+// uncross executes the crossing orders of the market at the price that
+// trades the most volume and opens it for continuous trading.
+// It has to be called with bookMu held.
+func (ex *Exchange) uncross(market Market) (*UncrossResponse, error) {
+	if phase := ex.phase(market); phase != PhaseCall {
+		return nil, ErrBadRequest.WithMessage("market %s is %s, not in an auction", market, phase).WithDetail("market", market)
+	}
+	ob := ex.orderBooks[market]
+	auction, _ := ob.Auction()
+	// the prices the bids locked at, pegged ones can move in the turn.
+	bidPrices := make(map[int64]float64)
+	for _, limit := range ob.Bids() {
+		for _, o := range limit.Orders {
+			bidPrices[o.ID] = limit.Price
+		}
+	}
+	_, matches, err := ex.executeLocked(market, orderbook.Command{Type: orderbook.CmdUncross, Timestamp: time.Now().UnixNano()})
+	if err != nil {
+		return nil, err
+	}
+
+	ex.mu.Lock()
+	ex.settleUncross(market, matches, bidPrices)
+	ex.dropFilled()
+	ex.mu.Unlock()
+	ex.Settler.Add(market, ex.markets[market], matches, ex.tradingFees, 0)
+	ex.setPhase(market, nil)
+
+	log.Printf("market %s uncrossed at %g, %g traded in %d matches", market, auction.Price, auction.Volume, len(matches))
+	return &UncrossResponse{Market: market, Price: auction.Price, Volume: auction.Volume, Matches: len(matches)}, nil
+}
+
+// settleUncross moves the funds of the matches of an uncross, both sides
+// rested in the book and pay from their locked funds. The bids locked
+// their own price, what they don't pay at the auction price is theirs again.
+// Both sides pay the maker fee.
+// It has to be called with ex.mu held.
+func (ex *Exchange) settleUncross(market Market, matches []orderbook.Match, bidPrices map[int64]float64) {
+	assets := ex.markets[market]
+
+	var entries []ledgerEntry
+	for _, match := range matches {
+		quoteAmount := match.SizeFilled * match.Price
+		locked := match.SizeFilled * bidPrices[match.Bid.ID]
+
+		entries = append(entries,
+			ledgerEntry{Op: opDebitLocked, UserID: match.Bid.UserID, Asset: assets.Quote, Amount: quoteAmount},
+			ledgerEntry{Op: opUnlock, UserID: match.Bid.UserID, Asset: assets.Quote, Amount: locked - quoteAmount},
+			ledgerEntry{Op: opDebitLocked, UserID: match.Ask.UserID, Asset: assets.Base, Amount: match.SizeFilled},
+		)
+		entries = append(entries, proceeds(assets, match, ex.tradingFees, 0)...)
+	}
+	if err := ex.Ledger.transfer(entries); err != nil {
+		log.Printf("settling the uncross of %s: %s", market, err)
+	}
+}
+
+func (ex *Exchange) auctionState(market Market) *AuctionResponse {
+	resp := &AuctionResponse{Market: market, Phase: ex.phase(market)}
+	if resp.Phase != PhaseCall {
+		return resp
+	}
+	if a := ex.auctions[market]; !a.endsAt.IsZero() {
+		resp.EndsAt = a.endsAt.UnixMilli()
+	}
+	if auction, ok := ex.orderBooks[market].Auction(); ok {
+		resp.Indicative = &auction
+	}
+	return resp
+}
+
+func (ex *Exchange) handleGetAuction(c echo.Context) error {
+	market := Market(c.Param("market"))
+	if _, ok := ex.markets[market]; !ok {
+		return ErrMarketNotFound.WithDetail("market", market)
+	}
+
+	ex.bookMu.Lock()
+	resp := ex.auctionState(market)
+	ex.bookMu.Unlock()
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handleStartAuction opens the call phase of a market, trading continuously or halted.
+func (ex *Exchange) handleStartAuction(c echo.Context) error {
+	market := Market(c.Param("market"))
+	if _, ok := ex.markets[market]; !ok {
+		return ErrMarketNotFound.WithDetail("market", market)
+	}
+	var req AuctionRequest
+	if err := decodeBody(c, &req); err != nil {
+		return err
+	}
+	if req.DurationMs < 0 {
+		return ErrBadRequest.WithMessage("duration [%d] can't be negative", req.DurationMs)
+	}
+
+	ex.bookMu.Lock()
+	err := ex.startAuction(market, time.Duration(req.DurationMs)*time.Millisecond)
+	resp := ex.auctionState(market)
+	ex.bookMu.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Printf("market %s in an auction", market)
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (ex *Exchange) handleUncross(c echo.Context) error {
+	market := Market(c.Param("market"))
+	if _, ok := ex.markets[market]; !ok {
+		return ErrMarketNotFound.WithDetail("market", market)
+	}
+
+	ex.bookMu.Lock()
+	resp, err := ex.uncross(market)
+	ex.unlockBooks()
+	if err != nil {
+		return badRequest(err)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handleHaltMarket stops the trading of a market, an auction opens it again.
+func (ex *Exchange) handleHaltMarket(c echo.Context) error {
+	market := Market(c.Param("market"))
+	if _, ok := ex.markets[market]; !ok {
+		return ErrMarketNotFound.WithDetail("market", market)
+	}
+
+	ex.bookMu.Lock()
+	ex.setPhase(market, &marketAuction{phase: PhaseHalted})
+	resp := ex.auctionState(market)
+	ex.bookMu.Unlock()
+	log.Printf("market %s halted", market)
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ukibbb/crypto-exchange/orderbook"
+)
+
+func TestCallAuction(t *testing.T) {
+	ex := newTestExchange(t, "")
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+
+	admin, _ := ex.Users.Add(&User{})
+	alice, _ := ex.Users.Add(&User{})
+	bob, _ := ex.Users.Add(&User{})
+	adminKey, _ := ex.APIKeys.Create(admin.ID, PermAdmin)
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermTrade)
+	bobKey, _ := ex.APIKeys.Create(bob.ID, PermTrade)
+	ex.Ledger.Credit(alice.ID, AssetUSD, 1000)
+	ex.Ledger.Credit(bob.ID, AssetETH, 10)
+
+	assert(t, serve(aliceKey, http.MethodPost, "/book/ETH/auction", `{}`, nil), http.StatusForbidden)
+	state := &AuctionResponse{}
+	assert(t, serve(adminKey, http.MethodPost, "/book/ETH/auction", `{}`, state), http.StatusOK)
+	assert(t, state.Phase, PhaseCall)
+	assert(t, serve(adminKey, http.MethodPost, "/book/ETH/auction", `{}`, nil), http.StatusBadRequest)
+
+	// the orders collect, market orders have to wait.
+	apiErr := &APIError{}
+	assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"MARKET","Market":"ETH","Bid":true,"Size":1}`, apiErr), http.StatusConflict)
+	assert(t, apiErr.Code, CodeMarketClosed)
+	assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":2,"Price":102}`, nil), http.StatusOK)
+	assert(t, serve(bobKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Size":1,"Price":100}`, nil), http.StatusOK)
+	assert(t, serve(bobKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Size":2,"Price":101}`, nil), http.StatusOK)
+
+	// 2 trade at 101 and 102, the seller left over takes it down.
+	assert(t, serve(aliceKey, http.MethodGet, "/book/ETH/auction", "", state), http.StatusOK)
+	assert(t, *state.Indicative, orderbook.Auction{Price: 101, Volume: 2, Imbalance: -1})
+
+	uncrossed := &UncrossResponse{}
+	assert(t, serve(adminKey, http.MethodPost, "/book/ETH/uncross", "", uncrossed), http.StatusOK)
+	assert(t, *uncrossed, UncrossResponse{Market: MarketETH, Price: 101, Volume: 2, Matches: 2})
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 798})
+	assert(t, ex.Ledger.Balance(alice.ID, AssetETH), Balance{Available: 2})
+	assert(t, ex.Ledger.Balance(bob.ID, AssetETH), Balance{Available: 7, Locked: 1})
+	assert(t, ex.Ledger.Balance(bob.ID, AssetUSD), Balance{Available: 202})
+	assert(t, len(ex.Orders[alice.ID]), 0)
+
+	// trading continuously again.
+	state = &AuctionResponse{}
+	assert(t, serve(aliceKey, http.MethodGet, "/book/ETH/auction", "", state), http.StatusOK)
+	assert(t, *state, AuctionResponse{Market: MarketETH, Phase: PhaseContinuous})
+	assert(t, serve(adminKey, http.MethodPost, "/book/ETH/uncross", "", nil), http.StatusBadRequest)
+
+	// a halt takes nothing until an auction opens the market again.
+	assert(t, serve(adminKey, http.MethodPost, "/book/ETH/halt", "", nil), http.StatusOK)
+	assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":1,"Price":90}`, nil), http.StatusConflict)
+	assert(t, serve(bobKey, http.MethodDelete, "/orders", "", nil), http.StatusOK)
+	assert(t, serve(adminKey, http.MethodPost, "/book/ETH/auction", `{"DurationMs":1}`, nil), http.StatusOK)
+	assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":1,"Price":90}`, nil), http.StatusOK)
+
+	for deadline := time.Now().Add(time.Second); ; {
+		ex.bookMu.Lock()
+		phase := ex.phase(MarketETH)
+		ex.bookMu.Unlock()
+		if phase == PhaseContinuous {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the auction didn't uncross on time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert(t, ex.Ledger.Balance(bob.ID, AssetETH), Balance{Available: 8})
+}
@@ -0,0 +1,473 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	PermRead     Permission = "read"
+	PermTrade    Permission = "trade"
+	PermWithdraw Permission = "withdraw"
+	// operator endpoints, approving withdrawals etc.
+	PermAdmin Permission = "admin"
+
+	HeaderAPIKey    = "X-API-KEY"
+	HeaderTimestamp = "X-API-TIMESTAMP"
+	HeaderSignature = "X-API-SIGNATURE"
+
+	// requests signed longer ago than this (or this far in the future) are rejected.
+	authWindow = 30 * time.Second
+	// biggest body of a signed request, it's read whole before it's checked.
+	maxSignedBody = 1 << 20
+
+	ctxAPIKey = "apiKey"
+)
+
+type Permission string
+
+type APIKey struct {
+	Key string
+	// only set when the key is created, the store keeps its hash sealed.
+	Secret      string `json:",omitempty"`
+	UserID      int64
+	Permissions []Permission
+	CreatedAt   int64
+
+	secretHash []byte
+}
+
+func (k *APIKey) Can(perm Permission) bool {
+	return slices.Contains(k.Permissions, perm)
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of timestamp, method, path and body
+// with a newline after each of the first three, keyed with the SHA-256 of the
+// secret. The path includes the query string.
+func Sign(secret, timestamp, method, path string, body []byte) string {
+	return signHashed(hashSecret(secret), timestamp, method, path, body)
+}
+
+// hashSecret is what the store keeps of a secret. It can't give the secret
+// back, but it signs requests all the same, the store seals it before it
+// writes it.
+func hashSecret(secret string) []byte {
+	h := sha256.Sum256([]byte(secret))
+	return h[:]
+}
+
+func signHashed(secretHash []byte, timestamp, method, path string, body []byte) string {
+	mac := hmac.New(sha256.New, secretHash)
+	for _, field := range []string{timestamp, method, path} {
+		mac.Write([]byte(field))
+		mac.Write([]byte{'\n'})
+	}
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// APIKeyStore keeps the keys and writes every change to a JSON file next to
+// the users. The hashes of the secrets sign requests like the secrets do,
+// the file has them sealed with AES-GCM under a key the store derives from
+// the keystore passphrase with scrypt.
+type APIKeyStore struct {
+	// no file when empty, the keys are only kept in memory.
+	path string
+	// seals the hashes of the secrets in the file, with the salt of its key.
+	aead cipher.AEAD
+	salt []byte
+
+	mu   sync.RWMutex
+	keys map[string]*APIKey
+	// signatures seen inside the auth window, a request can't be sent twice.
+	seen map[string]time.Time
+	// the same signatures in the order they were seen, the oldest expire first.
+	seenQueue []seenSignature
+}
+
+type seenSignature struct {
+	signature string
+	at        time.Time
+}
+
+type apiKeyFile struct {
+	// of the key the secrets are sealed with.
+	Salt string `json:",omitempty"`
+	Keys []storedAPIKey
+}
+
+type storedAPIKey struct {
+	Key string
+	// the hash of the secret sealed, the nonce first.
+	SealedSecret string `json:",omitempty"`
+	// files from before the secrets were sealed, the store seals them when it loads them.
+	SecretHash  string `json:",omitempty"`
+	UserID      int64
+	Permissions []Permission
+	CreatedAt   int64
+}
+
+func newAPIKeyStore(path string) *APIKeyStore {
+	return &APIKeyStore{
+		path: path,
+		keys: make(map[string]*APIKey),
+		seen: make(map[string]time.Time),
+	}
+}
+
+// NewAPIKeyStore loads the keys from the file if it exists, the
+// passphrase opens the secrets in it.
+func NewAPIKeyStore(path, passphrase string) (*APIKeyStore, error) {
+	s := newAPIKeyStore(path)
+	if path == "" {
+		return s, nil
+	}
+	if passphrase == "" {
+		return nil, errors.New("no passphrase to seal the api key secrets with")
+	}
+
+	var file apiKeyFile
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("reading api keys from %s: %w", path, err)
+		}
+	}
+
+	salt, err := hex.DecodeString(file.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("reading api keys from %s: %w", path, err)
+	}
+	if len(salt) == 0 {
+		if salt, err = randomBytes(16); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.deriveKey(passphrase, salt); err != nil {
+		return nil, err
+	}
+
+	unsealed := false
+	for _, k := range file.Keys {
+		var secretHash []byte
+		if k.SealedSecret != "" {
+			secretHash, err = s.open(k.Key, k.SealedSecret)
+		} else {
+			unsealed = true
+			secretHash, err = hex.DecodeString(k.SecretHash)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading api key %s from %s: %w", k.Key, path, err)
+		}
+		s.keys[k.Key] = &APIKey{
+			Key:         k.Key,
+			UserID:      k.UserID,
+			Permissions: k.Permissions,
+			CreatedAt:   k.CreatedAt,
+			secretHash:  secretHash,
+		}
+	}
+	if unsealed {
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// deriveKey sets up the sealing of the secrets with the key of the passphrase.
+func (s *APIKeyStore) deriveKey(passphrase string, salt []byte) error {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	s.aead, s.salt = aead, salt
+	return nil
+}
+
+// seal encrypts the hash of a secret for the file, the key it belongs
+// to is authenticated with it so a sealed hash can't be moved to another key.
+func (s *APIKeyStore) seal(key string, secretHash []byte) (string, error) {
+	nonce, err := randomBytes(s.aead.NonceSize())
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(s.aead.Seal(nonce, nonce, secretHash, []byte(key))), nil
+}
+
+func (s *APIKeyStore) open(key, sealed string) ([]byte, error) {
+	data, err := hex.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < s.aead.NonceSize() {
+		return nil, errors.New("sealed secret too short")
+	}
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	secretHash, err := s.aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return nil, errors.New("can't open the sealed secret, wrong passphrase?")
+	}
+	return secretHash, nil
+}
+
+// save writes all keys to a temporary file first and renames it,
+// the same way the user registry does.
+func (s *APIKeyStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	file := apiKeyFile{Salt: hex.EncodeToString(s.salt), Keys: make([]storedAPIKey, 0, len(s.keys))}
+	for _, k := range s.keys {
+		sealed, err := s.seal(k.Key, k.secretHash)
+		if err != nil {
+			return err
+		}
+		file.Keys = append(file.Keys, storedAPIKey{
+			Key:          k.Key,
+			SealedSecret: sealed,
+			UserID:       k.UserID,
+			Permissions:  k.Permissions,
+			CreatedAt:    k.CreatedAt,
+		})
+	}
+	sort.Slice(file.Keys, func(i, j int) bool { return file.Keys[i].CreatedAt < file.Keys[j].CreatedAt })
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func randomHex(n int) (string, error) {
+	b, err := randomBytes(n)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Create returns the new key with its secret,
+// this is the only time the secret is handed out.
+func (s *APIKeyStore) Create(userID int64, perms ...Permission) (*APIKey, error) {
+	key, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &APIKey{
+		Key:         key,
+		UserID:      userID,
+		Permissions: perms,
+		CreatedAt:   time.Now().UnixNano(),
+		secretHash:  hashSecret(secret),
+	}
+
+	s.mu.Lock()
+	s.keys[k.Key] = k
+	if err := s.save(); err != nil {
+		delete(s.keys, k.Key)
+		s.mu.Unlock()
+		return nil, err
+	}
+	s.mu.Unlock()
+
+	c := *k
+	c.Secret = secret
+	return &c, nil
+}
+
+func (s *APIKeyStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.keys)
+}
+
+func (s *APIKeyStore) Get(key string) (*APIKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	k, ok := s.keys[key]
+	return k, ok
+}
+
+// List returns the keys of the user without their secrets.
+func (s *APIKeyStore) List(userID int64) []*APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []*APIKey{}
+	for _, k := range s.keys {
+		if k.UserID == userID {
+			c := *k
+			keys = append(keys, &c)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt < keys[j].CreatedAt })
+	return keys
+}
+
+func (s *APIKeyStore) Revoke(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[key]
+	if !ok {
+		return false, nil
+	}
+	delete(s.keys, key)
+	if err := s.save(); err != nil {
+		s.keys[key] = k
+		return false, err
+	}
+	return true, nil
+}
+
+// markSeen reports false if the signature was already used.
+func (s *APIKeyStore) markSeen(signature string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for ; n < len(s.seenQueue) && now.Sub(s.seenQueue[n].at) > 2*authWindow; n++ {
+		delete(s.seen, s.seenQueue[n].signature)
+	}
+	s.seenQueue = s.seenQueue[n:]
+	if _, ok := s.seen[signature]; ok {
+		return false
+	}
+	s.seen[signature] = now
+	s.seenQueue = append(s.seenQueue, seenSignature{signature: signature, at: now})
+	return true
+}
+
+// requireAuth checks the signature of the request and that the key has
+// the permission. The rate limit is taken once the key is verified, a
+// request that doesn't authenticate counts against its ip.
+func (ex *Exchange) requireAuth(perm Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key, err := ex.authenticate(c, perm)
+			if err := ex.limiter.allow(c, key); err != nil {
+				return err
+			}
+			if err != nil {
+				return err
+			}
+			c.Set(ctxAPIKey, key)
+			return next(c)
+		}
+	}
+}
+
+// authenticate returns the key the request is signed with, nil when it isn't.
+func (ex *Exchange) authenticate(c echo.Context, perm Permission) (*APIKey, error) {
+	req := c.Request()
+	keyStr := req.Header.Get(HeaderAPIKey)
+	timestamp := req.Header.Get(HeaderTimestamp)
+	signature := req.Header.Get(HeaderSignature)
+	if keyStr == "" || timestamp == "" || signature == "" {
+		return nil, ErrUnauthorized.WithMessage("missing authentication headers")
+	}
+
+	ms, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrUnauthorized.WithMessage("invalid timestamp")
+	}
+	now := time.Now()
+	if d := now.Sub(time.UnixMilli(ms)); d > authWindow || d < -authWindow {
+		return nil, ErrUnauthorized.WithMessage("timestamp outside of the auth window")
+	}
+
+	key, ok := ex.APIKeys.Get(keyStr)
+	if !ok {
+		return nil, ErrUnauthorized.WithMessage("invalid api key")
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Response(), req.Body, maxSignedBody))
+	if err != nil {
+		return nil, ErrBadRequest.WithMessage("reading the body: %s", err)
+	}
+	// the handler still needs to decode it.
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := signHashed(key.secretHash, timestamp, req.Method, req.URL.RequestURI(), body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, ErrUnauthorized.WithMessage("invalid signature")
+	}
+	if !ex.APIKeys.markSeen(signature, now) {
+		return nil, ErrUnauthorized.WithMessage("request already seen")
+	}
+
+	if !key.Can(perm) {
+		return nil, ErrForbidden.WithMessage("api key is missing permission %s", perm)
+	}
+	user, ok := ex.Users.Get(key.UserID)
+	if !ok {
+		return nil, ErrUnauthorized.WithMessage("user not found")
+	}
+	if !user.Can(perm) {
+		return nil, ErrForbidden.WithMessage("account is %s", user.Status)
+	}
+	return key, nil
+}
+
+// authUserID returns the user of the api key the request was signed with.
+func authUserID(c echo.Context) int64 {
+	return c.Get(ctxAPIKey).(*APIKey).UserID
+}
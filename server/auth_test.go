@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func signedRequest(key *APIKey, method, path, body string, at time.Time) *http.Request {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	timestamp := strconv.FormatInt(at.UnixMilli(), 10)
+	req.Header.Set(HeaderAPIKey, key.Key)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(key.Secret, timestamp, method, path, []byte(body)))
+	return req
+}
+
+func TestRequireAuth(t *testing.T) {
+	users, _ := NewUserRegistry("")
+	keys, _ := NewAPIKeyStore("", "")
+	ex := &Exchange{APIKeys: keys, Users: users}
+	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
+	e.POST("/order", func(c echo.Context) error {
+		return c.String(http.StatusOK, strconv.FormatInt(authUserID(c), 10))
+	}, ex.requireAuth(PermTrade))
+
+	alice, _ := users.Add(&User{})
+	bob, _ := users.Add(&User{})
+	trader, _ := ex.APIKeys.Create(alice.ID, PermRead, PermTrade)
+	reader, _ := ex.APIKeys.Create(bob.ID, PermRead)
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	req := signedRequest(trader, http.MethodPost, "/order", `{"Size":1}`, time.Now())
+	rec := serve(req)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, rec.Body.String(), "1")
+
+	// the exact same request again.
+	replay := signedRequest(trader, http.MethodPost, "/order", `{"Size":1}`, time.Now())
+	replay.Header = req.Header
+	assert(t, serve(replay).Code, http.StatusUnauthorized)
+
+	tampered := signedRequest(trader, http.MethodPost, "/order", `{"Size":1}`, time.Now().Add(time.Millisecond))
+	tampered.Body = http.NoBody
+	assert(t, serve(tampered).Code, http.StatusUnauthorized)
+
+	old := signedRequest(trader, http.MethodPost, "/order", `{"Size":2}`, time.Now().Add(-time.Minute))
+	assert(t, serve(old).Code, http.StatusUnauthorized)
+
+	forbidden := signedRequest(reader, http.MethodPost, "/order", `{"Size":3}`, time.Now())
+	assert(t, serve(forbidden).Code, http.StatusForbidden)
+
+	users.SetStatus(alice.ID, UserFrozen)
+	frozen := signedRequest(trader, http.MethodPost, "/order", `{"Size":4}`, time.Now())
+	assert(t, serve(frozen).Code, http.StatusForbidden)
+	users.SetStatus(alice.ID, UserActive)
+
+	ex.APIKeys.Revoke(trader.Key)
+	revoked := signedRequest(trader, http.MethodPost, "/order", `{"Size":5}`, time.Now())
+	assert(t, serve(revoked).Code, http.StatusUnauthorized)
+}
+
+func TestAPIKeysPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	keys, err := NewAPIKeyStore(path, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, _ := keys.Create(1, PermRead, PermTrade)
+	revoked, _ := keys.Create(2, PermRead)
+	if ok, err := keys.Revoke(revoked.Key); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+
+	// a restart, the secrets themselves were never written.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, strings.Contains(string(data), kept.Secret), false)
+	// nor what signs like them.
+	assert(t, strings.Contains(string(data), hex.EncodeToString(hashSecret(kept.Secret))), false)
+	_, err = NewAPIKeyStore(path, "wrong")
+	assert(t, err != nil, true)
+	keys, err = NewAPIKeyStore(path, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, keys.Len(), 1)
+	assert(t, keys.List(1)[0].Secret, "")
+	assert(t, keys.List(1)[0].Permissions, []Permission{PermRead, PermTrade})
+
+	users, _ := NewUserRegistry("")
+	users.Add(&User{})
+	ex := &Exchange{APIKeys: keys, Users: users}
+	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
+	e.GET("/me", func(c echo.Context) error {
+		return c.String(http.StatusOK, strconv.FormatInt(authUserID(c), 10))
+	}, ex.requireAuth(PermRead))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, signedRequest(kept, http.MethodGet, "/me", "", time.Now()))
+	assert(t, rec.Code, http.StatusOK)
+}
+
+func TestSignDelimitsFields(t *testing.T) {
+	// the same bytes split differently between path and body.
+	assert(t, Sign("s", "1", "POST", "/order", []byte("1")) != Sign("s", "1", "POST", "/order1", nil), true)
+}
+
+func TestMarkSeenExpires(t *testing.T) {
+	keys, _ := NewAPIKeyStore("", "")
+	now := time.Now()
+	assert(t, keys.markSeen("a", now), true)
+	assert(t, keys.markSeen("b", now.Add(authWindow)), true)
+	assert(t, keys.markSeen("a", now.Add(authWindow)), false)
+
+	// a is out of the window, b isn't yet.
+	later := now.Add(2*authWindow + time.Second)
+	assert(t, keys.markSeen("c", later), true)
+	assert(t, len(keys.seen), 2)
+	assert(t, keys.markSeen("b", later), false)
+	assert(t, keys.markSeen("a", later), true)
+}
+
+func TestRateLimitByVerifiedKey(t *testing.T) {
+	ex := newTestExchange(t, "")
+	ex.limiter = newRateLimiter(RateLimit{Rate: 0.001, Burst: 2})
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	alice, _ := ex.Users.Add(&User{})
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermRead)
+	serve := signedServer(t, e)
+	getBook := func() int {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/book/ETH", nil))
+		return rec.Code
+	}
+
+	// a made up key counts against the ip, it doesn't get a limit of its own.
+	madeUp := &APIKey{Key: aliceKey.Key + "x", Secret: "secret"}
+	assert(t, serve(madeUp, http.MethodGet, "/balance/"+itoa(alice.ID), "", nil), http.StatusUnauthorized)
+	assert(t, getBook(), http.StatusOK)
+	assert(t, getBook(), http.StatusTooManyRequests)
+	assert(t, serve(madeUp, http.MethodGet, "/balance/"+itoa(alice.ID), "", nil), http.StatusTooManyRequests)
+
+	// the key has its own limit.
+	for i := 0; i < 2; i++ {
+		assert(t, serve(aliceKey, http.MethodGet, "/balance/"+itoa(alice.ID), "", nil), http.StatusOK)
+	}
+	assert(t, serve(aliceKey, http.MethodGet, "/balance/"+itoa(alice.ID), "", nil), http.StatusTooManyRequests)
+}
+
+func TestRequireAuthLimitsTheBody(t *testing.T) {
+	ex := newTestExchange(t, "")
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	alice, _ := ex.Users.Add(&User{})
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermRead, PermTrade)
+
+	body := `{"Market":"ETH","Type":"LIMIT","Size":1,"Price":100,"Pad":"` + strings.Repeat("x", maxSignedBody) + `"}`
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, signedRequest(aliceKey, http.MethodPost, "/order", body, time.Now()))
+	assert(t, rec.Code, http.StatusBadRequest)
+}
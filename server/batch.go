@@ -0,0 +1,205 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ukibbb/crypto-exchange/orderbook"
+)
+
+// big enough for a full refresh of quotes.
+const maxBatchSize = 100
+
+// BatchRequest cancels orders and places new ones in a single turn of the
+// books, the cancels go first so their funds can back the new orders.
+type BatchRequest struct {
+	Orders  []PlaceOrderRequest
+	Cancels []int64
+	// nothing happens unless every item goes through. Only limit
+	// orders can be part of it, trades can't be taken back.
+	AllOrNothing bool
+}
+
+// BatchResult is what happened to one item of the batch.
+type BatchResult struct {
+	// the order placed or cancelled, 0 when placing it failed.
+	OrderID int64
+	Error   *APIError `json:",omitempty"`
+}
+
+// BatchResponse has a result for every item, in the order of the request.
+type BatchResponse struct {
+	Cancels []BatchResult
+	Orders  []BatchResult
+}
+
+// batchCancel is a checked cancel of an all or nothing batch.
+type batchCancel struct {
+	info  *orderInfo
+	order *orderbook.Order
+}
+
+func (ex *Exchange) handlePlaceBatch(c echo.Context) error {
+	var req BatchRequest
+	if err := decodeBody(c, &req); err != nil {
+		return err
+	}
+	if n := len(req.Orders) + len(req.Cancels); n == 0 || n > maxBatchSize {
+		return ErrBadRequest.WithMessage("a batch takes 1 to %d items, not %d", maxBatchSize, n)
+	}
+	userID := authUserID(c)
+	for i := range req.Orders {
+		req.Orders[i].UserID = userID
+	}
+
+	ex.bookMu.Lock()
+	defer ex.unlockBooks()
+
+	if !req.AllOrNothing {
+		return c.JSON(http.StatusOK, ex.runBatch(userID, &req))
+	}
+	resp, err := ex.runBatchAtomic(userID, &req)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// runBatch runs every item on its own, the ones that fail don't stop the rest.
+// It has to be called with bookMu held.
+func (ex *Exchange) runBatch(userID int64, req *BatchRequest) *BatchResponse {
+	resp := &BatchResponse{
+		Cancels: make([]BatchResult, len(req.Cancels)),
+		Orders:  make([]BatchResult, len(req.Orders)),
+	}
+
+	for i, id := range req.Cancels {
+		resp.Cancels[i].OrderID = id
+		if _, err := ex.cancelOwnOrder(userID, id); err != nil {
+			resp.Cancels[i].Error = badRequest(err)
+		}
+	}
+
+	for i := range req.Orders {
+		order, err := ex.submitOrder(&req.Orders[i])
+		if err != nil {
+			resp.Orders[i].Error = badRequest(err)
+			continue
+		}
+		resp.Orders[i].OrderID = order.ID
+	}
+
+	log.Printf("batch of user %d: %d cancels, %d orders", userID, len(req.Cancels), len(req.Orders))
+	return resp
+}
+
+// runBatchAtomic checks every item and moves all the funds before it touches
+// the books, nothing can fail after that. The first item that fails is
+// returned as the error, with where it was in the batch.
+// It has to be called with bookMu held.
+func (ex *Exchange) runBatchAtomic(userID int64, req *BatchRequest) (*BatchResponse, error) {
+	cancels := make([]batchCancel, len(req.Cancels))
+	seen := make(map[int64]bool)
+	for i, id := range req.Cancels {
+		info, err := ex.ownOrder(userID, id)
+		if err != nil {
+			return nil, batchError(err, "cancel", i)
+		}
+		if seen[id] {
+			return nil, batchError(ErrBadRequest.WithMessage("order [%d] is cancelled twice", id), "cancel", i)
+		}
+		o, ok := ex.orderBooks[info.Market].Orders[id]
+		if !ok || o.Limit == nil {
+			return nil, batchError(errNotOpen(ex.orderState(id, info)), "cancel", i)
+		}
+		seen[id] = true
+		cancels[i] = batchCancel{info: info, order: o}
+	}
+
+	orders := make([]*orderbook.Order, len(req.Orders))
+	for i, p := range req.Orders {
+		market := Market(p.Market)
+		ob, ok := ex.orderBooks[market]
+		if !ok {
+			return nil, batchError(ErrMarketNotFound.WithDetail("market", market), "order", i)
+		}
+		if err := ex.checkPhase(market, p.Type); err != nil {
+			return nil, batchError(err, "order", i)
+		}
+		if p.Type != LimitOrder || p.Peg != nil {
+			return nil, batchError(ErrBadRequest.WithMessage("only limit orders that aren't pegged can be part of an all or nothing batch"), "order", i)
+		}
+		o := ex.newOrder(p.Bid, p.Size, p.UserID)
+		expiresAt, err := ex.orderExpiry(&req.Orders[i], time.Unix(0, o.Timestamp))
+		if err != nil {
+			return nil, batchError(err, "order", i)
+		}
+		o.ExpiresAt = expiresAt
+		if err := ob.Check(orderbook.PlaceCommand(true, p.Price, o)); err != nil {
+			return nil, batchError(err, "order", i)
+		}
+		orders[i] = o
+	}
+
+	// the funds of the cancels first, they can back the new orders.
+	for _, cancel := range cancels {
+		ex.releaseOrder(cancel.info.Market, cancel.info.Price, cancel.order)
+	}
+	for i, o := range orders {
+		p := req.Orders[i]
+		if err := ex.reserveLimitOrder(Market(p.Market), p.Price, o); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				ex.releaseOrder(Market(req.Orders[j].Market), req.Orders[j].Price, orders[j])
+			}
+			for _, cancel := range cancels {
+				if err := ex.reserveLimitOrder(cancel.info.Market, cancel.info.Price, cancel.order); err != nil {
+					log.Printf("batch of user %d: reserving order %d again: %s", userID, cancel.order.ID, err)
+				}
+			}
+			return nil, batchError(err, "order", i)
+		}
+	}
+
+	resp := &BatchResponse{
+		Cancels: make([]BatchResult, len(req.Cancels)),
+		Orders:  make([]BatchResult, len(req.Orders)),
+	}
+	for i, cancel := range cancels {
+		id := cancel.order.ID
+		if _, _, err := ex.executeLocked(cancel.info.Market, orderbook.Command{Type: orderbook.CmdCancel, OrderID: id}); err != nil {
+			return nil, err
+		}
+		ex.mu.Lock()
+		ex.cancelled(cancel.info, cancel.order)
+		ex.mu.Unlock()
+		resp.Cancels[i].OrderID = id
+	}
+	for i, o := range orders {
+		if err := ex.placeLimitOrder(Market(req.Orders[i].Market), req.Orders[i].Price, o); err != nil {
+			return nil, err
+		}
+		resp.Orders[i].OrderID = o.ID
+	}
+
+	log.Printf("all or nothing batch of user %d: %d cancels, %d orders", userID, len(req.Cancels), len(req.Orders))
+	return resp, nil
+}
+
+// ownOrder looks up an order of the user, orders of other
+// users look the same as orders that don't exist.
+func (ex *Exchange) ownOrder(userID, id int64) (*orderInfo, error) {
+	ex.mu.RLock()
+	info, ok := ex.orderIndex[id]
+	ex.mu.RUnlock()
+	if !ok || info.UserID != userID {
+		return nil, ErrOrderNotFound.WithMessage("order not found [%d]", id).WithDetail("orderID", id)
+	}
+	return info, nil
+}
+
+// batchError points at the item of the batch the error is about.
+func batchError(err error, kind string, index int) *APIError {
+	return badRequest(err).WithDetail("item", kind).WithDetail("index", index)
+}
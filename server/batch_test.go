@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestPlaceBatch(t *testing.T) {
+	ex := newTestExchange(t, "")
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+
+	alice, _ := ex.Users.Add(&User{})
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermTrade)
+	ex.Ledger.Credit(alice.ID, AssetUSD, 1000)
+
+	// the second bid is more than is left, the rest still goes through.
+	resp := &BatchResponse{}
+	assert(t, serve(aliceKey, http.MethodPost, "/orders/batch", `{"Orders":[
+		{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":2,"Price":100},
+		{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":9,"Price":100},
+		{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":3,"Price":90}
+	]}`, resp), http.StatusOK)
+	assert(t, len(resp.Orders), 3)
+	assert(t, resp.Orders[0].Error == nil, true)
+	assert(t, resp.Orders[1].OrderID, int64(0))
+	assert(t, resp.Orders[1].Error.Code, CodeInsufficientBalance)
+	assert(t, resp.Orders[2].Error == nil, true)
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 530, Locked: 470})
+	first, second := resp.Orders[0].OrderID, resp.Orders[2].OrderID
+
+	// all or nothing: the second order fails so the cancel doesn't happen either.
+	apiErr := &APIError{}
+	assert(t, serve(aliceKey, http.MethodPost, "/orders/batch", `{"AllOrNothing":true,"Cancels":[`+itoa(first)+`],"Orders":[
+		{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":5,"Price":100},
+		{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":5,"Price":100}
+	]}`, apiErr), http.StatusBadRequest)
+	assert(t, apiErr.Code, CodeInsufficientBalance)
+	assert(t, apiErr.Details["item"], "order")
+	assert(t, apiErr.Details["index"], 1.0)
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 530, Locked: 470})
+	assert(t, ex.orderBooks[MarketETH].BidTotalVolume(), 5.0)
+
+	apiErr = &APIError{}
+	assert(t, serve(aliceKey, http.MethodPost, "/orders/batch", `{"AllOrNothing":true,"Orders":[
+		{"Type":"MARKET","Market":"ETH","Size":1}
+	]}`, apiErr), http.StatusBadRequest)
+	assert(t, apiErr.Details["index"], 0.0)
+
+	// the funds of the cancel back the new order.
+	resp = &BatchResponse{}
+	assert(t, serve(aliceKey, http.MethodPost, "/orders/batch", `{"AllOrNothing":true,"Cancels":[`+itoa(first)+`,`+itoa(second)+`],"Orders":[
+		{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":10,"Price":100}
+	]}`, resp), http.StatusOK)
+	assert(t, resp.Cancels[0].OrderID, first)
+	assert(t, resp.Orders[0].Error == nil, true)
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Locked: 1000})
+	assert(t, len(ex.Orders[alice.ID]), 1)
+	assert(t, ex.Orders[alice.ID][0].ID, resp.Orders[0].OrderID)
+
+	apiErr = &APIError{}
+	assert(t, serve(aliceKey, http.MethodPost, "/orders/batch", `{"Cancels":[]}`, apiErr), http.StatusBadRequest)
+}
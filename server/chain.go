@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// ChainClient is the part of the ethereum RPC client the exchange uses.
+// *ethclient.Client implements it, and so does the simulated backend
+// which is what the tests run against.
+type ChainClient interface {
+	ethereum.ChainReader
+	ethereum.ChainStateReader
+	ethereum.ChainIDReader
+	ethereum.ContractCaller
+	ethereum.LogFilterer
+	ethereum.PendingStateReader
+	ethereum.TransactionReader
+	ethereum.TransactionSender
+	ethereum.GasPricer
+	ethereum.GasPricer1559
+	ethereum.GasEstimator
+}
+
+type FeeConfig struct {
+	// upper bound of the priority fee (tip) per gas paid to the miner.
+	MaxTipCap *big.Int
+	// upper bound of the total fee per gas, base fee + tip.
+	MaxFeeCap *big.Int
+	// percentage added on top of the estimated gas for contract calls,
+	// their gas usage can change between estimation and execution.
+	GasLimitMargin uint64
+}
+
+var DefaultFeeConfig = FeeConfig{
+	MaxTipCap:      big.NewInt(5 * params.GWei),
+	MaxFeeCap:      big.NewInt(500 * params.GWei),
+	GasLimitMargin: 20,
+}
+
+// Chain builds, signs and sends transactions on an EVM network.
+type Chain struct {
+	Client  ChainClient
+	Nonces  *NonceManager
+	ChainID *big.Int
+	Fees    FeeConfig
+	// pays the gas of every other sender when set, see fundGas.
+	GasFunder Signer
+	// how often a gas top-up is checked until it's mined.
+	PollInterval time.Duration
+}
+
+// NewChain asks the client for the chain ID unless one is given.
+func NewChain(ctx context.Context, client ChainClient, chainID *big.Int, fees FeeConfig) (*Chain, error) {
+	if chainID == nil {
+		id, err := client.ChainID(ctx)
+		if err != nil {
+			return nil, err
+		}
+		chainID = id
+	}
+
+	return &Chain{
+		Client:       client,
+		Nonces:       NewNonceManager(client),
+		ChainID:      chainID,
+		Fees:         fees,
+		PollInterval: time.Second,
+	}, nil
+}
+
+// SendTx sends value and data (a contract call) from the account of the signer.
+func (c *Chain) SendTx(ctx context.Context, signer Signer, to common.Address, value *big.Int, data []byte) (*types.Transaction, error) {
+	return c.SendTxRecorded(ctx, signer, to, value, data, nil)
+}
+
+// SendTxRecorded hands the signed transaction to record before it's sent,
+// nothing is sent when it fails. A crash right after sending can't lose
+// a transaction that went out. When sending a recorded transaction fails
+// it's returned with the error, the node might have taken it anyway.
+// It keeps its nonce and isn't tracked, the caller has to find out what
+// happened to it.
+func (c *Chain) SendTxRecorded(ctx context.Context, signer Signer, to common.Address, value *big.Int, data []byte, record func(*types.Transaction) error) (*types.Transaction, error) {
+	from := signer.Address()
+	if err := c.fundGas(ctx, from, to, value, data); err != nil {
+		return nil, err
+	}
+
+	nonce, err := c.Nonces.Next(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := c.buildTx(ctx, from, nonce, to, value, data)
+	if err != nil {
+		c.Nonces.Release(from, nonce)
+		return nil, err
+	}
+
+	sign := func(tx *types.Transaction) (*types.Transaction, error) {
+		return signer.SignTx(tx, c.ChainID)
+	}
+	signedTx, err := sign(tx)
+	if err != nil {
+		c.Nonces.Release(from, nonce)
+		return nil, err
+	}
+	if record != nil {
+		if err := record(signedTx); err != nil {
+			c.Nonces.Release(from, nonce)
+			return nil, err
+		}
+	}
+	if err := c.Client.SendTransaction(ctx, signedTx); err != nil {
+		if record != nil {
+			return signedTx, err
+		}
+		c.Nonces.Release(from, nonce)
+		return nil, err
+	}
+	c.Nonces.Track(from, signedTx, sign)
+
+	// the hash of the signed transaction is what we need
+	// to look up the receipt once it's mined.
+	return signedTx, nil
+}
+
+// Recheck finds out what happened to a recorded transaction that might not
+// have gone out, before a restart or when sending it failed. Until its nonce
+// is used it's sent again, the node might have lost it, and it's tracked
+// from then on. It reports whether it was sent again. When the nonce went to
+// another transaction, like a gas bump of it that wasn't recorded, an
+// operator has to look at it.
+func (c *Chain) Recheck(ctx context.Context, signer Signer, tx *types.Transaction) (bool, error) {
+	from := signer.Address()
+	nonce, err := c.Client.NonceAt(ctx, from, nil)
+	if err != nil {
+		return false, err
+	}
+	var resent bool
+	if nonce > tx.Nonce() {
+		if _, err := c.Client.TransactionReceipt(ctx, tx.Hash()); err != nil {
+			return false, fmt.Errorf("tx %s isn't mined and its nonce %d is used, it needs an operator", tx.Hash().Hex(), tx.Nonce())
+		}
+	} else if err := c.Client.SendTransaction(ctx, tx); err != nil && !strings.Contains(err.Error(), "already known") {
+		return false, fmt.Errorf("sending tx %s again: %w", tx.Hash().Hex(), err)
+	} else if err == nil {
+		resent = true
+	}
+
+	c.Nonces.Track(from, tx, func(tx *types.Transaction) (*types.Transaction, error) {
+		return signer.SignTx(tx, c.ChainID)
+	})
+	return resent, nil
+}
+
+func (c *Chain) buildTx(ctx context.Context, from common.Address, nonce uint64, to common.Address, value *big.Int, data []byte) (*types.Transaction, error) {
+	tipCap, feeCap, err := c.suggestFees(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	gas, err := c.Client.EstimateGas(ctx, ethereum.CallMsg{
+		From:      from,
+		To:        &to,
+		Value:     value,
+		Data:      data,
+		GasTipCap: tipCap,
+		GasFeeCap: feeCap,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		gas += gas * c.Fees.GasLimitMargin / 100
+	}
+
+	return types.NewTx(&types.DynamicFeeTx{
+		ChainID:   c.ChainID,
+		Nonce:     nonce,
+		GasTipCap: tipCap,
+		GasFeeCap: feeCap,
+		Gas:       gas,
+		To:        &to,
+		Value:     value,
+		Data:      data,
+	}), nil
+}
+
+// suggestFees takes the tip suggested by the node and allows the base fee
+// to double before the transaction can't be included anymore,
+// both within the configured caps.
+func (c *Chain) suggestFees(ctx context.Context) (*big.Int, *big.Int, error) {
+	tipCap, err := c.Client.SuggestGasTipCap(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	head, err := c.Client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	baseFee := head.BaseFee
+	if baseFee == nil {
+		baseFee = big.NewInt(0)
+	}
+	if c.Fees.MaxTipCap != nil && tipCap.Cmp(c.Fees.MaxTipCap) > 0 {
+		tipCap = new(big.Int).Set(c.Fees.MaxTipCap)
+	}
+
+	feeCap := new(big.Int).Add(new(big.Int).Mul(baseFee, big.NewInt(2)), tipCap)
+	if c.Fees.MaxFeeCap != nil && feeCap.Cmp(c.Fees.MaxFeeCap) > 0 {
+		feeCap = new(big.Int).Set(c.Fees.MaxFeeCap)
+	}
+	if tipCap.Cmp(feeCap) > 0 {
+		tipCap = new(big.Int).Set(feeCap)
+	}
+
+	return tipCap, feeCap, nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestChainSendsDynamicFeeTx(t *testing.T) {
+	wallet := newTestWallet(t)
+	alice, bob := newTestUser(t, wallet, 1), newTestUser(t, wallet, 2)
+	backend := newTestBackend(t, alice, bob)
+	chain := newTestChain(t, backend)
+
+	// the simulated backend runs with the dev chain ID.
+	assert(t, chain.ChainID, big.NewInt(1337))
+
+	tx, err := transferETH(chain, testSigner(t, wallet, alice), bob.DepositAddress, ethToWei(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, tx.Type(), uint8(types.DynamicFeeTxType))
+	assert(t, tx.Gas(), uint64(21000))
+	assert(t, tx.ChainId(), big.NewInt(1337))
+
+	backend.Commit()
+	receipt, err := chain.Client.TransactionReceipt(context.Background(), tx.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, receipt.Status, types.ReceiptStatusSuccessful)
+}
+
+func TestChainFeeCaps(t *testing.T) {
+	alice := newTestUser(t, newTestWallet(t), 1)
+	backend := newTestBackend(t, alice)
+
+	fees := DefaultFeeConfig
+	fees.MaxTipCap = big.NewInt(1)
+	fees.MaxFeeCap = big.NewInt(1000)
+	chain, err := NewChain(context.Background(), backend.Client(), big.NewInt(1337), fees)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tipCap, feeCap, err := chain.suggestFees(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, tipCap, big.NewInt(1))
+	assert(t, feeCap, big.NewInt(1000))
+}
+
+func TestChainFundsGas(t *testing.T) {
+	wallet := newTestWallet(t)
+	hot, alice, bob := newTestUser(t, wallet, 0), newTestUser(t, wallet, 1), newTestUser(t, wallet, 2)
+	backend := newTestBackend(t, hot, bob)
+	chain := newTestChain(t, backend)
+	ctx := context.Background()
+
+	// alice has the 1 ETH to send and nothing for the gas.
+	if _, err := transferETH(chain, testSigner(t, wallet, bob), alice.DepositAddress, ethToWei(1)); err != nil {
+		t.Fatal(err)
+	}
+	backend.Commit()
+
+	chain.GasFunder = testSigner(t, wallet, hot)
+	chain.PollInterval = 10 * time.Millisecond
+	mine(t, backend)
+	tx, err := transferETH(chain, testSigner(t, wallet, alice), bob.DepositAddress, ethToWei(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := chain.Nonces.WaitMined(ctx, tx.Hash(), chain.PollInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, receipt.Status, types.ReceiptStatusSuccessful)
+
+	// the top-up is the gas at most, never what alice sends.
+	balance, err := chain.Client.BalanceAt(ctx, hot.DepositAddress, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, balance.Cmp(ethToWei(100)) < 0, true)
+	assert(t, balance.Cmp(ethToWei(99.99)) > 0, true)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// How the exchange holds funds on chain:
+//
+// Every user gets a deposit address the exchange holds the key of, the
+// Wallet, and that's where the funds of the user stay. Deposits to it are
+// credited, trades settle between the deposit addresses and withdrawals are
+// paid out of the deposit address of the user. What a deposit address has
+// on chain is what its user has on the ledger, less what isn't settled yet.
+//
+// The hot wallet holds no funds of the users. It pays the gas: a deposit
+// address that sends is topped up from it right before, so an address that
+// only holds tokens or spent its ETH can still move them. The trading fees
+// are settled to it. Its top-ups are not deposits.
+
+// fundGas tops the address up from the GasFunder with what the transaction
+// costs in gas at most. What the transaction sends has to be on the address
+// already, the top-up never covers it.
+func (c *Chain) fundGas(ctx context.Context, from, to common.Address, value *big.Int, data []byte) error {
+	if c.GasFunder == nil || c.GasFunder.Address() == from {
+		return nil
+	}
+
+	gas, err := c.Client.EstimateGas(ctx, ethereum.CallMsg{From: from, To: &to, Value: value, Data: data})
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		gas += gas * c.Fees.GasLimitMargin / 100
+	}
+	_, feeCap, err := c.suggestFees(ctx)
+	if err != nil {
+		return err
+	}
+	cost := new(big.Int).Mul(new(big.Int).SetUint64(gas), feeCap)
+
+	// what the address sent and isn't mined yet is gone already.
+	balance, err := c.Client.PendingBalanceAt(ctx, from)
+	if err != nil {
+		return err
+	}
+	short := new(big.Int).Sub(new(big.Int).Add(value, cost), balance)
+	if short.Sign() <= 0 {
+		return nil
+	}
+	if short.Cmp(cost) > 0 {
+		short = cost
+	}
+
+	tx, err := c.SendTx(ctx, c.GasFunder, from, short, nil)
+	if err != nil {
+		return fmt.Errorf("funding the gas of %s: %w", from.Hex(), err)
+	}
+	receipt, err := c.Nonces.WaitMined(ctx, tx.Hash(), c.PollInterval)
+	if err != nil {
+		return err
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return fmt.Errorf("funding the gas of %s: transaction %s reverted", from.Hex(), receipt.TxHash.Hex())
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ukibbb/crypto-exchange/orderbook"
+)
+
+// longest a dead man's switch can be set to.
+const maxCancelAfter = time.Hour
+
+// deadManKey is one timer of a user. A user has the timer of
+// POST /cancel-after and one for every websocket session.
+type deadManKey struct {
+	UserID int64
+	// 0 for the timer of POST /cancel-after.
+	Session uint64
+}
+
+type deadManTimer struct {
+	timer    *time.Timer
+	deadline time.Time
+}
+
+// deadManSwitch cancels all orders of a user once one of their timers
+// runs out without being armed again. Bots keep arming it while they
+// are alive, so a dead bot doesn't leave its orders on the book.
+type deadManSwitch struct {
+	mu      sync.Mutex
+	timers  map[deadManKey]*deadManTimer
+	stopped bool
+	// called without the lock held when a timer runs out.
+	expire func(userID int64)
+}
+
+func newDeadManSwitch(expire func(userID int64)) *deadManSwitch {
+	return &deadManSwitch{
+		timers: make(map[deadManKey]*deadManTimer),
+		expire: expire,
+	}
+}
+
+// arm starts the timer of the key over, it returns when it runs out.
+// It's the zero time once the switch is stopped.
+func (d *deadManSwitch) arm(key deadManKey, timeout time.Duration) time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if t, ok := d.timers[key]; ok {
+		t.timer.Stop()
+	}
+	if d.stopped {
+		return time.Time{}
+	}
+
+	t := &deadManTimer{deadline: time.Now().Add(timeout)}
+	t.timer = time.AfterFunc(timeout, func() {
+		d.mu.Lock()
+		// armed again or disarmed while this one was firing.
+		if d.timers[key] != t {
+			d.mu.Unlock()
+			return
+		}
+		delete(d.timers, key)
+		d.mu.Unlock()
+
+		d.expire(key.UserID)
+	})
+	d.timers[key] = t
+
+	return t.deadline
+}
+
+func (d *deadManSwitch) disarm(key deadManKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if t, ok := d.timers[key]; ok {
+		t.timer.Stop()
+		delete(d.timers, key)
+	}
+}
+
+// stop disarms every timer for good, at shutdown the orders
+// stay on the book whether the bots are around or not.
+func (d *deadManSwitch) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stopped = true
+	for key, t := range d.timers {
+		t.timer.Stop()
+		delete(d.timers, key)
+	}
+}
+
+// cancelUserOrders is what the switch does when it runs out.
+func (ex *Exchange) cancelUserOrders(userID int64) {
+	states, err := ex.cancelAll(ex.allMarkets(), orderbook.CancelFilter{UserID: userID})
+	if err != nil {
+		log.Printf("dead man's switch of user %d: %s", userID, err)
+		return
+	}
+	log.Printf("dead man's switch of user %d ran out, canceled %d orders", userID, len(states))
+}
+
+type CancelAfterRequest struct {
+	// 0 turns the switch off.
+	TimeoutMs int64
+}
+
+type CancelAfterResponse struct {
+	// unix milliseconds the orders get cancelled at, 0 when the switch is off.
+	Deadline int64
+}
+
+// handleCancelAfter arms the dead man's switch of the caller, all their
+// orders get cancelled unless it's armed again before the timeout.
+func (ex *Exchange) handleCancelAfter(c echo.Context) error {
+	var req CancelAfterRequest
+	if err := decodeBody(c, &req); err != nil {
+		return err
+	}
+	timeout := time.Duration(req.TimeoutMs) * time.Millisecond
+	if timeout < 0 || timeout > maxCancelAfter {
+		return ErrBadRequest.WithMessage("timeout has to be between 0 and %d ms", maxCancelAfter.Milliseconds())
+	}
+
+	key := deadManKey{UserID: authUserID(c)}
+	if timeout == 0 {
+		ex.deadMan.disarm(key)
+		return c.JSON(http.StatusOK, &CancelAfterResponse{})
+	}
+	deadline := ex.deadMan.arm(key, timeout)
+	if deadline.IsZero() {
+		return ErrUnavailable
+	}
+
+	return c.JSON(http.StatusOK, &CancelAfterResponse{Deadline: deadline.UnixMilli()})
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// waitFor polls until ok or fails the test after a second.
+func waitFor(t *testing.T, ok func() bool) {
+	t.Helper()
+	for start := time.Now(); !ok(); time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("timed out")
+		}
+	}
+}
+
+func TestCancelAfter(t *testing.T) {
+	ex := newTestExchange(t, "")
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+
+	alice, _ := ex.Users.Add(&User{})
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermTrade)
+	ex.Ledger.Credit(alice.ID, AssetUSD, 1000)
+	assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":1,"Price":100}`, nil), http.StatusOK)
+
+	assert(t, serve(aliceKey, http.MethodPost, "/cancel-after", `{"TimeoutMs":-1}`, nil), http.StatusBadRequest)
+
+	// turned off before it runs out.
+	resp := &CancelAfterResponse{}
+	assert(t, serve(aliceKey, http.MethodPost, "/cancel-after", `{"TimeoutMs":50}`, resp), http.StatusOK)
+	assert(t, resp.Deadline > time.Now().UnixMilli(), true)
+	assert(t, serve(aliceKey, http.MethodPost, "/cancel-after", `{"TimeoutMs":0}`, resp), http.StatusOK)
+	assert(t, resp.Deadline, int64(0))
+	time.Sleep(100 * time.Millisecond)
+	assert(t, len(ex.Orders[alice.ID]), 1)
+
+	assert(t, serve(aliceKey, http.MethodPost, "/cancel-after", `{"TimeoutMs":20}`, nil), http.StatusOK)
+	waitFor(t, func() bool {
+		ex.mu.RLock()
+		defer ex.mu.RUnlock()
+		return len(ex.Orders[alice.ID]) == 0
+	})
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 1000})
+}
+
+func TestSessionCancelsOnDisconnect(t *testing.T) {
+	ex := newTestExchange(t, "")
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	alice, _ := ex.Users.Add(&User{})
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermTrade)
+	ex.Ledger.Credit(alice.ID, AssetUSD, 1000)
+	assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":1,"Price":100}`, nil), http.StatusOK)
+
+	dial := func(path string) *websocket.Conn {
+		req := signedRequest(aliceKey, http.MethodGet, path, "", time.Now())
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+path, req.Header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	conn := dial("/ws?cancelAfterMs=100")
+	// the pings keep it going past the timeout.
+	for i := 0; i < 4; i++ {
+		if err := conn.WriteJSON(&SessionMessage{Type: MsgPing}); err != nil {
+			t.Fatal(err)
+		}
+		pong := &SessionMessage{}
+		if err := conn.ReadJSON(pong); err != nil {
+			t.Fatal(err)
+		}
+		assert(t, pong.Type, MsgPong)
+		assert(t, pong.Deadline > time.Now().UnixMilli(), true)
+		time.Sleep(40 * time.Millisecond)
+	}
+	assert(t, len(ex.Orders[alice.ID]), 1)
+
+	conn.Close()
+	waitFor(t, func() bool {
+		ex.mu.RLock()
+		defer ex.mu.RUnlock()
+		return len(ex.Orders[alice.ID]) == 0
+	})
+
+	// sessions are closed at shutdown, without cancelling anything.
+	assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":1,"Price":100}`, nil), http.StatusOK)
+	conn = dial("/ws?cancelAfterMs=50")
+	defer conn.Close()
+	ex.Close()
+	_, _, err := conn.ReadMessage()
+	assert(t, websocket.IsCloseError(err, websocket.CloseGoingAway), true)
+	time.Sleep(100 * time.Millisecond)
+	assert(t, len(ex.Orders[alice.ID]), 1)
+}
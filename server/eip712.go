@@ -0,0 +1,172 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	eip712DomainName    = "crypto-exchange"
+	eip712DomainVersion = "1"
+	// prices and sizes are signed as integers with 18 decimals,
+	// EIP-712 has no floating point types.
+	eip712Decimals = 18
+)
+
+var orderTypes = apitypes.Types{
+	"EIP712Domain": {
+		{Name: "name", Type: "string"},
+		{Name: "version", Type: "string"},
+		{Name: "chainId", Type: "uint256"},
+	},
+	"Order": {
+		{Name: "market", Type: "string"},
+		{Name: "orderType", Type: "string"},
+		{Name: "bid", Type: "bool"},
+		{Name: "price", Type: "uint256"},
+		{Name: "size", Type: "uint256"},
+		{Name: "nonce", Type: "uint256"},
+		{Name: "expiry", Type: "uint256"},
+	},
+}
+
+// SignedOrder is an order signed by the wallet of the user as EIP-712 typed data
+// (which is version 0x01 of EIP-191 signed data).
+// The server never needs the private key, the account is the address
+// recovered from the signature.
+type SignedOrder struct {
+	Market Market
+	Type   OrderType
+	Bid    bool
+	Price  float64
+	Size   float64
+	// every nonce can be used once per wallet.
+	Nonce uint64
+	// unix seconds after which the signed order can't be placed anymore.
+	Expiry int64
+}
+
+type SignedOrderRequest struct {
+	Order     SignedOrder
+	Signature hexutil.Bytes
+}
+
+// OrderTypedData is the EIP-712 message the wallet signs for the order.
+func OrderTypedData(chainID *big.Int, o *SignedOrder) apitypes.TypedData {
+	return apitypes.TypedData{
+		Types:       orderTypes,
+		PrimaryType: "Order",
+		Domain: apitypes.TypedDataDomain{
+			Name:    eip712DomainName,
+			Version: eip712DomainVersion,
+			ChainId: (*math.HexOrDecimal256)(chainID),
+		},
+		Message: apitypes.TypedDataMessage{
+			"market":    string(o.Market),
+			"orderType": string(o.Type),
+			"bid":       o.Bid,
+			"price":     toBaseUnits(o.Price, eip712Decimals).String(),
+			"size":      toBaseUnits(o.Size, eip712Decimals).String(),
+			"nonce":     new(big.Int).SetUint64(o.Nonce).String(),
+			"expiry":    big.NewInt(o.Expiry).String(),
+		},
+	}
+}
+
+// SignOrder signs the order the way a wallet does with eth_signTypedData_v4.
+func SignOrder(key *ecdsa.PrivateKey, chainID *big.Int, o *SignedOrder) ([]byte, error) {
+	hash, _, err := apitypes.TypedDataAndHash(OrderTypedData(chainID, o))
+	if err != nil {
+		return nil, err
+	}
+	sig, err := crypto.Sign(hash, key)
+	if err != nil {
+		return nil, err
+	}
+	// wallets return v as 27/28.
+	sig[crypto.RecoveryIDOffset] += 27
+	return sig, nil
+}
+
+// RecoverOrderSigner returns the address of the wallet that signed the order.
+func RecoverOrderSigner(chainID *big.Int, o *SignedOrder, sig []byte) (common.Address, error) {
+	if len(sig) != crypto.SignatureLength {
+		return common.Address{}, errors.New("invalid signature length")
+	}
+	hash, _, err := apitypes.TypedDataAndHash(OrderTypedData(chainID, o))
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	sig = common.CopyBytes(sig)
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	pub, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.PubkeyToAddress(*pub), nil
+}
+
+// useOrderNonce reports false if the wallet already placed an order with the nonce.
+func (ex *Exchange) useOrderNonce(address common.Address, nonce uint64) bool {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	nonces, ok := ex.orderNonces[address]
+	if !ok {
+		nonces = make(map[uint64]bool)
+		ex.orderNonces[address] = nonces
+	}
+	if nonces[nonce] {
+		return false
+	}
+	nonces[nonce] = true
+	return true
+}
+
+func (ex *Exchange) handlePlaceSignedOrder(c echo.Context) error {
+	var signedOrderData SignedOrderRequest
+	if err := decodeBody(c, &signedOrderData); err != nil {
+		return err
+	}
+	o := &signedOrderData.Order
+
+	if o.Expiry < time.Now().Unix() {
+		return ErrBadRequest.WithMessage("signed order expired")
+	}
+
+	address, err := RecoverOrderSigner(ex.Chain.ChainID, o, signedOrderData.Signature)
+	if err != nil {
+		return ErrUnauthorized.WithMessage("invalid signature: %s", err)
+	}
+	userID, ok := ex.Users.Wallets()[address]
+	if !ok {
+		return ErrUnauthorized.WithMessage("no account for wallet %s", address.Hex())
+	}
+	if user, _ := ex.Users.Get(userID); !user.Can(PermTrade) {
+		return ErrForbidden.WithMessage("account is %s", user.Status)
+	}
+	if !ex.useOrderNonce(address, o.Nonce) {
+		return ErrUnauthorized.WithMessage("order nonce already used")
+	}
+
+	return ex.placeOrder(c, &PlaceOrderRequest{
+		UserID: userID,
+		Type:   o.Type,
+		Bid:    o.Bid,
+		Size:   o.Size,
+		Price:  o.Price,
+		Market: o.Market,
+	})
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestRecoverOrderSigner(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet := crypto.PubkeyToAddress(key.PublicKey)
+	chainID := big.NewInt(1337)
+	order := &SignedOrder{
+		Market: MarketETH,
+		Type:   LimitOrder,
+		Bid:    true,
+		Price:  2000.5,
+		Size:   0.1,
+		Nonce:  1,
+		Expiry: time.Now().Add(time.Minute).Unix(),
+	}
+
+	sig, err := SignOrder(key, chainID, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address, err := RecoverOrderSigner(chainID, order, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, address, wallet)
+
+	// a signature for another chain or another order recovers another address.
+	address, _ = RecoverOrderSigner(big.NewInt(1), order, sig)
+	assert(t, address == wallet, false)
+
+	tampered := *order
+	tampered.Size = 10
+	address, _ = RecoverOrderSigner(chainID, &tampered, sig)
+	assert(t, address == wallet, false)
+}
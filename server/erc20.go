@@ -0,0 +1,327 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// the part of the ERC-20 standard the exchange needs.
+const erc20ABIJSON = `[
+	{"type":"function","name":"decimals","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint8"}]},
+	{"type":"function","name":"balanceOf","stateMutability":"view","inputs":[{"name":"owner","type":"address"}],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"transfer","stateMutability":"nonpayable","inputs":[{"name":"to","type":"address"},{"name":"value","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]},
+	{"type":"function","name":"transferFrom","stateMutability":"nonpayable","inputs":[{"name":"from","type":"address"},{"name":"to","type":"address"},{"name":"value","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]},
+	{"type":"event","name":"Transfer","anonymous":false,"inputs":[{"name":"from","type":"address","indexed":true},{"name":"to","type":"address","indexed":true},{"name":"value","type":"uint256","indexed":false}]}
+]`
+
+var (
+	erc20ABI = mustParseABI(erc20ABIJSON)
+	// topic of the Transfer(address,address,uint256) event.
+	transferEventID = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+)
+
+func mustParseABI(s string) abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(s))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// Token is an ERC-20 token listed on the exchange.
+type Token struct {
+	Asset    Asset
+	Address  common.Address
+	Decimals uint8
+}
+
+// ToUnits converts a book size into token units.
+func (t *Token) ToUnits(amount float64) *big.Int {
+	return toBaseUnits(amount, t.Decimals)
+}
+
+// FromUnits converts token units into a book size.
+func (t *Token) FromUnits(units *big.Int) float64 {
+	return fromBaseUnits(units, t.Decimals)
+}
+
+// NewToken reads the decimals from the token contract.
+func (c *Chain) NewToken(ctx context.Context, asset Asset, address common.Address) (*Token, error) {
+	out, err := c.callToken(ctx, address, "decimals")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		Asset:    asset,
+		Address:  address,
+		Decimals: *abi.ConvertType(out[0], new(uint8)).(*uint8),
+	}, nil
+}
+
+func (c *Chain) TokenBalance(ctx context.Context, token *Token, owner common.Address) (*big.Int, error) {
+	out, err := c.callToken(ctx, token.Address, "balanceOf", owner)
+	if err != nil {
+		return nil, err
+	}
+	return abi.ConvertType(out[0], new(big.Int)).(*big.Int), nil
+}
+
+func (c *Chain) callToken(ctx context.Context, address common.Address, method string, args ...any) ([]any, error) {
+	data, err := erc20ABI.Pack(method, args...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.Client.CallContract(ctx, ethereum.CallMsg{To: &address, Data: data}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return erc20ABI.Unpack(method, res)
+}
+
+// TransferToken sends amount token units from the account of the signer.
+func (c *Chain) TransferToken(ctx context.Context, signer Signer, token *Token, to common.Address, amount *big.Int) (*types.Transaction, error) {
+	data, err := erc20ABI.Pack("transfer", to, amount)
+	if err != nil {
+		return nil, err
+	}
+	return c.SendTx(ctx, signer, token.Address, big.NewInt(0), data)
+}
+
+// TransferTokenFrom moves token units the account of the signer was approved to spend.
+func (c *Chain) TransferTokenFrom(ctx context.Context, signer Signer, token *Token, from, to common.Address, amount *big.Int) (*types.Transaction, error) {
+	data, err := erc20ABI.Pack("transferFrom", from, to, amount)
+	if err != nil {
+		return nil, err
+	}
+	return c.SendTx(ctx, signer, token.Address, big.NewInt(0), data)
+}
+
+type tokenTransfer struct {
+	From  common.Address
+	To    common.Address
+	Value *big.Int
+}
+
+func parseTransferLog(l types.Log) (*tokenTransfer, error) {
+	if len(l.Topics) != 3 || l.Topics[0] != transferEventID {
+		return nil, fmt.Errorf("log %s:%d is not an ERC-20 Transfer", l.TxHash.Hex(), l.Index)
+	}
+
+	values, err := erc20ABI.Unpack("Transfer", l.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenTransfer{
+		From:  common.BytesToAddress(l.Topics[1].Bytes()),
+		To:    common.BytesToAddress(l.Topics[2].Bytes()),
+		Value: abi.ConvertType(values[0], new(big.Int)).(*big.Int),
+	}, nil
+}
+
+// blocks a single poll asks the node for at once.
+const depositScanBlocks = 1000
+
+// DepositWatcher credits the ledger for every ETH transfer and token
+// Transfer into the address of a user once it has enough confirmations.
+type DepositWatcher struct {
+	chain         *Chain
+	ledger        *Ledger
+	tokens        []*Token
+	users         func() map[common.Address]int64
+	confirmations uint64
+	// the hot wallet, what it sends is gas for the deposit addresses.
+	gasFunder common.Address
+
+	// next block to scan. It's journaled with the deposits
+	// and written with the ledger lock held, snapshots have
+	// it together with the balances it credited.
+	nextBlock uint64
+}
+
+// NewDepositWatcher starts scanning at the start block,
+// unless the journal has it further already.
+func NewDepositWatcher(chain *Chain, ledger *Ledger, users func() map[common.Address]int64, confirmations, startBlock uint64) *DepositWatcher {
+	return &DepositWatcher{
+		chain:         chain,
+		ledger:        ledger,
+		users:         users,
+		confirmations: confirmations,
+		nextBlock:     startBlock,
+	}
+}
+
+// restore moves the watcher to where the journal or a snapshot says it was.
+func (dw *DepositWatcher) restore(nextBlock uint64) {
+	dw.nextBlock = max(dw.nextBlock, nextBlock)
+}
+
+func (dw *DepositWatcher) AddToken(token *Token) {
+	dw.tokens = append(dw.tokens, token)
+}
+
+// Poll scans the blocks that got enough confirmations since the last poll.
+func (dw *DepositWatcher) Poll(ctx context.Context) error {
+	head, err := dw.chain.Client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if head.Number.Uint64() < dw.confirmations {
+		return nil
+	}
+	toBlock := head.Number.Uint64() - dw.confirmations
+
+	for dw.nextBlock <= toBlock {
+		if err := dw.scan(ctx, dw.nextBlock, min(dw.nextBlock+depositScanBlocks-1, toBlock)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan credits the deposits of the blocks and moves past them in one go.
+func (dw *DepositWatcher) scan(ctx context.Context, fromBlock, toBlock uint64) error {
+	users := dw.users()
+	credits, err := dw.ethDeposits(ctx, fromBlock, toBlock, users)
+	if err != nil {
+		return err
+	}
+	tokenCredits, err := dw.tokenDeposits(ctx, fromBlock, toBlock, users)
+	if err != nil {
+		return err
+	}
+
+	return dw.commit(append(credits, tokenCredits...), toBlock+1)
+}
+
+// ethDeposits finds the transactions sending ETH straight to the address of a
+// user. ETH a contract sends with an internal call isn't in the transactions,
+// it's not credited.
+func (dw *DepositWatcher) ethDeposits(ctx context.Context, fromBlock, toBlock uint64, users map[common.Address]int64) ([]ledgerEntry, error) {
+	signer := types.LatestSignerForChainID(dw.chain.ChainID)
+
+	var credits []ledgerEntry
+	for n := fromBlock; n <= toBlock; n++ {
+		block, err := dw.chain.Client.BlockByNumber(ctx, new(big.Int).SetUint64(n))
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range block.Transactions() {
+			if tx.To() == nil || tx.Value().Sign() == 0 {
+				continue
+			}
+			userID, ok := users[*tx.To()]
+			if !ok {
+				continue
+			}
+			from, err := types.Sender(signer, tx)
+			if err != nil {
+				log.Printf("deposit tx %s: %s", tx.Hash().Hex(), err)
+				continue
+			}
+			// settlement moves ETH between users, it's already on the ledger.
+			if _, internal := users[from]; internal || from == dw.gasFunder {
+				continue
+			}
+			receipt, err := dw.chain.Client.TransactionReceipt(ctx, tx.Hash())
+			if err != nil {
+				return nil, err
+			}
+			if receipt.Status != types.ReceiptStatusSuccessful {
+				continue
+			}
+
+			amount := weiToEth(tx.Value())
+			credits = append(credits, ledgerEntry{Op: opCredit, UserID: userID, Asset: AssetETH, Amount: amount})
+			log.Printf("deposit of %.8f ETH for user %d in tx %s", amount, userID, tx.Hash().Hex())
+		}
+	}
+	return credits, nil
+}
+
+// tokenDeposits finds the Transfer events of the listed tokens into the address of a user.
+func (dw *DepositWatcher) tokenDeposits(ctx context.Context, fromBlock, toBlock uint64, users map[common.Address]int64) ([]ledgerEntry, error) {
+	if len(dw.tokens) == 0 {
+		return nil, nil
+	}
+	tokens := make(map[common.Address]*Token, len(dw.tokens))
+	addresses := make([]common.Address, len(dw.tokens))
+	for i, token := range dw.tokens {
+		tokens[token.Address] = token
+		addresses[i] = token.Address
+	}
+
+	logs, err := dw.chain.Client.FilterLogs(ctx, ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(fromBlock),
+		ToBlock:   new(big.Int).SetUint64(toBlock),
+		Addresses: addresses,
+		Topics:    [][]common.Hash{{transferEventID}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var credits []ledgerEntry
+	for _, l := range logs {
+		transfer, err := parseTransferLog(l)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		userID, ok := users[transfer.To]
+		if !ok {
+			continue
+		}
+		// settlement moves tokens between users, those are
+		// already on the ledger.
+		if _, internal := users[transfer.From]; internal {
+			continue
+		}
+
+		token := tokens[l.Address]
+		amount := token.FromUnits(transfer.Value)
+		credits = append(credits, ledgerEntry{Op: opCredit, UserID: userID, Asset: token.Asset, Amount: amount})
+
+		log.Printf("deposit of %.8f %s for user %d in tx %s", amount, token.Asset, userID, l.TxHash.Hex())
+	}
+	return credits, nil
+}
+
+// commit credits the deposits and moves the watcher to the next block,
+// a restart doesn't scan the blocks of deposits it credited again.
+func (dw *DepositWatcher) commit(credits []ledgerEntry, nextBlock uint64) error {
+	var record *journalEntry
+	// nothing to credit, scanning the blocks again after a restart is harmless.
+	if len(credits) > 0 {
+		record = &journalEntry{DepositBlock: nextBlock}
+	}
+	return dw.ledger.commitRecord(record, credits, func() { dw.nextBlock = nextBlock })
+}
+
+func (dw *DepositWatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := dw.Poll(ctx); err != nil {
+			log.Printf("deposit scan failed: %s", err)
+		}
+	}
+}
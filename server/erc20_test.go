@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestTokenUnits(t *testing.T) {
+	usdc := &Token{Asset: AssetUSDC, Decimals: 6}
+
+	assert(t, usdc.ToUnits(2500.5).String(), "2500500000")
+	assert(t, usdc.FromUnits(big.NewInt(1_250_000)), 1.25)
+	assert(t, usdc.ToUnits(0.0000001).String(), "0")
+}
+
+func TestParseTransferLog(t *testing.T) {
+	from := common.HexToAddress("0x71B4ef0D3632C6b4d9A4bEf27B8b0136DEF7EFa2")
+	to := common.HexToAddress("0xD89596A710328F6e2970e97Ad341293509ddAA03")
+	data, err := erc20ABI.Events["Transfer"].Inputs.NonIndexed().Pack(big.NewInt(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transfer, err := parseTransferLog(types.Log{
+		Topics: []common.Hash{
+			transferEventID,
+			common.BytesToHash(from.Bytes()),
+			common.BytesToHash(to.Bytes()),
+		},
+		Data: data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, transfer.From, from)
+	assert(t, transfer.To, to)
+	assert(t, transfer.Value, big.NewInt(42))
+
+	_, err = parseTransferLog(types.Log{Topics: []common.Hash{transferEventID}})
+	assert(t, err != nil, true)
+}
+
+func TestTransferCallData(t *testing.T) {
+	to := common.HexToAddress("0xD89596A710328F6e2970e97Ad341293509ddAA03")
+	data, err := erc20ABI.Pack("transfer", to, big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// transfer(address,uint256)
+	assert(t, common.Bytes2Hex(data[:4]), "a9059cbb")
+	assert(t, len(data), 4+32+32)
+}
+
+func TestDepositWatcherCreditsETH(t *testing.T) {
+	wallet := newTestWallet(t)
+	alice, bob := newTestUser(t, wallet, 1), newTestUser(t, wallet, 2)
+	// sends from outside the exchange.
+	outsider := newTestUser(t, wallet, 3)
+	hot := newTestUser(t, wallet, 0)
+	backend := newTestBackend(t, alice, bob, outsider, hot)
+	chain := newTestChain(t, backend)
+
+	ledger := NewLedger()
+	users := func() map[common.Address]int64 {
+		return map[common.Address]int64{alice.DepositAddress: alice.ID, bob.DepositAddress: bob.ID}
+	}
+	dw := NewDepositWatcher(chain, ledger, users, 1, 0)
+	dw.gasFunder = hot.DepositAddress
+
+	if _, err := transferETH(chain, testSigner(t, wallet, outsider), alice.DepositAddress, ethToWei(2)); err != nil {
+		t.Fatal(err)
+	}
+	// settlement, it's on the ledger already.
+	if _, err := transferETH(chain, testSigner(t, wallet, bob), alice.DepositAddress, ethToWei(1)); err != nil {
+		t.Fatal(err)
+	}
+	// gas the hot wallet pays, not a deposit.
+	if _, err := transferETH(chain, testSigner(t, wallet, hot), alice.DepositAddress, ethToWei(1)); err != nil {
+		t.Fatal(err)
+	}
+	backend.Commit()
+
+	ctx := context.Background()
+	if err := dw.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// not confirmed yet.
+	assert(t, ledger.Balance(alice.ID, AssetETH), Balance{})
+
+	backend.Commit()
+	for i := 0; i < 2; i++ {
+		if err := dw.Poll(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert(t, ledger.Balance(alice.ID, AssetETH), Balance{Available: 2})
+	assert(t, ledger.Balance(bob.ID, AssetETH), Balance{})
+}
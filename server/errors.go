@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ukibbb/crypto-exchange/orderbook"
+)
+
+// ErrorCode tells a client what went wrong without parsing the message.
+type ErrorCode string
+
+const (
+	CodeBadRequest            ErrorCode = "BAD_REQUEST"
+	CodeUnauthorized          ErrorCode = "UNAUTHORIZED"
+	CodeForbidden             ErrorCode = "FORBIDDEN"
+	CodeNotFound              ErrorCode = "NOT_FOUND"
+	CodeOrderNotFound         ErrorCode = "ORDER_NOT_FOUND"
+	CodeMarketNotFound        ErrorCode = "MARKET_NOT_FOUND"
+	CodeOrderNotOpen          ErrorCode = "ORDER_NOT_OPEN"
+	CodeUserNotFound          ErrorCode = "USER_NOT_FOUND"
+	CodeInsufficientBalance   ErrorCode = "INSUFFICIENT_BALANCE"
+	CodeInsufficientLiquidity ErrorCode = "INSUFFICIENT_LIQUIDITY"
+	CodeInvalidPrice          ErrorCode = "INVALID_PRICE"
+	CodeInvalidSize           ErrorCode = "INVALID_SIZE"
+	CodeMarketClosed          ErrorCode = "MARKET_CLOSED"
+	CodeRateLimited           ErrorCode = "RATE_LIMITED"
+	CodeUnavailable           ErrorCode = "UNAVAILABLE"
+	CodeInternal              ErrorCode = "INTERNAL"
+)
+
+// APIError is the body of every error response:
+//
+//	{"code": "ORDER_NOT_FOUND", "message": "order not found [42]", "details": {"orderID": 42}}
+type APIError struct {
+	Status  int            `json:"-"`
+	Code    ErrorCode      `json:"code"`
+	Message string         `json:"message"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// Is matches any error with the same code, errors.Is(err, ErrOrderNotFound)
+// holds whatever the message and details of err are.
+func (e *APIError) Is(target error) bool {
+	t, ok := target.(*APIError)
+	return ok && t.Code == e.Code
+}
+
+// WithMessage returns a copy of the error with another message.
+func (e *APIError) WithMessage(format string, args ...any) *APIError {
+	cp := *e
+	cp.Message = fmt.Sprintf(format, args...)
+	return &cp
+}
+
+// WithDetail returns a copy of the error with the detail added.
+func (e *APIError) WithDetail(key string, value any) *APIError {
+	cp := *e
+	cp.Details = make(map[string]any, len(e.Details)+1)
+	for k, v := range e.Details {
+		cp.Details[k] = v
+	}
+	cp.Details[key] = value
+	return &cp
+}
+
+func newAPIError(status int, code ErrorCode, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+var (
+	ErrBadRequest            = newAPIError(http.StatusBadRequest, CodeBadRequest, "bad request")
+	ErrUnauthorized          = newAPIError(http.StatusUnauthorized, CodeUnauthorized, "unauthorized")
+	ErrForbidden             = newAPIError(http.StatusForbidden, CodeForbidden, "forbidden")
+	ErrNotFound              = newAPIError(http.StatusNotFound, CodeNotFound, "not found")
+	ErrOrderNotFound         = newAPIError(http.StatusNotFound, CodeOrderNotFound, "order not found")
+	ErrOrderNotOpen          = newAPIError(http.StatusConflict, CodeOrderNotOpen, "order is not open")
+	ErrMarketNotFound        = newAPIError(http.StatusNotFound, CodeMarketNotFound, "market not found")
+	ErrUserNotFound          = newAPIError(http.StatusNotFound, CodeUserNotFound, "user not found")
+	ErrInsufficientBalance   = newAPIError(http.StatusBadRequest, CodeInsufficientBalance, "insufficient balance")
+	ErrInsufficientLiquidity = newAPIError(http.StatusBadRequest, CodeInsufficientLiquidity, "not enough volume in the book")
+	ErrInvalidPrice          = newAPIError(http.StatusBadRequest, CodeInvalidPrice, "invalid price")
+	ErrInvalidSize           = newAPIError(http.StatusBadRequest, CodeInvalidSize, "invalid size")
+	ErrMarketClosed          = newAPIError(http.StatusConflict, CodeMarketClosed, "market is closed")
+	ErrRateLimited           = newAPIError(http.StatusTooManyRequests, CodeRateLimited, "rate limit exceeded")
+	ErrUnavailable           = newAPIError(http.StatusServiceUnavailable, CodeUnavailable, "exchange is shutting down")
+	ErrInternal              = newAPIError(http.StatusInternalServerError, CodeInternal, "internal error")
+
+	errNotYourAccount = ErrForbidden.WithMessage("not your account")
+)
+
+// knownError turns the errors of the books and the ledger
+// into api errors, it's nil for any other error.
+func knownError(err error) *APIError {
+	var (
+		apiErr     *APIError
+		balanceErr *InsufficientBalanceError
+	)
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.As(err, &balanceErr):
+		return ErrInsufficientBalance.WithMessage("%s", err).
+			WithDetail("asset", balanceErr.Asset).
+			WithDetail("available", balanceErr.Available).
+			WithDetail("requested", balanceErr.Requested)
+	case errors.Is(err, orderbook.ErrOrderNotFound):
+		return ErrOrderNotFound.WithMessage("%s", err)
+	case errors.Is(err, orderbook.ErrInvalidPrice):
+		return ErrInvalidPrice.WithMessage("%s", err)
+	case errors.Is(err, orderbook.ErrInvalidSize):
+		return ErrInvalidSize.WithMessage("%s", err)
+	case errors.Is(err, orderbook.ErrNotEnoughVolume):
+		return ErrInsufficientLiquidity.WithMessage("%s", err)
+	case errors.Is(err, orderbook.ErrOrderExists):
+		return ErrBadRequest.WithMessage("%s", err)
+	}
+	return nil
+}
+
+// badRequest blames the client for err, unless it's one of the known errors.
+func badRequest(err error) *APIError {
+	if apiErr := knownError(err); apiErr != nil {
+		return apiErr
+	}
+	return ErrBadRequest.WithMessage("%s", err)
+}
+
+// httpErrorHandler writes every error a handler returns as an APIError.
+// Errors nothing knows about are logged and don't leak to the client.
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	apiErr := knownError(err)
+	var httpErr *echo.HTTPError
+	if apiErr == nil && errors.As(err, &httpErr) {
+		apiErr = fromHTTPError(httpErr)
+	}
+	if apiErr == nil {
+		log.Printf("%s %s: %s", c.Request().Method, c.Request().URL.Path, err)
+		apiErr = ErrInternal
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(apiErr.Status)
+	} else {
+		err = c.JSON(apiErr.Status, apiErr)
+	}
+	if err != nil {
+		log.Printf("writing error response: %s", err)
+	}
+}
+
+// fromHTTPError covers the errors of echo itself, unknown routes and such.
+func fromHTTPError(httpErr *echo.HTTPError) *APIError {
+	code := CodeBadRequest
+	switch httpErr.Code {
+	case http.StatusUnauthorized:
+		code = CodeUnauthorized
+	case http.StatusForbidden:
+		code = CodeForbidden
+	case http.StatusNotFound:
+		code = CodeNotFound
+	case http.StatusTooManyRequests:
+		code = CodeRateLimited
+	case http.StatusServiceUnavailable:
+		code = CodeUnavailable
+	}
+	if httpErr.Code >= http.StatusInternalServerError && code == CodeBadRequest {
+		code = CodeInternal
+	}
+	return newAPIError(httpErr.Code, code, fmt.Sprint(httpErr.Message))
+}
+
+// decodeBody reads the JSON body of the request into v.
+func decodeBody(c echo.Context, v any) error {
+	if err := json.NewDecoder(c.Request().Body).Decode(v); err != nil {
+		return ErrBadRequest.WithMessage("invalid request body: %s", err)
+	}
+	return nil
+}
+
+// idParam parses the path parameter as an id.
+func idParam(c echo.Context, name string) (int64, error) {
+	id, err := strconv.ParseInt(c.Param(name), 10, 64)
+	if err != nil {
+		return 0, ErrBadRequest.WithMessage("invalid %s [%s]", name, c.Param(name))
+	}
+	return id, nil
+}
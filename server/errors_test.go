@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ukibbb/crypto-exchange/orderbook"
+)
+
+func TestErrorResponses(t *testing.T) {
+	ex := newTestExchange(t, "")
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	e.GET("/boom", func(c echo.Context) error { return errors.New("secret database password") })
+
+	user, _ := ex.Users.Add(&User{})
+	key, _ := ex.APIKeys.Create(user.ID, PermRead, PermTrade)
+	serve := func(req *http.Request) (int, *APIError) {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		apiErr := &APIError{}
+		if err := json.Unmarshal(rec.Body.Bytes(), apiErr); err != nil {
+			t.Fatalf("%s: %s", rec.Body, err)
+		}
+		return rec.Code, apiErr
+	}
+
+	code, apiErr := serve(signedRequest(key, http.MethodDelete, "/order/abc", "", time.Now()))
+	assert(t, code, http.StatusBadRequest)
+	assert(t, apiErr.Code, CodeBadRequest)
+
+	code, apiErr = serve(signedRequest(key, http.MethodDelete, "/order/42", "", time.Now()))
+	assert(t, code, http.StatusNotFound)
+	assert(t, apiErr.Code, CodeOrderNotFound)
+	assert(t, apiErr.Details["orderID"], float64(42))
+
+	order := `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":1,"Price":2000}`
+	code, apiErr = serve(signedRequest(key, http.MethodPost, "/order", order, time.Now()))
+	assert(t, code, http.StatusBadRequest)
+	assert(t, apiErr.Code, CodeInsufficientBalance)
+	assert(t, apiErr.Details["requested"], float64(2000))
+
+	code, apiErr = serve(httptest.NewRequest(http.MethodGet, "/book/DOGE", nil))
+	assert(t, code, http.StatusNotFound)
+	assert(t, apiErr.Code, CodeMarketNotFound)
+
+	code, apiErr = serve(httptest.NewRequest(http.MethodGet, "/nope", nil))
+	assert(t, code, http.StatusNotFound)
+	assert(t, apiErr.Code, CodeNotFound)
+
+	// the details of unknown errors stay in the log.
+	code, apiErr = serve(httptest.NewRequest(http.MethodGet, "/boom", nil))
+	assert(t, code, http.StatusInternalServerError)
+	assert(t, *apiErr, APIError{Code: CodeInternal, Message: "internal error"})
+}
+
+func TestKnownErrors(t *testing.T) {
+	ob := orderbook.NewOrderBook()
+	err := ob.Check(orderbook.Command{Type: orderbook.CmdPlaceLimit, OrderID: 1, Size: 1, Price: -1})
+	assert(t, errors.Is(badRequest(err), ErrInvalidPrice), true)
+
+	err = ob.Check(orderbook.Command{Type: orderbook.CmdCancel, OrderID: 7})
+	assert(t, errors.Is(badRequest(fmt.Errorf("cancel: %w", err)), ErrOrderNotFound), true)
+
+	err = ob.Check(orderbook.Command{Type: orderbook.CmdPlaceMarket, OrderID: 1, Size: 1})
+	assert(t, badRequest(err).Code, CodeInsufficientLiquidity)
+
+	// the exchange checks the volume before the book does.
+	ex := newTestExchange(t, "")
+	_, err = ex.lockMarketOrder(MarketETH, &orderbook.Order{UserID: 1, Bid: true, Size: 1})
+	assert(t, badRequest(err).Code, CodeInsufficientLiquidity)
+
+	assert(t, badRequest(errors.New("something else")).Code, CodeBadRequest)
+}
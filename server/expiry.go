@@ -0,0 +1,162 @@
+package server
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/ukibbb/crypto-exchange/orderbook"
+)
+
+const (
+	// the default, the order stays until it's filled or cancelled.
+	GoodTillCancel TimeInForce = "GTC"
+	// expires at the ExpiresAt of the order.
+	GoodTillDate TimeInForce = "GTD"
+	// expires at the end of the trading day.
+	DayOrder TimeInForce = "DAY"
+)
+
+type TimeInForce string
+
+// the scheduler looks again this often with nothing to expire,
+// it's woken up when an order expiring sooner comes in.
+const expiryIdle = time.Hour
+
+type expiryEntry struct {
+	at     int64
+	market Market
+	id     int64
+}
+
+// expiryQueue is a min heap of the orders to expire, the
+// ones that expire first first and by id when they expire together.
+// Cancelled and filled orders are left in it, expiring them fails.
+type expiryQueue []expiryEntry
+
+func (q expiryQueue) Len() int { return len(q) }
+func (q expiryQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].id < q[j].id
+}
+func (q expiryQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x any)   { *q = append(*q, x.(expiryEntry)) }
+func (q *expiryQueue) Pop() any {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return entry
+}
+
+// orderExpiry is when the order of the request expires in unix nanoseconds, 0 for never.
+func (ex *Exchange) orderExpiry(req *PlaceOrderRequest, now time.Time) (int64, error) {
+	if req.Type == MarketOrder && req.TimeInForce != "" && req.TimeInForce != GoodTillCancel {
+		return 0, ErrBadRequest.WithMessage("market orders can't be %s", req.TimeInForce)
+	}
+	if req.ExpiresAt != 0 && req.TimeInForce != GoodTillDate {
+		return 0, ErrBadRequest.WithMessage("only GTD orders take an expiry")
+	}
+
+	switch req.TimeInForce {
+	case "", GoodTillCancel:
+		return 0, nil
+	case GoodTillDate:
+		if req.ExpiresAt <= now.UnixMilli() {
+			return 0, ErrBadRequest.WithMessage("expiry [%d] has to be in the future", req.ExpiresAt).WithDetail("expiresAt", req.ExpiresAt)
+		}
+		return time.UnixMilli(req.ExpiresAt).UnixNano(), nil
+	case DayOrder:
+		return ex.dayEnd(now).UnixNano(), nil
+	}
+	return 0, ErrBadRequest.WithMessage("unknown time in force [%s]", req.TimeInForce)
+}
+
+// dayEnd is the next end of the trading day after now.
+func (ex *Exchange) dayEnd(now time.Time) time.Time {
+	now = now.UTC()
+	end := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Add(ex.dayEndOffset)
+	if !end.After(now) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
+// scheduleExpiry has to be called with bookMu held.
+func (ex *Exchange) scheduleExpiry(market Market, o *orderbook.Order) {
+	heap.Push(&ex.expiries, expiryEntry{at: o.ExpiresAt, market: market, id: o.ID})
+	if ex.expiries[0].id == o.ID {
+		select {
+		case ex.expiryWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// expireDue takes the orders that expired by now out of their books and
+// releases their funds, it returns them as they were at the end.
+// It has to be called with bookMu held.
+func (ex *Exchange) expireDue(now int64) []OrderState {
+	var expired []OrderState
+	for len(ex.expiries) > 0 && ex.expiries[0].at <= now {
+		entry := heap.Pop(&ex.expiries).(expiryEntry)
+		var price float64
+		if o, ok := ex.orderBooks[entry.market].Orders[entry.id]; ok && o.Limit != nil {
+			price = o.Limit.Price
+		}
+		o, _, err := ex.executeLocked(entry.market, orderbook.Command{Type: orderbook.CmdExpire, OrderID: entry.id, Timestamp: now})
+		if errors.Is(err, orderbook.ErrOrderNotFound) {
+			// filled or cancelled before it expired.
+			continue
+		}
+		if err != nil {
+			log.Printf("expiring order %d: %s", entry.id, err)
+			continue
+		}
+
+		ex.mu.Lock()
+		info, ok := ex.orderIndex[o.ID]
+		if !ok {
+			info = &orderInfo{Market: entry.market, UserID: o.UserID, Bid: o.Bid, Price: price, Size: o.Size, ExpiresAt: o.ExpiresAt}
+		}
+		ex.releaseOrder(info.Market, info.Price, o)
+		ex.cancelled(info, o)
+		info.expired = true
+		ex.mu.Unlock()
+
+		expired = append(expired, ex.orderState(o.ID, info))
+	}
+	return expired
+}
+
+// RunExpiry expires the GTD and day orders on time until the context is done.
+// The users find out through their websocket sessions.
+func (ex *Exchange) RunExpiry(ctx context.Context) {
+	for {
+		ex.bookMu.Lock()
+		expired := ex.expireDue(time.Now().UnixNano())
+		wait := expiryIdle
+		if len(ex.expiries) > 0 {
+			wait = time.Until(time.Unix(0, ex.expiries[0].at))
+		}
+		ex.unlockBooks()
+
+		for i := range expired {
+			log.Printf("order %d of user %d expired", expired[i].ID, expired[i].UserID)
+			ex.sessions.send(expired[i].UserID, &SessionMessage{Type: MsgExpired, Order: &expired[i]})
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-ex.expiryWake:
+			timer.Stop()
+		}
+	}
+}
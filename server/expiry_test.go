@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+func TestDayEnd(t *testing.T) {
+	ex := NewExchange(nil, nil, nil, nil, ExchangeConfig{DayEnd: 22 * time.Hour})
+	before := time.Date(2024, 3, 1, 21, 0, 0, 0, time.UTC)
+	assert(t, ex.dayEnd(before), time.Date(2024, 3, 1, 22, 0, 0, 0, time.UTC))
+	// at the end of the day is the next day already.
+	assert(t, ex.dayEnd(before.Add(time.Hour)), time.Date(2024, 3, 2, 22, 0, 0, 0, time.UTC))
+}
+
+func TestExpireOrders(t *testing.T) {
+	dir := t.TempDir()
+	ex := newTestExchange(t, dir)
+	// the day ends well after the GTD order, whatever time it is.
+	ex.dayEndOffset = time.Now().UTC().Add(3*time.Hour).Sub(time.Now().UTC().Truncate(24*time.Hour)) % (24 * time.Hour)
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+
+	alice, _ := ex.Users.Add(&User{})
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermTrade)
+	ex.Ledger.Credit(alice.ID, AssetUSD, 1000)
+
+	place := func(extra string, out any) int {
+		return serve(aliceKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":1,"Price":100`+extra+`}`, out)
+	}
+	expiresAt := time.Now().Add(time.Hour).UnixMilli()
+	apiErr := &APIError{}
+	assert(t, place(`,"TimeInForce":"GTD","ExpiresAt":1`, apiErr), http.StatusBadRequest)
+	assert(t, place(`,"ExpiresAt":`+strconv.FormatInt(expiresAt, 10), apiErr), http.StatusBadRequest)
+	assert(t, place(`,"TimeInForce":"IOC"`, apiErr), http.StatusBadRequest)
+	assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"MARKET","Market":"ETH","Size":1,"TimeInForce":"DAY"}`, apiErr), http.StatusBadRequest)
+
+	gtd, day := &PlaceOrderResponse{}, &PlaceOrderResponse{}
+	assert(t, place(`,"TimeInForce":"GTD","ExpiresAt":`+strconv.FormatInt(expiresAt, 10), gtd), http.StatusOK)
+	assert(t, place(`,"TimeInForce":"DAY"`, day), http.StatusOK)
+	assert(t, place(``, nil), http.StatusOK)
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 700, Locked: 300})
+
+	ex.bookMu.Lock()
+	assert(t, len(ex.expiries), 2)
+	assert(t, len(ex.expireDue(time.Now().UnixNano())), 0)
+	expired := ex.expireDue(time.UnixMilli(expiresAt).UnixNano())
+	ex.bookMu.Unlock()
+	assert(t, len(expired), 1)
+	assert(t, expired[0].ID, gtd.OrderID)
+	assert(t, expired[0].Status, OrderExpired)
+	assert(t, expired[0].ExpiresAt, expiresAt)
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 800, Locked: 200})
+
+	assert(t, serve(aliceKey, http.MethodDelete, "/order/"+itoa(gtd.OrderID), "", apiErr), http.StatusConflict)
+	assert(t, apiErr.Details["status"], string(OrderExpired))
+	ex.Journal.Close()
+
+	// the expiry is journaled and the day order is scheduled again.
+	recovered := newTestExchange(t, dir)
+	if err := recovered.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	_, ok := recovered.orderBooks[MarketETH].Orders[gtd.OrderID]
+	assert(t, ok, false)
+	assert(t, len(recovered.expiries), 1)
+	assert(t, recovered.expiries[0].id, day.OrderID)
+}
+
+func TestRunExpiry(t *testing.T) {
+	ex := newTestExchange(t, "")
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ex.RunExpiry(ctx)
+
+	alice, _ := ex.Users.Add(&User{})
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermTrade)
+	ex.Ledger.Credit(alice.ID, AssetUSD, 1000)
+
+	req := signedRequest(aliceKey, http.MethodGet, "/ws", "", time.Now())
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", req.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the scheduler is asleep, the order wakes it up.
+	expiresAt := time.Now().Add(50 * time.Millisecond).UnixMilli()
+	placed := &PlaceOrderResponse{}
+	body := `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":1,"Price":100,"TimeInForce":"GTD","ExpiresAt":` + strconv.FormatInt(expiresAt, 10) + `}`
+	assert(t, serve(aliceKey, http.MethodPost, "/order", body, placed), http.StatusOK)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	msg := &SessionMessage{}
+	if err := conn.ReadJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, msg.Type, MsgExpired)
+	assert(t, msg.Order.ID, placed.OrderID)
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 1000})
+}
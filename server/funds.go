@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/ukibbb/crypto-exchange/orderbook"
+)
+
+// FeeAccountID is the account the trading fees are credited to,
+// the settler pays them to the hot wallet.
+const FeeAccountID int64 = 0
+
+// TradingFees are the rates of what a side gets out of a trade it pays,
+// 0.001 is 0.1%. The taker is the market order, makers rested in the book.
+// Both sides of an auction are makers.
+type TradingFees struct {
+	Maker float64 `json:",omitempty"`
+	Taker float64 `json:",omitempty"`
+}
+
+// of is what the buyer pays of the base and the seller of the quote they got,
+// takerID is the order that took the liquidity, 0 when both rested.
+func (f TradingFees) of(match orderbook.Match, takerID int64) (float64, float64) {
+	buyerRate, sellerRate := f.Maker, f.Maker
+	if takerID != 0 && match.Bid.ID == takerID {
+		buyerRate = f.Taker
+	}
+	if takerID != 0 && match.Ask.ID == takerID {
+		sellerRate = f.Taker
+	}
+	return match.SizeFilled * buyerRate, match.SizeFilled * match.Price * sellerRate
+}
+
+// proceeds credits both sides of the match what they got, less their
+// fees, and the fees to the fee account.
+func proceeds(assets MarketAssets, match orderbook.Match, fees TradingFees, takerID int64) []ledgerEntry {
+	buyerFee, sellerFee := fees.of(match, takerID)
+	entries := []ledgerEntry{
+		{Op: opCredit, UserID: match.Bid.UserID, Asset: assets.Base, Amount: match.SizeFilled - buyerFee},
+		{Op: opCredit, UserID: match.Ask.UserID, Asset: assets.Quote, Amount: match.SizeFilled*match.Price - sellerFee},
+	}
+	if buyerFee > 0 {
+		entries = append(entries, ledgerEntry{Op: opCredit, UserID: FeeAccountID, Asset: assets.Base, Amount: buyerFee})
+	}
+	if sellerFee > 0 {
+		entries = append(entries, ledgerEntry{Op: opCredit, UserID: FeeAccountID, Asset: assets.Quote, Amount: sellerFee})
+	}
+	return entries
+}
+
+// Funds backing a limit order are locked when it's placed.
+// Bids lock size * price of the quote asset, asks lock size of the base asset.
+func reservation(assets MarketAssets, price float64, o *orderbook.Order) (Asset, float64) {
+	if o.Bid {
+		return assets.Quote, o.Size * price
+	}
+	return assets.Base, o.Size
+}
+
+func (ex *Exchange) reserveLimitOrder(market Market, price float64, o *orderbook.Order) error {
+	asset, amount := reservation(ex.markets[market], price, o)
+	return ex.Ledger.Lock(o.UserID, asset, amount)
+}
+
+// releaseOrder unlocks whatever is still reserved for the unfilled part of the order.
+func (ex *Exchange) releaseOrder(market Market, price float64, o *orderbook.Order) {
+	asset, amount := reservation(ex.markets[market], price, o)
+	if err := ex.Ledger.Unlock(o.UserID, asset, amount); err != nil {
+		log.Printf("releasing order %d: %s", o.ID, err)
+	}
+}
+
+// marketOrderCost walks the book the way the market order will and
+// returns what the taker pays for all of it.
+func (ex *Exchange) marketOrderCost(market Market, o *orderbook.Order) (Asset, float64, error) {
+	ob := ex.orderBooks[market]
+	assets := ex.markets[market]
+
+	if !o.Bid {
+		if o.Size > ob.BidTotalVolume() {
+			return "", 0, fmt.Errorf("%w [%.2f] for market order [%.2f]", orderbook.ErrNotEnoughVolume, ob.BidTotalVolume(), o.Size)
+		}
+		return assets.Base, o.Size, nil
+	}
+
+	if o.Size > ob.AskTotalVolume() {
+		return "", 0, fmt.Errorf("%w [%.2f] for market order [%.2f]", orderbook.ErrNotEnoughVolume, ob.AskTotalVolume(), o.Size)
+	}
+	cost, left := 0.0, o.Size
+	for _, limit := range ob.Asks() {
+		size := min(left, limit.TotalVolume)
+		cost += size * limit.Price
+		left -= size
+		if left <= 0 {
+			break
+		}
+	}
+	return assets.Quote, cost, nil
+}
+
+// lockMarketOrder locks what the market order pays before it's journaled,
+// nothing else takes the funds before its trades move them and those can't
+// fail after the append. It returns the amount it locked.
+func (ex *Exchange) lockMarketOrder(market Market, o *orderbook.Order) (float64, error) {
+	asset, cost, err := ex.marketOrderCost(market, o)
+	if err != nil {
+		return 0, err
+	}
+	if err := ex.Ledger.Lock(o.UserID, asset, cost); err != nil {
+		return 0, err
+	}
+	return cost, nil
+}
+
+// releaseMarketOrder unlocks what lockMarketOrder locked when the order didn't go in.
+func (ex *Exchange) releaseMarketOrder(market Market, o *orderbook.Order, locked float64) {
+	asset := ex.markets[market].Base
+	if o.Bid {
+		asset = ex.markets[market].Quote
+	}
+	if err := ex.Ledger.Unlock(o.UserID, asset, locked); err != nil {
+		log.Printf("releasing market order %d: %s", o.ID, err)
+	}
+}
+
+// applyMatches moves the funds between buyer and seller on the ledger.
+// Both sides pay from their locked funds, the resting one from what its
+// order reserved, the taker from what lockMarketOrder locked. What's left
+// of that is unlocked. Both pay their fee out of what they get.
+func (ex *Exchange) applyMatches(market Market, taker *orderbook.Order, matches []orderbook.Match, locked float64) error {
+	assets := ex.markets[market]
+
+	var entries []ledgerEntry
+	for _, match := range matches {
+		quoteAmount := match.SizeFilled * match.Price
+		if match.Bid == taker {
+			locked -= quoteAmount
+		} else {
+			locked -= match.SizeFilled
+		}
+		entries = append(entries,
+			ledgerEntry{Op: opDebitLocked, UserID: match.Bid.UserID, Asset: assets.Quote, Amount: quoteAmount},
+			ledgerEntry{Op: opDebitLocked, UserID: match.Ask.UserID, Asset: assets.Base, Amount: match.SizeFilled},
+		)
+		entries = append(entries, proceeds(assets, match, ex.tradingFees, taker.ID)...)
+	}
+	if locked > lockedDust {
+		asset := assets.Base
+		if taker.Bid {
+			asset = assets.Quote
+		}
+		entries = append(entries, ledgerEntry{Op: opUnlock, UserID: taker.UserID, Asset: asset, Amount: locked})
+	}
+
+	return ex.Ledger.transfer(entries)
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/ukibbb/crypto-exchange/orderbook"
+)
+
+// journalEntry is a single record of the journal, a command of a book
+// or changes of balances that don't come from trades.
+type journalEntry struct {
+	Market  Market             `json:",omitempty"`
+	Command *orderbook.Command `json:",omitempty"`
+	Ledger  []ledgerEntry      `json:",omitempty"`
+	// the deposit watcher scanned the blocks before it for the deposits of the record.
+	DepositBlock uint64 `json:",omitempty"`
+	// a withdrawal as it is after the record.
+	Withdrawal *withdrawalRecord `json:",omitempty"`
+	// the fees of the trades of the command, they can change between restarts.
+	Fees *TradingFees `json:",omitempty"`
+	// a batch of the settler or its transfers as they are after the record.
+	Settlement *settlementRecord `json:",omitempty"`
+	// a stop or a link as it is after the record.
+	Stop *stopRecord `json:",omitempty"`
+	Link *linkRecord `json:",omitempty"`
+}
+
+// execute checks the command, writes it to the journal and only then
+// applies it to the book. Commands go through one at a time so the
+// journal sees them in the order the books do.
+func (ex *Exchange) execute(market Market, cmd orderbook.Command) (*orderbook.Order, []orderbook.Match, error) {
+	ex.bookMu.Lock()
+	defer ex.unlockBooks()
+	return ex.executeLocked(market, cmd)
+}
+
+// executeLocked is execute for callers that hold bookMu, so that
+// what they do around the command happens in the same turn.
+func (ex *Exchange) executeLocked(market Market, cmd orderbook.Command) (*orderbook.Order, []orderbook.Match, error) {
+	ob, ok := ex.orderBooks[market]
+	if !ok {
+		return nil, nil, fmt.Errorf("market %s not found", market)
+	}
+	if err := ob.Check(cmd); err != nil {
+		return nil, nil, err
+	}
+
+	if ex.Journal != nil {
+		entry := &journalEntry{Market: market, Command: &cmd}
+		if trades(cmd.Type) && ex.tradingFees != (TradingFees{}) {
+			fees := ex.tradingFees
+			entry.Fees = &fees
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		seq, err := ex.Journal.Append(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("journaling %s order %d: %w", cmd.Type, cmd.OrderID, err)
+		}
+		cmd.Seq = seq
+	}
+
+	o, matches, err := ob.Apply(cmd)
+	if err == nil {
+		ex.settlePegs(market)
+	}
+	return o, matches, err
+}
+
+// journalLedger is the journal of the ledger.
+func (ex *Exchange) journalLedger(record *journalEntry) error {
+	if ex.Journal == nil {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := ex.Journal.Append(data); err != nil {
+		return fmt.Errorf("journaling %d ledger entries: %w", len(record.Ledger), err)
+	}
+	return nil
+}
+
+// Recover rebuilds the books and the balances from the latest snapshot and
+// replays the journal written after it, it has to run before the server takes
+// any orders. The trades of the replayed commands move the funds again and go
+// back to the settler, which re-queues what wasn't settled on chain.
+func (ex *Exchange) Recover() error {
+	ex.bookMu.Lock()
+	defer ex.bookMu.Unlock()
+
+	var snapshotSeq uint64
+	if ex.SnapshotDir != "" {
+		seq, err := ex.loadSnapshot()
+		if err != nil {
+			return err
+		}
+		snapshotSeq = seq
+	}
+	if ex.Journal == nil {
+		ex.rebuildOrders()
+		ex.reconcileLocked()
+		ex.Settler.resume()
+		return nil
+	}
+
+	from := snapshotSeq + 1
+	var replayed int
+	err := ex.Journal.Replay(from, func(seq uint64, data []byte) error {
+		// the segment with the first record after the snapshot was deleted.
+		if replayed == 0 && seq != from {
+			return fmt.Errorf("journal starts at record %d, the snapshot needs %d", seq, from)
+		}
+		replayed++
+
+		var entry journalEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("journal record %d: %w", seq, err)
+		}
+		if entry.Command == nil {
+			ex.Ledger.replay(entry.Ledger)
+			ex.Deposits.restore(entry.DepositBlock)
+			if entry.Withdrawal != nil {
+				ex.Withdrawals.restore(entry.Withdrawal)
+			}
+			if entry.Settlement != nil {
+				ex.Settler.restore(entry.Settlement)
+			}
+			if entry.Stop != nil {
+				ex.restoreStop(entry.Stop)
+			}
+			if entry.Link != nil {
+				ex.restoreLink(entry.Link)
+			}
+			return nil
+		}
+		ob, ok := ex.orderBooks[entry.Market]
+		if !ok {
+			return fmt.Errorf("journal record %d: market %s not found", seq, entry.Market)
+		}
+		if seq <= ob.Seq {
+			return nil
+		}
+		entry.Command.Seq = seq
+		ex.lastOrderID = max(ex.lastOrderID, entry.Command.OrderID)
+		// only commands that passed the check were written.
+		_, matches, err := ob.Apply(*entry.Command)
+		if err != nil {
+			return fmt.Errorf("journal record %d: %w", seq, err)
+		}
+		var fees TradingFees
+		if entry.Fees != nil {
+			fees = *entry.Fees
+		}
+		ex.Ledger.replay(ex.tradeEntries(entry.Market, *entry.Command, matches, fees))
+		if len(matches) > 0 {
+			ex.Settler.Add(entry.Market, ex.markets[entry.Market], matches, fees, takerID(*entry.Command))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ex.rebuildOrders()
+	ex.reconcileLocked()
+	ex.Settler.resume()
+	log.Printf("recovered the books from %d journal records after record %d", replayed, snapshotSeq)
+
+	return nil
+}
+
+// rebuildOrders indexes the resting orders of all books by user and by id.
+func (ex *Exchange) rebuildOrders() {
+	orders := make(map[int64][]*orderbook.Order)
+	index := make(map[int64]*orderInfo)
+	for market, ob := range ex.orderBooks {
+		for _, o := range ob.Orders {
+			// snapshots from before they had the last id.
+			ex.lastOrderID = max(ex.lastOrderID, o.ID)
+			if o.Limit != nil {
+				orders[o.UserID] = append(orders[o.UserID], o)
+				index[o.ID] = &orderInfo{Market: market, UserID: o.UserID, Bid: o.Bid, Price: o.Limit.Price, Size: o.Size, ExpiresAt: o.ExpiresAt}
+			}
+		}
+	}
+	// bookMu is held, the scheduler can't look at them yet.
+	ex.expiries = ex.expiries[:0]
+	for market, ob := range ex.orderBooks {
+		for _, o := range ob.Expiring() {
+			ex.expiries = append(ex.expiries, expiryEntry{at: o.ExpiresAt, market: market, id: o.ID})
+		}
+	}
+	heap.Init(&ex.expiries)
+	for _, userOrders := range orders {
+		sort.Slice(userOrders, func(i, j int) bool { return userOrders[i].Timestamp < userOrders[j].Timestamp })
+	}
+
+	ex.mu.Lock()
+	ex.Orders = orders
+	ex.orderIndex = index
+	ex.mu.Unlock()
+}
+
+// trades reports whether commands of the type can trade.
+func trades(t orderbook.CommandType) bool {
+	return t == orderbook.CmdPlaceMarket || t == orderbook.CmdUncross
+}
+
+// tradeEntries is what the matches of the command change of the balances,
+// whoever paid from their locked funds.
+func (ex *Exchange) tradeEntries(market Market, cmd orderbook.Command, matches []orderbook.Match, fees TradingFees) []ledgerEntry {
+	assets := ex.markets[market]
+
+	var entries []ledgerEntry
+	for _, match := range matches {
+		quoteAmount := match.SizeFilled * match.Price
+		entries = append(entries,
+			ledgerEntry{Op: opDebit, UserID: match.Bid.UserID, Asset: assets.Quote, Amount: quoteAmount},
+			ledgerEntry{Op: opDebit, UserID: match.Ask.UserID, Asset: assets.Base, Amount: match.SizeFilled},
+		)
+		entries = append(entries, proceeds(assets, match, fees, takerID(cmd))...)
+	}
+	return entries
+}
+
+// takerID is the order of the command that takes liquidity,
+// both sides of an uncross rested.
+func takerID(cmd orderbook.Command) int64 {
+	if cmd.Type == orderbook.CmdPlaceMarket {
+		return cmd.OrderID
+	}
+	return 0
+}
+
+// reconcileLocked locks what the resting orders and the withdrawals not done
+// yet reserve, the rest of what the users have is available. Replayed
+// balances only know the totals.
+func (ex *Exchange) reconcileLocked() {
+	reserved := ex.Withdrawals.locked()
+	for market, ob := range ex.orderBooks {
+		for _, o := range ob.Orders {
+			if o.Limit == nil {
+				continue
+			}
+			asset, amount := reservation(ex.markets[market], o.Limit.Price, o)
+			if reserved[o.UserID] == nil {
+				reserved[o.UserID] = make(map[Asset]float64)
+			}
+			reserved[o.UserID][asset] += amount
+		}
+	}
+	ex.Ledger.relock(reserved)
+}
@@ -0,0 +1,485 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/labstack/echo/v4"
+
+	"github.com/ukibbb/crypto-exchange/orderbook"
+	"github.com/ukibbb/crypto-exchange/wal"
+)
+
+func newTestExchange(t *testing.T, journalDir string) *Exchange {
+	users, _ := NewUserRegistry("")
+	ex := NewExchange(nil, nil, users, nil, DefaultExchangeConfig)
+	if journalDir != "" {
+		journal, err := wal.Open(journalDir, wal.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { journal.Close() })
+		ex.Journal = journal
+	}
+	return ex
+}
+
+func TestExchangeRecoversBooks(t *testing.T) {
+	dir := t.TempDir()
+	ex := newTestExchange(t, dir)
+
+	for i, price := range []float64{2000, 2010, 2010} {
+		o := &orderbook.Order{ID: int64(i + 1), UserID: 1, Size: 1, Timestamp: int64(i)}
+		if err := ex.handlePlaceLimitOrder(MarketETH, price, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	taker, matches, _, err := ex.handlePlaceMarketOrder(MarketETH, &orderbook.Order{ID: 4, UserID: 2, Bid: true, Size: 1.5, Timestamp: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(matches), 2)
+	assert(t, matches[0].Bid, taker)
+	if _, _, err := ex.execute(MarketETH, orderbook.Command{Type: orderbook.CmdCancel, OrderID: 3}); err != nil {
+		t.Fatal(err)
+	}
+	// a failed check is never journaled.
+	_, _, err = ex.execute(MarketETH, orderbook.Command{Type: orderbook.CmdCancel, OrderID: 3})
+	assert(t, err != nil, true)
+	ex.Journal.Close()
+
+	recovered := newTestExchange(t, dir)
+	if err := recovered.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	ob := recovered.orderBooks[MarketETH]
+	assert(t, ob.AskTotalVolume(), 0.5)
+	assert(t, len(ob.Trades), 2)
+	assert(t, len(recovered.Orders[1]), 1)
+	assert(t, recovered.Orders[1][0].ID, int64(2))
+	assert(t, recovered.Journal.LastSeq(), uint64(5))
+}
+
+func TestExchangeRecoversBalances(t *testing.T) {
+	dir := t.TempDir()
+	openExchange := func() *Exchange {
+		ex := newTestExchange(t, filepath.Join(dir, "journal"))
+		ex.SnapshotDir = filepath.Join(dir, "snapshots")
+		if err := ex.Recover(); err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+
+	ex := openExchange()
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+	alice, _ := ex.Users.Add(&User{})
+	bob, _ := ex.Users.Add(&User{})
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermTrade)
+	bobKey, _ := ex.APIKeys.Create(bob.ID, PermTrade)
+	ex.Ledger.Credit(alice.ID, AssetUSD, 1000)
+	ex.Ledger.Credit(bob.ID, AssetETH, 10)
+
+	assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":2,"Price":100}`, nil), http.StatusOK)
+	assert(t, serve(bobKey, http.MethodPost, "/order", `{"Type":"MARKET","Market":"ETH","Size":0.5}`, nil), http.StatusOK)
+	if _, err := ex.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, serve(bobKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Size":3,"Price":120}`, nil), http.StatusOK)
+	assert(t, serve(bobKey, http.MethodPost, "/order", `{"Type":"MARKET","Market":"ETH","Size":0.5}`, nil), http.StatusOK)
+	ex.Ledger.Credit(alice.ID, AssetUSD, 50)
+	want := map[int64]map[Asset]Balance{
+		alice.ID: {AssetUSD: {Available: 850, Locked: 100}, AssetETH: {Available: 1}},
+		bob.ID:   {AssetETH: {Available: 6, Locked: 3}, AssetUSD: {Available: 100}},
+	}
+	for userID, balances := range want {
+		assert(t, ex.Ledger.Balances(userID), balances)
+	}
+	ex.Journal.Close()
+
+	// the locked funds are back behind the orders, releasing them doesn't make money.
+	recovered := openExchange()
+	for userID, balances := range want {
+		assert(t, recovered.Ledger.Balances(userID), balances)
+	}
+	ids := []int64{recovered.Orders[alice.ID][0].ID, recovered.Orders[bob.ID][0].ID}
+	for _, id := range ids {
+		if _, err := recovered.cancelOwnOrder(recovered.orderIndex[id].UserID, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert(t, recovered.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 950})
+	assert(t, recovered.Ledger.Balance(bob.ID, AssetETH), Balance{Available: 9})
+}
+
+func TestExchangeChargesTradingFees(t *testing.T) {
+	dir := t.TempDir()
+	openExchange := func(fees TradingFees) *Exchange {
+		users, _ := NewUserRegistry("")
+		config := DefaultExchangeConfig
+		config.TradingFees = fees
+		ex := NewExchange(nil, nil, users, nil, config)
+		journal, err := wal.Open(dir, wal.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { journal.Close() })
+		ex.Journal = journal
+		if err := ex.Recover(); err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+
+	ex := openExchange(TradingFees{Maker: 0.25, Taker: 0.5})
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+	alice, _ := ex.Users.Add(&User{})
+	bob, _ := ex.Users.Add(&User{})
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermTrade)
+	bobKey, _ := ex.APIKeys.Create(bob.ID, PermTrade)
+	ex.Ledger.Credit(alice.ID, AssetUSD, 1000)
+	ex.Ledger.Credit(bob.ID, AssetETH, 10)
+
+	assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":4,"Price":100}`, nil), http.StatusOK)
+	assert(t, serve(bobKey, http.MethodPost, "/order", `{"Type":"MARKET","Market":"ETH","Size":2}`, nil), http.StatusOK)
+	// alice made the trade, bob took it.
+	want := map[int64]map[Asset]Balance{
+		alice.ID:     {AssetUSD: {Available: 600, Locked: 200}, AssetETH: {Available: 1.5}},
+		bob.ID:       {AssetETH: {Available: 8}, AssetUSD: {Available: 100}},
+		FeeAccountID: {AssetETH: {Available: 0.5}, AssetUSD: {Available: 100}},
+	}
+	trade, _ := ex.Settler.Trade(1)
+	assert(t, [2]float64{trade.BuyerFee, trade.SellerFee}, [2]float64{0.5, 100})
+	for userID, balances := range want {
+		assert(t, ex.Ledger.Balances(userID), balances)
+	}
+	ex.Journal.Close()
+
+	// the trade is replayed with the fees it was charged.
+	recovered := openExchange(TradingFees{})
+	for userID, balances := range want {
+		assert(t, recovered.Ledger.Balances(userID), balances)
+	}
+}
+
+func TestMarketOrderLocksBeforeJournaling(t *testing.T) {
+	ex := newTestExchange(t, t.TempDir())
+	ex.Ledger.Credit(1, AssetETH, 1)
+	ex.Ledger.Credit(2, AssetUSD, 1000)
+	submit := func(req *PlaceOrderRequest) error {
+		ex.bookMu.Lock()
+		defer ex.unlockBooks()
+		_, err := ex.submitOrder(req)
+		return err
+	}
+	if err := submit(&PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 1, Price: 100, Market: MarketETH}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the buyer pays from what the order locked, nothing stays locked.
+	if err := submit(&PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 0.5, Market: MarketETH}); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, ex.Ledger.Balance(2, AssetUSD), Balance{Available: 950})
+	assert(t, ex.Ledger.Balance(2, AssetETH), Balance{Available: 0.5})
+
+	// the order isn't journaled, what it locked is the buyer's again.
+	ex.Journal.Close()
+	assert(t, submit(&PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 0.5, Market: MarketETH}) != nil, true)
+	assert(t, ex.Ledger.Balance(2, AssetUSD), Balance{Available: 950})
+}
+
+func TestExchangeRecoversDeposits(t *testing.T) {
+	dir := t.TempDir()
+	openExchange := func() *Exchange {
+		ex := newTestExchange(t, filepath.Join(dir, "journal"))
+		ex.SnapshotDir = filepath.Join(dir, "snapshots")
+		if err := ex.Recover(); err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+
+	ex := openExchange()
+	credit := []ledgerEntry{{Op: opCredit, UserID: 1, Asset: AssetETH, Amount: 2}}
+	if err := ex.Deposits.commit(credit, 11); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ex.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ex.Deposits.commit(credit, 21); err != nil {
+		t.Fatal(err)
+	}
+	// blocks without deposits aren't journaled, they are scanned again.
+	if err := ex.Deposits.commit(nil, 31); err != nil {
+		t.Fatal(err)
+	}
+	ex.Journal.Close()
+
+	recovered := openExchange()
+	assert(t, recovered.Ledger.Balance(1, AssetETH), Balance{Available: 4})
+	assert(t, recovered.Deposits.nextBlock, uint64(21))
+}
+
+func TestExchangeResumesWithdrawals(t *testing.T) {
+	wallet := newTestWallet(t)
+	hot, user := newTestUser(t, wallet, 0), newTestUser(t, wallet, 0)
+	backend := newTestBackend(t, hot, user)
+	chain := newTestChain(t, backend)
+	to := newTestUser(t, wallet, 2).DepositAddress
+	users, _ := NewUserRegistry("")
+	user, _ = users.Add(user)
+	dir := t.TempDir()
+	openExchange := func() *Exchange {
+		ex := NewExchange(testSigner(t, wallet, hot), wallet, users, chain, DefaultExchangeConfig)
+		journal, err := wal.Open(dir, wal.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { journal.Close() })
+		ex.Journal = journal
+		if err := ex.Recover(); err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+
+	ex := openExchange()
+	ex.Ledger.Credit(user.ID, AssetETH, 10)
+	first, err := ex.Withdrawals.Request(user.ID, AssetETH, 1, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ex.Withdrawals.Request(user.ID, AssetETH, 2, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first one was signed and journaled, then the exchange went down before sending it.
+	w := ex.Withdrawals.withdrawals[first.ID]
+	_, err = chain.SendTxRecorded(context.Background(), testSigner(t, wallet, user), to, ethToWei(1), nil, func(tx *types.Transaction) error {
+		if err := ex.Withdrawals.sent(w, tx); err != nil {
+			return err
+		}
+		return errors.New("crash")
+	})
+	assert(t, err != nil, true)
+	ex.Journal.Close()
+
+	recovered := openExchange()
+	assert(t, recovered.Ledger.Balance(user.ID, AssetETH), Balance{Available: 7, Locked: 3})
+	sent, _ := recovered.Withdrawals.Get(first.ID)
+	assert(t, sent.Status, WithdrawalSent)
+	assert(t, sent.TxHash, w.TxHash)
+
+	mine(t, backend)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go recovered.Withdrawals.Run(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a, _ := recovered.Withdrawals.Get(first.ID)
+		b, _ := recovered.Withdrawals.Get(second.ID)
+		if a.Status == WithdrawalCompleted && b.Status == WithdrawalCompleted {
+			// the journaled tx went out, not a new one.
+			assert(t, a.TxHash, w.TxHash)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("withdrawals not completed: %s, %s", a.Status, b.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(t, recovered.Ledger.Balance(user.ID, AssetETH), Balance{Available: 7})
+	balance, err := chain.Client.BalanceAt(context.Background(), to, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, weiToEth(balance), 3.0)
+}
+
+// lossyClient fails the first send of every transaction, after it passed
+// it on when forward says so, like a connection that drops before the node answers.
+type lossyClient struct {
+	ChainClient
+	forward func(*types.Transaction) bool
+
+	mu   sync.Mutex
+	seen map[common.Hash]bool
+}
+
+func (c *lossyClient) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	c.mu.Lock()
+	first := !c.seen[tx.Hash()]
+	c.seen[tx.Hash()] = true
+	c.mu.Unlock()
+	if !first {
+		return c.ChainClient.SendTransaction(ctx, tx)
+	}
+	if c.forward(tx) {
+		if err := c.ChainClient.SendTransaction(ctx, tx); err != nil {
+			return err
+		}
+	}
+	return errors.New("i/o timeout")
+}
+
+func TestWithdrawalSendErrorsArentRefunded(t *testing.T) {
+	wallet := newTestWallet(t)
+	hot, user := newTestUser(t, wallet, 0), newTestUser(t, wallet, 0)
+	backend := newTestBackend(t, hot, user)
+	chain := newTestChain(t, backend)
+	// the 1 ETH withdrawal reaches the node, the 2 ETH one doesn't.
+	chain.Client = &lossyClient{
+		ChainClient: chain.Client,
+		forward:     func(tx *types.Transaction) bool { return tx.Value().Cmp(ethToWei(1)) == 0 },
+		seen:        make(map[common.Hash]bool),
+	}
+	to := newTestUser(t, wallet, 2).DepositAddress
+	users, _ := NewUserRegistry("")
+	user, _ = users.Add(user)
+	ex := NewExchange(testSigner(t, wallet, hot), wallet, users, chain, DefaultExchangeConfig)
+	ex.Withdrawals.pollInterval = 10 * time.Millisecond
+
+	ex.Ledger.Credit(user.ID, AssetETH, 10)
+	var ids []int64
+	for _, amount := range []float64{1, 2} {
+		w, err := ex.Withdrawals.Request(user.ID, AssetETH, amount, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, w.ID)
+	}
+
+	mine(t, backend)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ex.Withdrawals.Run(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, id := range ids {
+		for {
+			w, _ := ex.Withdrawals.Get(id)
+			if w.Status == WithdrawalCompleted {
+				break
+			}
+			// a failed send leaves it SENT, a refund would pay it twice.
+			assert(t, w.Status != WithdrawalFailed, true)
+			if time.Now().After(deadline) {
+				t.Fatalf("withdrawal %d not completed: %s", id, w.Status)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	assert(t, ex.Ledger.Balance(user.ID, AssetETH), Balance{Available: 7})
+	balance, err := chain.Client.BalanceAt(context.Background(), to, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, weiToEth(balance), 3.0)
+}
+
+func TestExchangeResumesSettlement(t *testing.T) {
+	wallet := newTestWallet(t)
+	alice, bob := newTestUser(t, wallet, 0), newTestUser(t, wallet, 0)
+	backend := newTestBackend(t, alice, bob)
+	users, _ := NewUserRegistry("")
+	alice, _ = users.Add(alice)
+	bob, _ = users.Add(bob)
+	dir := t.TempDir()
+	openExchange := func() *Exchange {
+		config := DefaultExchangeConfig
+		config.Settlement.PollInterval = 10 * time.Millisecond
+		ex := NewExchange(nil, wallet, users, newTestChain(t, backend), config)
+		ex.SnapshotDir = filepath.Join(dir, "snapshots")
+		journal, err := wal.Open(filepath.Join(dir, "journal"), wal.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { journal.Close() })
+		ex.Journal = journal
+		if err := ex.Recover(); err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+
+	ex := openExchange()
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermTrade)
+	bobKey, _ := ex.APIKeys.Create(bob.ID, PermTrade)
+	ex.Ledger.Credit(alice.ID, AssetUSD, 1000)
+	ex.Ledger.Credit(bob.ID, AssetETH, 10)
+	trade := func() {
+		assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":1,"Price":100}`, nil), http.StatusOK)
+		assert(t, serve(bobKey, http.MethodPost, "/order", `{"Type":"MARKET","Market":"ETH","Size":1}`, nil), http.StatusOK)
+	}
+
+	// nothing is mined, the exchange goes down waiting for the transfer
+	// of the first trade and before the second one is settled.
+	trade()
+	ctx, cancel := context.WithCancel(context.Background())
+	flushed := make(chan error)
+	go func() { flushed <- ex.Settler.Flush(ctx) }()
+	deadline := time.Now().Add(5 * time.Second)
+	sent, _ := ex.Settler.Trade(1)
+	for len(sent.Txs) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the transfer wasn't sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+		sent, _ = ex.Settler.Trade(1)
+	}
+	cancel()
+	assert(t, <-flushed != nil, true)
+	sent, _ = ex.Settler.Trade(1)
+	assert(t, sent.Status, SettlementSettling)
+	assert(t, len(sent.Txs), 1)
+	if _, err := ex.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	trade()
+	ex.Journal.Close()
+
+	recovered := openExchange()
+	first, _ := recovered.Settler.Trade(1)
+	assert(t, first.Txs, sent.Txs)
+	second, _ := recovered.Settler.Trade(2)
+	assert(t, second.Status, SettlementPending)
+
+	mine(t, backend)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := recovered.Settler.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{1, 2} {
+		trade, _ := recovered.Settler.Trade(id)
+		assert(t, trade.Status, SettlementSettled)
+	}
+	// the journaled transfer was waited for, not sent twice.
+	balance, err := backend.Client().BalanceAt(ctx, alice.DepositAddress, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, balance, ethToWei(102))
+	nonce, err := backend.Client().NonceAt(ctx, bob.DepositAddress, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, nonce, uint64(2))
+}
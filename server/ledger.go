@@ -0,0 +1,302 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+const AssetETH Asset = "ETH"
+
+type Asset string
+
+// Balance of a single asset for a user.
+// Locked funds are reserved (pending withdrawals, resting orders)
+// and can't be spend until they are released again.
+type Balance struct {
+	Available float64
+	Locked    float64
+}
+
+// float dust partial fills leave in the locked funds of an order,
+// less than this missing from a release isn't an error.
+const lockedDust = 1e-9
+
+type InsufficientBalanceError struct {
+	UserID    int64
+	Asset     Asset
+	Available float64
+	Requested float64
+	// it's the locked funds that are short, not the available ones.
+	Locked bool
+}
+
+func (e *InsufficientBalanceError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("insufficient locked %s balance for user %d: locked [%.8f] requested [%.8f]", e.Asset, e.UserID, e.Available, e.Requested)
+	}
+	return fmt.Sprintf("insufficient %s balance for user %d: available [%.8f] requested [%.8f]", e.Asset, e.UserID, e.Available, e.Requested)
+}
+
+const (
+	opCredit      ledgerOp = "CREDIT"
+	opDebit       ledgerOp = "DEBIT"
+	opLock        ledgerOp = "LOCK"
+	opUnlock      ledgerOp = "UNLOCK"
+	opDebitLocked ledgerOp = "DEBIT_LOCKED"
+)
+
+type ledgerOp string
+
+// journaled are the ops that change how much a user has. Locks follow from
+// the resting orders and are rebuilt from them when the exchange recovers.
+func (op ledgerOp) journaled() bool {
+	return op != opLock && op != opUnlock
+}
+
+// ledgerEntry is a single change of a balance.
+type ledgerEntry struct {
+	Op     ledgerOp
+	UserID int64
+	Asset  Asset
+	Amount float64
+}
+
+// apply changes the balance by the entry, or leaves it as it is
+// when there isn't enough for it.
+func (b *Balance) apply(e ledgerEntry) error {
+	short := func(have float64, locked bool) error {
+		return &InsufficientBalanceError{UserID: e.UserID, Asset: e.Asset, Available: have, Requested: e.Amount, Locked: locked}
+	}
+
+	switch e.Op {
+	case opCredit:
+		b.Available += e.Amount
+	case opDebit:
+		if b.Available < e.Amount {
+			return short(b.Available, false)
+		}
+		b.Available -= e.Amount
+	case opLock:
+		if b.Available < e.Amount {
+			return short(b.Available, false)
+		}
+		b.Available -= e.Amount
+		b.Locked += e.Amount
+	case opUnlock, opDebitLocked:
+		if b.Locked < e.Amount-lockedDust {
+			return short(b.Locked, true)
+		}
+		amount := min(e.Amount, b.Locked)
+		b.Locked -= amount
+		if e.Op == opUnlock {
+			b.Available += amount
+		}
+	default:
+		return fmt.Errorf("unknown ledger op %s", e.Op)
+	}
+	return nil
+}
+
+// Ledger keeps the off-chain balances of every user.
+type Ledger struct {
+	mu       sync.RWMutex
+	balances map[int64]map[Asset]*Balance
+	// writes the record to the journal before its entries are applied,
+	// it's called with mu held so the journal has them in order.
+	journal func(*journalEntry) error
+}
+
+func NewLedger() *Ledger {
+	return &Ledger{
+		balances: make(map[int64]map[Asset]*Balance),
+	}
+}
+
+func (l *Ledger) balance(userID int64, asset Asset) *Balance {
+	assets, ok := l.balances[userID]
+	if !ok {
+		assets = make(map[Asset]*Balance)
+		l.balances[userID] = assets
+	}
+	b, ok := assets[asset]
+	if !ok {
+		b = &Balance{}
+		assets[asset] = b
+	}
+	return b
+}
+
+func (l *Ledger) Balance(userID int64, asset Asset) Balance {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if b, ok := l.balances[userID][asset]; ok {
+		return *b
+	}
+	return Balance{}
+}
+
+func (l *Ledger) Balances(userID int64) map[Asset]Balance {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	balances := make(map[Asset]Balance)
+	for asset, b := range l.balances[userID] {
+		balances[asset] = *b
+	}
+	return balances
+}
+
+// commit journals the entry if it has to be and applies it.
+func (l *Ledger) commit(e ledgerEntry) error {
+	var record *journalEntry
+	if e.Op.journaled() {
+		record = &journalEntry{}
+	}
+	return l.commitRecord(record, []ledgerEntry{e}, nil)
+}
+
+// transfer applies the entries of trades, all of them or none. They aren't
+// journaled, replaying the commands of the books trades the same again.
+func (l *Ledger) transfer(entries []ledgerEntry) error {
+	return l.commitRecord(nil, entries, nil)
+}
+
+// commitRecord applies the entries, all of them or none. With a record the
+// ones that have to be are journaled in it first, update runs with them for
+// what else it has.
+func (l *Ledger) commitRecord(record *journalEntry, entries []ledgerEntry, update func()) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	type key struct {
+		userID int64
+		asset  Asset
+	}
+	next := make(map[key]Balance)
+	for _, e := range entries {
+		k := key{e.UserID, e.Asset}
+		b, ok := next[k]
+		if !ok {
+			b = *l.balance(e.UserID, e.Asset)
+		}
+		if err := b.apply(e); err != nil {
+			return err
+		}
+		next[k] = b
+	}
+	if record != nil && l.journal != nil {
+		record.Ledger = nil
+		for _, e := range entries {
+			if e.Op.journaled() {
+				record.Ledger = append(record.Ledger, e)
+			}
+		}
+		if err := l.journal(record); err != nil {
+			return err
+		}
+	}
+	for k, b := range next {
+		*l.balance(k.userID, k.asset) = b
+	}
+	if update != nil {
+		update()
+	}
+	return nil
+}
+
+// Credit adds funds to the available balance (deposits, refunds).
+func (l *Ledger) Credit(userID int64, asset Asset, amount float64) error {
+	return l.commit(ledgerEntry{Op: opCredit, UserID: userID, Asset: asset, Amount: amount})
+}
+
+// Debit removes funds from the available balance.
+func (l *Ledger) Debit(userID int64, asset Asset, amount float64) error {
+	return l.commit(ledgerEntry{Op: opDebit, UserID: userID, Asset: asset, Amount: amount})
+}
+
+// Lock moves funds from available into locked.
+func (l *Ledger) Lock(userID int64, asset Asset, amount float64) error {
+	return l.commit(ledgerEntry{Op: opLock, UserID: userID, Asset: asset, Amount: amount})
+}
+
+// Unlock moves funds back from locked into available.
+func (l *Ledger) Unlock(userID int64, asset Asset, amount float64) error {
+	return l.commit(ledgerEntry{Op: opUnlock, UserID: userID, Asset: asset, Amount: amount})
+}
+
+// DebitLocked removes funds that have been locked before
+// and have left the exchange for good.
+func (l *Ledger) DebitLocked(userID int64, asset Asset, amount float64) error {
+	return l.commit(ledgerEntry{Op: opDebitLocked, UserID: userID, Asset: asset, Amount: amount})
+}
+
+// replay applies journaled entries and the ones of replayed trades to the
+// totals, they were checked when they were made. relock splits them up again.
+func (l *Ledger) replay(entries []ledgerEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, e := range entries {
+		b := l.balance(e.UserID, e.Asset)
+		switch e.Op {
+		case opCredit:
+			b.Available += e.Amount
+		case opDebit, opDebitLocked:
+			b.Available -= e.Amount
+		}
+	}
+}
+
+// relock sets the locked funds of every user to what is reserved for them.
+func (l *Ledger) relock(reserved map[int64]map[Asset]float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for userID, assets := range reserved {
+		for asset := range assets {
+			l.balance(userID, asset)
+		}
+	}
+	for userID, assets := range l.balances {
+		for asset, b := range assets {
+			total := b.Available + b.Locked
+			b.Locked = reserved[userID][asset]
+			b.Available = total - b.Locked
+			if b.Available < -lockedDust {
+				log.Printf("user %d has %.8f %s less than their orders reserve", userID, -b.Available, asset)
+			}
+		}
+	}
+}
+
+// snapshot copies the balances of every user, read runs with them for
+// what has to match them, like the journal sequence number they are at.
+func (l *Ledger) snapshot(read func()) map[int64]map[Asset]Balance {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	balances := make(map[int64]map[Asset]Balance, len(l.balances))
+	for userID, assets := range l.balances {
+		balances[userID] = make(map[Asset]Balance, len(assets))
+		for asset, b := range assets {
+			balances[userID][asset] = *b
+		}
+	}
+	read()
+	return balances
+}
+
+// restore replaces the balances with the ones of a snapshot.
+func (l *Ledger) restore(balances map[int64]map[Asset]Balance) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.balances = make(map[int64]map[Asset]*Balance, len(balances))
+	for userID, assets := range balances {
+		for asset, b := range assets {
+			*l.balance(userID, asset) = b
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/labstack/echo/v4"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func TestLedgerLockUnlock(t *testing.T) {
+	l := NewLedger()
+	l.Credit(1, AssetETH, 10)
+
+	assert(t, l.Lock(1, AssetETH, 4), nil)
+	assert(t, l.Balance(1, AssetETH), Balance{Available: 6, Locked: 4})
+
+	var balanceErr *InsufficientBalanceError
+	assert(t, errors.As(l.Lock(1, AssetETH, 7), &balanceErr), true)
+
+	l.Unlock(1, AssetETH, 1)
+	assert(t, l.Balance(1, AssetETH), Balance{Available: 7, Locked: 3})
+
+	l.DebitLocked(1, AssetETH, 3)
+	assert(t, l.Balance(1, AssetETH), Balance{Available: 7, Locked: 0})
+
+	// nothing is locked anymore, releasing more doesn't make money.
+	assert(t, errors.As(l.Unlock(1, AssetETH, 1), &balanceErr), true)
+	assert(t, balanceErr.Locked, true)
+	assert(t, errors.As(l.DebitLocked(1, AssetETH, 1), &balanceErr), true)
+	assert(t, l.Balance(1, AssetETH), Balance{Available: 7, Locked: 0})
+}
+
+func TestWithdrawalLimits(t *testing.T) {
+	l := NewLedger()
+	l.Credit(1, AssetETH, 100)
+	ww := NewWithdrawalWorker(nil, nil, nil, l, WithdrawalLimits{
+		MaxAmount:         20,
+		DailyLimit:        30,
+		ApprovalThreshold: 5,
+	})
+	to := common.HexToAddress("0x71B4ef0D3632C6b4d9A4bEf27B8b0136DEF7EFa2")
+
+	_, err := ww.Request(1, AssetETH, 21, to)
+	assert(t, err != nil, true)
+
+	w, err := ww.Request(1, AssetETH, 2, to)
+	assert(t, err, nil)
+	assert(t, w.Status, WithdrawalQueued)
+
+	w, err = ww.Request(1, AssetETH, 15, to)
+	assert(t, err, nil)
+	assert(t, w.Status, WithdrawalPendingApproval)
+	assert(t, l.Balance(1, AssetETH), Balance{Available: 83, Locked: 17})
+
+	// 2 + 15 + 14 > 30
+	_, err = ww.Request(1, AssetETH, 14, to)
+	assert(t, err != nil, true)
+
+	w, err = ww.Reject(w.ID)
+	assert(t, err, nil)
+	assert(t, w.Status, WithdrawalRejected)
+	assert(t, l.Balance(1, AssetETH), Balance{Available: 98, Locked: 2})
+
+	// the rejected withdrawal doesn't count against the limit anymore.
+	_, err = ww.Request(1, AssetETH, 14, to)
+	assert(t, err, nil)
+}
+
+func TestToBaseUnits(t *testing.T) {
+	assert(t, ethToWei(0.1).String(), "100000000000000000")
+	assert(t, ethToWei(1.5).String(), "1500000000000000000")
+	assert(t, toBaseUnits(12.345678, 6).String(), "12345678")
+	assert(t, weiToEth(ethToWei(2.25)), 2.25)
+}
+
+func TestCreditBalance(t *testing.T) {
+	ex := newTestExchange(t, "")
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+
+	admin, _ := ex.Users.Add(&User{})
+	alice, _ := ex.Users.Add(&User{})
+	adminKey, _ := ex.APIKeys.Create(admin.ID, PermAdmin)
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermRead, PermTrade)
+	path := "/balance/" + itoa(alice.ID) + "/credit"
+
+	assert(t, serve(aliceKey, http.MethodPost, path, `{"Asset":"USD","Amount":100}`, nil), http.StatusForbidden)
+	resp := &BalancesResponse{}
+	assert(t, serve(adminKey, http.MethodPost, path, `{"Asset":"USD","Amount":100}`, resp), http.StatusOK)
+	assert(t, resp.Balances[AssetUSD], Balance{Available: 100})
+
+	// ETH only comes in as deposits.
+	assert(t, serve(adminKey, http.MethodPost, path, `{"Asset":"ETH","Amount":1}`, nil), http.StatusBadRequest)
+	assert(t, serve(adminKey, http.MethodPost, path, `{"Asset":"DOGE","Amount":1}`, nil), http.StatusBadRequest)
+	assert(t, serve(adminKey, http.MethodPost, path, `{"Asset":"USD","Amount":-1}`, nil), http.StatusBadRequest)
+	assert(t, serve(adminKey, http.MethodPost, "/balance/99/credit", `{"Asset":"USD","Amount":1}`, nil), http.StatusNotFound)
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 100})
+}
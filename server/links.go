@@ -0,0 +1,380 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// a bracket waiting for its entry to fill.
+	LinkPending LinkStatus = "PENDING"
+	// the legs are placed, what one fills comes off the other and the
+	// first to fill or leave cancels the other.
+	LinkActive LinkStatus = "ACTIVE"
+	LinkDone   LinkStatus = "DONE"
+)
+
+type LinkStatus string
+
+// LinkRequest places two orders that cancel each other, one cancels other (OCO).
+// With an entry it's a bracket: the legs are the exits of the entry and are
+// only placed once it's filled, on the other side and for what got filled.
+type LinkRequest struct {
+	Entry *PlaceOrderRequest `json:",omitempty"`
+	// a limit or a stop each, for example a take profit and a stop loss.
+	Legs []PlaceOrderRequest
+}
+
+// OrderLink is an OCO pair or a bracket as the user sees it.
+type OrderLink struct {
+	ID     int64
+	UserID int64
+	Market Market
+	// the entry order of a bracket.
+	Entry int64 `json:",omitempty"`
+	// the ids of the legs, 0 while a bracket waits for its entry.
+	Legs   [2]int64
+	Status LinkStatus
+}
+
+type LinkResponse struct {
+	Link OrderLink
+}
+
+type GetLinksResponse struct {
+	Links []OrderLink
+}
+
+// orderLink sits above the books and watches the orders it links at the end of
+// every turn, it doesn't matter what filled or took them out. Links are
+// journaled whenever they change, like the stops.
+type orderLink struct {
+	OrderLink
+	legs []PlaceOrderRequest
+	// what the fills of each leg took off the other so far.
+	shrunk [2]float64
+}
+
+// linkRecord is a link as it is after the journal record.
+type linkRecord struct {
+	OrderLink
+	Requests []PlaceOrderRequest
+	Shrunk   [2]float64
+}
+
+func (link *orderLink) record() linkRecord {
+	return linkRecord{OrderLink: link.OrderLink, Requests: link.legs, Shrunk: link.shrunk}
+}
+
+// restoreLink puts the link of the record back. It has to be called with bookMu held.
+func (ex *Exchange) restoreLink(r *linkRecord) {
+	ex.nextLinkID = max(ex.nextLinkID, r.ID)
+	ex.addLink(&orderLink{OrderLink: r.OrderLink, legs: r.Requests, shrunk: r.Shrunk})
+}
+
+// linkRecords are the links by id. It has to be called with bookMu held.
+func (ex *Exchange) linkRecords() []linkRecord {
+	records := make([]linkRecord, 0, len(ex.links))
+	for _, link := range ex.links {
+		records = append(records, link.record())
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records
+}
+
+// journalLink writes the link as it is now, a link that can't be
+// journaled is still watched until the next restart.
+func (ex *Exchange) journalLink(link *orderLink) {
+	record := link.record()
+	if err := ex.journalLedger(&journalEntry{Link: &record}); err != nil {
+		log.Printf("link %d of user %d: %s", link.ID, link.UserID, err)
+	}
+}
+
+// checkLinkRequest fills in the legs of a bracket from the entry and
+// makes sure the orders can be linked at all.
+func checkLinkRequest(req *LinkRequest) error {
+	if len(req.Legs) != 2 {
+		return ErrBadRequest.WithMessage("a link takes two legs, not %d", len(req.Legs))
+	}
+	if e := req.Entry; e != nil {
+		if e.Type != LimitOrder && e.Type != MarketOrder {
+			return ErrBadRequest.WithMessage("the entry of a bracket is a limit or market order, not [%s]", e.Type)
+		}
+		for i := range req.Legs {
+			leg := &req.Legs[i]
+			if leg.Market != e.Market || leg.Bid == e.Bid {
+				return ErrBadRequest.WithMessage("the legs of a bracket are on the other side of the entry, on its market").WithDetail("leg", i)
+			}
+			if leg.Size != 0 && leg.Size != e.Size {
+				return ErrBadRequest.WithMessage("the legs of a bracket have the size of the entry").WithDetail("leg", i)
+			}
+			leg.Size = e.Size
+		}
+	}
+	for i, leg := range req.Legs {
+		if leg.Type != LimitOrder && leg.Type != StopOrder {
+			return ErrBadRequest.WithMessage("a leg is a limit or stop order, not [%s]", leg.Type).WithDetail("leg", i)
+		}
+	}
+	if req.Legs[0].Market != req.Legs[1].Market || req.Legs[0].Bid != req.Legs[1].Bid {
+		return ErrBadRequest.WithMessage("the legs are on the same side of the same market")
+	}
+	return nil
+}
+
+// placeLink places the entry of a bracket or the legs of an OCO.
+// It has to be called with bookMu held.
+func (ex *Exchange) placeLink(userID int64, req *LinkRequest) (*orderLink, error) {
+	ex.nextLinkID++
+	link := &orderLink{
+		OrderLink: OrderLink{ID: ex.nextLinkID, UserID: userID, Market: req.Legs[0].Market},
+		legs:      req.Legs,
+	}
+
+	if req.Entry != nil {
+		entry, err := ex.submitOrder(req.Entry)
+		if err != nil {
+			return nil, err
+		}
+		link.Entry = entry.ID
+		link.Status = LinkPending
+		ex.addLink(link)
+		// market orders are done once they're placed.
+		if req.Entry.Type == MarketOrder {
+			if err := ex.placeLegs(link, req.Entry.Size); err != nil {
+				return link, badRequest(err).WithDetail("entryID", entry.ID)
+			}
+		}
+		return link, nil
+	}
+
+	if err := ex.placeLegs(link, 0); err != nil {
+		// the first leg couldn't be taken back.
+		if link.Status == LinkActive {
+			ex.addLink(link)
+		}
+		return nil, err
+	}
+	ex.addLink(link)
+	return link, nil
+}
+
+func (ex *Exchange) addLink(link *orderLink) {
+	ex.links[link.ID] = link
+	for _, id := range append([]int64{link.Entry}, link.Legs[:]...) {
+		if id != 0 {
+			ex.linked[id] = link.ID
+		}
+	}
+}
+
+// placeLegs places both legs or none, a size other than 0 is the size they get.
+// It has to be called with bookMu held.
+func (ex *Exchange) placeLegs(link *orderLink, size float64) error {
+	for i := range link.legs {
+		leg := link.legs[i]
+		if size != 0 {
+			leg.Size = size
+		}
+		order, err := ex.submitOrder(&leg)
+		if err != nil {
+			link.Status = LinkDone
+			if i > 0 {
+				if _, cerr := ex.cancelOwnOrder(link.UserID, link.Legs[0]); cerr != nil {
+					// the first leg stays, the link keeps watching it.
+					log.Printf("link %d of user %d: cancelling leg %d: %s", link.ID, link.UserID, link.Legs[0], cerr)
+					link.Status = LinkActive
+				} else {
+					link.Legs[0] = 0
+				}
+			}
+			return batchError(err, "leg", i)
+		}
+		link.Legs[i] = order.ID
+		ex.linked[order.ID] = link.ID
+	}
+	link.Status = LinkActive
+	return nil
+}
+
+// legState is what the leg filled so far and whether it's done, filled or
+// out of the book. It has to be called with bookMu held.
+func (ex *Exchange) legState(userID, id int64) (float64, bool) {
+	// a leg that was never placed.
+	if id == 0 {
+		return 0, false
+	}
+	if _, ok := ex.stops[id]; ok {
+		return 0, false
+	}
+	info, err := ex.ownOrder(userID, id)
+	if err != nil {
+		// a stop that fired or was cancelled.
+		return 0, true
+	}
+	state := ex.orderState(id, info)
+	return state.Filled, state.Status != OrderOpen
+}
+
+// shrinkLeg takes size off the leg, it's cancelled when nothing is left.
+// It has to be called with bookMu held.
+func (ex *Exchange) shrinkLeg(userID, id int64, size float64) error {
+	if s, ok := ex.stops[id]; ok {
+		s.Size -= size
+		gone := s.Size <= 0
+		if gone {
+			delete(ex.stops, id)
+		}
+		return ex.journalStop(s, gone)
+	}
+	info, err := ex.ownOrder(userID, id)
+	if err != nil {
+		return err
+	}
+	o, ok := ex.orderBooks[info.Market].Orders[id]
+	if !ok || o.Limit == nil {
+		return nil
+	}
+	if o.Size <= size {
+		_, err := ex.cancelOrder(id, info)
+		return err
+	}
+	return ex.amendOrder(userID, id, &AmendOrderRequest{Market: info.Market, Price: o.Limit.Price, Size: o.Size - size})
+}
+
+// runLinks moves the links on after a turn of the books: filled entries
+// get their legs, partial fills of a leg shrink the other and the first leg
+// that's done cancels the other. It reports whether it placed, changed or
+// cancelled anything. It has to be called with bookMu held.
+func (ex *Exchange) runLinks() bool {
+	ids := make([]int64, 0, len(ex.links))
+	for id, link := range ex.links {
+		if link.Status != LinkDone {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	changed := false
+	for _, id := range ids {
+		link := ex.links[id]
+		if ex.runLink(link) {
+			ex.journalLink(link)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// runLink moves the link on, it reports whether anything changed.
+func (ex *Exchange) runLink(link *orderLink) bool {
+	switch link.Status {
+	case LinkPending:
+		info, err := ex.ownOrder(link.UserID, link.Entry)
+		if err != nil {
+			return false
+		}
+		state := ex.orderState(link.Entry, info)
+		if state.Status == OrderOpen {
+			return false
+		}
+		if state.Filled == 0 {
+			link.Status = LinkDone
+			return true
+		}
+		if err := ex.placeLegs(link, state.Filled); err != nil {
+			log.Printf("bracket %d of user %d: placing the exits: %s", link.ID, link.UserID, err)
+		}
+		return true
+	case LinkActive:
+		var (
+			filled [2]float64
+			done   [2]bool
+		)
+		for i, legID := range link.Legs {
+			filled[i], done[i] = ex.legState(link.UserID, legID)
+		}
+		if done[0] || done[1] {
+			for i, legID := range link.Legs {
+				if !done[i] && legID != 0 {
+					if _, err := ex.cancelOwnOrder(link.UserID, legID); err != nil {
+						log.Printf("link %d of user %d: cancelling leg %d: %s", link.ID, link.UserID, legID, err)
+					}
+				}
+			}
+			link.Status = LinkDone
+			return true
+		}
+		// a partial fill leaves the rest of the position behind the other leg.
+		changed := false
+		for i := range link.Legs {
+			other := link.Legs[1-i]
+			if filled[i] <= link.shrunk[i] || other == 0 {
+				continue
+			}
+			changed = true
+			if err := ex.shrinkLeg(link.UserID, other, filled[i]-link.shrunk[i]); err != nil {
+				log.Printf("link %d of user %d: shrinking leg %d: %s", link.ID, link.UserID, other, err)
+			}
+			link.shrunk[i] = filled[i]
+		}
+		return changed
+	}
+	return false
+}
+
+// userLinks are the links of the user by id. It has to be called with bookMu held.
+func (ex *Exchange) userLinks(userID int64) []OrderLink {
+	links := []OrderLink{}
+	for _, link := range ex.links {
+		if link.UserID == userID {
+			links = append(links, link.OrderLink)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].ID < links[j].ID })
+	return links
+}
+
+func (ex *Exchange) handlePlaceLink(c echo.Context) error {
+	var req LinkRequest
+	if err := decodeBody(c, &req); err != nil {
+		return err
+	}
+	userID := authUserID(c)
+	if req.Entry != nil {
+		req.Entry.UserID = userID
+	}
+	for i := range req.Legs {
+		req.Legs[i].UserID = userID
+	}
+	if err := checkLinkRequest(&req); err != nil {
+		return err
+	}
+
+	ex.bookMu.Lock()
+	link, err := ex.placeLink(userID, &req)
+	var resp *LinkResponse
+	if link != nil {
+		ex.journalLink(link)
+		resp = &LinkResponse{Link: link.OrderLink}
+	}
+	ex.unlockBooks()
+	if err != nil {
+		return err
+	}
+	log.Printf("link %d of user %d placed", link.ID, userID)
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (ex *Exchange) handleGetLinks(c echo.Context) error {
+	ex.bookMu.Lock()
+	links := ex.userLinks(authUserID(c))
+	ex.bookMu.Unlock()
+
+	return c.JSON(http.StatusOK, &GetLinksResponse{Links: links})
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestLinkedOrders(t *testing.T) {
+	ex := newTestExchange(t, "")
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+
+	alice, _ := ex.Users.Add(&User{})
+	bob, _ := ex.Users.Add(&User{})
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermRead, PermTrade)
+	bobKey, _ := ex.APIKeys.Create(bob.ID, PermRead, PermTrade)
+	ex.Ledger.Credit(alice.ID, AssetUSD, 1000)
+	ex.Ledger.Credit(bob.ID, AssetETH, 10)
+
+	// a trade at 100 for the stops to follow.
+	assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":1,"Price":100}`, nil), http.StatusOK)
+	assert(t, serve(bobKey, http.MethodPost, "/order", `{"Type":"MARKET","Market":"ETH","Size":1}`, nil), http.StatusOK)
+
+	oco := `{"Legs":[
+		{"Type":"LIMIT","Market":"ETH","Size":1,"Price":120},
+		{"Type":"STOP","Market":"ETH","Size":1,"Stop":{"StopPrice":90}}
+	]}`
+	apiErr := &APIError{}
+	assert(t, serve(bobKey, http.MethodPost, "/links", `{"Legs":[{"Type":"LIMIT","Market":"ETH","Size":1,"Price":120}]}`, apiErr), http.StatusBadRequest)
+	assert(t, serve(bobKey, http.MethodPost, "/links", `{"Legs":[
+		{"Type":"LIMIT","Market":"ETH","Size":1,"Price":120},
+		{"Type":"STOP","Market":"ETH","Size":1,"Stop":{"StopPrice":110}}
+	]}`, apiErr), http.StatusBadRequest)
+	assert(t, apiErr.Details["index"], 1.0)
+	// the take profit leg didn't stay.
+	assert(t, ex.Ledger.Balance(bob.ID, AssetETH), Balance{Available: 9})
+
+	// alice buys the take profit, the stop loss goes with it.
+	placed := &LinkResponse{}
+	assert(t, serve(bobKey, http.MethodPost, "/links", oco, placed), http.StatusOK)
+	assert(t, placed.Link.Status, LinkActive)
+	orders := &GetOrdersResponse{}
+	assert(t, serve(bobKey, http.MethodGet, "/order/"+itoa(bob.ID), "", orders), http.StatusOK)
+	assert(t, orders.Asks[0].LinkID, placed.Link.ID)
+	assert(t, orders.Stops[0].LinkID, placed.Link.ID)
+	assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"MARKET","Market":"ETH","Bid":true,"Size":1}`, nil), http.StatusOK)
+	assert(t, len(ex.stops), 0)
+
+	// cancelling a leg cancels the other.
+	cancelled := &LinkResponse{}
+	assert(t, serve(bobKey, http.MethodPost, "/links", oco, cancelled), http.StatusOK)
+	assert(t, serve(bobKey, http.MethodDelete, "/order/"+itoa(cancelled.Link.Legs[1]), "", nil), http.StatusOK)
+	assert(t, len(ex.Orders[bob.ID]), 0)
+	assert(t, ex.Ledger.Balance(bob.ID, AssetETH), Balance{Available: 8})
+
+	// a bracket of alice, the exits are placed once bob fills the entry.
+	bracket := &LinkResponse{}
+	assert(t, serve(aliceKey, http.MethodPost, "/links", `{
+		"Entry":{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":2,"Price":100},
+		"Legs":[
+			{"Type":"LIMIT","Market":"ETH","Price":130},
+			{"Type":"STOP","Market":"ETH","Stop":{"Trail":10}}
+		]}`, bracket), http.StatusOK)
+	assert(t, bracket.Link.Status, LinkPending)
+	assert(t, serve(bobKey, http.MethodPost, "/order", `{"Type":"MARKET","Market":"ETH","Size":2}`, nil), http.StatusOK)
+
+	links := &GetLinksResponse{}
+	assert(t, serve(aliceKey, http.MethodGet, "/links", "", links), http.StatusOK)
+	assert(t, len(links.Links), 1)
+	assert(t, links.Links[0].Status, LinkActive)
+	assert(t, ex.Ledger.Balance(alice.ID, AssetETH), Balance{Available: 2, Locked: 2})
+	assert(t, ex.stops[links.Links[0].Legs[1]].Size, 2.0)
+
+	// a partial fill of the take profit leaves a stop loss for the rest.
+	partial := &LinkResponse{}
+	assert(t, serve(bobKey, http.MethodPost, "/links", `{"Legs":[
+		{"Type":"LIMIT","Market":"ETH","Size":2,"Price":120},
+		{"Type":"STOP","Market":"ETH","Size":2,"Stop":{"StopPrice":90}}
+	]}`, partial), http.StatusOK)
+	assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"MARKET","Market":"ETH","Bid":true,"Size":0.5}`, nil), http.StatusOK)
+	assert(t, ex.links[partial.Link.ID].Status, LinkActive)
+	assert(t, ex.stops[partial.Link.Legs[1]].Size, 1.5)
+	assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"MARKET","Market":"ETH","Bid":true,"Size":1.5}`, nil), http.StatusOK)
+	assert(t, ex.links[partial.Link.ID].Status, LinkDone)
+	_, ok := ex.stops[partial.Link.Legs[1]]
+	assert(t, ok, false)
+
+	done := &GetLinksResponse{}
+	assert(t, serve(bobKey, http.MethodGet, "/links", "", done), http.StatusOK)
+	assert(t, done.Links[0].Status, LinkDone)
+	assert(t, done.Links[1].Status, LinkDone)
+}
+
+func TestStopsAndLinksRecover(t *testing.T) {
+	dir := t.TempDir()
+	openExchange := func() *Exchange {
+		ex := newTestExchange(t, filepath.Join(dir, "journal"))
+		ex.SnapshotDir = filepath.Join(dir, "snapshots")
+		if err := ex.Recover(); err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+	ex := openExchange()
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+
+	alice, _ := ex.Users.Add(&User{})
+	bob, _ := ex.Users.Add(&User{})
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermTrade)
+	bobKey, _ := ex.APIKeys.Create(bob.ID, PermTrade)
+	ex.Ledger.Credit(alice.ID, AssetUSD, 1000)
+	ex.Ledger.Credit(bob.ID, AssetETH, 10)
+	trade := func(price string) {
+		assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":1,"Price":`+price+`}`, nil), http.StatusOK)
+		assert(t, serve(bobKey, http.MethodPost, "/order", `{"Type":"MARKET","Market":"ETH","Size":1}`, nil), http.StatusOK)
+	}
+
+	// a trailing stop that moved, a cancelled one and an OCO.
+	trade("100")
+	trailing, cancelled := &PlaceOrderResponse{}, &PlaceOrderResponse{}
+	assert(t, serve(bobKey, http.MethodPost, "/order", `{"Type":"STOP","Market":"ETH","Size":1,"Stop":{"Trail":10}}`, trailing), http.StatusOK)
+	assert(t, serve(bobKey, http.MethodPost, "/order", `{"Type":"STOP","Market":"ETH","Size":1,"Stop":{"StopPrice":50}}`, cancelled), http.StatusOK)
+	assert(t, serve(bobKey, http.MethodDelete, "/order/"+itoa(cancelled.OrderID), "", nil), http.StatusOK)
+	placed := &LinkResponse{}
+	assert(t, serve(bobKey, http.MethodPost, "/links", `{"Legs":[
+		{"Type":"LIMIT","Market":"ETH","Size":1,"Price":130},
+		{"Type":"STOP","Market":"ETH","Size":1,"Stop":{"StopPrice":90}}
+	]}`, placed), http.StatusOK)
+	trade("120")
+	ex.Journal.Close()
+
+	check := func(ex *Exchange) {
+		t.Helper()
+		assert(t, len(ex.stops), 2)
+		assert(t, ex.stops[trailing.OrderID].Trigger, 110.0)
+		assert(t, ex.stops[trailing.OrderID].best, 120.0)
+		assert(t, ex.links[placed.Link.ID].OrderLink, placed.Link)
+		assert(t, ex.linked[placed.Link.Legs[1]], placed.Link.ID)
+		assert(t, ex.nextLinkID, placed.Link.ID)
+		// the stops keep their ids, new orders don't get them.
+		assert(t, ex.newOrder(false, 1, bob.ID).ID > placed.Link.Legs[1], true)
+	}
+	recovered := openExchange()
+	check(recovered)
+
+	// and from a snapshot.
+	if _, err := recovered.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	recovered.Journal.Close()
+	check(openExchange())
+}
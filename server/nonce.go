@@ -0,0 +1,309 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// nodes only accept a replacement transaction that pays at least
+// 10% more, bump a bit more than that to be safe.
+const gasBumpPercent = 12
+
+// signFn signs a transaction for its sender.
+// It is kept with every pending transaction so it can be re-signed with a higher fee.
+type signFn func(*types.Transaction) (*types.Transaction, error)
+
+type pendingTx struct {
+	from  common.Address
+	nonce uint64
+	// every transaction sent with this nonce, the last one is the current replacement.
+	txs    []*types.Transaction
+	sign   signFn
+	sentAt time.Time
+}
+
+func (p *pendingTx) latest() *types.Transaction {
+	return p.txs[len(p.txs)-1]
+}
+
+type senderNonces struct {
+	synced  bool
+	next    uint64
+	pending map[uint64]*pendingTx
+	// handed out and never sent, they are handed out again before next.
+	released map[uint64]bool
+}
+
+// NonceManager hands out nonces locally so concurrent sends
+// from the same account never reuse a nonce.
+// The next nonce is synced from the chain on the first use of an account,
+// after that it only goes up. A nonce a failed send gives back is handed
+// out again first, so it doesn't leave a gap the later transactions wait
+// behind. Transactions that are not mined after StuckAfter are replaced
+// with the same nonce and a higher gas price.
+type NonceManager struct {
+	client     ChainClient
+	StuckAfter time.Duration
+
+	mu      sync.Mutex
+	senders map[common.Address]*senderNonces
+	hashes  map[common.Hash]*pendingTx
+}
+
+func NewNonceManager(client ChainClient) *NonceManager {
+	return &NonceManager{
+		client:     client,
+		StuckAfter: 2 * time.Minute,
+		senders:    make(map[common.Address]*senderNonces),
+		hashes:     make(map[common.Hash]*pendingTx),
+	}
+}
+
+func (nm *NonceManager) sender(from common.Address) *senderNonces {
+	s, ok := nm.senders[from]
+	if !ok {
+		s = &senderNonces{pending: make(map[uint64]*pendingTx), released: make(map[uint64]bool)}
+		nm.senders[from] = s
+	}
+	return s
+}
+
+// Next returns the nonce to use for the next transaction of the account.
+func (nm *NonceManager) Next(ctx context.Context, from common.Address) (uint64, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	s := nm.sender(from)
+	if !s.synced || len(s.released) > 0 {
+		nonce, err := nm.client.PendingNonceAt(ctx, from)
+		if err != nil {
+			return 0, err
+		}
+		// the node has them, the send failed after it went out.
+		for released := range s.released {
+			if released < nonce {
+				delete(s.released, released)
+			}
+		}
+		// a nonce handed out before can still be on its way to the
+		// node, the chain going further only happens on a first sync
+		// or when the account sends from somewhere else too.
+		s.next = max(s.next, nonce)
+		s.synced = true
+	}
+
+	if len(s.released) > 0 {
+		lowest := s.next
+		for released := range s.released {
+			lowest = min(lowest, released)
+		}
+		delete(s.released, lowest)
+		return lowest, nil
+	}
+	nonce := s.next
+	s.next++
+	return nonce, nil
+}
+
+// Release gives back a nonce Next handed out when the transaction wasn't
+// sent, Next hands it out again before any new one.
+func (nm *NonceManager) Release(from common.Address, nonce uint64) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	nm.sender(from).released[nonce] = true
+}
+
+// Track remembers a sent transaction so it can be replaced if it gets stuck.
+func (nm *NonceManager) Track(from common.Address, tx *types.Transaction, sign signFn) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	p := &pendingTx{
+		from:   from,
+		nonce:  tx.Nonce(),
+		txs:    []*types.Transaction{tx},
+		sign:   sign,
+		sentAt: time.Now(),
+	}
+	nm.sender(from).pending[p.nonce] = p
+	nm.hashes[tx.Hash()] = p
+}
+
+// candidates returns the hashes of all transactions that
+// share the nonce with the given one.
+func (nm *NonceManager) candidates(hash common.Hash) []common.Hash {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	p, ok := nm.hashes[hash]
+	if !ok {
+		return []common.Hash{hash}
+	}
+	hashes := make([]common.Hash, len(p.txs))
+	for i, tx := range p.txs {
+		hashes[i] = tx.Hash()
+	}
+	return hashes
+}
+
+// WaitMined waits until the transaction or one of its replacements is mined.
+func (nm *NonceManager) WaitMined(ctx context.Context, hash common.Hash, interval time.Duration) (*types.Receipt, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// the replacements are collected along the way, once the
+	// nonce is mined the manager forgets about them.
+	seen := map[common.Hash]bool{}
+	hashes := []common.Hash{}
+	for {
+		for _, h := range nm.candidates(hash) {
+			if !seen[h] {
+				seen[h] = true
+				hashes = append(hashes, h)
+			}
+		}
+
+		for _, h := range hashes {
+			receipt, err := nm.client.TransactionReceipt(ctx, h)
+			if err == nil {
+				return receipt, nil
+			}
+			if !errors.Is(err, ethereum.NotFound) {
+				log.Printf("receipt error for tx %s: %s", h.Hex(), err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run checks for stuck transactions until the context is done.
+func (nm *NonceManager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		nm.CheckStuck(ctx)
+	}
+}
+
+// CheckStuck forgets about the transactions that are mined and
+// replaces the ones that are pending (or were dropped from the pool) for too long.
+func (nm *NonceManager) CheckStuck(ctx context.Context) {
+	nm.mu.Lock()
+	senders := make([]common.Address, 0, len(nm.senders))
+	for from := range nm.senders {
+		senders = append(senders, from)
+	}
+	nm.mu.Unlock()
+
+	for _, from := range senders {
+		confirmed, err := nm.client.NonceAt(ctx, from, nil)
+		if err != nil {
+			log.Printf("nonce check failed for %s: %s", from.Hex(), err)
+			continue
+		}
+
+		stuck := []*pendingTx{}
+		nm.mu.Lock()
+		s := nm.sender(from)
+		for nonce, p := range s.pending {
+			if nonce < confirmed {
+				delete(s.pending, nonce)
+				for _, tx := range p.txs {
+					delete(nm.hashes, tx.Hash())
+				}
+				continue
+			}
+			if time.Since(p.sentAt) >= nm.StuckAfter {
+				stuck = append(stuck, p)
+			}
+		}
+		nm.mu.Unlock()
+
+		for _, p := range stuck {
+			if err := nm.replace(ctx, p); err != nil {
+				log.Printf("replacing tx %s (nonce %d) failed: %s", p.latest().Hash().Hex(), p.nonce, err)
+			}
+		}
+	}
+}
+
+func (nm *NonceManager) replace(ctx context.Context, p *pendingTx) error {
+	nm.mu.Lock()
+	current := p.latest()
+	nm.mu.Unlock()
+
+	if _, _, err := nm.client.TransactionByHash(ctx, current.Hash()); errors.Is(err, ethereum.NotFound) {
+		log.Printf("tx %s (nonce %d) was dropped, resending with a gas bump", current.Hash().Hex(), p.nonce)
+	} else {
+		log.Printf("tx %s (nonce %d) is stuck, replacing with a gas bump", current.Hash().Hex(), p.nonce)
+	}
+
+	signedTx, err := p.sign(bumpGas(current))
+	if err != nil {
+		return err
+	}
+	if err := nm.client.SendTransaction(ctx, signedTx); err != nil {
+		return err
+	}
+
+	nm.mu.Lock()
+	p.txs = append(p.txs, signedTx)
+	p.sentAt = time.Now()
+	nm.hashes[signedTx.Hash()] = p
+	nm.mu.Unlock()
+
+	return nil
+}
+
+// bumpGas returns an unsigned copy of the transaction paying gasBumpPercent more.
+// The fee caps are ignored on purpose, a stuck transaction blocks every
+// transaction of the account after it.
+func bumpGas(tx *types.Transaction) *types.Transaction {
+	if tx.Type() == types.DynamicFeeTxType {
+		return types.NewTx(&types.DynamicFeeTx{
+			ChainID:   tx.ChainId(),
+			Nonce:     tx.Nonce(),
+			GasTipCap: bump(tx.GasTipCap()),
+			GasFeeCap: bump(tx.GasFeeCap()),
+			Gas:       tx.Gas(),
+			To:        tx.To(),
+			Value:     tx.Value(),
+			Data:      tx.Data(),
+		})
+	}
+
+	return types.NewTx(&types.LegacyTx{
+		Nonce:    tx.Nonce(),
+		To:       tx.To(),
+		Value:    tx.Value(),
+		Gas:      tx.Gas(),
+		GasPrice: bump(tx.GasPrice()),
+		Data:     tx.Data(),
+	})
+}
+
+func bump(v *big.Int) *big.Int {
+	bumped := new(big.Int).Mul(v, big.NewInt(100+gasBumpPercent))
+	return bumped.Div(bumped, big.NewInt(100))
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestNonceManagerConcurrentSends(t *testing.T) {
+	wallet := newTestWallet(t)
+	alice, bob := newTestUser(t, wallet, 1), newTestUser(t, wallet, 2)
+	backend := newTestBackend(t, alice, bob)
+	chain := newTestChain(t, backend)
+	signer := testSigner(t, wallet, alice)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := transferETH(chain, signer, bob.DepositAddress, ethToWei(0.1))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	backend.Commit()
+
+	nonce, err := chain.Client.NonceAt(context.Background(), alice.DepositAddress, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, nonce, uint64(10))
+}
+
+func TestNonceManagerReplacesStuckTx(t *testing.T) {
+	wallet := newTestWallet(t)
+	alice, bob := newTestUser(t, wallet, 1), newTestUser(t, wallet, 2)
+	backend := newTestBackend(t, alice, bob)
+	chain := newTestChain(t, backend)
+	nonces := chain.Nonces
+	nonces.StuckAfter = 0
+
+	tx, err := transferETH(chain, testSigner(t, wallet, alice), bob.DepositAddress, ethToWei(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is mined, so the transaction is replaced.
+	nonces.CheckStuck(context.Background())
+	replacements := nonces.candidates(tx.Hash())
+	assert(t, len(replacements), 2)
+
+	backend.Commit()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	receipt, err := nonces.WaitMined(ctx, tx.Hash(), 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, receipt.TxHash, replacements[1])
+
+	// mined nonces are forgotten.
+	nonces.CheckStuck(context.Background())
+	assert(t, len(nonces.candidates(tx.Hash())), 1)
+}
+
+func TestNonceManagerRelease(t *testing.T) {
+	alice := newTestUser(t, newTestWallet(t), 1)
+	backend := newTestBackend(t, alice)
+	nonces := NewNonceManager(backend.Client())
+	ctx := context.Background()
+
+	nonce, _ := nonces.Next(ctx, alice.DepositAddress)
+	assert(t, nonce, uint64(0))
+	nonce, _ = nonces.Next(ctx, alice.DepositAddress)
+	assert(t, nonce, uint64(1))
+
+	// the chain still says 0, but 1 is handed out already.
+	nonces.Release(alice.DepositAddress, 0)
+	nonce, _ = nonces.Next(ctx, alice.DepositAddress)
+	assert(t, nonce, uint64(0))
+	nonce, _ = nonces.Next(ctx, alice.DepositAddress)
+	assert(t, nonce, uint64(2))
+}
+
+// heldClient fails sending the transactions of value fail and holds the
+// ones of value hold until release is closed.
+type heldClient struct {
+	ChainClient
+	fail, hold *big.Int
+	held       chan struct{}
+	release    chan struct{}
+}
+
+func (c *heldClient) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	switch {
+	case tx.Value().Cmp(c.fail) == 0:
+		return errors.New("i/o timeout")
+	case tx.Value().Cmp(c.hold) == 0:
+		close(c.held)
+		<-c.release
+	}
+	return c.ChainClient.SendTransaction(ctx, tx)
+}
+
+func TestNonceManagerReusesFailedNonce(t *testing.T) {
+	wallet := newTestWallet(t)
+	alice, bob := newTestUser(t, wallet, 1), newTestUser(t, wallet, 2)
+	backend := newTestBackend(t, alice, bob)
+	chain := newTestChain(t, backend)
+	client := &heldClient{
+		ChainClient: chain.Client,
+		fail:        big.NewInt(1),
+		hold:        big.NewInt(2),
+		held:        make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	chain.Client = client
+	signer := testSigner(t, wallet, alice)
+	ctx := context.Background()
+
+	// the first sender has nonce 0 and is still sending when the second one fails with 1.
+	sent := make(chan error)
+	go func() {
+		_, err := chain.SendTx(ctx, signer, bob.DepositAddress, big.NewInt(2), nil)
+		sent <- err
+	}()
+	<-client.held
+	if _, err := chain.SendTx(ctx, signer, bob.DepositAddress, big.NewInt(1), nil); err == nil {
+		t.Fatal("expected the send to fail")
+	}
+
+	// 1 is handed out again, not the 0 the chain has as pending.
+	tx, err := chain.SendTx(ctx, signer, bob.DepositAddress, big.NewInt(3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, tx.Nonce(), uint64(1))
+	close(client.release)
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	backend.Commit()
+	nonce, err := chain.Client.NonceAt(ctx, alice.DepositAddress, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, nonce, uint64(2))
+}
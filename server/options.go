@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
+
+	"github.com/ukibbb/crypto-exchange/config"
+)
+
+// ExchangeConfig tunes the workers of the exchange.
+type ExchangeConfig struct {
+	// blocks a deposit has to be buried under before it's credited.
+	Confirmations uint64
+	// first block scanned for deposits, the journal has where it got to after that.
+	DepositStartBlock uint64
+	Withdrawals       WithdrawalLimits
+	Settlement        SettlementConfig
+	// time after midnight UTC the trading day ends, day orders expire then.
+	DayEnd      time.Duration
+	TradingFees TradingFees
+}
+
+var DefaultExchangeConfig = ExchangeConfig{
+	Confirmations: 12,
+	Withdrawals:   DefaultWithdrawalLimits,
+	Settlement:    DefaultSettlementConfig,
+}
+
+// Options is everything StartServer needs to know.
+type Options struct {
+	Addr string
+	// the server speaks https when both are set.
+	TLSCert string
+	TLSKey  string
+	// requests per api key, or per ip without one. Zero turns it off.
+	RateLimit RateLimit
+
+	RPCURL string
+	// asked from the node when zero.
+	ChainID int64
+	Fees    FeeConfig
+
+	// encrypted keystore file of the hot wallet.
+	HotWalletKeystore string
+	// keystore directory of the deposit addresses.
+	DepositKeystore string
+	// passphrase of both keystores.
+	KeystorePassphrase string
+
+	UsersPath        string
+	KeysPath         string
+	JournalDir       string
+	SnapshotDir      string
+	SnapshotInterval time.Duration
+
+	// ERC-20 tokens to list, by asset.
+	Tokens map[Asset]common.Address
+	// markets opened next to the ETH market.
+	Markets map[Market]MarketAssets
+
+	Exchange ExchangeConfig
+}
+
+// DefaultOptions runs against a local dev chain.
+func DefaultOptions() Options {
+	return Options{
+		Addr:             ":3000",
+		RPCURL:           "http://localhost:7545",
+		Fees:             DefaultFeeConfig,
+		DepositKeystore:  "keystore/deposits",
+		UsersPath:        "data/users.json",
+		KeysPath:         "data/keys.json",
+		JournalDir:       "data/journal",
+		SnapshotDir:      "data/snapshots",
+		SnapshotInterval: 10 * time.Minute,
+		Tokens:           make(map[Asset]common.Address),
+		Markets:          make(map[Market]MarketAssets),
+		Exchange:         DefaultExchangeConfig,
+	}
+}
+
+// NewOptions turns a valid config into the options of the server.
+func NewOptions(cfg *config.Config) Options {
+	opts := DefaultOptions()
+
+	opts.Addr = cfg.Server.Listen
+	opts.TLSCert = cfg.Server.TLS.Cert
+	opts.TLSKey = cfg.Server.TLS.Key
+	opts.RateLimit = RateLimit{Rate: cfg.Server.RateLimit.Rate, Burst: cfg.Server.RateLimit.Burst}
+
+	opts.RPCURL = cfg.Chain.RPC
+	opts.ChainID = cfg.Chain.ChainID
+	opts.Fees = FeeConfig{
+		MaxTipCap:      new(big.Int).Mul(new(big.Int).SetUint64(cfg.Chain.Fees.MaxTipGwei), big.NewInt(params.GWei)),
+		MaxFeeCap:      new(big.Int).Mul(new(big.Int).SetUint64(cfg.Chain.Fees.MaxFeeGwei), big.NewInt(params.GWei)),
+		GasLimitMargin: cfg.Chain.Fees.GasLimitMargin,
+	}
+
+	opts.HotWalletKeystore = cfg.Keys.HotWallet
+	opts.DepositKeystore = cfg.Keys.Deposits
+	opts.KeystorePassphrase = cfg.Keys.Passphrase
+
+	opts.UsersPath = cfg.Storage.Users
+	opts.KeysPath = cfg.Storage.APIKeys
+	opts.JournalDir = cfg.Storage.Journal
+	opts.SnapshotDir = cfg.Storage.Snapshots
+	opts.SnapshotInterval = cfg.Storage.SnapshotInterval
+
+	for asset, address := range cfg.Tokens {
+		opts.Tokens[Asset(asset)] = common.HexToAddress(address)
+	}
+	for name, market := range cfg.Markets {
+		opts.Markets[Market(name)] = MarketAssets{Base: Asset(market.Base), Quote: Asset(market.Quote)}
+	}
+
+	opts.Exchange.Confirmations = cfg.Chain.Confirmations
+	opts.Exchange.DepositStartBlock = cfg.Chain.DepositStartBlock
+	opts.Exchange.Withdrawals = WithdrawalLimits{
+		MaxAmount:         cfg.Withdrawals.MaxAmount,
+		DailyLimit:        cfg.Withdrawals.DailyLimit,
+		ApprovalThreshold: cfg.Withdrawals.ApprovalThreshold,
+	}
+	opts.Exchange.TradingFees = TradingFees{Maker: cfg.Trading.MakerFee, Taker: cfg.Trading.TakerFee}
+	if dayEnd, err := time.Parse(config.DayEndLayout, cfg.Trading.DayEnd); err == nil {
+		opts.Exchange.DayEnd = dayEnd.Sub(time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC))
+	}
+
+	return opts
+}
+
+func (opts *Options) validate() error {
+	if opts.KeystorePassphrase == "" {
+		return errors.New("no keystore passphrase")
+	}
+	if opts.HotWalletKeystore == "" {
+		return errors.New("no hot wallet keystore")
+	}
+	if (opts.TLSCert == "") != (opts.TLSKey == "") {
+		return errors.New("tls needs both a certificate and a key")
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
+
+	"github.com/ukibbb/crypto-exchange/config"
+)
+
+func TestNewOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exchange.yaml")
+	err := os.WriteFile(path, []byte(`
+server:
+  listen: ":8443"
+  rateLimit: {rate: 20, burst: 40}
+chain:
+  confirmations: 6
+  fees: {maxTipGwei: 2, maxFeeGwei: 100, gasLimitMargin: 10}
+tokens:
+  USDC: "0x0000000000000000000000000000000000000abc"
+markets:
+  ETH-USDC: {base: ETH, quote: USDC}
+trading:
+  dayEnd: "21:30"
+  makerFee: 0.001
+  takerFee: 0.002
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := NewOptions(cfg)
+	assert(t, opts.Addr, ":8443")
+	assert(t, opts.RateLimit, RateLimit{Rate: 20, Burst: 40})
+	assert(t, opts.Fees.MaxTipCap, big.NewInt(2*params.GWei))
+	assert(t, opts.Fees.MaxFeeCap, big.NewInt(100*params.GWei))
+	assert(t, opts.Exchange.Confirmations, uint64(6))
+	assert(t, opts.Exchange.DayEnd, 21*time.Hour+30*time.Minute)
+	assert(t, opts.Exchange.TradingFees, TradingFees{Maker: 0.001, Taker: 0.002})
+	assert(t, opts.Exchange.Withdrawals, DefaultWithdrawalLimits)
+	assert(t, opts.Tokens[AssetUSDC], common.HexToAddress("0xabc"))
+	assert(t, opts.Markets[MarketETHUSDC], MarketAssets{Base: AssetETH, Quote: AssetUSDC})
+}
+
+func TestConfigDefaultsMatchTheServer(t *testing.T) {
+	assert(t, NewOptions(config.Default()), DefaultOptions())
+}
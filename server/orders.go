@@ -0,0 +1,304 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ukibbb/crypto-exchange/orderbook"
+)
+
+const (
+	OrderOpen      OrderStatus = "OPEN"
+	OrderFilled    OrderStatus = "FILLED"
+	OrderCancelled OrderStatus = "CANCELLED"
+	OrderExpired   OrderStatus = "EXPIRED"
+)
+
+type OrderStatus string
+
+// orderInfo is what the exchange keeps of every limit order,
+// it outlives the order in the book.
+type orderInfo struct {
+	Market Market
+	UserID int64
+	Bid    bool
+	Price  float64
+	// size the order was placed with. Orders restored from a
+	// snapshot only know the size they had at the snapshot.
+	Size float64
+	// unix nanoseconds, 0 for orders that don't expire.
+	ExpiresAt int64
+	// set when the order is cancelled, expired too when it expired.
+	cancelled bool
+	expired   bool
+	filled    float64
+}
+
+// OrderState is an order as the user sees it.
+type OrderState struct {
+	ID     int64
+	Market Market
+	UserID int64
+	Bid    bool
+	Price  float64
+	Size   float64
+	Filled float64
+	// still in the book, 0 once the order is filled or cancelled.
+	Remaining float64
+	Status    OrderStatus
+	// unix milliseconds the order expires at.
+	ExpiresAt int64 `json:",omitempty"`
+}
+
+type CancelOrderResponse struct {
+	Order OrderState
+}
+
+type CancelAllResponse struct {
+	Orders []OrderState
+}
+
+// newOrder is a new order with the next id, ids only go up, the journal
+// and the snapshots keep the last one. It has to be called with bookMu held.
+func (ex *Exchange) newOrder(bid bool, size float64, userID int64) *orderbook.Order {
+	ex.lastOrderID++
+	o := orderbook.NewOrder(bid, size, userID)
+	o.ID = ex.lastOrderID
+	return o
+}
+
+// indexOrder remembers the market of a limit order that was just placed.
+func (ex *Exchange) indexOrder(market Market, price float64, o *orderbook.Order) {
+	ex.orderIndex[o.ID] = &orderInfo{Market: market, UserID: o.UserID, Bid: o.Bid, Price: price, Size: o.Size, ExpiresAt: o.ExpiresAt}
+}
+
+// orderState has to be called with bookMu held, the book can't change under it.
+func (ex *Exchange) orderState(id int64, info *orderInfo) OrderState {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	state := OrderState{
+		ID:     id,
+		Market: info.Market,
+		UserID: info.UserID,
+		Bid:    info.Bid,
+		Price:  info.Price,
+		Size:   info.Size,
+	}
+	if info.ExpiresAt != 0 {
+		state.ExpiresAt = time.Unix(0, info.ExpiresAt).UnixMilli()
+	}
+
+	switch o, ok := ex.orderBooks[info.Market].Orders[id]; {
+	case info.expired:
+		state.Status = OrderExpired
+		state.Filled = info.filled
+	case info.cancelled:
+		state.Status = OrderCancelled
+		state.Filled = info.filled
+	case ok && o.Limit != nil:
+		state.Status = OrderOpen
+		state.Remaining = o.Size
+		state.Filled = info.Size - o.Size
+	default:
+		state.Status = OrderFilled
+		state.Filled = info.Size
+	}
+	return state
+}
+
+// cancelOrder takes the order out of its book and releases what's
+// still reserved for it. Orders that already left the book are an error.
+// It has to be called with bookMu held.
+func (ex *Exchange) cancelOrder(id int64, info *orderInfo) (OrderState, error) {
+	o, _, err := ex.executeLocked(info.Market, orderbook.Command{Type: orderbook.CmdCancel, OrderID: id})
+	if errors.Is(err, orderbook.ErrOrderNotFound) {
+		state := ex.orderState(id, info)
+		return state, errNotOpen(state)
+	}
+	if err != nil {
+		return OrderState{}, err
+	}
+
+	ex.mu.Lock()
+	ex.releaseOrder(info.Market, info.Price, o)
+	ex.cancelled(info, o)
+	ex.mu.Unlock()
+
+	return ex.orderState(id, info), nil
+}
+
+func errNotOpen(state OrderState) *APIError {
+	return ErrOrderNotOpen.
+		WithMessage("order [%d] is already %s", state.ID, strings.ToLower(string(state.Status))).
+		WithDetail("orderID", state.ID).
+		WithDetail("status", state.Status)
+}
+
+// cancelled forgets an order that just left the book as a resting order,
+// the caller releases its funds. It has to be called with ex.mu held.
+func (ex *Exchange) cancelled(info *orderInfo, o *orderbook.Order) {
+	info.cancelled = true
+	info.filled = info.Size - o.Size
+	orders := ex.Orders[o.UserID]
+	for i, userOrder := range orders {
+		if userOrder.ID == o.ID {
+			ex.Orders[o.UserID] = append(orders[:i:i], orders[i+1:]...)
+			break
+		}
+	}
+}
+
+// handleCancelOrder cancels an order of the caller on whatever market it's on.
+// Orders of other users look the same as orders that don't exist.
+func (ex *Exchange) handleCancelOrder(c echo.Context) error {
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+
+	ex.bookMu.Lock()
+	state, err := ex.cancelOwnOrder(authUserID(c), id)
+	ex.unlockBooks()
+	if err != nil {
+		return err
+	}
+	log.Printf("order canceled id => %d", id)
+
+	return c.JSON(http.StatusOK, &CancelOrderResponse{Order: state})
+}
+
+// cancelOwnOrder cancels a resting order or a stop of the user.
+// It has to be called with bookMu held.
+func (ex *Exchange) cancelOwnOrder(userID, id int64) (OrderState, error) {
+	if s, ok := ex.stops[id]; ok && s.UserID == userID {
+		if err := ex.journalStop(s, true); err != nil {
+			return OrderState{}, err
+		}
+		delete(ex.stops, id)
+		return s.cancelled(), nil
+	}
+	info, err := ex.ownOrder(userID, id)
+	if err != nil {
+		return OrderState{}, err
+	}
+	return ex.cancelOrder(id, info)
+}
+
+// cancelAll cancels the resting orders and stops of the filter on all
+// the markets in a single turn of the books, no order can come in between.
+func (ex *Exchange) cancelAll(markets []Market, filter orderbook.CancelFilter) ([]OrderState, error) {
+	ex.bookMu.Lock()
+	defer ex.unlockBooks()
+
+	states := []OrderState{}
+	for _, market := range markets {
+		ob, ok := ex.orderBooks[market]
+		if !ok {
+			return nil, ErrMarketNotFound.WithDetail("market", market)
+		}
+		states = append(states, ex.cancelStops(market, filter)...)
+		orders := ob.Select(filter)
+		if len(orders) == 0 {
+			continue
+		}
+		prices := make([]float64, len(orders))
+		for i, o := range orders {
+			prices[i] = o.Limit.Price
+		}
+
+		if _, _, err := ex.executeLocked(market, orderbook.CancelAllCommand(filter)); err != nil {
+			return nil, err
+		}
+
+		infos := make([]*orderInfo, len(orders))
+		ex.mu.Lock()
+		for i, o := range orders {
+			info, ok := ex.orderIndex[o.ID]
+			if !ok {
+				info = &orderInfo{Market: market, UserID: o.UserID, Bid: o.Bid, Price: prices[i], Size: o.Size}
+				ex.orderIndex[o.ID] = info
+			}
+			ex.releaseOrder(market, prices[i], o)
+			ex.cancelled(info, o)
+			infos[i] = info
+		}
+		ex.mu.Unlock()
+
+		for i, o := range orders {
+			states = append(states, ex.orderState(o.ID, infos[i]))
+		}
+	}
+	return states, nil
+}
+
+// allMarkets lists the markets sorted by name.
+func (ex *Exchange) allMarkets() []Market {
+	markets := make([]Market, 0, len(ex.markets))
+	for market := range ex.markets {
+		markets = append(markets, market)
+	}
+	sort.Slice(markets, func(i, j int) bool { return markets[i] < markets[j] })
+	return markets
+}
+
+// sideParam reads the side of the query, bid or ask in any case. Empty is both sides.
+func sideParam(c echo.Context) (string, error) {
+	side := strings.ToUpper(c.QueryParam("side"))
+	if side != "" && side != orderbook.SideBid && side != orderbook.SideAsk {
+		return "", ErrBadRequest.WithMessage("unknown side [%s]", c.QueryParam("side"))
+	}
+	return side, nil
+}
+
+// handleCancelAll cancels every resting order of the caller, on all
+// markets unless the query names one, and on one side if it names that.
+func (ex *Exchange) handleCancelAll(c echo.Context) error {
+	side, err := sideParam(c)
+	if err != nil {
+		return err
+	}
+	var markets []Market
+	if market := Market(c.QueryParam("market")); market != "" {
+		if _, ok := ex.markets[market]; !ok {
+			return ErrMarketNotFound.WithDetail("market", market)
+		}
+		markets = append(markets, market)
+	} else {
+		markets = ex.allMarkets()
+	}
+
+	userID := authUserID(c)
+	states, err := ex.cancelAll(markets, orderbook.CancelFilter{UserID: userID, Side: side})
+	if err != nil {
+		return err
+	}
+	log.Printf("canceled %d orders of user %d", len(states), userID)
+
+	return c.JSON(http.StatusOK, &CancelAllResponse{Orders: states})
+}
+
+// handleClearMarket cancels the orders of every user on the market, for admins.
+func (ex *Exchange) handleClearMarket(c echo.Context) error {
+	market := Market(c.Param("market"))
+	if _, ok := ex.markets[market]; !ok {
+		return ErrMarketNotFound.WithDetail("market", market)
+	}
+	side, err := sideParam(c)
+	if err != nil {
+		return err
+	}
+
+	states, err := ex.cancelAll([]Market{market}, orderbook.CancelFilter{AllUsers: true, Side: side})
+	if err != nil {
+		return err
+	}
+	log.Printf("cleared %d orders of market %s", len(states), market)
+
+	return c.JSON(http.StatusOK, &CancelAllResponse{Orders: states})
+}
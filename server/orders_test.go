@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestCancelOrder(t *testing.T) {
+	ex := newTestExchange(t, "")
+	e := echo.New()
+	ex.RegisterRoutes(e)
+
+	alice, _ := ex.Users.Add(&User{})
+	bob, _ := ex.Users.Add(&User{})
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermRead, PermTrade)
+	bobKey, _ := ex.APIKeys.Create(bob.ID, PermRead, PermTrade)
+	ex.Ledger.Credit(alice.ID, AssetUSD, 1000)
+	ex.Ledger.Credit(bob.ID, AssetETH, 10)
+
+	serve := signedServer(t, e)
+	placeBid := func(size string) int64 {
+		placed := &PlaceOrderResponse{}
+		code := serve(aliceKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":`+size+`,"Price":100}`, placed)
+		assert(t, code, http.StatusOK)
+		return placed.OrderID
+	}
+
+	id := placeBid("2")
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 800, Locked: 200})
+
+	// bob can't see alice's orders, let alone cancel them.
+	apiErr := &APIError{}
+	assert(t, serve(bobKey, http.MethodDelete, "/order/"+itoa(id), "", apiErr), http.StatusNotFound)
+	assert(t, apiErr.Code, CodeOrderNotFound)
+
+	assert(t, serve(bobKey, http.MethodPost, "/order", `{"Type":"MARKET","Market":"ETH","Size":0.5}`, nil), http.StatusOK)
+
+	resp := &CancelOrderResponse{}
+	assert(t, serve(aliceKey, http.MethodDelete, "/order/"+itoa(id), "", resp), http.StatusOK)
+	assert(t, resp.Order, OrderState{ID: id, Market: MarketETH, UserID: alice.ID, Bid: true, Price: 100, Size: 2, Filled: 0.5, Status: OrderCancelled})
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 950})
+	assert(t, len(ex.Orders[alice.ID]), 0)
+
+	apiErr = &APIError{}
+	assert(t, serve(aliceKey, http.MethodDelete, "/order/"+itoa(id), "", apiErr), http.StatusConflict)
+	assert(t, apiErr.Code, CodeOrderNotOpen)
+	assert(t, apiErr.Details["status"], string(OrderCancelled))
+
+	filled := placeBid("1")
+	assert(t, serve(bobKey, http.MethodPost, "/order", `{"Type":"MARKET","Market":"ETH","Size":1}`, nil), http.StatusOK)
+	apiErr = &APIError{}
+	assert(t, serve(aliceKey, http.MethodDelete, "/order/"+itoa(filled), "", apiErr), http.StatusConflict)
+	assert(t, apiErr.Details["status"], string(OrderFilled))
+}
+
+func TestCancelAll(t *testing.T) {
+	dir := t.TempDir()
+	ex := newTestExchange(t, dir)
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+
+	alice, _ := ex.Users.Add(&User{})
+	bob, _ := ex.Users.Add(&User{})
+	admin, _ := ex.Users.Add(&User{})
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermTrade)
+	bobKey, _ := ex.APIKeys.Create(bob.ID, PermTrade)
+	adminKey, _ := ex.APIKeys.Create(admin.ID, PermAdmin)
+	ex.Ledger.Credit(alice.ID, AssetUSD, 1000)
+	ex.Ledger.Credit(alice.ID, AssetETH, 10)
+	ex.Ledger.Credit(bob.ID, AssetETH, 10)
+
+	place := func(key *APIKey, bid bool, price string) {
+		body := `{"Type":"LIMIT","Market":"ETH","Bid":` + strconv.FormatBool(bid) + `,"Size":1,"Price":` + price + `}`
+		assert(t, serve(key, http.MethodPost, "/order", body, nil), http.StatusOK)
+	}
+	place(aliceKey, true, "90")
+	place(aliceKey, true, "95")
+	place(aliceKey, false, "110")
+	place(bobKey, false, "120")
+
+	apiErr := &APIError{}
+	assert(t, serve(aliceKey, http.MethodDelete, "/orders?side=up", "", apiErr), http.StatusBadRequest)
+	assert(t, serve(aliceKey, http.MethodDelete, "/orders?market=DOGE", "", apiErr), http.StatusNotFound)
+	assert(t, apiErr.Code, CodeMarketNotFound)
+
+	resp := &CancelAllResponse{}
+	assert(t, serve(aliceKey, http.MethodDelete, "/orders?market=ETH&side=bid", "", resp), http.StatusOK)
+	assert(t, len(resp.Orders), 2)
+	for _, o := range resp.Orders {
+		assert(t, o.Bid, true)
+		assert(t, o.Status, OrderCancelled)
+	}
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 1000})
+	assert(t, ex.Ledger.Balance(alice.ID, AssetETH), Balance{Available: 9, Locked: 1})
+
+	// bob's order is not alice's to cancel.
+	resp = &CancelAllResponse{}
+	assert(t, serve(aliceKey, http.MethodDelete, "/orders", "", resp), http.StatusOK)
+	assert(t, len(resp.Orders), 1)
+	assert(t, resp.Orders[0].Price, 110.0)
+	assert(t, len(ex.Orders[alice.ID]), 0)
+	assert(t, ex.orderBooks[MarketETH].AskTotalVolume(), 1.0)
+
+	// only admins clear a market.
+	assert(t, serve(bobKey, http.MethodDelete, "/book/ETH/orders", "", nil), http.StatusForbidden)
+	resp = &CancelAllResponse{}
+	assert(t, serve(adminKey, http.MethodDelete, "/book/ETH/orders", "", resp), http.StatusOK)
+	assert(t, len(resp.Orders), 1)
+	assert(t, resp.Orders[0].UserID, bob.ID)
+	assert(t, ex.Ledger.Balance(bob.ID, AssetETH), Balance{Available: 10})
+	ex.Journal.Close()
+
+	// the cancels are journaled like any other command.
+	recovered := newTestExchange(t, dir)
+	if err := recovered.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(recovered.orderBooks[MarketETH].Orders), 0)
+}
+
+// signedServer serves signed requests of the key. The same request
+// twice in a millisecond is a replay, so each one gets its own.
+func TestAmendOrder(t *testing.T) {
+	ex := newTestExchange(t, "")
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+
+	alice, _ := ex.Users.Add(&User{})
+	bob, _ := ex.Users.Add(&User{})
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermRead, PermTrade)
+	bobKey, _ := ex.APIKeys.Create(bob.ID, PermRead, PermTrade)
+	ex.Ledger.Credit(alice.ID, AssetUSD, 1000)
+
+	placed := &PlaceOrderResponse{}
+	assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":2,"Price":100}`, placed), http.StatusOK)
+	path := "/order/" + itoa(placed.OrderID)
+
+	assert(t, serve(bobKey, http.MethodPatch, path, `{"Market":"ETH","Price":90,"Size":1}`, nil), http.StatusNotFound)
+	assert(t, serve(aliceKey, http.MethodPatch, path, `{"Market":"ETH","Price":90,"Size":3}`, nil), http.StatusOK)
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 730, Locked: 270})
+
+	// what can't be paid for leaves the order as it was.
+	assert(t, serve(aliceKey, http.MethodPatch, path, `{"Market":"ETH","Price":500,"Size":3}`, nil), http.StatusBadRequest)
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 730, Locked: 270})
+
+	ex.bookMu.Lock()
+	ex.setPhase(MarketETH, &marketAuction{phase: PhaseHalted})
+	ex.bookMu.Unlock()
+	assert(t, serve(aliceKey, http.MethodPatch, path, `{"Market":"ETH","Price":80,"Size":1}`, nil), http.StatusConflict)
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 730, Locked: 270})
+}
+
+func signedServer(t *testing.T, e *echo.Echo) func(key *APIKey, method, path, body string, out any) int {
+	requests := 0
+	return func(key *APIKey, method, path, body string, out any) int {
+		requests++
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, signedRequest(key, method, path, body, time.Now().Add(time.Duration(requests)*time.Millisecond)))
+		if out != nil {
+			if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+				t.Fatalf("%s: %s", rec.Body, err)
+			}
+		}
+		return rec.Code
+	}
+}
+
+func itoa(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+func TestGetBookHasOrderIDs(t *testing.T) {
+	ex := newTestExchange(t, "")
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	placeTestOrders(t, ex, 1, 4)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/book/ETH", nil))
+	assert(t, rec.Code, http.StatusOK)
+	book := &OrderBookData{}
+	if err := json.Unmarshal(rec.Body.Bytes(), book); err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for _, o := range append(book.Asks, book.Bids...) {
+		ids = append(ids, o.ID)
+	}
+	assert(t, ids, []int64{1, 3, 4, 2})
+}
@@ -0,0 +1,59 @@
+package server
+
+import "log"
+
+// settlePegs moves the reservations of the pegged orders the book just
+// repriced. A bid that went up locks more of the quote asset, when the user
+// doesn't have it the order is cancelled at the price it was reserved at.
+// It has to be called with bookMu held.
+func (ex *Exchange) settlePegs(market Market) {
+	type unfunded struct {
+		id   int64
+		info *orderInfo
+	}
+	var cancel []unfunded
+
+	ex.mu.Lock()
+	for _, o := range ex.orderBooks[market].Pegged() {
+		info, ok := ex.orderIndex[o.ID]
+		// still being placed, it's reserved at the price it got.
+		if !ok || info.Price == o.Limit.Price {
+			continue
+		}
+		if o.Bid {
+			ex.releaseOrder(market, info.Price, o)
+			if err := ex.reserveLimitOrder(market, o.Limit.Price, o); err != nil {
+				if err := ex.reserveLimitOrder(market, info.Price, o); err != nil {
+					log.Printf("pegged order %d: reserving it again: %s", o.ID, err)
+				}
+				cancel = append(cancel, unfunded{id: o.ID, info: info})
+				continue
+			}
+		}
+		info.Price = o.Limit.Price
+	}
+	ex.mu.Unlock()
+
+	for _, c := range cancel {
+		if _, err := ex.cancelOrder(c.id, c.info); err != nil {
+			log.Printf("cancelling pegged order %d: %s", c.id, err)
+			continue
+		}
+		log.Printf("pegged order %d of user %d cancelled, no funds to follow the book", c.id, c.info.UserID)
+	}
+}
+
+// pegPrice is where a pegged order of the request goes now.
+func (ex *Exchange) pegPrice(market Market, req *PlaceOrderRequest) (float64, error) {
+	if req.Type != LimitOrder {
+		return 0, ErrBadRequest.WithMessage("only limit orders can be pegged")
+	}
+	if err := req.Peg.Check(); err != nil {
+		return 0, badRequest(err)
+	}
+	price, ok := ex.orderBooks[market].PegPrice(req.Bid, req.Peg)
+	if !ok {
+		return 0, ErrBadRequest.WithMessage("market %s has no %s price to peg to", market, req.Peg.Ref)
+	}
+	return price, nil
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestPeggedOrderFollowsBook(t *testing.T) {
+	ex := newTestExchange(t, "")
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+
+	alice, _ := ex.Users.Add(&User{})
+	carol, _ := ex.Users.Add(&User{})
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermRead, PermTrade)
+	carolKey, _ := ex.APIKeys.Create(carol.ID, PermTrade)
+	ex.Ledger.Credit(alice.ID, AssetUSD, 250)
+	ex.Ledger.Credit(carol.ID, AssetUSD, 1000)
+
+	bid := func(price string) {
+		assert(t, serve(carolKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":1,"Price":`+price+`}`, nil), http.StatusOK)
+	}
+	pegged := `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":1,"Peg":{"Ref":"PRIMARY","Offset":1}}`
+
+	apiErr := &APIError{}
+	assert(t, serve(aliceKey, http.MethodPost, "/order", pegged, apiErr), http.StatusBadRequest)
+	assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":1,"Peg":{"Ref":"LAST"}}`, apiErr), http.StatusBadRequest)
+
+	bid("100")
+	placed := &PlaceOrderResponse{}
+	assert(t, serve(aliceKey, http.MethodPost, "/order", pegged, placed), http.StatusOK)
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 149, Locked: 101})
+
+	// the reservation goes along with the price.
+	bid("110")
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 139, Locked: 111})
+	orders := &GetOrdersResponse{}
+	assert(t, serve(aliceKey, http.MethodGet, "/order/"+itoa(alice.ID), "", orders), http.StatusOK)
+	assert(t, orders.Bids[0].Price, 111.0)
+	assert(t, orders.Bids[0].Peg.Offset, 1.0)
+
+	apiErr = &APIError{}
+	assert(t, serve(aliceKey, http.MethodPatch, "/order/"+itoa(placed.OrderID), `{"Market":"ETH","Price":120,"Size":1}`, apiErr), http.StatusBadRequest)
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 139, Locked: 111})
+
+	// alice can't follow it to 301, the order goes.
+	bid("300")
+	assert(t, ex.Ledger.Balance(alice.ID, AssetUSD), Balance{Available: 250})
+	cancelled := &APIError{}
+	assert(t, serve(aliceKey, http.MethodDelete, "/order/"+itoa(placed.OrderID), "", cancelled), http.StatusConflict)
+	assert(t, cancelled.Details["status"], string(OrderCancelled))
+}
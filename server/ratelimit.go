@@ -0,0 +1,61 @@
+package server
+
+import (
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
+)
+
+type RateLimit struct {
+	// requests per second.
+	Rate float64
+	// requests allowed at once above the rate.
+	Burst int
+}
+
+// rateLimiter limits every api key on its own, requests that aren't
+// authenticated share the limit of their ip. The key is only taken once
+// it's verified, made up keys don't get a limit of their own.
+// A nil rateLimiter doesn't limit anything.
+type rateLimiter struct {
+	store middleware.RateLimiterStore
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{store: middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+		Rate:      rate.Limit(limit.Rate),
+		Burst:     limit.Burst,
+		ExpiresIn: 3 * time.Minute,
+	})}
+}
+
+// allow takes the request off the limit of the key, of its ip without one.
+func (rl *rateLimiter) allow(c echo.Context, key *APIKey) error {
+	if rl == nil {
+		return nil
+	}
+	id := "ip:" + c.RealIP()
+	if key != nil {
+		id = "key:" + key.Key
+	}
+	ok, err := rl.store.Allow(id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// limitByIP limits the routes that don't authenticate, requireAuth limits the others.
+func (ex *Exchange) limitByIP(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := ex.limiter.allow(c, nil); err != nil {
+			return err
+		}
+		return next(c)
+	}
+}
@@ -2,23 +2,25 @@ package server
 
 import (
 	"context"
-	"crypto/ecdsa"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"net/http"
-	"strconv"
+	"os"
+	"os/signal"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
 
 	"github.com/labstack/echo/v4"
 	"github.com/ukibbb/crypto-exchange/orderbook"
+	"github.com/ukibbb/crypto-exchange/wal"
 )
 
 // Account nonce.
@@ -27,61 +29,43 @@ import (
 // If it's a new account sending out a transaction then the nonce will be 0.
 // Every new transaction from an account must have a nonce that the previous nonce incremented by 1.
 // the ethereum client provides a helper method PendingNonceAt that will return the next nonce you should use.
+// Asking for it on every send breaks as soon as two transfers from the same account
+// run at the same time, so the NonceManager hands them out instead.
 
 // The function requires the public address of the account we're sending from
-// -- which we can derive from the private key.
-
-func transferETH(client *ethclient.Client, fromPrivKey *ecdsa.PrivateKey, to common.Address, amount *big.Int) error {
-	ctx := context.Background()
-	publicKey := fromPrivKey.Public()
-	publicKeyEcdsa, ok := publicKey.(*ecdsa.PublicKey)
-	if !ok {
-		return errors.New("error casting publick key to ECDSA")
-	}
-	fromAddress := crypto.PubkeyToAddress(*publicKeyEcdsa)
-	nonce, err := client.PendingNonceAt(ctx, fromAddress)
-	if err != nil {
-		return err
-	}
-
-	// amount := big.NewInt(int64(1000000000000000000)) // in wei (1 eth)
-	gasLimit := uint64(21000) // in units // gas Limit for standard eth transfer
-	// The go-ethereum client provides the SuggestGasPrice function
-	// for getting the average gas price based on x number of previous blocks.
-	gasPrice, err := client.SuggestGasPrice(context.Background()) // in wei (30 gwei)
-	if err != nil {
-		return err
-	}
-	// toAddress := common.HexToAddress("0x71B4ef0D3632C6b4d9A4bEf27B8b0136DEF7EFa2")
-	tx := types.NewTransaction(nonce, to, amount, gasLimit, gasPrice, nil)
-	chainID := big.NewInt(1337)
-	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), fromPrivKey)
-	if err != nil {
-		return err
-	}
-	return client.SendTransaction(ctx, signedTx)
-
-}
+// -- which the signer knows, the private key itself never leaves it.
 
 // Ether supports up to 18 decimal places so 1 ETH is 1 plus 18 zeros.
 // Etherum blockchain uses wei
 
-// The next step is to sign the transaction with the private key of the sender.
-// To do this we call the SignTx method that takes
-// in the unsigned transaction and the private key that we constructed earlier.
-// The SignTx method requires the EIP155 signer, which we derive the chain ID from the client.
+// The transaction is an EIP-1559 dynamic fee transaction, instead of a single gas price
+// it pays the base fee of the block plus a tip for the miner, up to the fee cap.
+// The gas limit is estimated by the node, 21000 for a plain transfer.
 
-// chainID, err := client.NetworkID(context.Background())
+// The next step is to have the signer of the sender sign the transaction.
+// The signer needs the chain ID so a transaction can't be replayed on another network,
+// we ask the client for it (or take it from the config).
 
 // Now we are finally ready to broadcast the transaction to the entire network
 // by calling SendTransaction on the client which takes in the signed transaction.
 
+func transferETH(chain *Chain, from Signer, to common.Address, amount *big.Int) (*types.Transaction, error) {
+	return chain.SendTx(context.Background(), from, to, amount, nil)
+}
+
 const (
-	MarketOrder        OrderType = "MARKET"
-	LimitOrder         OrderType = "LIMIT"
-	exchangePrivateKey string    = "8185d90ca5d546283e99f33cad1d6c97e8ea707e2cf6bf1dd65ae8f7b53878f0"
+	MarketOrder OrderType = "MARKET"
+	LimitOrder  OrderType = "LIMIT"
+	// waits outside the book and places a market or limit order when it fires.
+	StopOrder OrderType = "STOP"
 
 	MarketETH Market = "ETH"
+	// markets of two listed assets are named BASE-QUOTE.
+	MarketETHUSDC Market = "ETH-USDC"
+
+	AssetUSDC Asset = "USDC"
+
+	AssetUSD Asset = "USD"
 )
 
 type (
@@ -89,120 +73,304 @@ type (
 	Market    string
 )
 
-func StartServer() {
+// MarketAssets are the two assets traded on a market.
+// Sizes are in the base asset, prices in the quote asset.
+type MarketAssets struct {
+	Base  Asset
+	Quote Asset
+}
+
+// StartServer runs the exchange until the server stops.
+func StartServer(opts Options) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	ctx := context.Background()
+
 	e := echo.New()
-	e.HTTPErrorHandler = httpErrorHandler
-	client, err := ethclient.Dial("http://localhost:7545")
+	client, err := ethclient.Dial(opts.RPCURL)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	ex, err := NewExchange(exchangePrivateKey, client)
+	var chainID *big.Int
+	if opts.ChainID != 0 {
+		chainID = big.NewInt(opts.ChainID)
+	}
+	chain, err := NewChain(ctx, client, chainID, opts.Fees)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	hotWallet, err := LoadKeystoreSigner(opts.HotWalletKeystore, opts.KeystorePassphrase)
+	if err != nil {
+		return err
+	}
+	wallet := NewKeystoreWallet(keystore.NewKeyStore(opts.DepositKeystore, keystore.StandardScryptN, keystore.StandardScryptP), opts.KeystorePassphrase)
+	users, err := NewUserRegistry(opts.UsersPath)
+	if err != nil {
+		return err
+	}
+	keys, err := NewAPIKeyStore(opts.KeysPath, opts.KeystorePassphrase)
+	if err != nil {
+		return err
+	}
+	ex := NewExchange(hotWallet, wallet, users, chain, opts.Exchange)
+	if opts.RateLimit.Rate > 0 {
+		ex.limiter = newRateLimiter(opts.RateLimit)
+	}
+	ex.APIKeys = keys
+	log.Printf("hot wallet => %s", hotWallet.Address().Hex())
 
-	// account := common.HexToAddress("0xD89596A710328F6e2970e97Ad341293509ddAA03")
-
-	// ctx := context.Background()
-	// balance, err := client.BalanceAt(ctx, account, nil)
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// ethConversionFactor := new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
-	// // Since the division result may be fractional, convert big.Int to big.Float
-	// weiFloat := new(big.Float).SetInt(balance)
-	// ethConversionFactorFloat := new(big.Float).SetInt(ethConversionFactor) // Convert factor to big.Float
-	// eth := new(big.Float).Quo(weiFloat, ethConversionFactorFloat)
-
-	// fmt.Println("eth wei", eth, balance)
+	for asset, address := range opts.Tokens {
+		token, err := chain.NewToken(ctx, asset, address)
+		if err != nil {
+			return fmt.Errorf("listing %s: %w", asset, err)
+		}
+		ex.ListToken(token)
+	}
+	for market, assets := range opts.Markets {
+		if err := ex.AddMarket(market, assets); err != nil {
+			return fmt.Errorf("market %s: %w", market, err)
+		}
+	}
 
-	// privateKey, err := crypto.HexToECDSA("8185d90ca5d546283e99f33cad1d6c97e8ea707e2cf6bf1dd65ae8f7b53878f0")
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
+	journal, err := wal.Open(opts.JournalDir, wal.Options{})
+	if err != nil {
+		return err
+	}
+	ex.Journal = journal
+	ex.SnapshotDir = opts.SnapshotDir
+	if err := ex.Recover(); err != nil {
+		return err
+	}
 
-	// func ethToWei(ethValue float64) *big.Int {
-	// 	eth := big.NewFloat(ethValue)
-	// 	ethConversionFactor := new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil))
-	// 	weiFloat := new(big.Float).Mul(eth, ethConversionFactor)
-	// 	wei := new(big.Int)
-	// 	weiFloat.Int(wei) // Convert back to big.Int
-	// 	return wei
-	// }
-	pkStr := "94be1fbf0c0b02d2196f7f3f610db86590435a8f773ef60aa5724d2154d6a506"
-	user := NewUser(pkStr, 5)
-	ex.Users[user.ID] = user
+	// the operator is created with the cli, the server never hands out keys it wasn't asked for.
+	if keys.Len() == 0 {
+		log.Printf("no api keys yet, create the operator with: exchange user create -admin")
+	}
 
-	e.Start(":3000")
+	// the workers stop with the context, SIGINT or SIGTERM cancel it.
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	e.POST("/order", ex.handlePlaceOrder)
-	e.DELETE("/order/:id", ex.handleCancelOrder)
+	go ex.Chain.Nonces.Run(ctx, 15*time.Second)
+	go ex.Withdrawals.Run(ctx)
+	go ex.Settler.Run(ctx)
+	go ex.Deposits.Run(ctx, 15*time.Second)
+	go ex.RunSnapshots(ctx, opts.SnapshotInterval)
+	go ex.RunExpiry(ctx)
 
-	e.GET("/order/:userID", ex.handleGetOrders)
-	e.GET("/book/:market", ex.handleGetBook)
-	e.GET("/book/:market/bid", ex.handleGetBestBid)
-	e.GET("/book/:market/ask", ex.handleGetBestAsk)
-}
+	ex.RegisterRoutes(e)
 
-type User struct {
-	ID         int64
-	PrivateKey *ecdsa.PrivateKey
-}
+	errc := make(chan error, 1)
+	go func() {
+		if opts.TLSCert != "" {
+			errc <- e.StartTLS(opts.Addr, opts.TLSCert, opts.TLSKey)
+		} else {
+			errc <- e.Start(opts.Addr)
+		}
+	}()
 
-func NewUser(privateKey string, id int64) *User {
-	ecdsaPrivateKey, err := crypto.HexToECDSA(privateKey)
-	if err != nil {
-		panic(err)
+	select {
+	case err := <-errc:
+		ex.Close()
+		return err
+	case <-ctx.Done():
 	}
-
-	return &User{
-		ID:         id,
-		PrivateKey: ecdsaPrivateKey,
+	stop()
+	log.Printf("shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	ex.Drain()
+	if err := e.Shutdown(ctx); err != nil {
+		log.Printf("requests still running after %s: %s", shutdownTimeout, err)
 	}
+	return ex.Close()
 }
 
-func httpErrorHandler(err error, c echo.Context) {
-	fmt.Println(err)
-}
-
-func NewExchange(privateKey string, client *ethclient.Client) (*Exchange, error) {
+// RegisterRoutes adds the api of the exchange to e, the errors
+// of the handlers are written as APIError.
+func (ex *Exchange) RegisterRoutes(e *echo.Echo) {
+	e.HTTPErrorHandler = httpErrorHandler
 
-	ecdsaPrivateKey, err := crypto.HexToECDSA(privateKey)
-	if err != nil {
-		return nil, err
-	}
+	read, trade, withdraw, admin := ex.requireAuth(PermRead), ex.requireAuth(PermTrade), ex.requireAuth(PermWithdraw), ex.requireAuth(PermAdmin)
+
+	e.POST("/order", ex.handlePlaceOrder, ex.takingOrders, trade)
+	e.POST("/order/signed", ex.handlePlaceSignedOrder, ex.limitByIP, ex.takingOrders)
+	e.DELETE("/order/:id", ex.handleCancelOrder, trade)
+	e.DELETE("/orders", ex.handleCancelAll, trade)
+	e.POST("/orders/batch", ex.handlePlaceBatch, ex.takingOrders, trade)
+	e.POST("/cancel-after", ex.handleCancelAfter, trade)
+	e.GET("/ws", ex.handleSession, trade)
+	e.PATCH("/order/:id", ex.handleAmendOrder, ex.takingOrders, trade)
+	e.POST("/links", ex.handlePlaceLink, ex.takingOrders, trade)
+	e.GET("/links", ex.handleGetLinks, read)
+
+	e.GET("/order/:userID", ex.handleGetOrders, read)
+	e.GET("/book/:market", ex.handleGetBook, ex.limitByIP)
+	e.GET("/book/:market/bid", ex.handleGetBestBid, ex.limitByIP)
+	e.GET("/book/:market/ask", ex.handleGetBestAsk, ex.limitByIP)
+	e.DELETE("/book/:market/orders", ex.handleClearMarket, admin)
+	e.GET("/book/:market/auction", ex.handleGetAuction, ex.limitByIP)
+	e.POST("/book/:market/auction", ex.handleStartAuction, admin)
+	e.POST("/book/:market/uncross", ex.handleUncross, admin)
+	e.POST("/book/:market/halt", ex.handleHaltMarket, admin)
+
+	e.GET("/trade/:id", ex.handleGetTrade, read)
+
+	e.POST("/users", ex.handleCreateUser, admin)
+	e.GET("/users/:id", ex.handleGetUser, read)
+	e.PUT("/users/:id/status", ex.handleSetUserStatus, admin)
+	e.GET("/users/:id/keys", ex.handleGetAPIKeys, read)
+	e.POST("/users/:id/keys", ex.handleCreateAPIKey, read)
+	e.DELETE("/users/:id/keys/:key", ex.handleRevokeAPIKey, read)
+
+	e.GET("/balance/:userID", ex.handleGetBalances, read)
+	e.POST("/balance/:userID/credit", ex.handleCreditBalance, admin)
+	e.POST("/withdraw", ex.handleWithdraw, withdraw)
+	e.GET("/withdraw/:id", ex.handleGetWithdrawal, read)
+	e.POST("/withdraw/:id/approve", ex.handleApproveWithdrawal, admin)
+	e.POST("/withdraw/:id/reject", ex.handleRejectWithdrawal, admin)
+}
 
+// NewExchange holds the funds of the users on the deposit addresses of the
+// wallet, the hot wallet pays their gas. See custody.go.
+func NewExchange(hotWallet Signer, wallet Wallet, users *UserRegistry, chain *Chain, config ExchangeConfig) *Exchange {
 	orderbooks := make(map[Market]*orderbook.OrderBook)
 	orderbooks[MarketETH] = orderbook.NewOrderBook()
-	return &Exchange{
-		Client: client,
-		Users:  make(map[int64]*User),
+	markets := map[Market]MarketAssets{
+		MarketETH: {Base: AssetETH, Quote: AssetUSD},
+	}
+	ledger := NewLedger()
+	ex := &Exchange{
+		Chain: chain,
+		Users: users,
 		// orders:     make(map[int64]int64),
-		Orders:     make(map[int64][]*orderbook.Order),
-		PrivateKey: ecdsaPrivateKey,
-		orderBooks: orderbooks,
-	}, nil
+		Orders:       make(map[int64][]*orderbook.Order),
+		HotWallet:    hotWallet,
+		Wallet:       wallet,
+		Ledger:       ledger,
+		APIKeys:      newAPIKeyStore(""),
+		orderIndex:   make(map[int64]*orderInfo),
+		orderNonces:  make(map[common.Address]map[uint64]bool),
+		Withdrawals:  NewWithdrawalWorker(chain, wallet, users.Get, ledger, config.Withdrawals),
+		orderBooks:   orderbooks,
+		markets:      markets,
+		tokens:       make(map[Asset]*Token),
+		expiryWake:   make(chan struct{}, 1),
+		dayEndOffset: config.DayEnd,
+		tradingFees:  config.TradingFees,
+		stops:        make(map[int64]*stopOrder),
+		links:        make(map[int64]*orderLink),
+		linked:       make(map[int64]int64),
+		auctions:     make(map[Market]*marketAuction),
+	}
+	ledger.journal = ex.journalLedger
+	ex.Settler = NewSettler(chain, ex.settlementUser, wallet, config.Settlement)
+	ex.Settler.journal = ex.journalLedger
+	ex.Deposits = NewDepositWatcher(chain, ledger, users.Addresses, config.Confirmations, config.DepositStartBlock)
+	if hotWallet != nil {
+		ex.Deposits.gasFunder = hotWallet.Address()
+		if chain != nil {
+			chain.GasFunder = hotWallet
+		}
+	}
+	ex.deadMan = newDeadManSwitch(ex.cancelUserOrders)
+
+	return ex
 }
 
 type Exchange struct {
-	Client *ethclient.Client
-
-	mu    sync.RWMutex
-	Users map[int64]*User
-
+	Chain *Chain
+
+	Users *UserRegistry
+	// every command to the books is written to it first, nil turns it off.
+	Journal *wal.Log
+	// snapshots of the books are written here, empty turns them off.
+	SnapshotDir string
+	// commands to the books run one at a time.
+	bookMu sync.Mutex
+	// set once the exchange stops taking orders.
+	draining atomic.Bool
+	// cancels the orders of users whose bots stopped checking in.
+	deadMan  *deadManSwitch
+	sessions sessions
+	// nil when the requests aren't limited.
+	limiter *rateLimiter
+	// orders with an expiry, guarded by bookMu.
+	expiries     expiryQueue
+	expiryWake   chan struct{}
+	dayEndOffset time.Duration
+	tradingFees  TradingFees
+	// stops waiting to fire by id, guarded by bookMu.
+	stops map[int64]*stopOrder
+	// OCO pairs and brackets by id and the link of every order in one, guarded by bookMu.
+	links      map[int64]*orderLink
+	linked     map[int64]int64
+	nextLinkID int64
+	// the last id of an order or a stop, guarded by bookMu.
+	lastOrderID int64
+	// markets in an auction or halted, guarded by bookMu.
+	auctions map[Market]*marketAuction
+
+	mu     sync.RWMutex
 	Orders map[int64][]*orderbook.Order
+	// every limit order by id, filled and cancelled ones too.
+	orderIndex map[int64]*orderInfo
 	// orders     map[int64]int64
-	PrivateKey *ecdsa.PrivateKey
-	orderBooks map[Market]*orderbook.OrderBook
+	HotWallet   Signer
+	Wallet      Wallet
+	Ledger      *Ledger
+	APIKeys     *APIKeyStore
+	Withdrawals *WithdrawalWorker
+	Settler     *Settler
+	Deposits    *DepositWatcher
+	orderBooks  map[Market]*orderbook.OrderBook
+	markets     map[Market]MarketAssets
+	tokens      map[Asset]*Token
+	// nonces of the wallet signed orders that were placed already.
+	orderNonces map[common.Address]map[uint64]bool
+}
+
+// ListToken makes an ERC-20 token tradable, deposits of it are
+// credited and trades in it are settled on chain.
+func (ex *Exchange) ListToken(token *Token) {
+	ex.tokens[token.Asset] = token
+	ex.Settler.AddToken(token)
+	ex.Deposits.AddToken(token)
+}
+
+// AddMarket opens a new book for the pair.
+// Both assets have to be ETH or a listed token.
+func (ex *Exchange) AddMarket(market Market, assets MarketAssets) error {
+	for _, asset := range []Asset{assets.Base, assets.Quote} {
+		if _, ok := ex.tokens[asset]; asset != AssetETH && !ok {
+			return fmt.Errorf("asset %s is not listed", asset)
+		}
+	}
+	ex.markets[market] = assets
+	ex.orderBooks[market] = orderbook.NewOrderBook()
+
+	return nil
 }
 
 type PlaceOrderRequest struct {
+	// ignored by the server, orders are placed for
+	// the user of the api key the request is signed with.
 	UserID int64
 	Type   OrderType
 	Bid    bool
 	Size   float64
 	Price  float64
 	Market Market
+	// GTC when empty.
+	TimeInForce TimeInForce `json:",omitempty"`
+	// unix milliseconds a GTD order expires at.
+	ExpiresAt int64 `json:",omitempty"`
+	// of STOP orders.
+	Stop *StopParams `json:",omitempty"`
+	// of pegged limit orders, the book sets the price and Price is ignored.
+	Peg *orderbook.Peg `json:",omitempty"`
 }
 
 type OrderBookData struct {
@@ -219,6 +387,10 @@ type Order struct {
 	Size      float64
 	Bid       bool
 	Timestamp int64
+	// the peg of pegged orders, Price is where it has them now.
+	Peg *orderbook.Peg `json:",omitempty"`
+	// the OCO pair or bracket the order is part of.
+	LinkID int64 `json:",omitempty"`
 }
 
 type CancelOrderRequest struct {
@@ -243,14 +415,19 @@ type PriceResponse struct {
 
 func (ex *Exchange) handleGetBestBid(c echo.Context) error {
 	market := Market(c.Param("market"))
-	ob := ex.orderBooks[market]
-	if len(ob.Bids()) == 0 {
-		return fmt.Errorf("the bids are empty")
+	ob, ok := ex.orderBooks[market]
+	if !ok {
+		return ErrMarketNotFound
+	}
+	ex.bookMu.Lock()
+	bids := ob.Bids()
+	ex.bookMu.Unlock()
+	if len(bids) == 0 {
+		return ErrNotFound.WithMessage("the bids are empty")
 	}
-	bestBidPrice := ob.Bids()[0].Price
 
 	pr := PriceResponse{
-		Price: bestBidPrice,
+		Price: bids[0].Price,
 	}
 
 	return c.JSON(http.StatusOK, pr)
@@ -258,14 +435,19 @@ func (ex *Exchange) handleGetBestBid(c echo.Context) error {
 }
 func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
 	market := Market(c.Param("market"))
-	ob := ex.orderBooks[market]
-	if len(ob.Asks()) == 0 {
-		return fmt.Errorf("the asks are empty")
+	ob, ok := ex.orderBooks[market]
+	if !ok {
+		return ErrMarketNotFound
+	}
+	ex.bookMu.Lock()
+	asks := ob.Asks()
+	ex.bookMu.Unlock()
+	if len(asks) == 0 {
+		return ErrNotFound.WithMessage("the asks are empty")
 	}
-	bestAskPrice := ob.Asks()[0].Price
 
 	pr := PriceResponse{
-		Price: bestAskPrice,
+		Price: asks[0].Price,
 	}
 
 	return c.JSON(http.StatusOK, pr)
@@ -274,21 +456,36 @@ func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
 type GetOrdersResponse struct {
 	Asks []Order
 	Bids []Order
+	// waiting to fire, with where their triggers are now.
+	Stops []StopState
 }
 
 func (ex *Exchange) handleGetOrders(c echo.Context) error {
-	userIDStr := c.Param("userID")
-	userID, err := strconv.Atoi(userIDStr)
+	userID, err := idParam(c, "userID")
 	if err != nil {
 		return err
 	}
+	if userID != authUserID(c) {
+		return errNotYourAccount
+	}
+
+	ex.bookMu.Lock()
+	stops := ex.userStops(userID)
+	linked := make(map[int64]int64)
+	for _, link := range ex.userLinks(userID) {
+		for _, id := range append([]int64{link.Entry}, link.Legs[:]...) {
+			linked[id] = link.ID
+		}
+	}
+	ex.bookMu.Unlock()
 
 	ex.mu.RLock()
 	defer ex.mu.RUnlock()
-	orderBookOrders := ex.Orders[int64(userID)]
+	orderBookOrders := ex.Orders[userID]
 	ordersResp := &GetOrdersResponse{
-		Asks: []Order{},
-		Bids: []Order{},
+		Asks:  []Order{},
+		Bids:  []Order{},
+		Stops: stops,
 	}
 
 	for i := 0; i < len(orderBookOrders); i++ {
@@ -305,6 +502,8 @@ func (ex *Exchange) handleGetOrders(c echo.Context) error {
 			Size:      orderBookOrders[i].Size,
 			Timestamp: orderBookOrders[i].Timestamp,
 			Bid:       orderBookOrders[i].Bid,
+			Peg:       orderBookOrders[i].Peg,
+			LinkID:    linked[orderBookOrders[i].ID],
 		}
 
 		if order.Bid {
@@ -318,10 +517,18 @@ func (ex *Exchange) handleGetOrders(c echo.Context) error {
 	return c.JSON(http.StatusOK, ordersResp)
 }
 
-func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order) ([]orderbook.Match, []*MatchedOrder) {
-	ob := ex.orderBooks[market]
+func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order) (*orderbook.Order, []orderbook.Match, []*MatchedOrder, error) {
+	ex.bookMu.Lock()
+	defer ex.unlockBooks()
+	return ex.placeMarketOrder(market, order)
+}
 
-	matches := ob.PlaceMarketOrder(order)
+// placeMarketOrder has to be called with bookMu held.
+func (ex *Exchange) placeMarketOrder(market Market, order *orderbook.Order) (*orderbook.Order, []orderbook.Match, []*MatchedOrder, error) {
+	order, matches, err := ex.executeLocked(market, orderbook.PlaceCommand(false, 0, order))
+	if err != nil {
+		return nil, nil, nil, err
+	}
 	matchedOrders := make([]*MatchedOrder, len(matches))
 
 	isBid := false
@@ -329,8 +536,6 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 		isBid = true
 	}
 
-	totalSizeFilled := 0.0
-	sumPrice := 0.0
 	for i := 0; i < len(matchedOrders); i++ {
 		id := matches[i].Bid.ID
 		limitUserID := matches[i].Bid.UserID
@@ -344,17 +549,21 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 			Size:   matches[i].SizeFilled,
 			Price:  matches[i].Price,
 		}
+	}
 
-		totalSizeFilled += matches[i].SizeFilled
-		sumPrice += matches[i].Price
+	ex.mu.Lock()
+	ex.dropFilled()
 
-	}
-	avgPrice := sumPrice / float64(len(matches))
-	_ = avgPrice
+	ex.mu.Unlock()
 
-	newOrderMap := make(map[int64][]*orderbook.Order)
+	return order, matches, matchedOrders, nil
 
-	ex.mu.RLock()
+}
+
+// dropFilled forgets the orders of the users that got filled.
+// It has to be called with ex.mu held.
+func (ex *Exchange) dropFilled() {
+	newOrderMap := make(map[int64][]*orderbook.Order)
 
 	for userID, orderbookOrders := range ex.Orders {
 		for i := 0; i < len(orderbookOrders); i++ {
@@ -370,58 +579,111 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 	}
 
 	ex.Orders = newOrderMap
-
-	ex.mu.Unlock()
-
-	return matches, matchedOrders
-
 }
 
 func (ex *Exchange) handlePlaceLimitOrder(market Market, price float64, o *orderbook.Order) error {
-	ob := ex.orderBooks[market]
-	ob.PlaceLimitOrder(price, o)
+	ex.bookMu.Lock()
+	defer ex.unlockBooks()
+	return ex.placeLimitOrder(market, price, o)
+}
+
+// placeLimitOrder has to be called with bookMu held,
+// a cancel all can't run before the order is indexed.
+func (ex *Exchange) placeLimitOrder(market Market, price float64, o *orderbook.Order) error {
+	o, _, err := ex.executeLocked(market, orderbook.PlaceCommand(true, price, o))
+	if err != nil {
+		return err
+	}
 
 	ex.mu.Lock()
 	ex.Orders[o.UserID] = append(ex.Orders[o.UserID], o)
+	ex.indexOrder(market, price, o)
 	ex.mu.Unlock()
+	if o.ExpiresAt != 0 {
+		ex.scheduleExpiry(market, o)
+	}
+	return nil
+}
 
-	// keep track of the user orders.
-
-	// user, ok := ex.users[o.UserID]
-	// if !ok {
-	// 	return fmt.Errorf("user not found: %d", user.ID)
-	// }
-
-	// exchangePubKey := ex.PrivateKey.Public()
-	// exchangePubKeyECDSA, ok := exchangePubKey.(*ecdsa.PublicKey)
-
-	// if !ok {
-	// 	return errors.New("error casting public key to ecdsa")
-	// }
-
-	// toAddress := crypto.PubkeyToAddress(*exchangePubKeyECDSA)
+type AmendOrderRequest struct {
+	Market Market
+	Price  float64
+	Size   float64
+}
 
-	// amount := big.NewInt(int64(o.Size))
+// handleAmendOrder moves the reservation of the order to the new price and size.
+func (ex *Exchange) handleAmendOrder(c echo.Context) error {
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+	var amendData AmendOrderRequest
+	if err := decodeBody(c, &amendData); err != nil {
+		return err
+	}
+	if _, ok := ex.orderBooks[amendData.Market]; !ok {
+		return ErrMarketNotFound.WithDetail("market", amendData.Market)
+	}
 
-	// return transferETH(ex.Client, user.PrivateKey, toAddress, amount)
-	// transfer from users => exchange
+	ex.bookMu.Lock()
+	err = ex.amendOrder(authUserID(c), id, &amendData)
+	ex.unlockBooks()
+	if err != nil {
+		return badRequest(err)
+	}
 
-	return nil
+	return c.JSON(http.StatusOK, &PlaceOrderResponse{OrderID: id})
 }
 
-func (ex *Exchange) handleCancelOrder(c echo.Context) error {
-
-	idStr := c.Param("id")
-	id, _ := strconv.Atoi(idStr)
-
-	ob := ex.orderBooks[MarketETH]
-	order := ob.Orders[int64(id)]
+// amendOrder checks the amend and moves the funds before it touches the book,
+// in the same turn so nothing can fill or cancel the order in between.
+// It has to be called with bookMu held.
+func (ex *Exchange) amendOrder(userID, id int64, req *AmendOrderRequest) error {
+	if err := ex.checkPhase(req.Market, LimitOrder); err != nil {
+		return err
+	}
+	ob := ex.orderBooks[req.Market]
+	order, ok := ob.Orders[id]
+	if !ok || order.Limit == nil || order.UserID != userID {
+		return ErrOrderNotFound.WithMessage("order not found [%d]", id).WithDetail("orderID", id)
+	}
+	cmd := orderbook.Command{
+		Type:      orderbook.CmdAmend,
+		OrderID:   id,
+		Price:     req.Price,
+		Size:      req.Size,
+		Timestamp: time.Now().UnixNano(),
+	}
+	if err := ob.Check(cmd); err != nil {
+		return err
+	}
 
-	ob.CancelOrder(order)
+	price, remaining := order.Limit.Price, order.Size
+	ex.releaseOrder(req.Market, price, order)
+	amended := &orderbook.Order{UserID: order.UserID, Bid: order.Bid, Size: req.Size}
+	if err := ex.reserveLimitOrder(req.Market, req.Price, amended); err != nil {
+		if err := ex.reserveLimitOrder(req.Market, price, order); err != nil {
+			log.Printf("amending order %d: reserving it again: %s", id, err)
+		}
+		return err
+	}
+	if _, _, err := ex.executeLocked(req.Market, cmd); err != nil {
+		ex.releaseOrder(req.Market, req.Price, amended)
+		if err := ex.reserveLimitOrder(req.Market, price, order); err != nil {
+			log.Printf("amending order %d: reserving it again: %s", id, err)
+		}
+		return err
+	}
 
-	log.Println("order canceled id => ", id)
+	// what was filled before stays filled.
+	ex.mu.Lock()
+	if info, ok := ex.orderIndex[id]; ok {
+		info.Size += req.Size - remaining
+		info.Price = req.Price
+	}
+	ex.mu.Unlock()
 
-	return c.JSON(200, map[string]any{"msg": "order deleted"})
+	return nil
 }
 
 func (ex *Exchange) handleGetBook(c echo.Context) error {
@@ -429,9 +691,13 @@ func (ex *Exchange) handleGetBook(c echo.Context) error {
 
 	ob, ok := ex.orderBooks[market]
 	if !ok {
-		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "market not found"})
+		return ErrMarketNotFound.WithDetail("market", market)
 	}
 
+	// the orders change with every turn of the books.
+	ex.bookMu.Lock()
+	defer ex.bookMu.Unlock()
+
 	orderbookData := OrderBookData{
 		TotalBidVolume: ob.BidTotalVolume(),
 		TotalAskVolume: ob.AskTotalVolume(),
@@ -458,6 +724,7 @@ func (ex *Exchange) handleGetBook(c echo.Context) error {
 		for _, order := range limit.Orders {
 			o := Order{
 				UserID:    order.UserID,
+				ID:        order.ID,
 				Price:     order.Limit.Price,
 				Size:      order.Size,
 				Bid:       order.Bid,
@@ -473,28 +740,20 @@ func (ex *Exchange) handleGetBook(c echo.Context) error {
 
 func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
 	var placeOrderData PlaceOrderRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&placeOrderData); err != nil {
+	if err := decodeBody(c, &placeOrderData); err != nil {
 		return err
 	}
+	placeOrderData.UserID = authUserID(c)
 
-	market := Market(placeOrderData.Market)
-	order := orderbook.NewOrder(placeOrderData.Bid, placeOrderData.Size, placeOrderData.UserID)
-
-	// limit order
-	if placeOrderData.Type == LimitOrder {
-		if err := ex.handlePlaceLimitOrder(market, placeOrderData.Price, order); err != nil {
-			return err
-		}
-	}
-
-	// market order
-	if placeOrderData.Type == MarketOrder {
-		matches, _ := ex.handlePlaceMarketOrder(market, order)
-		if err := ex.handleMatches(matches); err != nil {
-			return err
-
-		}
+	return ex.placeOrder(c, &placeOrderData)
+}
 
+func (ex *Exchange) placeOrder(c echo.Context, placeOrderData *PlaceOrderRequest) error {
+	ex.bookMu.Lock()
+	order, err := ex.submitOrder(placeOrderData)
+	ex.unlockBooks()
+	if err != nil {
+		return err
 	}
 
 	resp := &PlaceOrderResponse{
@@ -504,31 +763,90 @@ func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
 
 }
 
-func (ex *Exchange) handleMatches(matches []orderbook.Match) error {
-	for _, match := range matches {
-		fromUser, ok := ex.Users[match.Ask.UserID]
-		if !ok {
-			return fmt.Errorf("user not found %d", match.Ask.UserID)
+// submitOrder checks the funds for the order and places it.
+// It has to be called with bookMu held.
+func (ex *Exchange) submitOrder(placeOrderData *PlaceOrderRequest) (*orderbook.Order, error) {
+	market := Market(placeOrderData.Market)
+	if _, ok := ex.markets[market]; !ok {
+		return nil, ErrMarketNotFound.WithDetail("market", market)
+	}
+	if placeOrderData.Type != LimitOrder && placeOrderData.Type != MarketOrder && placeOrderData.Type != StopOrder {
+		return nil, ErrBadRequest.WithMessage("unknown order type [%s]", placeOrderData.Type)
+	}
+	if err := ex.checkPhase(market, placeOrderData.Type); err != nil {
+		return nil, err
+	}
+	order := ex.newOrder(placeOrderData.Bid, placeOrderData.Size, placeOrderData.UserID)
+	if placeOrderData.Type == StopOrder {
+		if err := ex.placeStop(placeOrderData, order); err != nil {
+			return nil, err
 		}
+		return order, nil
+	}
+	if placeOrderData.Stop != nil {
+		return nil, ErrBadRequest.WithMessage("only stop orders take a stop")
+	}
+	if placeOrderData.Peg != nil {
+		price, err := ex.pegPrice(market, placeOrderData)
+		if err != nil {
+			return nil, err
+		}
+		order.Peg = placeOrderData.Peg
+		placeOrderData.Price = price
+	}
+	expiresAt, err := ex.orderExpiry(placeOrderData, time.Unix(0, order.Timestamp))
+	if err != nil {
+		return nil, err
+	}
+	order.ExpiresAt = expiresAt
 
-		toUser, ok := ex.Users[match.Bid.UserID]
-		if !ok {
-			return fmt.Errorf("user not found %d", match.Bid.UserID)
+	// limit order
+	if placeOrderData.Type == LimitOrder {
+		if err := ex.reserveLimitOrder(market, placeOrderData.Price, order); err != nil {
+			return nil, badRequest(err)
 		}
-		// this is only used for the fees.
-		// exchangePubKey := ex.PrivateKey.Public()
-		// exchangePubKeyECDSA, ok := exchangePubKey.(*ecdsa.PublicKey)
+		if err := ex.placeLimitOrder(market, placeOrderData.Price, order); err != nil {
+			ex.releaseOrder(market, placeOrderData.Price, order)
+			return nil, badRequest(err)
+		}
+	}
 
-		// if !ok {
-		// 	return errors.New("error casting public key to ecdsa")
-		// }
+	// market order
+	if placeOrderData.Type == MarketOrder {
+		locked, err := ex.lockMarketOrder(market, order)
+		if err != nil {
+			return nil, badRequest(err)
+		}
+		taker, matches, _, err := ex.placeMarketOrder(market, order)
+		if err != nil {
+			ex.releaseMarketOrder(market, order, locked)
+			return nil, badRequest(err)
+		}
+		if err := ex.handleMatches(market, taker, matches, locked); err != nil {
+			return nil, err
+		}
+	}
 
-		toAddress := crypto.PubkeyToAddress(toUser.PrivateKey.Public().(ecdsa.PublicKey))
+	return order, nil
+}
 
-		amount := big.NewInt(int64(match.SizeFilled))
+func (ex *Exchange) handleMatches(market Market, taker *orderbook.Order, matches []orderbook.Match, locked float64) error {
+	if err := ex.applyMatches(market, taker, matches, locked); err != nil {
+		return err
+	}
+	ex.Settler.Add(market, ex.markets[market], matches, ex.tradingFees, taker.ID)
 
-		transferETH(ex.Client, fromUser.PrivateKey, toAddress, amount)
+	return nil
+}
 
+// settlementUser is the user the settler moves funds of, the fees are
+// paid to the hot wallet.
+func (ex *Exchange) settlementUser(id int64) (*User, bool) {
+	if id == FeeAccountID {
+		if ex.HotWallet == nil {
+			return nil, false
+		}
+		return &User{ID: FeeAccountID, DepositAddress: ex.HotWallet.Address()}, true
 	}
-	return nil
+	return ex.Users.Get(id)
 }
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// the server pings the client this often.
+	wsPingInterval = 20 * time.Second
+	// a connection without a pong or message for this long is dead.
+	wsReadTimeout  = 3 * wsPingInterval
+	wsWriteTimeout = 5 * time.Second
+)
+
+const (
+	MsgPing = "ping"
+	MsgPong = "pong"
+	// an order of the user expired.
+	MsgExpired = "expired"
+	// a stop of the user fired, with the order it placed or why it couldn't.
+	MsgTriggered = "triggered"
+)
+
+// SessionMessage is a message of the private websocket session, both ways.
+type SessionMessage struct {
+	Type string
+	// unix milliseconds the orders of the session get cancelled at,
+	// in the pongs of sessions with a dead man's switch.
+	Deadline int64       `json:",omitempty"`
+	Order    *OrderState `json:",omitempty"`
+	Stop     *StopState  `json:",omitempty"`
+}
+
+// the api key authenticates the upgrade request, not a cookie,
+// so any origin can open a session.
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type session struct {
+	userID int64
+	conn   *websocket.Conn
+	// one writer at a time, control messages don't need it.
+	writeMu sync.Mutex
+}
+
+func (s *session) send(msg *SessionMessage) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return s.conn.WriteJSON(msg)
+}
+
+// sessions are the open private websocket sessions, they are closed at shutdown.
+type sessions struct {
+	mu       sync.Mutex
+	nextID   uint64
+	sessions map[uint64]*session
+	closed   bool
+}
+
+func (s *sessions) add(userID int64, conn *websocket.Conn) (uint64, *session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, nil, false
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[uint64]*session)
+	}
+	s.nextID++
+	sess := &session{userID: userID, conn: conn}
+	s.sessions[s.nextID] = sess
+	return s.nextID, sess, true
+}
+
+func (s *sessions) remove(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// send sends the message to every session of the user. A session that
+// can't take it is left to its read loop, which notices it's gone.
+func (s *sessions) send(userID int64, msg *SessionMessage) {
+	s.mu.Lock()
+	var to []*session
+	for _, sess := range s.sessions {
+		if sess.userID == userID {
+			to = append(to, sess)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, sess := range to {
+		sess.send(msg)
+	}
+}
+
+// closeAll tells every client the server is going away and
+// closes the connections, no new sessions are opened after it.
+func (s *sessions) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	for id, sess := range s.sessions {
+		sess.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteTimeout))
+		sess.conn.Close()
+		delete(s.sessions, id)
+	}
+}
+
+// handleSession opens the private websocket session of the caller. With
+// ?cancelAfterMs= set, the session arms a dead man's switch of its own:
+// every message of the client starts it over, and once the client stops
+// sending or goes away all the orders of the user get cancelled. Pongs
+// don't count, a bot that hangs with its connection open is dead too.
+func (ex *Exchange) handleSession(c echo.Context) error {
+	var timeout time.Duration
+	if ms := c.QueryParam("cancelAfterMs"); ms != "" {
+		n, err := strconv.ParseInt(ms, 10, 64)
+		timeout = time.Duration(n) * time.Millisecond
+		if err != nil || timeout <= 0 || timeout > maxCancelAfter {
+			return ErrBadRequest.WithMessage("cancelAfterMs has to be between 1 and %d", maxCancelAfter.Milliseconds())
+		}
+	}
+
+	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		// the upgrader already answered.
+		return nil
+	}
+	defer conn.Close()
+
+	userID := authUserID(c)
+	id, sess, ok := ex.sessions.add(userID, conn)
+	if !ok {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(wsWriteTimeout))
+		return nil
+	}
+	defer ex.sessions.remove(id)
+
+	key := deadManKey{UserID: userID, Session: id}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = ex.deadMan.arm(key, timeout)
+	}
+	log.Printf("session %d of user %d opened", id, userID)
+
+	done := make(chan struct{})
+	defer close(done)
+	go pingSession(conn, done)
+
+	conn.SetReadLimit(4 << 10)
+	conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	})
+
+	for {
+		var msg SessionMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			// the switch of the session keeps running and cancels the orders when it runs out.
+			log.Printf("session %d of user %d closed: %s", id, userID, err)
+			return nil
+		}
+		conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		if timeout > 0 {
+			deadline = ex.deadMan.arm(key, timeout)
+		}
+
+		if msg.Type != MsgPing {
+			continue
+		}
+		pong := &SessionMessage{Type: MsgPong}
+		if !deadline.IsZero() {
+			pong.Deadline = deadline.UnixMilli()
+		}
+		if err := sess.send(pong); err != nil {
+			return nil
+		}
+	}
+}
+
+// pingSession keeps pinging the client until the session is done.
+func pingSession(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+			return
+		}
+	}
+}
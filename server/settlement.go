@@ -0,0 +1,800 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/labstack/echo/v4"
+	"github.com/ukibbb/crypto-exchange/orderbook"
+)
+
+const (
+	SettlementPending SettlementStatus = "PENDING"
+	// in a batch, its transfers are on their way, Txs has the ones sent so far.
+	SettlementSettling SettlementStatus = "SETTLING"
+	SettlementSettled  SettlementStatus = "SETTLED"
+	SettlementFailed   SettlementStatus = "FAILED"
+)
+
+type SettlementStatus string
+
+// TradeSettlement is the on-chain settlement state of a single trade.
+type TradeSettlement struct {
+	ID       int64
+	Market   Market
+	BuyerID  int64
+	SellerID int64
+	Base     Asset
+	Quote    Asset
+	Price    float64
+	Size     float64
+	// paid to the fee account out of the base the buyer and the quote the seller gets.
+	BuyerFee  float64 `json:",omitempty"`
+	SellerFee float64 `json:",omitempty"`
+	Status    SettlementStatus
+	BatchID   int64
+	Error     string
+	// the transactions of the transfers that settle it.
+	Txs []common.Hash `json:",omitempty"`
+
+	// transfers the trade waits for, and how many of them failed.
+	unsettled int
+	failed    int
+}
+
+type SettlementConfig struct {
+	// pending trades are settled every interval...
+	Interval time.Duration
+	// ...or as soon as there are this many of them.
+	Threshold int
+	// a transfer that can't be sent is retried MaxRetries times,
+	// waiting RetryBackoff, 2*RetryBackoff, 4*RetryBackoff... in between.
+	// After that it's re-queued with the next flushes, backing off the
+	// same way up to maxRequeueBackoff.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	PollInterval time.Duration
+}
+
+var DefaultSettlementConfig = SettlementConfig{
+	Interval:     10 * time.Second,
+	Threshold:    100,
+	MaxRetries:   3,
+	RetryBackoff: time.Second,
+	PollInterval: time.Second,
+}
+
+// Transfer is a single net movement of an asset between two users.
+type Transfer struct {
+	Asset  Asset
+	From   int64
+	To     int64
+	Amount float64
+}
+
+// the longest a failed transfer waits before it's tried again.
+const maxRequeueBackoff = 10 * time.Minute
+
+// settlementRecord is a change of the settlement the journal has: a batch
+// taking the pending trades with the transfers that net them, or transfers
+// as they are after the record.
+type settlementRecord struct {
+	Batch     int64            `json:",omitempty"`
+	Trades    []int64          `json:",omitempty"`
+	Transfers []transferRecord `json:",omitempty"`
+}
+
+// transferRecord is a transfer of a batch the way the journal and the
+// snapshots have it. It keeps the signed transaction from before it's
+// sent until it's mined, a restart waits for it instead of paying twice.
+type transferRecord struct {
+	ID int64
+	Transfer
+	Trades   []int64
+	Status   SettlementStatus
+	Tx       hexutil.Bytes `json:",omitempty"`
+	Error    string        `json:",omitempty"`
+	Attempts int           `json:",omitempty"`
+}
+
+// settlementState is the settler in a snapshot.
+type settlementState struct {
+	NextTradeID    int64
+	NextBatchID    int64
+	NextTransferID int64
+	Trades         []TradeSettlement
+	// the transfers not settled yet.
+	Transfers []transferRecord `json:",omitempty"`
+}
+
+// settlementTransfer is a transfer of a batch with the trades it settles.
+type settlementTransfer struct {
+	transferRecord
+	trades []*TradeSettlement
+	// sent and not seen mined yet, it's waited for instead of sent again.
+	tx *types.Transaction
+	// the transaction came from the journal or failed to go out,
+	// the node might not have it.
+	recheck bool
+	err     error
+	next    time.Time
+}
+
+// assetTransfer is the call that moves the amount of an asset to an address:
+// where the transaction goes, with what value and data.
+type assetTransfer func(to common.Address, amount float64) (common.Address, *big.Int, []byte, error)
+
+// Settler collects the trades coming out of the books and settles them on chain in batches.
+// All trades of a batch are netted per user and asset first, so a user
+// trading back and forth ends up with (at most) a single transfer.
+// Every batch and every change of its transfers is journaled before it's
+// made, a restart picks up what wasn't settled yet.
+type Settler struct {
+	chain     *Chain
+	users     func(int64) (*User, bool)
+	wallet    Wallet
+	config    SettlementConfig
+	transfers map[Asset]assetTransfer
+	journal   func(*journalEntry) error
+
+	mu             sync.RWMutex
+	nextTradeID    int64
+	nextBatchID    int64
+	nextTransferID int64
+	trades         map[int64]*TradeSettlement
+	pending        []*TradeSettlement
+	// the transfers not settled yet by id.
+	open map[int64]*settlementTransfer
+	// failed transfers waiting for their next attempt.
+	requeued []*settlementTransfer
+	flush    chan struct{}
+}
+
+func NewSettler(chain *Chain, users func(int64) (*User, bool), wallet Wallet, config SettlementConfig) *Settler {
+	s := &Settler{
+		chain:     chain,
+		users:     users,
+		wallet:    wallet,
+		config:    config,
+		transfers: make(map[Asset]assetTransfer),
+		trades:    make(map[int64]*TradeSettlement),
+		open:      make(map[int64]*settlementTransfer),
+		flush:     make(chan struct{}, 1),
+	}
+	// trades move funds between the deposit addresses of the users,
+	// the exchange holds their keys.
+	s.transfers[AssetETH] = func(to common.Address, amount float64) (common.Address, *big.Int, []byte, error) {
+		return to, ethToWei(amount), nil, nil
+	}
+
+	return s
+}
+
+// AddToken settles the token on chain from now on.
+func (s *Settler) AddToken(token *Token) {
+	s.transfers[token.Asset] = func(to common.Address, amount float64) (common.Address, *big.Int, []byte, error) {
+		data, err := erc20ABI.Pack("transfer", to, token.ToUnits(amount))
+		return token.Address, big.NewInt(0), data, err
+	}
+}
+
+// Add records the matches as pending trades, takerID is the order that
+// took the liquidity, 0 when both sides rested. The trades come out of
+// commands that are journaled already, replaying them adds them again.
+func (s *Settler) Add(market Market, assets MarketAssets, matches []orderbook.Match, fees TradingFees, takerID int64) []*TradeSettlement {
+	s.mu.Lock()
+	trades := make([]*TradeSettlement, len(matches))
+	for i, match := range matches {
+		s.nextTradeID++
+		buyerFee, sellerFee := fees.of(match, takerID)
+		trade := &TradeSettlement{
+			ID:        s.nextTradeID,
+			Market:    market,
+			BuyerID:   match.Bid.UserID,
+			SellerID:  match.Ask.UserID,
+			Base:      assets.Base,
+			Quote:     assets.Quote,
+			Price:     match.Price,
+			Size:      match.SizeFilled,
+			BuyerFee:  buyerFee,
+			SellerFee: sellerFee,
+			Status:    SettlementPending,
+		}
+		s.trades[trade.ID] = trade
+		s.pending = append(s.pending, trade)
+		trades[i] = trade
+	}
+	full := len(s.pending) >= s.config.Threshold
+	s.mu.Unlock()
+
+	if full {
+		select {
+		case s.flush <- struct{}{}:
+		default:
+		}
+	}
+
+	return trades
+}
+
+func (s *Settler) Trade(id int64) (*TradeSettlement, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	trade, ok := s.trades[id]
+	if !ok {
+		return nil, false
+	}
+	t := *trade
+	t.Txs = append([]common.Hash(nil), trade.Txs...)
+	return &t, true
+}
+
+// save journals the record and only then applies it, it returns the
+// transfers of a new batch. It has to be called with mu held.
+func (s *Settler) save(record *settlementRecord) ([]*settlementTransfer, error) {
+	if s.journal != nil {
+		if err := s.journal(&journalEntry{Settlement: record}); err != nil {
+			return nil, err
+		}
+	}
+	return s.apply(record), nil
+}
+
+// restore applies a record of the journal.
+func (s *Settler) restore(record *settlementRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apply(record)
+}
+
+// apply has to be called with mu held.
+func (s *Settler) apply(record *settlementRecord) []*settlementTransfer {
+	if record.Batch == 0 {
+		for _, r := range record.Transfers {
+			s.applyTransfer(r)
+		}
+		return nil
+	}
+
+	s.nextBatchID = max(s.nextBatchID, record.Batch)
+	batch := make(map[int64]bool, len(record.Trades))
+	for _, id := range record.Trades {
+		batch[id] = true
+		if trade, ok := s.trades[id]; ok {
+			trade.Status = SettlementSettling
+			trade.BatchID = record.Batch
+		}
+	}
+	var pending []*TradeSettlement
+	for _, trade := range s.pending {
+		if !batch[trade.ID] {
+			pending = append(pending, trade)
+		}
+	}
+	s.pending = pending
+
+	transfers := make([]*settlementTransfer, len(record.Transfers))
+	for i, r := range record.Transfers {
+		transfers[i] = s.addTransfer(r)
+	}
+	// trades netted out completely have nothing to wait for.
+	for _, id := range record.Trades {
+		if trade, ok := s.trades[id]; ok {
+			updateTrade(trade)
+		}
+	}
+	return transfers
+}
+
+// addTransfer opens the transfer and makes its trades wait for it.
+// It has to be called with mu held.
+func (s *Settler) addTransfer(r transferRecord) *settlementTransfer {
+	s.nextTransferID = max(s.nextTransferID, r.ID)
+	t := &settlementTransfer{transferRecord: r}
+	if r.Status == SettlementSettled {
+		return t
+	}
+	for _, id := range r.Trades {
+		if trade, ok := s.trades[id]; ok {
+			t.trades = append(t.trades, trade)
+			trade.unsettled++
+			if r.Status == SettlementFailed {
+				trade.failed++
+			}
+		}
+	}
+	if len(r.Tx) > 0 {
+		t.tx = decodeTx(r.ID, r.Tx)
+	}
+	s.open[r.ID] = t
+	return t
+}
+
+// applyTransfer changes the transfer to what the record has and the trades
+// it settles with it. It has to be called with mu held.
+func (s *Settler) applyTransfer(r transferRecord) {
+	t, ok := s.open[r.ID]
+	if !ok {
+		return
+	}
+	var tx *types.Transaction
+	if len(r.Tx) > 0 {
+		tx = decodeTx(r.ID, r.Tx)
+	}
+	for _, trade := range t.trades {
+		if t.Status == SettlementFailed {
+			trade.failed--
+		}
+		switch r.Status {
+		case SettlementFailed:
+			trade.failed++
+			trade.Error = r.Error
+		case SettlementSettled:
+			trade.unsettled--
+		}
+		if tx != nil && (t.tx == nil || t.tx.Hash() != tx.Hash()) {
+			trade.Txs = append(trade.Txs, tx.Hash())
+		}
+		updateTrade(trade)
+	}
+	t.transferRecord = r
+	t.tx = tx
+	if r.Status == SettlementSettled {
+		delete(s.open, r.ID)
+	}
+}
+
+// updateTrade sets the status of a trade of a batch from its transfers.
+func updateTrade(trade *TradeSettlement) {
+	switch {
+	case trade.unsettled == 0:
+		trade.Status = SettlementSettled
+		trade.Error = ""
+	case trade.failed > 0:
+		trade.Status = SettlementFailed
+	default:
+		trade.Status = SettlementSettling
+		trade.Error = ""
+	}
+}
+
+func decodeTx(id int64, raw []byte) *types.Transaction {
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(raw); err != nil {
+		log.Printf("settlement transfer %d: reading its tx: %s", id, err)
+		return nil
+	}
+	return tx
+}
+
+// state is the settler for a snapshot. It has to be called with mu held.
+func (s *Settler) state() *settlementState {
+	state := &settlementState{
+		NextTradeID:    s.nextTradeID,
+		NextBatchID:    s.nextBatchID,
+		NextTransferID: s.nextTransferID,
+		Trades:         make([]TradeSettlement, 0, len(s.trades)),
+	}
+	for _, trade := range s.trades {
+		state.Trades = append(state.Trades, *trade)
+	}
+	sort.Slice(state.Trades, func(i, j int) bool { return state.Trades[i].ID < state.Trades[j].ID })
+	for _, t := range s.open {
+		state.Transfers = append(state.Transfers, t.transferRecord)
+	}
+	sort.Slice(state.Transfers, func(i, j int) bool { return state.Transfers[i].ID < state.Transfers[j].ID })
+	return state
+}
+
+// restoreState puts the settler back to the snapshot.
+func (s *Settler) restoreState(state *settlementState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextTradeID = state.NextTradeID
+	s.nextBatchID = state.NextBatchID
+	s.nextTransferID = state.NextTransferID
+	for i := range state.Trades {
+		trade := state.Trades[i]
+		s.trades[trade.ID] = &trade
+		if trade.Status == SettlementPending {
+			s.pending = append(s.pending, &trade)
+		}
+	}
+	for _, r := range state.Transfers {
+		s.addTransfer(r)
+	}
+}
+
+// resume re-queues the transfers that weren't settled before a restart,
+// the ones that have a transaction are checked on chain first.
+func (s *Settler) resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requeued = s.requeued[:0]
+	for _, t := range s.open {
+		t.recheck = t.tx != nil
+		s.requeued = append(s.requeued, t)
+	}
+	sort.Slice(s.requeued, func(i, j int) bool { return s.requeued[i].ID < s.requeued[j].ID })
+	if len(s.requeued) > 0 {
+		log.Printf("%d settlement transfers re-queued", len(s.requeued))
+	}
+}
+
+// Run settles the pending trades periodically or when the threshold is hit.
+func (s *Settler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.flush:
+		}
+
+		if err := s.Flush(ctx); err != nil {
+			log.Printf("settlement failed: %s", err)
+		}
+	}
+}
+
+// Flush settles all trades that are pending right now as a single batch,
+// along with the failed transfers that are due again. Only the trades of the
+// transfers that fail are marked FAILED, they are SETTLED once the
+// re-queued transfers go through.
+func (s *Settler) Flush(ctx context.Context) error {
+	now := time.Now()
+	s.mu.Lock()
+	var (
+		batchID   int64
+		transfers []*settlementTransfer
+		waiting   []*settlementTransfer
+	)
+	for _, t := range s.requeued {
+		if t.next.After(now) {
+			waiting = append(waiting, t)
+		} else {
+			transfers = append(transfers, t)
+		}
+	}
+	retried := len(transfers)
+	if len(s.pending) > 0 {
+		record := &settlementRecord{Batch: s.nextBatchID + 1}
+		for _, trade := range s.pending {
+			record.Trades = append(record.Trades, trade.ID)
+		}
+		nextID := s.nextTransferID
+		for _, transfer := range netTransfers(netPositions(s.pending)) {
+			nextID++
+			r := transferRecord{ID: nextID, Transfer: transfer, Status: SettlementPending}
+			for _, trade := range transferTrades(s.pending, transfer) {
+				r.Trades = append(r.Trades, trade.ID)
+			}
+			record.Transfers = append(record.Transfers, r)
+		}
+		batch, err := s.save(record)
+		if err != nil {
+			s.mu.Unlock()
+			return fmt.Errorf("journaling batch %d: %w", record.Batch, err)
+		}
+		batchID = record.Batch
+		transfers = append(transfers, batch...)
+	}
+	s.requeued = waiting
+	s.mu.Unlock()
+
+	if len(transfers) == 0 {
+		return nil
+	}
+
+	s.settle(ctx, transfers)
+
+	s.mu.Lock()
+	var failed int
+	for _, t := range transfers {
+		r := t.transferRecord
+		switch {
+		case t.err == nil:
+			r.Status = SettlementSettled
+			r.Tx = nil
+			r.Error = ""
+		case ctx.Err() != nil:
+			// shutting down, it's picked up again as it is.
+			s.requeued = append(s.requeued, t)
+			continue
+		default:
+			failed++
+			r.Status = SettlementFailed
+			r.Error = t.err.Error()
+			if t.tx == nil {
+				r.Tx = nil
+			}
+			backoff := maxRequeueBackoff
+			if r.Attempts < 30 {
+				backoff = min(s.config.RetryBackoff<<r.Attempts, maxRequeueBackoff)
+			}
+			r.Attempts++
+			t.next = now.Add(backoff)
+			s.requeued = append(s.requeued, t)
+			log.Printf("settlement transfer of %.8f %s from user %d to user %d failed (attempt %d), re-queued in %s: %s",
+				t.Amount, t.Asset, t.From, t.To, r.Attempts, backoff, t.err)
+		}
+		if _, err := s.save(&settlementRecord{Transfers: []transferRecord{r}}); err != nil {
+			// it's settled again after a restart, a sent transaction is waited for.
+			log.Printf("journaling settlement transfer %d: %s", t.ID, err)
+		}
+	}
+	s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("batch %d: %w", batchID, err)
+	}
+	if failed > 0 {
+		return fmt.Errorf("batch %d: %d of %d transfers failed and were re-queued", batchID, failed, len(transfers))
+	}
+	log.Printf("settlement batch %d settled %d transfers and %d re-queued ones", batchID, len(transfers)-retried, retried)
+
+	return nil
+}
+
+// transferTrades are the trades of the batch the transfer settles: the ones
+// with a leg from its payer to its payee, or when netting moved the
+// funds past them, the ones the payer pays or the payee gets in.
+func transferTrades(batch []*TradeSettlement, transfer Transfer) []*TradeSettlement {
+	legs := func(trade *TradeSettlement) [][2]int64 {
+		switch transfer.Asset {
+		case trade.Base:
+			return [][2]int64{{trade.SellerID, trade.BuyerID}}
+		case trade.Quote:
+			return [][2]int64{{trade.BuyerID, trade.SellerID}}
+		}
+		return nil
+	}
+
+	var exact, touching []*TradeSettlement
+	for _, trade := range batch {
+		for _, leg := range legs(trade) {
+			if leg[0] == transfer.From && leg[1] == transfer.To {
+				exact = append(exact, trade)
+			} else if leg[0] == transfer.From || leg[1] == transfer.To {
+				touching = append(touching, trade)
+			}
+		}
+	}
+	if len(exact) > 0 {
+		return exact
+	}
+	return touching
+}
+
+// settle sends the transfers and waits for them, the outcome of each ends up in its err.
+func (s *Settler) settle(ctx context.Context, transfers []*settlementTransfer) {
+	for _, t := range transfers {
+		t.err = nil
+		if t.tx != nil {
+			continue
+		}
+		call, ok := s.transfers[t.Asset]
+		if !ok {
+			// there is nothing on chain for this asset yet,
+			// the ledger is all there is.
+			continue
+		}
+
+		signer, to, err := s.parties(t.Transfer)
+		if err != nil {
+			t.err = err
+			continue
+		}
+		callTo, value, data, err := call(to, t.Amount)
+		if err != nil {
+			t.err = err
+			continue
+		}
+		var tx *types.Transaction
+		tx, t.err = s.sendWithRetry(ctx, func() (*types.Transaction, error) {
+			return s.chain.SendTxRecorded(ctx, signer, callTo, value, data, func(tx *types.Transaction) error {
+				return s.sent(t, tx)
+			})
+		})
+		if tx != nil && t.err != nil {
+			log.Printf("settlement transfer %d: sending tx %s: %s", t.ID, tx.Hash().Hex(), t.err)
+			t.err = nil
+			t.recheck = true
+		}
+	}
+
+	for _, t := range transfers {
+		if t.tx == nil || t.err != nil {
+			continue
+		}
+		if t.recheck {
+			signer, _, err := s.parties(t.Transfer)
+			if err == nil {
+				_, err = s.chain.Recheck(ctx, signer, t.tx)
+			}
+			if err != nil {
+				t.err = err
+				continue
+			}
+			t.recheck = false
+		}
+		receipt, err := s.chain.Nonces.WaitMined(ctx, t.tx.Hash(), s.config.PollInterval)
+		if err != nil {
+			// it might still be mined, the next attempt waits for it again.
+			t.err = err
+			continue
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			t.err = fmt.Errorf("transaction %s reverted", receipt.TxHash.Hex())
+			// it's done, the next attempt sends a new one.
+			t.tx = nil
+		}
+	}
+}
+
+// parties are the signer of the payer of the transfer and the address of the payee.
+func (s *Settler) parties(transfer Transfer) (Signer, common.Address, error) {
+	from, ok := s.users(transfer.From)
+	if !ok {
+		return nil, common.Address{}, fmt.Errorf("user not found %d", transfer.From)
+	}
+	to, ok := s.users(transfer.To)
+	if !ok {
+		return nil, common.Address{}, fmt.Errorf("user not found %d", transfer.To)
+	}
+	signer, err := s.wallet.Signer(from.DepositAddress)
+	if err != nil {
+		return nil, common.Address{}, err
+	}
+	return signer, to.DepositAddress, nil
+}
+
+// sent journals the signed transaction of the transfer before it goes out.
+func (s *Settler) sent(t *settlementTransfer, tx *types.Transaction) error {
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := t.transferRecord
+	r.Status = SettlementSettling
+	r.Tx = raw
+	_, err = s.save(&settlementRecord{Transfers: []transferRecord{r}})
+	return err
+}
+
+// sendWithRetry stops retrying once a transaction was journaled,
+// it might have gone out.
+func (s *Settler) sendWithRetry(ctx context.Context, send func() (*types.Transaction, error)) (*types.Transaction, error) {
+	backoff := s.config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		tx, err := send()
+		if err == nil || tx != nil {
+			return tx, err
+		}
+		if attempt >= s.config.MaxRetries {
+			return nil, err
+		}
+
+		log.Printf("settlement transfer failed (attempt %d), retrying in %s: %s", attempt+1, backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// netPositions sums up what every user gets (positive) or owes (negative) per asset.
+func netPositions(trades []*TradeSettlement) map[Asset]map[int64]float64 {
+	positions := make(map[Asset]map[int64]float64)
+	add := func(asset Asset, userID int64, amount float64) {
+		if positions[asset] == nil {
+			positions[asset] = make(map[int64]float64)
+		}
+		positions[asset][userID] += amount
+	}
+
+	for _, trade := range trades {
+		quoteAmount := trade.Size * trade.Price
+		add(trade.Base, trade.BuyerID, trade.Size-trade.BuyerFee)
+		add(trade.Base, trade.SellerID, -trade.Size)
+		add(trade.Quote, trade.BuyerID, -quoteAmount)
+		add(trade.Quote, trade.SellerID, quoteAmount-trade.SellerFee)
+		if trade.BuyerFee > 0 {
+			add(trade.Base, FeeAccountID, trade.BuyerFee)
+		}
+		if trade.SellerFee > 0 {
+			add(trade.Quote, FeeAccountID, trade.SellerFee)
+		}
+	}
+
+	return positions
+}
+
+// dust left over by float arithmetic when positions cancel each other out.
+const settlementDust = 1e-12
+
+// netTransfers pairs the users that owe with the users that get paid.
+// Users are processed in order of their ids so the same positions
+// always result in the same transfers.
+func netTransfers(positions map[Asset]map[int64]float64) []Transfer {
+	assets := make([]Asset, 0, len(positions))
+	for asset := range positions {
+		assets = append(assets, asset)
+	}
+	sort.Slice(assets, func(i, j int) bool { return assets[i] < assets[j] })
+
+	transfers := []Transfer{}
+	for _, asset := range assets {
+		type position struct {
+			userID int64
+			amount float64
+		}
+		var payers, payees []*position
+		for userID, amount := range positions[asset] {
+			if amount < -settlementDust {
+				payers = append(payers, &position{userID, -amount})
+			}
+			if amount > settlementDust {
+				payees = append(payees, &position{userID, amount})
+			}
+		}
+		sort.Slice(payers, func(i, j int) bool { return payers[i].userID < payers[j].userID })
+		sort.Slice(payees, func(i, j int) bool { return payees[i].userID < payees[j].userID })
+
+		for i, j := 0, 0; i < len(payers) && j < len(payees); {
+			amount := math.Min(payers[i].amount, payees[j].amount)
+			transfers = append(transfers, Transfer{
+				Asset:  asset,
+				From:   payers[i].userID,
+				To:     payees[j].userID,
+				Amount: amount,
+			})
+
+			payers[i].amount -= amount
+			payees[j].amount -= amount
+			if payers[i].amount <= settlementDust {
+				i++
+			}
+			if payees[j].amount <= settlementDust {
+				j++
+			}
+		}
+	}
+
+	return transfers
+}
+
+func (ex *Exchange) handleGetTrade(c echo.Context) error {
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+
+	// the trades of others are as good as not there, like their orders.
+	key := c.Get(ctxAPIKey).(*APIKey)
+	trade, ok := ex.Settler.Trade(id)
+	if !ok || (trade.BuyerID != key.UserID && trade.SellerID != key.UserID && !key.Can(PermAdmin)) {
+		return ErrNotFound.WithMessage("trade not found")
+	}
+	return c.JSON(http.StatusOK, trade)
+}
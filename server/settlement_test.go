@@ -0,0 +1,241 @@
+package server
+
+import (
+	"context"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/labstack/echo/v4"
+	"github.com/ukibbb/crypto-exchange/orderbook"
+)
+
+// newTestWallet is a keystore wallet with cheap key encryption.
+func newTestWallet(t *testing.T) *KeystoreWallet {
+	ks := keystore.NewKeyStore(t.TempDir(), keystore.LightScryptN, keystore.LightScryptP)
+	return NewKeystoreWallet(ks, "test")
+}
+
+func newTestUser(t *testing.T, wallet Wallet, id int64) *User {
+	address, err := wallet.NewAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &User{ID: id, DepositAddress: address}
+}
+
+func testSigner(t *testing.T, wallet Wallet, user *User) Signer {
+	signer, err := wallet.Signer(user.DepositAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// newTestBackend funds every user with 100 ETH.
+func newTestBackend(t *testing.T, users ...*User) *simulated.Backend {
+	alloc := types.GenesisAlloc{}
+	for _, user := range users {
+		alloc[user.DepositAddress] = types.Account{Balance: ethToWei(100)}
+	}
+	backend := simulated.NewBackend(alloc)
+	t.Cleanup(func() { backend.Close() })
+
+	return backend
+}
+
+func newTestChain(t *testing.T, backend *simulated.Backend) *Chain {
+	chain, err := NewChain(context.Background(), backend.Client(), nil, DefaultFeeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain
+}
+
+// mine keeps committing blocks until the test is done.
+func mine(t *testing.T, backend *simulated.Backend) {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				backend.Commit()
+			}
+		}
+	}()
+}
+
+func testMatch(buyer, seller int64, size, price float64) orderbook.Match {
+	return orderbook.Match{
+		Bid:        &orderbook.Order{UserID: buyer, Bid: true},
+		Ask:        &orderbook.Order{UserID: seller},
+		SizeFilled: size,
+		Price:      price,
+	}
+}
+
+func TestNetTransfers(t *testing.T) {
+	trades := []*TradeSettlement{
+		{BuyerID: 1, SellerID: 2, Base: AssetETH, Quote: AssetUSD, Size: 1, Price: 2000},
+		{BuyerID: 2, SellerID: 1, Base: AssetETH, Quote: AssetUSD, Size: 0.25, Price: 2000},
+		{BuyerID: 3, SellerID: 2, Base: AssetETH, Quote: AssetUSD, Size: 0.5, Price: 2000},
+	}
+
+	transfers := netTransfers(netPositions(trades))
+
+	assert(t, transfers, []Transfer{
+		{Asset: AssetETH, From: 2, To: 1, Amount: 0.75},
+		{Asset: AssetETH, From: 2, To: 3, Amount: 0.5},
+		{Asset: AssetUSD, From: 1, To: 2, Amount: 1500},
+		{Asset: AssetUSD, From: 3, To: 2, Amount: 1000},
+	})
+}
+
+func TestSettlerNetsBatch(t *testing.T) {
+	wallet := newTestWallet(t)
+	alice, bob := newTestUser(t, wallet, 1), newTestUser(t, wallet, 2)
+	backend := newTestBackend(t, alice, bob)
+	mine(t, backend)
+
+	users := map[int64]*User{alice.ID: alice, bob.ID: bob}
+	config := DefaultSettlementConfig
+	config.PollInterval = 10 * time.Millisecond
+	s := NewSettler(newTestChain(t, backend), func(id int64) (*User, bool) {
+		user, ok := users[id]
+		return user, ok
+	}, wallet, config)
+
+	assets := MarketAssets{Base: AssetETH, Quote: AssetUSD}
+	trades := s.Add(MarketETH, assets, []orderbook.Match{
+		testMatch(alice.ID, bob.ID, 1.5, 2000),
+		testMatch(bob.ID, alice.ID, 0.3, 2010),
+		testMatch(alice.ID, bob.ID, 0.05, 1990),
+	}, TradingFees{}, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, trade := range trades {
+		settled, _ := s.Trade(trade.ID)
+		assert(t, settled.Status, SettlementSettled)
+		assert(t, settled.BatchID, int64(1))
+	}
+
+	// a single net transfer of 1.25 ETH, alice pays no gas.
+	balance, err := backend.Client().BalanceAt(ctx, alice.DepositAddress, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, balance, new(big.Int).Add(ethToWei(100), ethToWei(1.25)))
+
+	nonce, err := backend.Client().NonceAt(ctx, bob.DepositAddress, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, nonce, uint64(1))
+}
+
+func TestSettlerFailsUnknownUser(t *testing.T) {
+	wallet := newTestWallet(t)
+	alice := newTestUser(t, wallet, 1)
+	backend := newTestBackend(t, alice)
+
+	s := NewSettler(newTestChain(t, backend), func(id int64) (*User, bool) {
+		if id == alice.ID {
+			return alice, true
+		}
+		return nil, false
+	}, wallet, DefaultSettlementConfig)
+
+	trades := s.Add(MarketETH, MarketAssets{Base: AssetETH, Quote: AssetUSD}, []orderbook.Match{
+		testMatch(alice.ID, 2, 1, 2000),
+	}, TradingFees{}, 0)
+
+	assert(t, s.Flush(context.Background()) != nil, true)
+
+	trade, _ := s.Trade(trades[0].ID)
+	assert(t, trade.Status, SettlementFailed)
+}
+
+func TestSettlerRequeuesFailedTransfers(t *testing.T) {
+	wallet := newTestWallet(t)
+	alice, bob, carol := newTestUser(t, wallet, 1), newTestUser(t, wallet, 2), newTestUser(t, wallet, 3)
+	backend := newTestBackend(t, alice, bob, carol)
+	mine(t, backend)
+
+	// carol isn't known yet, the transfer to her fails.
+	users := map[int64]*User{alice.ID: alice, bob.ID: bob}
+	config := DefaultSettlementConfig
+	config.PollInterval = 10 * time.Millisecond
+	config.RetryBackoff = time.Millisecond
+	s := NewSettler(newTestChain(t, backend), func(id int64) (*User, bool) {
+		user, ok := users[id]
+		return user, ok
+	}, wallet, config)
+
+	trades := s.Add(MarketETH, MarketAssets{Base: AssetETH, Quote: AssetUSD}, []orderbook.Match{
+		testMatch(alice.ID, bob.ID, 1, 2000),
+		testMatch(carol.ID, bob.ID, 0.5, 2000),
+	}, TradingFees{}, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert(t, s.Flush(ctx) != nil, true)
+
+	settled, _ := s.Trade(trades[0].ID)
+	assert(t, settled.Status, SettlementSettled)
+	failed, _ := s.Trade(trades[1].ID)
+	assert(t, failed.Status, SettlementFailed)
+	assert(t, failed.Error, "user not found 3")
+
+	users[carol.ID] = carol
+	time.Sleep(5 * time.Millisecond)
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	settled, _ = s.Trade(trades[1].ID)
+	assert(t, settled.Status, SettlementSettled)
+	assert(t, settled.Error, "")
+
+	// only the failed transfer was sent again.
+	for user, want := range map[*User]float64{alice: 101, carol: 100.5} {
+		balance, err := backend.Client().BalanceAt(ctx, user.DepositAddress, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert(t, balance, ethToWei(want))
+	}
+}
+
+func TestGetTradeOnlyForItsParties(t *testing.T) {
+	ex := newTestExchange(t, "")
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+	var keys []*APIKey
+	for _, perms := range [][]Permission{{PermRead, PermTrade}, {PermRead, PermTrade}, {PermRead}, {PermRead, PermAdmin}} {
+		user, _ := ex.Users.Add(&User{})
+		key, _ := ex.APIKeys.Create(user.ID, perms...)
+		keys = append(keys, key)
+	}
+	alice, bob, carol, admin := keys[0], keys[1], keys[2], keys[3]
+	ex.Ledger.Credit(alice.UserID, AssetUSD, 1000)
+	ex.Ledger.Credit(bob.UserID, AssetETH, 10)
+	assert(t, serve(alice, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":1,"Price":100}`, nil), http.StatusOK)
+	assert(t, serve(bob, http.MethodPost, "/order", `{"Type":"MARKET","Market":"ETH","Size":1}`, nil), http.StatusOK)
+
+	for key, want := range map[*APIKey]int{alice: http.StatusOK, bob: http.StatusOK, carol: http.StatusNotFound, admin: http.StatusOK} {
+		assert(t, serve(key, http.MethodGet, "/trade/1", "", nil), want)
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// time the requests running at shutdown get to finish.
+const shutdownTimeout = 30 * time.Second
+
+// takingOrders turns new orders away once the exchange is draining.
+func (ex *Exchange) takingOrders(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if ex.draining.Load() {
+			return ErrUnavailable
+		}
+		return next(c)
+	}
+}
+
+// Drain stops taking orders, the orders already
+// being placed still go through. Cancels are still taken.
+func (ex *Exchange) Drain() {
+	ex.draining.Store(true)
+}
+
+// Close turns the dead man's switches off and closes the websocket
+// sessions, the orders of the bots stay for the next start. Then it
+// waits for the command running on the books, takes a last snapshot
+// so the next start has nothing to replay and flushes and closes the
+// journal. The books can't be changed afterwards.
+func (ex *Exchange) Close() error {
+	ex.Drain()
+	if ex.deadMan != nil {
+		ex.deadMan.stop()
+	}
+	ex.sessions.closeAll()
+
+	if ex.SnapshotDir != "" && ex.Journal != nil {
+		if path, err := ex.Snapshot(); err != nil {
+			log.Printf("last snapshot failed: %s", err)
+		} else {
+			log.Printf("wrote the last snapshot %s", path)
+		}
+	}
+
+	ex.bookMu.Lock()
+	defer ex.bookMu.Unlock()
+	if ex.Journal == nil {
+		return nil
+	}
+	return ex.Journal.Close()
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ukibbb/crypto-exchange/wal"
+)
+
+func TestRegisterRoutes(t *testing.T) {
+	ex := newTestExchange(t, "")
+	e := echo.New()
+	ex.RegisterRoutes(e)
+
+	user, _ := ex.Users.Add(&User{})
+	key, _ := ex.APIKeys.Create(user.ID, PermRead, PermTrade)
+	serve := func(req *http.Request) int {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	order := `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":1,"Price":2000}`
+
+	assert(t, serve(httptest.NewRequest(http.MethodGet, "/book/ETH", nil)), http.StatusOK)
+	// no funds for it, but the order got to the exchange.
+	assert(t, serve(signedRequest(key, http.MethodPost, "/order", order, time.Now())), http.StatusBadRequest)
+
+	ex.Drain()
+	assert(t, serve(signedRequest(key, http.MethodPost, "/order", order, time.Now())), http.StatusServiceUnavailable)
+	assert(t, serve(httptest.NewRequest(http.MethodGet, "/book/ETH", nil)), http.StatusOK)
+}
+
+func TestCloseFlushesJournal(t *testing.T) {
+	dir := t.TempDir()
+	ex := newTestExchange(t, filepath.Join(dir, "journal"))
+	ex.SnapshotDir = filepath.Join(dir, "snapshots")
+	placeTestOrders(t, ex, 1, 10)
+
+	if err := ex.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ex.Journal.Append([]byte("late"))
+	assert(t, errors.Is(err, wal.ErrClosed), true)
+
+	// the last snapshot has everything, nothing is left to replay.
+	snapshots, _ := os.ReadDir(ex.SnapshotDir)
+	assert(t, len(snapshots), 1)
+
+	restarted := newTestExchange(t, filepath.Join(dir, "journal"))
+	restarted.SnapshotDir = ex.SnapshotDir
+	if err := restarted.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(restarted.orderBooks[MarketETH].Orders), 10)
+	assert(t, restarted.orderBooks[MarketETH].Seq, uint64(10))
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Signer signs transactions for a single account.
+// The chain only ever sees the signer, never the key behind it,
+// which could as well live in a keystore, an HSM or a remote service.
+type Signer interface {
+	Address() common.Address
+	SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error)
+}
+
+// KeySigner signs with a key held in memory.
+type KeySigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func NewKeySigner(key *ecdsa.PrivateKey) *KeySigner {
+	return &KeySigner{key: key}
+}
+
+func (s *KeySigner) Address() common.Address {
+	return crypto.PubkeyToAddress(s.key.PublicKey)
+}
+
+func (s *KeySigner) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	return types.SignTx(tx, types.LatestSignerForChainID(chainID), s.key)
+}
+
+// LoadKeystoreSigner decrypts a go-ethereum keystore (v3) file.
+func LoadKeystoreSigner(path, passphrase string) (*KeySigner, error) {
+	keyJSON, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := keystore.DecryptKey(keyJSON, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting keystore %s: %w", path, err)
+	}
+	return NewKeySigner(key.PrivateKey), nil
+}
+
+// Wallet holds the keys of the deposit addresses, every user gets one.
+type Wallet interface {
+	NewAccount() (common.Address, error)
+	Signer(address common.Address) (Signer, error)
+}
+
+// KeystoreWallet keeps the deposit keys encrypted in a go-ethereum keystore directory.
+// A key is decrypted the first time it has to sign and stays unlocked afterwards.
+type KeystoreWallet struct {
+	ks         *keystore.KeyStore
+	passphrase string
+
+	mu       sync.Mutex
+	unlocked map[common.Address]bool
+}
+
+func NewKeystoreWallet(ks *keystore.KeyStore, passphrase string) *KeystoreWallet {
+	return &KeystoreWallet{
+		ks:         ks,
+		passphrase: passphrase,
+		unlocked:   make(map[common.Address]bool),
+	}
+}
+
+func (w *KeystoreWallet) NewAccount() (common.Address, error) {
+	account, err := w.ks.NewAccount(w.passphrase)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return account.Address, nil
+}
+
+func (w *KeystoreWallet) Signer(address common.Address) (Signer, error) {
+	account, err := w.ks.Find(accounts.Account{Address: address})
+	if err != nil {
+		return nil, fmt.Errorf("no key for deposit address %s: %w", address.Hex(), err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.unlocked[address] {
+		if err := w.ks.Unlock(account, w.passphrase); err != nil {
+			return nil, err
+		}
+		w.unlocked[address] = true
+	}
+
+	return &keystoreSigner{ks: w.ks, account: account}, nil
+}
+
+type keystoreSigner struct {
+	ks      *keystore.KeyStore
+	account accounts.Account
+}
+
+func (s *keystoreSigner) Address() common.Address {
+	return s.account.Address
+}
+
+func (s *keystoreSigner) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	return s.ks.SignTx(s.account, tx, chainID)
+}
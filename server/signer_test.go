@@ -0,0 +1,49 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestLoadKeystoreSigner(t *testing.T) {
+	account, err := keystore.StoreKey(t.TempDir(), "hot wallet", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := LoadKeystoreSigner(account.URL.Path, "hot wallet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, signer.Address(), account.Address)
+
+	_, err = LoadKeystoreSigner(account.URL.Path, "wrong")
+	assert(t, err != nil, true)
+}
+
+func TestKeystoreWalletSigns(t *testing.T) {
+	wallet := newTestWallet(t)
+	alice, bob := newTestUser(t, wallet, 1), newTestUser(t, wallet, 2)
+	backend := newTestBackend(t, alice, bob)
+	chain := newTestChain(t, backend)
+
+	signer := testSigner(t, wallet, alice)
+	assert(t, signer.Address(), alice.DepositAddress)
+
+	tx, err := transferETH(chain, signer, bob.DepositAddress, ethToWei(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, err := types.Sender(types.LatestSignerForChainID(chain.ChainID), tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, from, alice.DepositAddress)
+
+	// only the keys of the wallet can sign.
+	_, err = wallet.Signer(common.HexToAddress("0x01"))
+	assert(t, err != nil, true)
+}
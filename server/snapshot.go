@@ -0,0 +1,371 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ukibbb/crypto-exchange/orderbook"
+)
+
+// Snapshot file layout, little endian:
+//
+//	magic "EXSN" | version uint16 | journal seq uint64 | markets uint32
+//	per market: name length uint16 | name | snapshot length uint32 | book snapshot
+//	state length uint32 | state json (since version 2)
+//	crc32 (IEEE) of everything before it | uint32
+const (
+	exchangeSnapshotVersion uint16 = 2
+	snapshotExt                    = ".snap"
+	// the older one is the fallback in case the latest can't be read.
+	snapshotsKept = 2
+)
+
+var exchangeSnapshotMagic = [4]byte{'E', 'X', 'S', 'N'}
+
+// snapshotState is what the exchange keeps besides the books.
+type snapshotState struct {
+	Balances map[int64]map[Asset]Balance
+	// the next block the deposit watcher scans.
+	DepositBlock uint64
+	Withdrawals  []withdrawalRecord `json:",omitempty"`
+	Settlement   *settlementState   `json:",omitempty"`
+	LastOrderID  int64              `json:",omitempty"`
+	Stops        []stopRecord       `json:",omitempty"`
+	Links        []linkRecord       `json:",omitempty"`
+}
+
+// Snapshot writes all books to a new snapshot file. The journal segments
+// the kept snapshots cover are deleted afterwards.
+func (ex *Exchange) Snapshot() (string, error) {
+	if ex.SnapshotDir == "" {
+		return "", errors.New("no snapshot directory")
+	}
+
+	data, seq, err := ex.encodeSnapshot()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(ex.SnapshotDir, 0o700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(ex.SnapshotDir, fmt.Sprintf("%020d%s", seq, snapshotExt))
+	if err := writeFileSync(path, data); err != nil {
+		return "", err
+	}
+
+	if err := ex.compact(); err != nil {
+		return path, err
+	}
+	return path, nil
+}
+
+// encodeSnapshot takes the books at a single point of the journal.
+func (ex *Exchange) encodeSnapshot() ([]byte, uint64, error) {
+	ex.bookMu.Lock()
+	defer ex.bookMu.Unlock()
+
+	lastSeq := func() uint64 { return 0 }
+	if ex.Journal != nil {
+		lastSeq = ex.Journal.LastSeq
+	}
+	var (
+		state snapshotState
+		seq   uint64
+	)
+	// withdrawals change under their lock first, then the ledger's.
+	// The settler journals under its own lock.
+	ex.Withdrawals.mu.RLock()
+	ex.Settler.mu.RLock()
+	state.Withdrawals = ex.Withdrawals.records()
+	state.Settlement = ex.Settler.state()
+	state.LastOrderID = ex.lastOrderID
+	state.Stops = ex.stopRecords()
+	state.Links = ex.linkRecords()
+	state.Balances = ex.Ledger.snapshot(func() {
+		seq = lastSeq()
+		state.DepositBlock = ex.Deposits.nextBlock
+	})
+	ex.Settler.mu.RUnlock()
+	ex.Withdrawals.mu.RUnlock()
+	stateData, err := json.Marshal(&state)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	markets := make([]Market, 0, len(ex.orderBooks))
+	for market := range ex.orderBooks {
+		markets = append(markets, market)
+	}
+	sort.Slice(markets, func(i, j int) bool { return markets[i] < markets[j] })
+
+	buf := &bytes.Buffer{}
+	w := func(v any) {
+		binary.Write(buf, binary.LittleEndian, v)
+	}
+	w(exchangeSnapshotMagic)
+	w(exchangeSnapshotVersion)
+	w(seq)
+	w(uint32(len(markets)))
+	for _, market := range markets {
+		book, err := ex.orderBooks[market].Snapshot()
+		if err != nil {
+			return nil, 0, err
+		}
+		w(uint16(len(market)))
+		buf.WriteString(string(market))
+		w(uint32(len(book)))
+		buf.Write(book)
+	}
+	w(uint32(len(stateData)))
+	buf.Write(stateData)
+	w(crc32.ChecksumIEEE(buf.Bytes()))
+
+	return buf.Bytes(), seq, nil
+}
+
+// writeFileSync writes to a temporary file and renames it,
+// a crash never leaves half a snapshot behind.
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+type snapshotFile struct {
+	seq  uint64
+	path string
+}
+
+// snapshots lists the snapshot files, the latest first.
+func (ex *Exchange) snapshots() ([]snapshotFile, error) {
+	entries, err := os.ReadDir(ex.SnapshotDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []snapshotFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, snapshotExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, snapshotExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, snapshotFile{seq: seq, path: filepath.Join(ex.SnapshotDir, name)})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].seq > files[j].seq })
+
+	return files, nil
+}
+
+// compact deletes all but the latest snapshots and the journal
+// segments that come before the oldest one kept.
+func (ex *Exchange) compact() error {
+	files, err := ex.snapshots()
+	if err != nil {
+		return err
+	}
+	if len(files) > snapshotsKept {
+		for _, f := range files[snapshotsKept:] {
+			if err := os.Remove(f.path); err != nil {
+				return err
+			}
+		}
+		files = files[:snapshotsKept]
+	}
+
+	if ex.Journal == nil || len(files) == 0 {
+		return nil
+	}
+	return ex.Journal.TruncateBefore(files[len(files)-1].seq + 1)
+}
+
+// decodeSnapshot restores the books of the file into new books,
+// nothing is touched when the file is bad.
+func (ex *Exchange) decodeSnapshot(data []byte) (map[Market]*orderbook.OrderBook, *snapshotState, uint64, error) {
+	books, state, seq, err := decodeSnapshotFile(data)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	for market := range books {
+		if _, ok := ex.orderBooks[market]; !ok {
+			return nil, nil, 0, fmt.Errorf("snapshot has a book for the unknown market %s", market)
+		}
+	}
+	return books, state, seq, nil
+}
+
+// DecodeSnapshot reads a snapshot file written by Snapshot, it returns
+// the books by market and the journal sequence number it was taken at.
+func DecodeSnapshot(data []byte) (map[Market]*orderbook.OrderBook, uint64, error) {
+	books, _, seq, err := decodeSnapshotFile(data)
+	return books, seq, err
+}
+
+// decodeSnapshotFile reads the books and the state of the exchange,
+// the state of a version 1 snapshot is empty.
+func decodeSnapshotFile(data []byte) (map[Market]*orderbook.OrderBook, *snapshotState, uint64, error) {
+	bad := func(err error) (map[Market]*orderbook.OrderBook, *snapshotState, uint64, error) {
+		return nil, nil, 0, err
+	}
+	if len(data) < 4 {
+		return bad(orderbook.ErrBadSnapshot)
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return bad(fmt.Errorf("%w: checksum mismatch", orderbook.ErrBadSnapshot))
+	}
+
+	r := bytes.NewReader(body)
+	var (
+		magic   [4]byte
+		version uint16
+		seq     uint64
+		markets uint32
+	)
+	for _, v := range []any{&magic, &version, &seq, &markets} {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return bad(fmt.Errorf("%w: %s", orderbook.ErrBadSnapshot, err))
+		}
+	}
+	if magic != exchangeSnapshotMagic {
+		return bad(orderbook.ErrBadSnapshot)
+	}
+	if version != 1 && version != exchangeSnapshotVersion {
+		return bad(fmt.Errorf("%w: unsupported version %d", orderbook.ErrBadSnapshot, version))
+	}
+
+	books := make(map[Market]*orderbook.OrderBook)
+	for i := uint32(0); i < markets; i++ {
+		var nameLen uint16
+		if err := binary.Read(r, binary.LittleEndian, &nameLen); err != nil {
+			return bad(fmt.Errorf("%w: %s", orderbook.ErrBadSnapshot, err))
+		}
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return bad(fmt.Errorf("%w: %s", orderbook.ErrBadSnapshot, err))
+		}
+		var bookLen uint32
+		if err := binary.Read(r, binary.LittleEndian, &bookLen); err != nil || int(bookLen) > r.Len() {
+			return bad(orderbook.ErrBadSnapshot)
+		}
+		book := make([]byte, bookLen)
+		io.ReadFull(r, book)
+
+		market := Market(name)
+		ob := orderbook.NewOrderBook()
+		if err := ob.Restore(book); err != nil {
+			return bad(fmt.Errorf("market %s: %w", market, err))
+		}
+		books[market] = ob
+	}
+
+	state := &snapshotState{}
+	if version >= 2 {
+		var stateLen uint32
+		if err := binary.Read(r, binary.LittleEndian, &stateLen); err != nil || int(stateLen) != r.Len() {
+			return bad(orderbook.ErrBadSnapshot)
+		}
+		stateData := make([]byte, stateLen)
+		io.ReadFull(r, stateData)
+		if err := json.Unmarshal(stateData, state); err != nil {
+			return bad(fmt.Errorf("%w: %s", orderbook.ErrBadSnapshot, err))
+		}
+	}
+
+	return books, state, seq, nil
+}
+
+// loadSnapshot restores the books and the balances from the latest readable snapshot
+// and returns the journal sequence number it was taken at.
+func (ex *Exchange) loadSnapshot() (uint64, error) {
+	files, err := ex.snapshots()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, f := range files {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			return 0, err
+		}
+		books, state, seq, err := ex.decodeSnapshot(data)
+		if err != nil {
+			log.Printf("skipping snapshot %s: %s", f.path, err)
+			continue
+		}
+		for market, ob := range books {
+			ex.orderBooks[market] = ob
+		}
+		ex.Ledger.restore(state.Balances)
+		ex.Deposits.restore(state.DepositBlock)
+		for i := range state.Withdrawals {
+			ex.Withdrawals.restore(&state.Withdrawals[i])
+		}
+		if state.Settlement != nil {
+			ex.Settler.restoreState(state.Settlement)
+		}
+		ex.lastOrderID = max(ex.lastOrderID, state.LastOrderID)
+		for i := range state.Stops {
+			ex.restoreStop(&state.Stops[i])
+		}
+		for i := range state.Links {
+			ex.restoreLink(&state.Links[i])
+		}
+		log.Printf("restored the books from snapshot %s", f.path)
+		return seq, nil
+	}
+
+	return 0, nil
+}
+
+// RunSnapshots takes a snapshot every interval until the context is done.
+func (ex *Exchange) RunSnapshots(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := ex.Snapshot(); err != nil {
+			log.Printf("snapshot failed: %s", err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ukibbb/crypto-exchange/orderbook"
+	"github.com/ukibbb/crypto-exchange/wal"
+)
+
+func placeTestOrders(t *testing.T, ex *Exchange, from, to int) {
+	t.Helper()
+	for i := from; i <= to; i++ {
+		o := &orderbook.Order{ID: int64(i), UserID: int64(i % 3), Bid: i%2 == 0, Size: 1, Timestamp: int64(i)}
+		price := 2000.0 + float64(i%5)
+		if o.Bid {
+			price -= 10
+		}
+		if err := ex.handlePlaceLimitOrder(MarketETH, price, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSnapshotCompactsJournal(t *testing.T) {
+	dir := t.TempDir()
+	openExchange := func() *Exchange {
+		users, _ := NewUserRegistry("")
+		ex := NewExchange(nil, nil, users, nil, DefaultExchangeConfig)
+		journal, err := wal.Open(filepath.Join(dir, "journal"), wal.Options{SegmentSize: 512})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { journal.Close() })
+		ex.Journal = journal
+		ex.SnapshotDir = filepath.Join(dir, "snapshots")
+		if err := ex.Recover(); err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+
+	ex := openExchange()
+	placeTestOrders(t, ex, 1, 20)
+	if _, err := ex.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	placeTestOrders(t, ex, 21, 30)
+	segments := len(ex.Journal.Segments())
+	if _, err := ex.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	placeTestOrders(t, ex, 31, 40)
+	if _, err := ex.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the two latest snapshots are kept, and the journal after the older one.
+	snapshots, _ := os.ReadDir(ex.SnapshotDir)
+	assert(t, len(snapshots), 2)
+	assert(t, len(ex.Journal.Segments()) < segments, true)
+
+	for _, id := range []int64{35, 40} {
+		if _, _, err := ex.execute(MarketETH, orderbook.Command{Type: orderbook.CmdCancel, OrderID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ex.Journal.Close()
+
+	recovered := openExchange()
+	expected, _ := ex.orderBooks[MarketETH].Snapshot()
+	got, _ := recovered.orderBooks[MarketETH].Snapshot()
+	assert(t, got, expected)
+	// orders 35 of user 2 and 40 of user 1 were cancelled after the last snapshot.
+	assert(t, len(recovered.Orders[2]), 12)
+	// the ids go on after the cancelled order too.
+	recovered.bookMu.Lock()
+	assert(t, recovered.newOrder(true, 1, 1).ID, int64(41))
+	recovered.bookMu.Unlock()
+}
+
+func TestRecoverFallsBackToOlderSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	ex := newTestExchange(t, filepath.Join(dir, "journal"))
+	ex.SnapshotDir = filepath.Join(dir, "snapshots")
+
+	placeTestOrders(t, ex, 1, 5)
+	ex.Snapshot()
+	placeTestOrders(t, ex, 6, 10)
+	latest, err := ex.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(latest, []byte("garbage"), 0o600)
+	ex.Journal.Close()
+
+	recovered := newTestExchange(t, filepath.Join(dir, "journal"))
+	recovered.SnapshotDir = ex.SnapshotDir
+	if err := recovered.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(recovered.orderBooks[MarketETH].Orders), 10)
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"log"
+	"sort"
+
+	"github.com/ukibbb/crypto-exchange/orderbook"
+)
+
+const (
+	// the best price on the other side, the bid for sell stops and the ask for buy stops.
+	RefBest StopReference = "BEST"
+	// the price of the last trade of the market.
+	RefLast StopReference = "LAST"
+)
+
+type StopReference string
+
+// StopParams are what a STOP order is made of on top of the side, size and market.
+// A plain stop fires at StopPrice. A trailing stop has a Trail or a TrailPercent
+// instead, its trigger follows the reference price while it moves in the
+// favour of the user and stays put when it moves against them.
+type StopParams struct {
+	StopPrice    float64 `json:",omitempty"`
+	Trail        float64 `json:",omitempty"`
+	TrailPercent float64 `json:",omitempty"`
+	// LAST when empty.
+	Reference StopReference `json:",omitempty"`
+	// the order placed when it fires, MARKET when empty.
+	Then OrderType `json:",omitempty"`
+	// how far from the trigger the limit price of a LIMIT stop is,
+	// below it for sell stops and above it for buy stops.
+	LimitOffset float64 `json:",omitempty"`
+}
+
+// StopState is a stop as the user sees it.
+type StopState struct {
+	ID     int64
+	Market Market
+	UserID int64
+	Bid    bool
+	Size   float64
+	StopParams
+	// the price the stop fires at, where it is now for trailing stops.
+	Trigger float64
+	// the order the stop placed once it fired.
+	OrderID int64     `json:",omitempty"`
+	Error   *APIError `json:",omitempty"`
+	// the OCO pair or bracket the stop is part of.
+	LinkID int64 `json:",omitempty"`
+}
+
+// stopOrder waits outside the books until its reference price crosses the
+// trigger. Nothing is reserved for them: the funds are checked when they
+// fire, the same way as for market orders. Every change of a stop is
+// journaled, a restart brings it back where it was.
+type stopOrder struct {
+	StopState
+	// the best reference price so far, the highest for sell
+	// stops and the lowest for buy stops.
+	best float64
+}
+
+// stopRecord is a stop as it is after the journal record, Gone once it
+// fired or was cancelled.
+type stopRecord struct {
+	StopState
+	Best float64 `json:",omitempty"`
+	Gone bool    `json:",omitempty"`
+}
+
+// journalStop writes the stop as it is now, gone tells it's taken out.
+func (ex *Exchange) journalStop(s *stopOrder, gone bool) error {
+	return ex.journalLedger(&journalEntry{Stop: &stopRecord{StopState: s.StopState, Best: s.best, Gone: gone}})
+}
+
+// restoreStop puts the stop of the record back or takes it out.
+// It has to be called with bookMu held.
+func (ex *Exchange) restoreStop(r *stopRecord) {
+	ex.lastOrderID = max(ex.lastOrderID, r.ID)
+	if r.Gone {
+		delete(ex.stops, r.ID)
+		return
+	}
+	ex.stops[r.ID] = &stopOrder{StopState: r.StopState, best: r.Best}
+}
+
+// stopRecords are the waiting stops by id. It has to be called with bookMu held.
+func (ex *Exchange) stopRecords() []stopRecord {
+	records := make([]stopRecord, 0, len(ex.stops))
+	for _, s := range ex.stops {
+		records = append(records, stopRecord{StopState: s.StopState, Best: s.best})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records
+}
+
+func (s *stopOrder) trailing() bool {
+	return s.Trail > 0 || s.TrailPercent > 0
+}
+
+// update moves the trigger with the reference price, it returns
+// whether the price reached it.
+func (s *stopOrder) update(price float64) bool {
+	if s.trailing() {
+		if s.best == 0 || (!s.Bid && price > s.best) || (s.Bid && price < s.best) {
+			s.best = price
+		}
+		trail := s.Trail
+		if s.TrailPercent > 0 {
+			trail = s.best * s.TrailPercent / 100
+		}
+		if s.Bid {
+			s.Trigger = s.best + trail
+		} else {
+			s.Trigger = s.best - trail
+		}
+	}
+
+	if s.Bid {
+		return price >= s.Trigger
+	}
+	return price <= s.Trigger
+}
+
+// referencePrice is the price a stop on the side follows, false while the market has none.
+func referencePrice(ob *orderbook.OrderBook, ref StopReference, bid bool) (float64, bool) {
+	if ref == RefLast {
+		if len(ob.Trades) == 0 {
+			return 0, false
+		}
+		return ob.Trades[len(ob.Trades)-1].Price, true
+	}
+	limits := ob.Bids()
+	if bid {
+		limits = ob.Asks()
+	}
+	if len(limits) == 0 {
+		return 0, false
+	}
+	return limits[0].Price, true
+}
+
+// placeStop checks the stop of the request and keeps it until it fires,
+// the order only lends it its id. It has to be called with bookMu held.
+func (ex *Exchange) placeStop(req *PlaceOrderRequest, order *orderbook.Order) error {
+	p := req.Stop
+	if p == nil {
+		return ErrBadRequest.WithMessage("stop orders need the stop")
+	}
+	if req.Size <= 0 {
+		return ErrBadRequest.WithMessage("size has to be positive")
+	}
+	if req.TimeInForce != "" || req.ExpiresAt != 0 {
+		return ErrBadRequest.WithMessage("stop orders don't take a time in force")
+	}
+	set := 0
+	for _, v := range []float64{p.StopPrice, p.Trail, p.TrailPercent} {
+		if v < 0 {
+			return ErrBadRequest.WithMessage("stop prices and trails can't be negative")
+		}
+		if v > 0 {
+			set++
+		}
+	}
+	if set != 1 {
+		return ErrBadRequest.WithMessage("a stop takes one of a stop price, a trail or a trail percent")
+	}
+	if p.TrailPercent >= 100 {
+		return ErrBadRequest.WithMessage("trail percent [%g] has to be below 100", p.TrailPercent)
+	}
+
+	params := *p
+	if params.Reference == "" {
+		params.Reference = RefLast
+	}
+	if params.Reference != RefLast && params.Reference != RefBest {
+		return ErrBadRequest.WithMessage("unknown stop reference [%s]", params.Reference)
+	}
+	if params.Then == "" {
+		params.Then = MarketOrder
+	}
+	if params.Then != MarketOrder && params.Then != LimitOrder {
+		return ErrBadRequest.WithMessage("stops place market or limit orders, not [%s]", params.Then)
+	}
+	if params.LimitOffset < 0 || (params.LimitOffset > 0 && params.Then != LimitOrder) {
+		return ErrBadRequest.WithMessage("only limit stops take a limit offset and it can't be negative")
+	}
+
+	price, ok := referencePrice(ex.orderBooks[req.Market], params.Reference, req.Bid)
+	if !ok {
+		return ErrBadRequest.WithMessage("market %s has no %s price to follow", req.Market, params.Reference)
+	}
+	s := &stopOrder{StopState: StopState{
+		ID:         order.ID,
+		Market:     req.Market,
+		UserID:     req.UserID,
+		Bid:        req.Bid,
+		Size:       req.Size,
+		StopParams: params,
+		Trigger:    params.StopPrice,
+	}}
+	if s.update(price) {
+		return ErrBadRequest.WithMessage("stop price [%g] is already reached, the %s price is %g", p.StopPrice, params.Reference, price).WithDetail("price", price)
+	}
+
+	if err := ex.journalStop(s, false); err != nil {
+		return err
+	}
+	ex.stops[s.ID] = s
+	return nil
+}
+
+// fireStops places the orders of the stops the books reached, until
+// none is left, what they trade can fire more. It returns the ones that
+// fired. It has to be called with bookMu held.
+func (ex *Exchange) fireStops() []StopState {
+	var fired []StopState
+	for len(ex.stops) > 0 {
+		ids := make([]int64, 0, len(ex.stops))
+		for id := range ex.stops {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		n := len(fired)
+		for _, id := range ids {
+			s := ex.stops[id]
+			// they wait for the market to trade continuously again.
+			if ex.phase(s.Market) != PhaseContinuous {
+				continue
+			}
+			price, ok := referencePrice(ex.orderBooks[s.Market], s.Reference, s.Bid)
+			if !ok {
+				continue
+			}
+			trigger, best := s.Trigger, s.best
+			if !s.update(price) {
+				// a trailing stop that followed the price.
+				if s.Trigger != trigger || s.best != best {
+					if err := ex.journalStop(s, false); err != nil {
+						log.Printf("stop %d of user %d: %s", id, s.UserID, err)
+					}
+				}
+				continue
+			}
+			if err := ex.journalStop(s, true); err != nil {
+				log.Printf("stop %d of user %d: %s", id, s.UserID, err)
+			}
+			delete(ex.stops, id)
+
+			req := &PlaceOrderRequest{UserID: s.UserID, Type: s.Then, Bid: s.Bid, Size: s.Size, Market: s.Market}
+			if s.Then == LimitOrder {
+				req.Price = s.Trigger - s.LimitOffset
+				if s.Bid {
+					req.Price = s.Trigger + s.LimitOffset
+				}
+			}
+			order, err := ex.submitOrder(req)
+			if err != nil {
+				s.Error = badRequest(err)
+				log.Printf("stop %d of user %d fired at %g: %s", id, s.UserID, s.Trigger, err)
+			} else {
+				s.OrderID = order.ID
+				log.Printf("stop %d of user %d fired at %g, placed order %d", id, s.UserID, s.Trigger, order.ID)
+			}
+			fired = append(fired, s.StopState)
+		}
+		if len(fired) == n {
+			break
+		}
+	}
+	return fired
+}
+
+// unlockBooks ends a turn of the books that could have moved prices, it
+// fires the stops and runs the links before it lets the next turn in.
+func (ex *Exchange) unlockBooks() {
+	var fired []StopState
+	for {
+		fired = append(fired, ex.fireStops()...)
+		if !ex.runLinks() {
+			break
+		}
+	}
+	ex.bookMu.Unlock()
+
+	for i := range fired {
+		ex.sessions.send(fired[i].UserID, &SessionMessage{Type: MsgTriggered, Stop: &fired[i]})
+	}
+}
+
+// cancelStops takes the stops of the filter on the market out, it
+// returns them as cancelled orders. It has to be called with bookMu held.
+func (ex *Exchange) cancelStops(market Market, filter orderbook.CancelFilter) []OrderState {
+	var ids []int64
+	for id, s := range ex.stops {
+		if s.Market == market && filter.Match(&orderbook.Order{UserID: s.UserID, Bid: s.Bid}) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	states := make([]OrderState, len(ids))
+	for i, id := range ids {
+		s := ex.stops[id]
+		if err := ex.journalStop(s, true); err != nil {
+			log.Printf("stop %d of user %d: %s", id, s.UserID, err)
+		}
+		states[i] = s.cancelled()
+		delete(ex.stops, id)
+	}
+	return states
+}
+
+// cancelled is the stop as a cancelled order, at the price it would have fired at.
+func (s *stopOrder) cancelled() OrderState {
+	return OrderState{
+		ID:     s.ID,
+		Market: s.Market,
+		UserID: s.UserID,
+		Bid:    s.Bid,
+		Price:  s.Trigger,
+		Size:   s.Size,
+		Status: OrderCancelled,
+	}
+}
+
+// userStops are the waiting stops of the user by id. It has to be called with bookMu held.
+func (ex *Exchange) userStops(userID int64) []StopState {
+	stops := []StopState{}
+	for _, s := range ex.stops {
+		if s.UserID == userID {
+			state := s.StopState
+			state.LinkID = ex.linked[s.ID]
+			stops = append(stops, state)
+		}
+	}
+	sort.Slice(stops, func(i, j int) bool { return stops[i].ID < stops[j].ID })
+	return stops
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestTrailingStop(t *testing.T) {
+	ex := newTestExchange(t, "")
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+
+	alice, _ := ex.Users.Add(&User{})
+	bob, _ := ex.Users.Add(&User{})
+	carol, _ := ex.Users.Add(&User{})
+	aliceKey, _ := ex.APIKeys.Create(alice.ID, PermTrade)
+	bobKey, _ := ex.APIKeys.Create(bob.ID, PermRead, PermTrade)
+	carolKey, _ := ex.APIKeys.Create(carol.ID, PermTrade)
+	ex.Ledger.Credit(alice.ID, AssetUSD, 10000)
+	ex.Ledger.Credit(bob.ID, AssetETH, 1)
+	ex.Ledger.Credit(carol.ID, AssetETH, 10)
+
+	// carol sells into a bid of alice at the price, that's the last trade.
+	trade := func(price string) {
+		assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":1,"Price":`+price+`}`, nil), http.StatusOK)
+		assert(t, serve(carolKey, http.MethodPost, "/order", `{"Type":"MARKET","Market":"ETH","Size":1}`, nil), http.StatusOK)
+	}
+	stop := func(params string, out any) int {
+		return serve(bobKey, http.MethodPost, "/order", `{"Type":"STOP","Market":"ETH","Size":1,"Stop":{`+params+`}}`, out)
+	}
+	stops := func() []StopState {
+		orders := &GetOrdersResponse{}
+		assert(t, serve(bobKey, http.MethodGet, "/order/"+itoa(bob.ID), "", orders), http.StatusOK)
+		return orders.Stops
+	}
+
+	apiErr := &APIError{}
+	assert(t, stop(`"Trail":10`, apiErr), http.StatusBadRequest)
+	trade("100")
+	assert(t, stop(`"Trail":10,"TrailPercent":5`, apiErr), http.StatusBadRequest)
+	assert(t, stop(`"StopPrice":110`, apiErr), http.StatusBadRequest)
+	assert(t, stop(`"Trail":10,"LimitOffset":1`, apiErr), http.StatusBadRequest)
+
+	// a plain stop that is cancelled and a trailing one.
+	plain, trailing := &PlaceOrderResponse{}, &PlaceOrderResponse{}
+	assert(t, stop(`"StopPrice":50`, plain), http.StatusOK)
+	assert(t, stop(`"Trail":10`, trailing), http.StatusOK)
+	assert(t, len(stops()), 2)
+	cancelled := &CancelOrderResponse{}
+	assert(t, serve(bobKey, http.MethodDelete, "/order/"+itoa(plain.OrderID), "", cancelled), http.StatusOK)
+	assert(t, cancelled.Order.Status, OrderCancelled)
+	assert(t, cancelled.Order.Price, 50.0)
+	assert(t, stops()[0].Trigger, 90.0)
+
+	// the trigger follows the price up, not down.
+	trade("120")
+	assert(t, stops()[0].Trigger, 110.0)
+	trade("115")
+	assert(t, stops()[0].Trigger, 110.0)
+	assert(t, ex.Ledger.Balance(bob.ID, AssetETH), Balance{Available: 1})
+
+	// alice bids for two, carol sells one at 105 and bob's stop sells the other.
+	assert(t, serve(aliceKey, http.MethodPost, "/order", `{"Type":"LIMIT","Market":"ETH","Bid":true,"Size":2,"Price":105}`, nil), http.StatusOK)
+	assert(t, serve(carolKey, http.MethodPost, "/order", `{"Type":"MARKET","Market":"ETH","Size":1}`, nil), http.StatusOK)
+	assert(t, len(stops()), 0)
+	assert(t, ex.Ledger.Balance(bob.ID, AssetETH), Balance{})
+	assert(t, ex.Ledger.Balance(bob.ID, AssetUSD), Balance{Available: 105})
+}
+
+func TestStopUpdate(t *testing.T) {
+	// a buy stop trailing the ask by 10 percent, placed as a limit one above.
+	s := &stopOrder{StopState: StopState{Bid: true, StopParams: StopParams{TrailPercent: 10, Then: LimitOrder, LimitOffset: 1}}}
+	assert(t, s.update(100), false)
+	assert(t, s.Trigger, 110.0)
+	assert(t, s.update(80), false)
+	assert(t, s.Trigger, 88.0)
+	assert(t, s.update(85), false)
+	assert(t, s.Trigger, 88.0)
+	assert(t, s.update(88), true)
+}
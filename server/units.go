@@ -0,0 +1,38 @@
+package server
+
+import (
+	"math/big"
+	"strconv"
+)
+
+const ethDecimals = 18
+
+// toBaseUnits converts an amount as used by the books (1.5 ETH)
+// into the smallest unit of the asset (wei for ETH).
+// The float is formatted into its shortest decimal representation first
+// so 0.1 becomes exactly 100000000000000000 wei and not 100000000000000005.
+func toBaseUnits(amount float64, decimals uint8) *big.Int {
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(amount, 'f', -1, 64))
+	if !ok {
+		return big.NewInt(0)
+	}
+	factor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	r.Mul(r, new(big.Rat).SetInt(factor))
+
+	return new(big.Int).Quo(r.Num(), r.Denom())
+}
+
+// fromBaseUnits is the inverse of toBaseUnits.
+func fromBaseUnits(amount *big.Int, decimals uint8) float64 {
+	factor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	f, _ := new(big.Rat).SetFrac(amount, factor).Float64()
+	return f
+}
+
+func ethToWei(eth float64) *big.Int {
+	return toBaseUnits(eth, ethDecimals)
+}
+
+func weiToEth(wei *big.Int) float64 {
+	return fromBaseUnits(wei, ethDecimals)
+}
@@ -0,0 +1,396 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	UserActive UserStatus = "ACTIVE"
+	// a frozen account can only read, no trading and no withdrawals.
+	UserFrozen UserStatus = "FROZEN"
+	// trading is still allowed, the funds can't leave the exchange.
+	UserWithdrawDisabled UserStatus = "WITHDRAW_DISABLED"
+)
+
+type UserStatus string
+
+// User funds sit on a deposit address the exchange holds the key of,
+// the exchange never sees a key of the user.
+type User struct {
+	ID     int64
+	Status UserStatus
+	// deposits to it are credited to the user, trades settle between them.
+	DepositAddress common.Address
+	// the user's own wallet, it signs the EIP-712 orders.
+	WalletAddress common.Address
+	CreatedAt     int64
+}
+
+// Can reports whether the status of the account allows what the permission grants.
+func (u *User) Can(perm Permission) bool {
+	switch u.Status {
+	case UserFrozen:
+		return perm == PermRead
+	case UserWithdrawDisabled:
+		return perm != PermWithdraw
+	default:
+		return true
+	}
+}
+
+// UserRegistry keeps the users and writes every change to a JSON file,
+// so they are still registered after a restart.
+type UserRegistry struct {
+	// no file when empty, the users are only kept in memory.
+	path string
+
+	mu     sync.RWMutex
+	nextID int64
+	users  map[int64]*User
+}
+
+type userRegistryFile struct {
+	NextID int64
+	Users  []*User
+}
+
+// NewUserRegistry loads the users from the file if it exists.
+func NewUserRegistry(path string) (*UserRegistry, error) {
+	r := &UserRegistry{
+		path:  path,
+		users: make(map[int64]*User),
+	}
+	if path == "" {
+		return r, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file userRegistryFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("reading users from %s: %w", path, err)
+	}
+	r.nextID = file.NextID
+	for _, user := range file.Users {
+		r.users[user.ID] = user
+	}
+
+	return r, nil
+}
+
+// Add registers the user under the next free ID.
+func (r *UserRegistry) Add(user *User) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if user.WalletAddress != (common.Address{}) {
+		for _, u := range r.users {
+			if u.WalletAddress == user.WalletAddress {
+				return nil, fmt.Errorf("wallet %s is already registered", user.WalletAddress.Hex())
+			}
+		}
+	}
+
+	r.nextID++
+	u := *user
+	u.ID = r.nextID
+	if u.Status == "" {
+		u.Status = UserActive
+	}
+	r.users[u.ID] = &u
+
+	if err := r.save(); err != nil {
+		delete(r.users, u.ID)
+		r.nextID--
+		return nil, err
+	}
+
+	c := u
+	return &c, nil
+}
+
+func (r *UserRegistry) Get(id int64) (*User, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return nil, false
+	}
+	c := *user
+	return &c, true
+}
+
+func (r *UserRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.users)
+}
+
+func (r *UserRegistry) SetStatus(id int64, status UserStatus) (*User, error) {
+	switch status {
+	case UserActive, UserFrozen, UserWithdrawDisabled:
+	default:
+		return nil, fmt.Errorf("invalid user status [%s]", status)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return nil, fmt.Errorf("user %d not found", id)
+	}
+	prev := user.Status
+	user.Status = status
+	if err := r.save(); err != nil {
+		user.Status = prev
+		return nil, err
+	}
+
+	c := *user
+	return &c, nil
+}
+
+// Addresses maps the deposit addresses to their users.
+func (r *UserRegistry) Addresses() map[common.Address]int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	addresses := make(map[common.Address]int64, len(r.users))
+	for id, user := range r.users {
+		addresses[user.DepositAddress] = id
+	}
+	return addresses
+}
+
+// Wallets maps the wallets of the users to them.
+func (r *UserRegistry) Wallets() map[common.Address]int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	wallets := make(map[common.Address]int64, len(r.users))
+	for id, user := range r.users {
+		if user.WalletAddress != (common.Address{}) {
+			wallets[user.WalletAddress] = id
+		}
+	}
+	return wallets
+}
+
+// save writes the whole registry to a temporary file first
+// and renames it, a crash never leaves half a file behind.
+func (r *UserRegistry) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	file := userRegistryFile{
+		NextID: r.nextID,
+		Users:  make([]*User, 0, len(r.users)),
+	}
+	for _, user := range r.users {
+		file.Users = append(file.Users, user)
+	}
+	sort.Slice(file.Users, func(i, j int) bool { return file.Users[i].ID < file.Users[j].ID })
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o700); err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// NewUser creates a deposit address for the user in the exchange wallet.
+func (ex *Exchange) NewUser(wallet common.Address) (*User, error) {
+	address, err := ex.Wallet.NewAccount()
+	if err != nil {
+		return nil, err
+	}
+
+	return ex.Users.Add(&User{
+		DepositAddress: address,
+		WalletAddress:  wallet,
+		CreatedAt:      time.Now().UnixNano(),
+	})
+}
+
+type CreateUserRequest struct {
+	// optional, without it the user can't place wallet signed orders.
+	WalletAddress string
+}
+
+type CreateUserResponse struct {
+	User *User
+	// first key of the user, it can do everything but admin.
+	APIKey *APIKey
+}
+
+type CreateAPIKeyRequest struct {
+	Permissions []Permission
+}
+
+type UserStatusRequest struct {
+	Status UserStatus
+}
+
+// accountParam returns the user of the path, a user can only
+// get at their own account unless the key is an admin key.
+func accountParam(c echo.Context) (int64, bool, error) {
+	id, err := idParam(c, "id")
+	if err != nil {
+		return 0, false, err
+	}
+	key := c.Get(ctxAPIKey).(*APIKey)
+	return id, id == key.UserID || key.Can(PermAdmin), nil
+}
+
+func (ex *Exchange) handleCreateUser(c echo.Context) error {
+	var createUserData CreateUserRequest
+	if err := decodeBody(c, &createUserData); err != nil {
+		return err
+	}
+
+	var wallet common.Address
+	if createUserData.WalletAddress != "" {
+		if !common.IsHexAddress(createUserData.WalletAddress) {
+			return ErrBadRequest.WithMessage("invalid wallet address")
+		}
+		wallet = common.HexToAddress(createUserData.WalletAddress)
+	}
+
+	user, err := ex.NewUser(wallet)
+	if err != nil {
+		return badRequest(err)
+	}
+	key, err := ex.APIKeys.Create(user.ID, PermRead, PermTrade, PermWithdraw)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, &CreateUserResponse{User: user, APIKey: key})
+}
+
+func (ex *Exchange) handleGetUser(c echo.Context) error {
+	id, ok, err := accountParam(c)
+	if err != nil {
+		return err
+	}
+	user, found := ex.Users.Get(id)
+	if !ok || !found {
+		return ErrUserNotFound
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+func (ex *Exchange) handleSetUserStatus(c echo.Context) error {
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+	var statusData UserStatusRequest
+	if err := decodeBody(c, &statusData); err != nil {
+		return err
+	}
+
+	user, err := ex.Users.SetStatus(id, statusData.Status)
+	if err != nil {
+		return badRequest(err)
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+func (ex *Exchange) handleGetAPIKeys(c echo.Context) error {
+	id, ok, err := accountParam(c)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errNotYourAccount
+	}
+	return c.JSON(http.StatusOK, ex.APIKeys.List(id))
+}
+
+// handleCreateAPIKey hands out a new key, it can't get a permission
+// the key the request is signed with doesn't have.
+func (ex *Exchange) handleCreateAPIKey(c echo.Context) error {
+	id, ok, err := accountParam(c)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errNotYourAccount
+	}
+	if _, found := ex.Users.Get(id); !found {
+		return ErrUserNotFound
+	}
+
+	var keyData CreateAPIKeyRequest
+	if err := decodeBody(c, &keyData); err != nil {
+		return err
+	}
+	if len(keyData.Permissions) == 0 {
+		return ErrBadRequest.WithMessage("no permissions given")
+	}
+	signedWith := c.Get(ctxAPIKey).(*APIKey)
+	for _, perm := range keyData.Permissions {
+		if !signedWith.Can(perm) {
+			return ErrForbidden.WithMessage("api key is missing permission %s", perm)
+		}
+	}
+
+	key, err := ex.APIKeys.Create(id, keyData.Permissions...)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, key)
+}
+
+// handleRevokeAPIKey takes a key back, only with a key that has
+// every permission of it, a read key can't revoke a trading key.
+func (ex *Exchange) handleRevokeAPIKey(c echo.Context) error {
+	id, ok, err := accountParam(c)
+	if err != nil {
+		return err
+	}
+	key, found := ex.APIKeys.Get(c.Param("key"))
+	if !ok || !found || key.UserID != id {
+		return ErrNotFound.WithMessage("api key not found")
+	}
+	signedWith := c.Get(ctxAPIKey).(*APIKey)
+	for _, perm := range key.Permissions {
+		if !signedWith.Can(perm) {
+			return ErrForbidden.WithMessage("api key is missing permission %s", perm)
+		}
+	}
+
+	if _, err := ex.APIKeys.Revoke(key.Key); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]any{"msg": "api key revoked"})
+}
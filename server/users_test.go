@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/labstack/echo/v4"
+)
+
+func TestUserRegistryPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	users, err := NewUserRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wallet := common.HexToAddress("0x01")
+	alice, err := users.Add(&User{DepositAddress: common.HexToAddress("0xa1"), WalletAddress: wallet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, alice.ID, int64(1))
+	assert(t, alice.Status, UserActive)
+
+	// a wallet belongs to a single user.
+	_, err = users.Add(&User{WalletAddress: wallet})
+	assert(t, err != nil, true)
+
+	bob, _ := users.Add(&User{DepositAddress: common.HexToAddress("0xb0")})
+	assert(t, bob.ID, int64(2))
+	if _, err := users.SetStatus(bob.ID, UserWithdrawDisabled); err != nil {
+		t.Fatal(err)
+	}
+	_, err = users.SetStatus(bob.ID, "GONE")
+	assert(t, err != nil, true)
+
+	// a restart.
+	users, err = NewUserRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, ok := users.Get(bob.ID)
+	assert(t, ok, true)
+	assert(t, restored.Status, UserWithdrawDisabled)
+	assert(t, restored.Can(PermTrade), true)
+	assert(t, restored.Can(PermWithdraw), false)
+	assert(t, users.Wallets(), map[common.Address]int64{wallet: alice.ID})
+
+	carol, _ := users.Add(&User{})
+	assert(t, carol.ID, int64(3))
+}
+
+func TestAPIKeyManagement(t *testing.T) {
+	ex := newTestExchange(t, "")
+	e := echo.New()
+	ex.RegisterRoutes(e)
+	serve := signedServer(t, e)
+
+	alice, _ := ex.Users.Add(&User{})
+	bob, _ := ex.Users.Add(&User{})
+	reader, _ := ex.APIKeys.Create(alice.ID, PermRead)
+	trader, _ := ex.APIKeys.Create(alice.ID, PermRead, PermTrade)
+	bobKey, _ := ex.APIKeys.Create(bob.ID, PermRead, PermTrade)
+	keys := "/users/" + itoa(alice.ID) + "/keys"
+
+	// a read key can't mint itself more than read.
+	assert(t, serve(reader, http.MethodPost, keys, `{"Permissions":["read","trade"]}`, nil), http.StatusForbidden)
+	created := &APIKey{}
+	assert(t, serve(reader, http.MethodPost, keys, `{"Permissions":["read"]}`, created), http.StatusOK)
+	assert(t, created.Permissions, []Permission{PermRead})
+	assert(t, serve(trader, http.MethodPost, keys, `{"Permissions":["withdraw"]}`, nil), http.StatusForbidden)
+
+	// nor revoke a stronger key, and nobody gets at the keys of another user.
+	assert(t, serve(reader, http.MethodDelete, keys+"/"+trader.Key, "", nil), http.StatusForbidden)
+	assert(t, serve(bobKey, http.MethodPost, keys, `{"Permissions":["read"]}`, nil), http.StatusForbidden)
+	assert(t, serve(bobKey, http.MethodDelete, keys+"/"+reader.Key, "", nil), http.StatusNotFound)
+	assert(t, serve(trader, http.MethodDelete, keys+"/"+created.Key, "", nil), http.StatusOK)
+	assert(t, len(ex.APIKeys.List(alice.ID)), 2)
+}
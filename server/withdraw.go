@@ -0,0 +1,614 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	WithdrawalPendingApproval WithdrawalStatus = "PENDING_APPROVAL"
+	WithdrawalQueued          WithdrawalStatus = "QUEUED"
+	WithdrawalSent            WithdrawalStatus = "SENT"
+	WithdrawalCompleted       WithdrawalStatus = "COMPLETED"
+	WithdrawalFailed          WithdrawalStatus = "FAILED"
+	WithdrawalRejected        WithdrawalStatus = "REJECTED"
+)
+
+type WithdrawalStatus string
+
+type Withdrawal struct {
+	ID        int64
+	UserID    int64
+	Asset     Asset
+	Amount    float64
+	To        common.Address
+	Status    WithdrawalStatus
+	TxHash    common.Hash
+	Error     string
+	CreatedAt int64
+}
+
+// refunded reports whether the locked funds went back to the user,
+// so the withdrawal should not count against the daily limit.
+func (w *Withdrawal) refunded() bool {
+	return w.Status == WithdrawalFailed || w.Status == WithdrawalRejected
+}
+
+type WithdrawalLimits struct {
+	// maximum amount of a single withdrawal.
+	MaxAmount float64
+	// maximum amount a user can withdraw in 24 hours.
+	DailyLimit float64
+	// withdrawals above this amount have to be approved
+	// by an operator before they are sent.
+	ApprovalThreshold float64
+}
+
+var DefaultWithdrawalLimits = WithdrawalLimits{
+	MaxAmount:         100,
+	DailyLimit:        250,
+	ApprovalThreshold: 10,
+}
+
+// withdrawalRecord is a withdrawal the way the journal and the snapshots
+// have it, with the signed transaction while it's sent.
+type withdrawalRecord struct {
+	Withdrawal
+	Tx hexutil.Bytes `json:",omitempty"`
+}
+
+// WithdrawalWorker sends the withdrawals from the deposit addresses of the
+// users one by one and tracks each transaction until it's mined. Every change
+// of a withdrawal is journaled through the ledger before it's made.
+type WithdrawalWorker struct {
+	chain        *Chain
+	wallet       Wallet
+	users        func(int64) (*User, bool)
+	ledger       *Ledger
+	limits       WithdrawalLimits
+	pollInterval time.Duration
+
+	mu          sync.RWMutex
+	nextID      int64
+	withdrawals map[int64]*Withdrawal
+	// signed transactions of the SENT withdrawals, sent again
+	// after a restart when the node lost them.
+	txs   map[int64][]byte
+	queue chan *Withdrawal
+}
+
+func NewWithdrawalWorker(chain *Chain, wallet Wallet, users func(int64) (*User, bool), ledger *Ledger, limits WithdrawalLimits) *WithdrawalWorker {
+	return &WithdrawalWorker{
+		chain:        chain,
+		wallet:       wallet,
+		users:        users,
+		ledger:       ledger,
+		limits:       limits,
+		pollInterval: 2 * time.Second,
+		withdrawals:  make(map[int64]*Withdrawal),
+		txs:          make(map[int64][]byte),
+		queue:        make(chan *Withdrawal, 1024),
+	}
+}
+
+// save journals the withdrawal as next with what that does to the balance of
+// the user, and only then changes it. It has to be called with mu held.
+func (ww *WithdrawalWorker) save(w *Withdrawal, next Withdrawal, tx []byte, entries ...ledgerEntry) error {
+	record := &journalEntry{Withdrawal: &withdrawalRecord{Withdrawal: next, Tx: tx}}
+	return ww.ledger.commitRecord(record, entries, func() {
+		*w = next
+		ww.withdrawals[w.ID] = w
+		ww.setTx(w.ID, w.Status, tx)
+	})
+}
+
+func (ww *WithdrawalWorker) setTx(id int64, status WithdrawalStatus, tx []byte) {
+	if status != WithdrawalSent {
+		delete(ww.txs, id)
+		return
+	}
+	if tx != nil {
+		ww.txs[id] = tx
+	}
+}
+
+// restore puts back a withdrawal from the journal or a snapshot.
+func (ww *WithdrawalWorker) restore(record *withdrawalRecord) {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+
+	w := record.Withdrawal
+	ww.withdrawals[w.ID] = &w
+	ww.nextID = max(ww.nextID, w.ID)
+	ww.setTx(w.ID, w.Status, record.Tx)
+}
+
+// records copies the withdrawals for a snapshot, it has to be called with mu held.
+func (ww *WithdrawalWorker) records() []withdrawalRecord {
+	records := make([]withdrawalRecord, 0, len(ww.withdrawals))
+	for _, w := range ww.withdrawals {
+		records = append(records, withdrawalRecord{Withdrawal: *w, Tx: ww.txs[w.ID]})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records
+}
+
+// locked is what the withdrawals not done yet hold of the balances.
+func (ww *WithdrawalWorker) locked() map[int64]map[Asset]float64 {
+	ww.mu.RLock()
+	defer ww.mu.RUnlock()
+
+	locked := make(map[int64]map[Asset]float64)
+	for _, w := range ww.withdrawals {
+		switch w.Status {
+		case WithdrawalPendingApproval, WithdrawalQueued, WithdrawalSent:
+			if locked[w.UserID] == nil {
+				locked[w.UserID] = make(map[Asset]float64)
+			}
+			locked[w.UserID][w.Asset] += w.Amount
+		}
+	}
+	return locked
+}
+
+// Request validates the withdrawal against the limits and locks the funds.
+// Small withdrawals are queued right away, large ones wait for approval.
+func (ww *WithdrawalWorker) Request(userID int64, asset Asset, amount float64, to common.Address) (*Withdrawal, error) {
+	if asset != AssetETH {
+		return nil, fmt.Errorf("withdrawals of %s are not supported", asset)
+	}
+	if amount <= 0 {
+		return nil, fmt.Errorf("invalid withdrawal amount [%.8f]", amount)
+	}
+	if amount > ww.limits.MaxAmount {
+		return nil, fmt.Errorf("withdrawal amount [%.8f] exceeds the maximum [%.8f]", amount, ww.limits.MaxAmount)
+	}
+	if to == (common.Address{}) {
+		return nil, errors.New("invalid withdrawal address")
+	}
+
+	ww.mu.Lock()
+	if withdrawn := ww.withdrawnSince(userID, time.Now().Add(-24*time.Hour)); withdrawn+amount > ww.limits.DailyLimit {
+		ww.mu.Unlock()
+		return nil, fmt.Errorf("daily withdrawal limit [%.8f] exceeded, already withdrawn [%.8f]", ww.limits.DailyLimit, withdrawn)
+	}
+
+	w := &Withdrawal{
+		ID:        ww.nextID + 1,
+		UserID:    userID,
+		Asset:     asset,
+		Amount:    amount,
+		To:        to,
+		Status:    WithdrawalQueued,
+		CreatedAt: time.Now().UnixNano(),
+	}
+	if amount > ww.limits.ApprovalThreshold {
+		w.Status = WithdrawalPendingApproval
+	}
+	if err := ww.save(w, *w, nil, ledgerEntry{Op: opLock, UserID: userID, Asset: asset, Amount: amount}); err != nil {
+		ww.mu.Unlock()
+		return nil, err
+	}
+	ww.nextID = w.ID
+	c := *w
+	ww.mu.Unlock()
+
+	// never block on the queue while holding the lock,
+	// the worker needs it to update the status.
+	if c.Status == WithdrawalQueued {
+		ww.queue <- w
+	}
+
+	return &c, nil
+}
+
+func (ww *WithdrawalWorker) withdrawnSince(userID int64, since time.Time) float64 {
+	total := 0.0
+	for _, w := range ww.withdrawals {
+		if w.UserID != userID || w.refunded() || w.CreatedAt < since.UnixNano() {
+			continue
+		}
+		total += w.Amount
+	}
+	return total
+}
+
+func (ww *WithdrawalWorker) Approve(id int64) (*Withdrawal, error) {
+	ww.mu.Lock()
+	w, ok := ww.withdrawals[id]
+	if !ok {
+		ww.mu.Unlock()
+		return nil, fmt.Errorf("withdrawal not found %d", id)
+	}
+	if w.Status != WithdrawalPendingApproval {
+		ww.mu.Unlock()
+		return nil, fmt.Errorf("withdrawal %d is not pending approval (%s)", id, w.Status)
+	}
+	next := *w
+	next.Status = WithdrawalQueued
+	if err := ww.save(w, next, nil); err != nil {
+		ww.mu.Unlock()
+		return nil, err
+	}
+	c := *w
+	ww.mu.Unlock()
+
+	ww.queue <- w
+
+	return &c, nil
+}
+
+func (ww *WithdrawalWorker) Reject(id int64) (*Withdrawal, error) {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+
+	w, ok := ww.withdrawals[id]
+	if !ok {
+		return nil, fmt.Errorf("withdrawal not found %d", id)
+	}
+	if w.Status != WithdrawalPendingApproval {
+		return nil, fmt.Errorf("withdrawal %d is not pending approval (%s)", id, w.Status)
+	}
+	next := *w
+	next.Status = WithdrawalRejected
+	if err := ww.save(w, next, nil, ledgerEntry{Op: opUnlock, UserID: w.UserID, Asset: w.Asset, Amount: w.Amount}); err != nil {
+		return nil, err
+	}
+
+	c := *w
+	return &c, nil
+}
+
+func (ww *WithdrawalWorker) Get(id int64) (*Withdrawal, bool) {
+	ww.mu.RLock()
+	defer ww.mu.RUnlock()
+
+	w, ok := ww.withdrawals[id]
+	if !ok {
+		return nil, false
+	}
+	c := *w
+	return &c, true
+}
+
+// Run sends again what was sent or queued before a restart
+// and then processes the queue until the context is done.
+func (ww *WithdrawalWorker) Run(ctx context.Context) {
+	ww.resume(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case w := <-ww.queue:
+			ww.process(ctx, w)
+		}
+	}
+}
+
+// resume picks up the withdrawals the journal had sent or queued.
+// The sent ones go first, their nonces come before the queued ones.
+func (ww *WithdrawalWorker) resume(ctx context.Context) {
+	type sentWithdrawal struct {
+		w  *Withdrawal
+		tx []byte
+	}
+	var (
+		sent   []sentWithdrawal
+		queued []*Withdrawal
+	)
+	ww.mu.RLock()
+	for _, w := range ww.withdrawals {
+		switch w.Status {
+		case WithdrawalSent:
+			sent = append(sent, sentWithdrawal{w: w, tx: ww.txs[w.ID]})
+		case WithdrawalQueued:
+			queued = append(queued, w)
+		}
+	}
+	ww.mu.RUnlock()
+	sort.Slice(sent, func(i, j int) bool { return sent[i].w.ID < sent[j].w.ID })
+	sort.Slice(queued, func(i, j int) bool { return queued[i].ID < queued[j].ID })
+
+	for _, s := range sent {
+		tx := new(types.Transaction)
+		if err := tx.UnmarshalBinary(s.tx); err != nil {
+			log.Printf("withdrawal %d: reading tx %s: %s", s.w.ID, s.w.TxHash.Hex(), err)
+			continue
+		}
+		if ww.recheck(ctx, s.w, tx) {
+			go ww.track(ctx, s.w, tx)
+		}
+	}
+	for _, w := range queued {
+		if ctx.Err() != nil {
+			return
+		}
+		ww.process(ctx, w)
+	}
+}
+
+// recheck finds out what happened to a transaction that was journaled but
+// might not have gone out, before a restart or when sending it failed.
+func (ww *WithdrawalWorker) recheck(ctx context.Context, w *Withdrawal, tx *types.Transaction) bool {
+	signer, err := ww.signer(w.UserID)
+	if err != nil {
+		log.Printf("withdrawal %d: %s", w.ID, err)
+		return false
+	}
+	resent, err := ww.chain.Recheck(ctx, signer, tx)
+	if err != nil {
+		log.Printf("withdrawal %d: %s", w.ID, err)
+		return false
+	}
+	if resent {
+		log.Printf("withdrawal %d sent tx %s again", w.ID, tx.Hash().Hex())
+	}
+	return true
+}
+
+// resend rechecks a journaled transaction that failed to go out until it's
+// sent or mined, then tracks it. The withdrawal stays SENT meanwhile, the
+// node might have taken the transaction and refunding it would pay twice.
+func (ww *WithdrawalWorker) resend(ctx context.Context, w *Withdrawal, tx *types.Transaction) {
+	wait := ww.pollInterval
+	for !ww.recheck(ctx, w, tx) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > time.Minute {
+			wait = time.Minute
+		}
+	}
+	ww.track(ctx, w, tx)
+}
+
+func (ww *WithdrawalWorker) process(ctx context.Context, w *Withdrawal) {
+	// resume already took what was queued before Run.
+	ww.mu.RLock()
+	queued := w.Status == WithdrawalQueued
+	ww.mu.RUnlock()
+	if !queued {
+		return
+	}
+
+	// the transaction is journaled before it goes out,
+	// a restart never sends the withdrawal a second time.
+	signer, err := ww.signer(w.UserID)
+	if err != nil {
+		ww.fail(w, err)
+		return
+	}
+	tx, err := ww.chain.SendTxRecorded(ctx, signer, w.To, ethToWei(w.Amount), nil, func(tx *types.Transaction) error {
+		return ww.sent(w, tx)
+	})
+	if err != nil && tx != nil {
+		log.Printf("withdrawal %d: sending tx %s: %s", w.ID, tx.Hash().Hex(), err)
+		go ww.resend(ctx, w, tx)
+		return
+	}
+	if err != nil {
+		// the transaction was never journaled, so it never went out.
+		ww.fail(w, err)
+		return
+	}
+
+	log.Printf("withdrawal %d sent tx => %s", w.ID, tx.Hash().Hex())
+
+	go ww.track(ctx, w, tx)
+}
+
+// signer signs for the deposit address of the user, withdrawals are paid out of it.
+func (ww *WithdrawalWorker) signer(userID int64) (Signer, error) {
+	user, ok := ww.users(userID)
+	if !ok {
+		return nil, fmt.Errorf("user not found %d", userID)
+	}
+	return ww.wallet.Signer(user.DepositAddress)
+}
+
+// sent journals the signed transaction of the withdrawal.
+func (ww *WithdrawalWorker) sent(w *Withdrawal, tx *types.Transaction) error {
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	next := *w
+	next.Status = WithdrawalSent
+	next.TxHash = tx.Hash()
+	return ww.save(w, next, raw)
+}
+
+// track waits until the transaction is mined.
+// A successful transaction finalises the withdrawal, a reverted one refunds it.
+func (ww *WithdrawalWorker) track(ctx context.Context, w *Withdrawal, tx *types.Transaction) {
+	receipt, err := ww.chain.Nonces.WaitMined(ctx, tx.Hash(), ww.pollInterval)
+	if err != nil {
+		// shutting down, the withdrawal stays SENT.
+		return
+	}
+
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		ww.fail(w, fmt.Errorf("transaction %s reverted", receipt.TxHash.Hex()))
+		return
+	}
+
+	ww.mu.Lock()
+	next := *w
+	next.Status = WithdrawalCompleted
+	// the transaction might have been replaced with a gas bump.
+	next.TxHash = receipt.TxHash
+	err = ww.save(w, next, nil, ledgerEntry{Op: opDebitLocked, UserID: w.UserID, Asset: w.Asset, Amount: w.Amount})
+	ww.mu.Unlock()
+	if err != nil {
+		log.Printf("completing withdrawal %d: %s", w.ID, err)
+		return
+	}
+
+	log.Printf("withdrawal %d completed in block %d", w.ID, receipt.BlockNumber)
+}
+
+func (ww *WithdrawalWorker) fail(w *Withdrawal, err error) {
+	ww.mu.Lock()
+	next := *w
+	next.Status = WithdrawalFailed
+	next.Error = err.Error()
+	serr := ww.save(w, next, nil, ledgerEntry{Op: opUnlock, UserID: w.UserID, Asset: w.Asset, Amount: w.Amount})
+	ww.mu.Unlock()
+	if serr != nil {
+		log.Printf("failing withdrawal %d (%s): %s", w.ID, err, serr)
+		return
+	}
+
+	log.Printf("withdrawal %d failed, refunded: %s", w.ID, err)
+}
+
+type WithdrawRequest struct {
+	Asset  Asset
+	Amount float64
+	To     string
+}
+
+type BalancesResponse struct {
+	Balances map[Asset]Balance
+}
+
+func (ex *Exchange) handleGetBalances(c echo.Context) error {
+	userID, err := idParam(c, "userID")
+	if err != nil {
+		return err
+	}
+	if userID != authUserID(c) {
+		return errNotYourAccount
+	}
+
+	resp := &BalancesResponse{
+		Balances: ex.Ledger.Balances(userID),
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// CreditRequest funds an asset that doesn't live on chain,
+// like the USD paid in by bank transfer.
+type CreditRequest struct {
+	Asset  Asset
+	Amount float64
+}
+
+// offChainAsset is an asset traded on a market that
+// no deposit address can receive.
+func (ex *Exchange) offChainAsset(asset Asset) bool {
+	if asset == AssetETH {
+		return false
+	}
+	if _, ok := ex.tokens[asset]; ok {
+		return false
+	}
+	for _, assets := range ex.markets {
+		if assets.Base == asset || assets.Quote == asset {
+			return true
+		}
+	}
+	return false
+}
+
+// handleCreditBalance credits an off-chain asset to a user, assets on chain
+// only come in as deposits.
+func (ex *Exchange) handleCreditBalance(c echo.Context) error {
+	userID, err := idParam(c, "userID")
+	if err != nil {
+		return err
+	}
+	if _, ok := ex.Users.Get(userID); !ok {
+		return ErrNotFound.WithMessage("user not found [%d]", userID)
+	}
+	var req CreditRequest
+	if err := decodeBody(c, &req); err != nil {
+		return err
+	}
+	if !ex.offChainAsset(req.Asset) {
+		return ErrBadRequest.WithMessage("asset %q is not traded off chain, it's funded by deposits", req.Asset).WithDetail("asset", req.Asset)
+	}
+	if req.Amount <= 0 {
+		return ErrBadRequest.WithMessage("amount [%g] has to be positive", req.Amount)
+	}
+
+	if err := ex.Ledger.Credit(userID, req.Asset, req.Amount); err != nil {
+		return err
+	}
+	log.Printf("credited %.8f %s to user %d", req.Amount, req.Asset, userID)
+
+	return c.JSON(http.StatusOK, &BalancesResponse{Balances: ex.Ledger.Balances(userID)})
+}
+
+func (ex *Exchange) handleWithdraw(c echo.Context) error {
+	var withdrawData WithdrawRequest
+	if err := decodeBody(c, &withdrawData); err != nil {
+		return err
+	}
+
+	if !common.IsHexAddress(withdrawData.To) {
+		return ErrBadRequest.WithMessage("invalid withdrawal address")
+	}
+
+	w, err := ex.Withdrawals.Request(authUserID(c), withdrawData.Asset, withdrawData.Amount, common.HexToAddress(withdrawData.To))
+	if err != nil {
+		return badRequest(err)
+	}
+
+	return c.JSON(http.StatusOK, w)
+}
+
+func (ex *Exchange) handleGetWithdrawal(c echo.Context) error {
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+
+	w, ok := ex.Withdrawals.Get(id)
+	if !ok || w.UserID != authUserID(c) {
+		return ErrNotFound.WithMessage("withdrawal not found")
+	}
+	return c.JSON(http.StatusOK, w)
+}
+
+func (ex *Exchange) handleApproveWithdrawal(c echo.Context) error {
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+
+	w, err := ex.Withdrawals.Approve(id)
+	if err != nil {
+		return badRequest(err)
+	}
+	return c.JSON(http.StatusOK, w)
+}
+
+func (ex *Exchange) handleRejectWithdrawal(c echo.Context) error {
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+
+	w, err := ex.Withdrawals.Reject(id)
+	if err != nil {
+		return badRequest(err)
+	}
+	return c.JSON(http.StatusOK, w)
+}
@@ -0,0 +1,159 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/ukibbb/crypto-exchange/orderbook"
+)
+
+// the crash test runs the exchange side in a child process.
+const crashDirEnv = "WAL_CRASH_DIR"
+
+// nextCommand makes up a valid command for the book, the same rng
+// on the same book always makes up the same command.
+func nextCommand(ob *orderbook.OrderBook, rng *rand.Rand, i int) orderbook.Command {
+	for {
+		cmd := orderbook.Command{
+			OrderID:   int64(i + 1),
+			UserID:    rng.Int63n(5),
+			Bid:       rng.Intn(2) == 0,
+			Price:     float64(95 + rng.Intn(10)),
+			Size:      float64(1 + rng.Intn(10)),
+			Timestamp: int64(i),
+		}
+		switch r := rng.Intn(10); {
+		case r < 6:
+			cmd.Type = orderbook.CmdPlaceLimit
+		case r < 8:
+			cmd.Type = orderbook.CmdPlaceMarket
+		case r < 9:
+			cmd.Type = orderbook.CmdCancel
+			cmd.OrderID = rng.Int63n(int64(i + 1))
+		default:
+			cmd.Type = orderbook.CmdAmend
+			cmd.OrderID = rng.Int63n(int64(i + 1))
+		}
+		if ob.Check(cmd) == nil {
+			return cmd
+		}
+	}
+}
+
+// bookState is everything that has to survive a crash.
+func bookState(ob *orderbook.OrderBook) string {
+	var b strings.Builder
+	for _, limits := range [][]*orderbook.Limit{ob.Asks(), ob.Bids()} {
+		for _, limit := range limits {
+			fmt.Fprintf(&b, "%.2f/%.2f:", limit.Price, limit.TotalVolume)
+			for _, o := range limit.Orders {
+				fmt.Fprintf(&b, " %d/%.2f", o.ID, o.Size)
+			}
+			b.WriteString("\n")
+		}
+	}
+	for _, trade := range ob.Trades {
+		fmt.Fprintf(&b, "%+v\n", *trade)
+	}
+	return b.String()
+}
+
+// TestCrashChild is the child process, it journals commands until it gets killed.
+func TestCrashChild(t *testing.T) {
+	dir := os.Getenv(crashDirEnv)
+	if dir == "" {
+		t.Skip("only runs as the child of TestRecoverAfterKill")
+	}
+
+	l, err := Open(dir, Options{SegmentSize: 4 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ob := orderbook.NewOrderBook()
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; ; i++ {
+		cmd := nextCommand(ob, rng, i)
+		data, _ := json.Marshal(cmd)
+		seq, err := l.Append(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := ob.Apply(cmd); err != nil {
+			t.Fatal(err)
+		}
+		// the command is acknowledged.
+		fmt.Printf("ack %d\n", seq)
+	}
+}
+
+func TestRecoverAfterKill(t *testing.T) {
+	if os.Getenv(crashDirEnv) != "" {
+		return
+	}
+	dir := t.TempDir()
+
+	child := exec.Command(os.Args[0], "-test.run=^TestCrashChild$")
+	child.Env = append(os.Environ(), crashDirEnv+"="+dir)
+	stdout, err := child.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// kill it in the middle of the batch, without warning.
+	var acked uint64
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if _, err := fmt.Sscanf(scanner.Text(), "ack %d", &acked); err == nil && acked >= 500 {
+			break
+		}
+	}
+	child.Process.Kill()
+	child.Wait()
+	if acked < 500 {
+		t.Fatalf("child only acknowledged %d commands", acked)
+	}
+
+	l, err := Open(dir, Options{SegmentSize: 4 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	recovered := orderbook.NewOrderBook()
+	var replayed int
+	err = l.Replay(1, func(seq uint64, payload []byte) error {
+		var cmd orderbook.Command
+		if err := json.Unmarshal(payload, &cmd); err != nil {
+			return err
+		}
+		replayed++
+		_, _, err := recovered.Apply(cmd)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing acknowledged got lost.
+	assert(t, replayed >= int(acked), true)
+	assert(t, l.LastSeq(), uint64(replayed))
+
+	// the book is the one the child had after the last journaled command.
+	expected := orderbook.NewOrderBook()
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < replayed; i++ {
+		if _, _, err := expected.Apply(nextCommand(expected, rng, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert(t, bookState(recovered), bookState(expected))
+	assert(t, len(recovered.Trades) > 0, true)
+}
@@ -0,0 +1,428 @@
+// Package wal is an append-only, checksummed log split into segment files.
+//
+// Every record gets the next sequence number, starting at 1. A segment is
+// named after the sequence number of its first record, so the segments
+// sort in log order and whole segments can be deleted once a snapshot
+// covers them.
+//
+// Record layout, little endian:
+//
+//	crc32 (castagnoli) of seq + payload | uint32
+//	payload length                      | uint32
+//	seq                                 | uint64
+//	payload                             | length bytes
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	headerSize = 16
+	segmentExt = ".wal"
+
+	DefaultSegmentSize = 64 << 20
+	// a record bigger than this is corruption, not data.
+	maxRecordSize = 64 << 20
+)
+
+var (
+	ErrCorrupt = errors.New("wal: corrupt record")
+	ErrClosed  = errors.New("wal: log is closed")
+	// an append failed and what it wrote couldn't be cut off again.
+	ErrFailed = errors.New("wal: log failed")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type Options struct {
+	// a new segment is started once the current one is bigger than this.
+	SegmentSize int64
+	// skips the fsync after every append, a crash can lose
+	// acknowledged records. Only for tests and benchmarks.
+	NoSync bool
+}
+
+// segmentFile is the part of *os.File the log writes segments with.
+type segmentFile interface {
+	io.WriteCloser
+	io.Seeker
+	Sync() error
+	Truncate(size int64) error
+}
+
+type segment struct {
+	firstSeq uint64
+	path     string
+}
+
+type Log struct {
+	dir  string
+	opts Options
+
+	mu       sync.Mutex
+	segments []segment
+	file     segmentFile
+	// size of the current segment up to the end of its last record.
+	size    int64
+	nextSeq uint64
+	closed  bool
+	// set once the log can't be appended to anymore, Append returns it.
+	failed error
+}
+
+func segmentName(firstSeq uint64) string {
+	return fmt.Sprintf("%020d%s", firstSeq, segmentExt)
+}
+
+// Open opens the log in dir, creating it if needed.
+// A record the last segment ends in that was only partly written
+// (the process died writing it) is cut off.
+func Open(dir string, opts Options) (*Log, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	l := &Log{dir: dir, opts: opts, nextSeq: 1}
+	segments, err := l.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	l.segments = segments
+
+	if len(segments) == 0 {
+		if err := l.newSegment(1); err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+
+	last := segments[len(segments)-1]
+	nextSeq, validSize, err := scanSegment(last)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(last.path, os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(validSize); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(validSize, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.file = f
+	l.size = validSize
+	l.nextSeq = nextSeq
+
+	return l, nil
+}
+
+func (l *Log) listSegments() ([]segment, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		firstSeq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{firstSeq: firstSeq, path: filepath.Join(l.dir, name)})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].firstSeq < segments[j].firstSeq })
+
+	return segments, nil
+}
+
+// scanSegment returns the sequence number after the last intact record
+// and the size of the segment up to the end of that record.
+func scanSegment(s segment) (uint64, int64, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	nextSeq := s.firstSeq
+	var size int64
+	r := bufio.NewReader(f)
+	for {
+		seq, payload, err := readRecord(r)
+		if err != nil {
+			// anything after the last intact record is a torn write.
+			return nextSeq, size, nil
+		}
+		if seq != nextSeq {
+			return 0, 0, fmt.Errorf("%w: %s expected seq %d got %d", ErrCorrupt, s.path, nextSeq, seq)
+		}
+		nextSeq++
+		size += headerSize + int64(len(payload))
+	}
+}
+
+func readRecord(r io.Reader) (uint64, []byte, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, nil, ErrCorrupt
+		}
+		return 0, nil, err
+	}
+	sum := binary.LittleEndian.Uint32(header[0:4])
+	length := binary.LittleEndian.Uint32(header[4:8])
+	seq := binary.LittleEndian.Uint64(header[8:16])
+	if length > maxRecordSize {
+		return 0, nil, ErrCorrupt
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, ErrCorrupt
+	}
+	if checksum(seq, payload) != sum {
+		return 0, nil, ErrCorrupt
+	}
+
+	return seq, payload, nil
+}
+
+func checksum(seq uint64, payload []byte) uint32 {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], seq)
+	crc := crc32.Update(0, crcTable, b[:])
+	return crc32.Update(crc, crcTable, payload)
+}
+
+func (l *Log) newSegment(firstSeq uint64) error {
+	path := filepath.Join(l.dir, segmentName(firstSeq))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	l.file = f
+	l.size = 0
+	l.segments = append(l.segments, segment{firstSeq: firstSeq, path: path})
+
+	return l.syncDir()
+}
+
+// syncDir makes the creation or deletion of a segment durable.
+func (l *Log) syncDir() error {
+	if l.opts.NoSync {
+		return nil
+	}
+	d, err := os.Open(l.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Append writes the record and syncs it to disk before it returns,
+// once it returns the record survives a crash.
+func (l *Log) Append(payload []byte) (uint64, error) {
+	if len(payload) > maxRecordSize {
+		return 0, fmt.Errorf("wal: record of %d bytes is too big", len(payload))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, ErrClosed
+	}
+	if l.failed != nil {
+		return 0, l.failed
+	}
+	if l.size >= l.opts.SegmentSize {
+		if err := l.newSegment(l.nextSeq); err != nil {
+			return 0, err
+		}
+	}
+
+	seq := l.nextSeq
+	buf := make([]byte, headerSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], checksum(seq, payload))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(payload)))
+	binary.LittleEndian.PutUint64(buf[8:16], seq)
+	copy(buf[headerSize:], payload)
+
+	if err := l.write(buf); err != nil {
+		// the next record has to go where this one would have gone, a record
+		// after a torn one is cut off on open and its seq would come twice.
+		if rerr := l.rewind(); rerr != nil {
+			l.failed = fmt.Errorf("%w: %w", ErrFailed, rerr)
+		}
+		return 0, err
+	}
+	l.size += int64(len(buf))
+	l.nextSeq++
+
+	return seq, nil
+}
+
+func (l *Log) write(buf []byte) error {
+	if _, err := l.file.Write(buf); err != nil {
+		return err
+	}
+	if l.opts.NoSync {
+		return nil
+	}
+	return l.file.Sync()
+}
+
+// rewind cuts off whatever a failed append wrote after the last record.
+func (l *Log) rewind() error {
+	if err := l.file.Truncate(l.size); err != nil {
+		return err
+	}
+	if _, err := l.file.Seek(l.size, io.SeekStart); err != nil {
+		return err
+	}
+	if l.opts.NoSync {
+		return nil
+	}
+	return l.file.Sync()
+}
+
+// LastSeq is the sequence number of the last record, 0 for an empty log.
+func (l *Log) LastSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.nextSeq - 1
+}
+
+// Replay calls fn for every record from the sequence number on, in order.
+func (l *Log) Replay(from uint64, fn func(seq uint64, payload []byte) error) error {
+	l.mu.Lock()
+	segments := append([]segment(nil), l.segments...)
+	lastSeq := l.nextSeq - 1
+	l.mu.Unlock()
+
+	for i, s := range segments {
+		// every record of the segment comes before from.
+		if i+1 < len(segments) && segments[i+1].firstSeq <= from {
+			continue
+		}
+		if err := replaySegment(s, from, lastSeq, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func replaySegment(s segment, from, lastSeq uint64, fn func(uint64, []byte) error) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	expected := s.firstSeq
+	r := bufio.NewReader(f)
+	for expected <= lastSeq {
+		seq, payload, err := readRecord(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s seq %d: %w", s.path, expected, err)
+		}
+		if seq != expected {
+			return fmt.Errorf("%w: %s expected seq %d got %d", ErrCorrupt, s.path, expected, seq)
+		}
+		expected++
+
+		if seq < from {
+			continue
+		}
+		if err := fn(seq, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TruncateBefore deletes the segments that only hold records before seq.
+// The segment being written to is never deleted.
+func (l *Log) TruncateBefore(seq uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var deleted int
+	for i := 0; i+1 < len(l.segments); i++ {
+		if l.segments[i+1].firstSeq > seq {
+			break
+		}
+		if err := os.Remove(l.segments[i].path); err != nil {
+			return err
+		}
+		deleted++
+	}
+	if deleted == 0 {
+		return nil
+	}
+	l.segments = l.segments[deleted:]
+
+	return l.syncDir()
+}
+
+// Segments returns the paths of the segment files in log order.
+func (l *Log) Segments() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	paths := make([]string, len(l.segments))
+	for i, s := range l.segments {
+		paths[i] = s.path
+	}
+	return paths
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
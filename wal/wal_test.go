@@ -0,0 +1,202 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func appendN(t *testing.T, l *Log, from, to int) {
+	t.Helper()
+	for i := from; i <= to; i++ {
+		seq, err := l.Append([]byte(fmt.Sprintf("record %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert(t, seq, uint64(i))
+	}
+}
+
+func replayAll(t *testing.T, l *Log, from uint64) []string {
+	t.Helper()
+	var records []string
+	err := l.Replay(from, func(seq uint64, payload []byte) error {
+		records = append(records, fmt.Sprintf("%d:%s", seq, payload))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestAppendReplaySegments(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{SegmentSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, 1, 10)
+	// every segment fits about two records.
+	assert(t, len(l.Segments()) > 3, true)
+	l.Close()
+
+	l, err = Open(dir, Options{SegmentSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	assert(t, l.LastSeq(), uint64(10))
+	appendN(t, l, 11, 12)
+
+	records := replayAll(t, l, 9)
+	assert(t, records, []string{"9:record 9", "10:record 10", "11:record 11", "12:record 12"})
+	assert(t, len(replayAll(t, l, 1)), 12)
+}
+
+func TestOpenCutsTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, 1, 3)
+	l.Close()
+
+	// the process died halfway through writing the fourth record.
+	f, err := os.OpenFile(l.Segments()[0], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{1, 2, 3, 4, 5, 6, 7})
+	f.Close()
+
+	l, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	assert(t, l.LastSeq(), uint64(3))
+	appendN(t, l, 4, 4)
+	assert(t, len(replayAll(t, l, 1)), 4)
+}
+
+func TestReplayDetectsCorruption(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{SegmentSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	appendN(t, l, 1, 6)
+
+	// flip a byte of the payload of the first record.
+	first := l.Segments()[0]
+	data, _ := os.ReadFile(first)
+	data[headerSize] ^= 0xff
+	os.WriteFile(first, data, 0o600)
+
+	err = l.Replay(1, func(uint64, []byte) error { return nil })
+	assert(t, errors.Is(err, ErrCorrupt), true)
+}
+
+func TestTruncateBefore(t *testing.T) {
+	l, err := Open(t.TempDir(), Options{SegmentSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	appendN(t, l, 1, 10)
+
+	segments := len(l.Segments())
+	if err := l.TruncateBefore(7); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(l.Segments()) < segments, true)
+
+	// everything from 7 on is still there.
+	records := replayAll(t, l, 7)
+	assert(t, records, []string{"7:record 7", "8:record 8", "9:record 9", "10:record 10"})
+
+	if err := l.TruncateBefore(100); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(l.Segments()), 1)
+	appendN(t, l, 11, 11)
+}
+
+// faultyFile writes half of the next buffer and fails, a full disk.
+type faultyFile struct {
+	segmentFile
+	failWrite    bool
+	failTruncate bool
+}
+
+func (f *faultyFile) Write(b []byte) (int, error) {
+	if !f.failWrite {
+		return f.segmentFile.Write(b)
+	}
+	n, _ := f.segmentFile.Write(b[:len(b)/2])
+	return n, errors.New("no space left on device")
+}
+
+func (f *faultyFile) Truncate(size int64) error {
+	if f.failTruncate {
+		return errors.New("input/output error")
+	}
+	return f.segmentFile.Truncate(size)
+}
+
+func TestAppendRollsBackFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, 1, 2)
+
+	f := &faultyFile{segmentFile: l.file, failWrite: true}
+	l.file = f
+	if _, err := l.Append([]byte("lost")); err == nil {
+		t.Fatal("expected the append to fail")
+	}
+	// the torn bytes are gone, the record after them isn't cut off on open.
+	f.failWrite = false
+	appendN(t, l, 3, 3)
+	l.Close()
+
+	l, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	assert(t, replayAll(t, l, 1), []string{"1:record 1", "2:record 2", "3:record 3"})
+}
+
+func TestAppendFailsLogWhenRollbackFails(t *testing.T) {
+	l, err := Open(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	appendN(t, l, 1, 1)
+
+	f := &faultyFile{segmentFile: l.file, failWrite: true, failTruncate: true}
+	l.file = f
+	if _, err := l.Append([]byte("lost")); err == nil {
+		t.Fatal("expected the append to fail")
+	}
+	f.failWrite = false
+	_, err = l.Append([]byte("record 2"))
+	assert(t, errors.Is(err, ErrFailed), true)
+	assert(t, l.LastSeq(), uint64(1))
+}